@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -11,11 +13,30 @@ import (
 	"time"
 
 	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"internal-transfers/transfer"
 )
 
-// App holds the database connection pool
+// App holds the database connection pool and runtime configuration
 type App struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Replica *sql.DB // serves read-only queries; DB when no replica is configured
+	Config  *Config
+	Gateway ExternalGateway // nil when external legs settle through file exports
+	OTP     OTPProvider     // nil when step-up verification is disabled
+	Risk    []RiskChecker
+
+	Notifications *notificationDispatcher // nil when no channel is configured
+	Events        *accountHub
+	AccessLog     *accessLogger
+	Cache         *accountCache // nil when no Redis address is configured
+	Stmts         *preparedStatements
+	Breaker       *circuitBreaker // guards the primary; nil when disabled
+	Faults        *faultInjector  // nil unless fault injection is enabled
+	Flags         *featureFlags
+	Maintenance   *maintenanceMode
+	Jobs          *scheduler
 }
 
 // TransferRequest represents the JSON body for a fund transfer
@@ -23,121 +44,569 @@ type TransferRequest struct {
 	FromAccountID int     `json:"source_account_id"`
 	ToAccountID   int     `json:"destination_account_id"`
 	Amount        float64 `json:"amount"`
+	// FromIBAN and ToIBAN address the accounts by IBAN instead of ID
+	FromIBAN string `json:"source_iban,omitempty"`
+	ToIBAN   string `json:"destination_iban,omitempty"`
+	// FromAlias and ToAlias address the accounts by alias instead of ID
+	FromAlias string `json:"source_alias,omitempty"`
+	ToAlias   string `json:"destination_alias,omitempty"`
+	// ToTenantID addresses a destination account of another tenant; the
+	// transfer must be allowed by the cross-tenant configuration
+	ToTenantID string `json:"destination_tenant_id,omitempty"`
+	// External sends the funds to an account at another institution
+	// instead of ToAccountID
+	External *ExternalDestination `json:"external_destination,omitempty"`
+	// Reference (e.g. an invoice number) and Memo are stored with the
+	// transaction for reconciliation
+	Reference string `json:"reference,omitempty"`
+	Memo      string `json:"memo,omitempty"`
+	// Category and Tags label the transaction for budgeting; see
+	// PATCH /transactions/{id}
+	Category string   `json:"category,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	// AllowDuplicate makes the transfer even when an identical one was made
+	// within the duplicate window
+	AllowDuplicate bool `json:"allow_duplicate,omitempty"`
+
+	// pendingID is the transaction a held transfer was recorded under;
+	// verified and approved mark the holds it has already cleared
+	pendingID int
+	verified  bool
+	approved  bool
+	// preparedID is the prepared transfer the transfer confirms, and
+	// preparedFee the fee held with it, charged instead of the current one
+	preparedID  int
+	preparedFee float64
+}
+
+// TransferResult is returned for a successful transfer
+type TransferResult struct {
+	FromAccountID int     `json:"source_account_id"`
+	ToAccountID   int     `json:"destination_account_id"`
+	ToTenantID    string  `json:"destination_tenant_id"`
+	Amount        float64 `json:"amount"`
+	Fee           float64 `json:"fee"`
+
+	TransactionID  int                  `json:"transaction_id"`
+	Status         string               `json:"status"`
+	ChallengeID    string               `json:"challenge_id,omitempty"`
+	External       *ExternalDestination `json:"external_destination,omitempty"`
+	ExternalStatus string               `json:"external_status,omitempty"`
 }
 
 // Account represents an account record
 type Account struct {
-	ID          int       `json:"account_id"`
-	Balance     float64   `json:"balance"`
-	LastUpdated time.Time `json:"-"` // used for optimistic locking
+	ID          int        `json:"account_id"`
+	Balance     float64    `json:"balance"`
+	IBAN        *string    `json:"iban,omitempty"`
+	CustomerID  *int       `json:"customer_id,omitempty"`
+	LastUpdated time.Time  `json:"-"` // used for optimistic locking and the ETag
+	ClosedAt    *time.Time `json:"closed_at,omitempty"`
+	AccountType *string    `json:"account_type,omitempty"`
+	Alias       *string    `json:"alias,omitempty"`
+	ExternalRef *string    `json:"external_ref,omitempty"`
+	// MainBalance is the part of Balance outside Wallets; both are only set
+	// for accounts with wallets
+	MainBalance *float64 `json:"main_balance,omitempty"`
+	Wallets     []Wallet `json:"wallets,omitempty"`
 }
 
 // CreateAccountRequest represents the JSON body for creating a new account
 type CreateAccountRequest struct {
-	AccountID     int     `json:"account_id"`
+	AccountID      int     `json:"account_id"`
 	InitialBalance float64 `json:"initial_balance"`
+	CustomerID     *int    `json:"customer_id,omitempty"`
+	// IBAN is generated from the configured country and bank code when empty
+	IBAN string `json:"iban,omitempty"`
+	// AccountType is one of the configured account types, empty for none
+	AccountType string `json:"account_type,omitempty"`
+	// Alias is a unique handle transfers can address the account by
+	Alias string `json:"alias,omitempty"`
+	// ExternalRef is the identifier of the account in another system,
+	// unique per tenant
+	ExternalRef string `json:"external_ref,omitempty"`
 }
 
 // APIResponse defines the structure of all API responses
 type APIResponse struct {
-	Status  string      `json:"status"`
-	Code    int         `json:"code"`
-	Message string      `json:"message"`
-	Data    interface{} `json:"data,omitempty"`
+	Status     string       `json:"status"`
+	Code       int          `json:"code"`
+	Message    string       `json:"message"`
+	Data       interface{}  `json:"data,omitempty"`
+	Errors     []FieldError `json:"errors,omitempty"`
+	Pagination *Pagination  `json:"pagination,omitempty"`
+}
+
+// apiError is a failure carrying the message, API error code and HTTP status
+// of the response it maps onto
+type apiError struct {
+	Message string
+	Code    int
+	Status  int
+	Data    interface{}
+	Errors  []FieldError
+}
+
+func newAPIError(message string, code int, statusCode int) *apiError {
+	return &apiError{Message: message, Code: code, Status: statusCode}
+}
+
+func (e *apiError) Error() string {
+	return e.Message
 }
 
-// writeJSONError writes a standardized JSON error response
+// writeJSONError writes a standardized error response
 func writeJSONError(w http.ResponseWriter, message string, code int, statusCode int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(APIResponse{
+	writeResponse(w, statusCode, APIResponse{
 		Status:  "error",
 		Code:    code,
 		Message: message,
 	})
 }
 
-// writeJSONSuccess writes a standardized JSON success response
+// writeAPIError writes the error response for e, including its data
+func writeAPIError(w http.ResponseWriter, e *apiError) {
+	writeResponse(w, e.Status, APIResponse{
+		Status:  "error",
+		Code:    e.Code,
+		Message: e.Message,
+		Data:    e.Data,
+		Errors:  e.Errors,
+	})
+}
+
+// writeJSONSuccess writes a standardized success response
 func writeJSONSuccess(w http.ResponseWriter, data interface{}, message string, code int, statusCode int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(APIResponse{
-		Status:  "success",
-		Code:    code,
-		Message: message,
-		Data:    data,
+	writeJSONPage(w, data, nil, message, code, statusCode)
+}
+
+// writeJSONPage writes a success response holding one page of a list
+func writeJSONPage(w http.ResponseWriter, data interface{}, page *Pagination, message string, code int, statusCode int) {
+	writeResponse(w, statusCode, APIResponse{
+		Status:     "success",
+		Code:       code,
+		Message:    message,
+		Data:       data,
+		Pagination: page,
 	})
 }
 
 func main() {
-	db, err := sql.Open("postgres", "user=postgres password=postgres dbname=bank sslmode=disable")
+	sandboxMode := flag.Bool("sandbox", false, "serve demo accounts from memory instead of PostgreSQL")
+	seedMode := flag.Bool("seed", false, "load the configured fixtures into the database and exit")
+	flag.Parse()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *sandboxMode || cfg.Sandbox.Enabled {
+		if *seedMode {
+			log.Fatal("-seed loads fixtures into PostgreSQL and cannot be combined with sandbox mode")
+		}
+		log.Fatal(runSandbox(cfg))
+	}
+
+	breaker := newCircuitBreaker("primary", cfg.Database.Breaker)
+	db, err := openDB(cfg.Database.DSN, breaker, cfg.Database)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
+	configurePool(db, "primary", cfg.Database)
+	go breaker.probe(context.Background(), db)
 
-	app := &App{DB: db}
+	if err := migrate(db); err != nil {
+		log.Fatal(err)
+	}
 
-	http.HandleFunc("/accounts", app.handleCreateAccount)
-	http.HandleFunc("/accounts/", app.handleGetAccount)
-	http.HandleFunc("/transactions", app.handleTransfer)
+	replica := db
+	if cfg.Database.ReplicaDSN != "" {
+		replicaBreaker := newCircuitBreaker("replica", cfg.Database.Breaker)
+		if replica, err = openDB(cfg.Database.ReplicaDSN, replicaBreaker, cfg.Database); err != nil {
+			log.Fatal(err)
+		}
+		defer replica.Close()
+		configurePool(replica, "replica", cfg.Database)
+		go replicaBreaker.probe(context.Background(), replica)
+		go runPeriodically(context.Background(), "replica pool", poolCheckInterval, poolMonitor(replica))
+	}
+	go runPeriodically(context.Background(), "primary pool", poolCheckInterval, poolMonitor(db))
 
-	fmt.Println("Server starting on port 8081...")
-	log.Fatal(http.ListenAndServe(":8081", nil))
+	app := &App{DB: db, Replica: replica, Breaker: breaker, Config: cfg, Risk: newRiskCheckers(cfg.Risk), Events: newAccountHub(), AccessLog: newAccessLogger(db, cfg.AccessLog)}
+	app.AccessLog.start(context.Background())
+	if app.Cache = newAccountCache(cfg.Cache); app.Cache != nil {
+		app.Events.onBalance = func(e BalanceEvent) { app.Cache.invalidate(context.Background(), e.TenantID, e.AccountID) }
+		app.Events.onReconnect = func() { app.Cache.flush(context.Background()) }
+	}
+	if app.Stmts, err = app.prepareStatements(); err != nil {
+		log.Fatal(err)
+	}
+	go app.Events.listen(context.Background(), func(ctx context.Context) (string, error) {
+		return cfg.Database.Credentials.dsn(ctx, cfg.Database.DSN)
+	})
+	// scheduled jobs run on one replica only
+	elector := newLeaderElector(db, cfg.Leader)
+	elector.start(context.Background())
+	app.Jobs = newScheduler(db, elector, cfg.Scheduler)
+	app.Jobs.add(JobStatements, "@every 24h", app.generateStatements)
+	app.Jobs.add(JobSnapshots, "@every 1h", app.snapshotBalances)
+	app.Jobs.add(JobPartitions, "@every 24h", app.createPartitions)
+	if len(cfg.Auth.Signing.Clients) > 0 {
+		app.Jobs.add(JobRequestSignatures, "@every 1h", app.pruneSignatures)
+	}
+	app.Jobs.add(JobIdempotencyKeys, "@every 1h", app.pruneIdempotencyKeys)
+	if cfg.Auth.quotasEnabled() {
+		app.Jobs.add(JobQuotaUsage, "@every 24h", app.pruneQuotaUsage)
+	}
+	if cfg.Reconciliation.IntervalSeconds > 0 {
+		app.Jobs.add(JobReconciliation, fmt.Sprintf("@every %ds", cfg.Reconciliation.IntervalSeconds), app.reconcile)
+	}
+	if cfg.Retention.TransactionDays > 0 {
+		app.Jobs.add(JobRetention, fmt.Sprintf("@every %ds", cfg.Retention.IntervalSeconds), app.archiveTransactions)
+	}
+	if cfg.Messaging.Transport != "" {
+		app.Jobs.add(JobInboundCommands, "@every 24h", app.pruneInboundCommands)
+	}
+	app.Jobs.add(JobWebhookDeliveries, "@every 24h", app.pruneWebhookDeliveries)
+	app.Jobs.add(JobSweeps, "@daily", app.sweepBalances)
+	if cfg.TermDeposits.InterestAccountID != 0 {
+		app.Jobs.add(JobTermDeposits, "@every 1h", app.matureDeposits)
+	}
+	if err := app.Jobs.start(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	go runPeriodically(context.Background(), "read model", time.Duration(cfg.ReadModel.IntervalSeconds)*time.Second, app.projectReadModel)
+	if cfg.External.Gateway.URL != "" {
+		app.Gateway = newHTTPGateway(cfg.External.Gateway)
+		go app.recoverExternalTransfers(context.Background())
+	}
+	if app.Notifications = newNotificationDispatcher(db, cfg.Notifications); app.Notifications != nil {
+		app.Notifications.start(context.Background())
+	}
+	if cfg.StepUp.Threshold > 0 {
+		app.OTP = newOTPProvider(cfg.StepUp)
+	}
+	app.Faults = newFaultInjector(cfg.FaultInjection)
+	app.Flags = newFeatureFlags(db, cfg)
+	if err := app.Flags.refresh(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	go runPeriodically(context.Background(), "feature flags", time.Duration(cfg.Flags.RefreshSeconds)*time.Second, app.Flags.refresh)
+	app.Maintenance = newMaintenanceMode(db)
+	go runPeriodically(context.Background(), "maintenance", maintenanceRefreshInterval, app.Maintenance.refresh)
+	if cfg.EventSourcing.Enabled {
+		if err := app.seedAccountEvents(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *seedMode {
+		if err := app.seedFixtures(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	transport := newMessageTransport(cfg)
+	if transport != nil {
+		go app.consumeCommands(context.Background(), transport)
+	}
+	go runPeriodically(context.Background(), "transfer events", time.Second, func(ctx context.Context) error { return app.relayEvents(ctx, transport) })
+	go app.deliverWebhooks(context.Background())
+
+	http.HandleFunc("POST /accounts", app.handleCreateAccount)
+	http.HandleFunc("POST /accounts/import", app.handleImportAccounts)
+	http.HandleFunc("GET /accounts", app.handleListAccounts)
+	http.HandleFunc("GET /accounts/{id}", app.handleGetAccount)
+	http.HandleFunc("GET /accounts/by-alias/{alias}", app.handleGetAccountByAlias)
+	http.HandleFunc("PUT /accounts/{id}", app.handlePutAccount)
+	http.HandleFunc("PATCH /accounts/{id}", accountRoute(app.handlePatchAccount))
+	http.HandleFunc("DELETE /accounts/{id}", accountRoute(app.handleCloseAccount))
+	http.HandleFunc("GET /accounts/{id}/transactions", accountRoute(app.handleAccountTransactions))
+	http.HandleFunc("GET /accounts/{id}/events", accountRoute(app.handleAccountEvents))
+	http.HandleFunc("GET /accounts/{id}/balance", accountRoute(app.handleBalanceAsOf))
+	http.HandleFunc("GET /accounts/{id}/balance-history", accountRoute(app.handleBalanceHistory))
+	http.HandleFunc("GET /accounts/{id}/snapshots", accountRoute(app.handleSnapshots))
+	http.HandleFunc("GET /accounts/{id}/replay", accountRoute(app.handleAccountReplay))
+	http.HandleFunc("GET /accounts/{id}/statements/{period}", accountRoute(app.handleStatement))
+	http.HandleFunc("GET /accounts/{id}/wallets", accountRoute(app.handleListWallets))
+	http.HandleFunc("POST /accounts/{id}/wallets", accountRoute(app.handleCreateWallet))
+	http.HandleFunc("DELETE /accounts/{id}/wallets/{name}", accountRoute(app.handleDeleteWallet))
+	http.HandleFunc("POST /accounts/{id}/wallets/moves", accountRoute(app.handleWalletMove))
+	http.HandleFunc("GET /accounts/{id}/sweeps", accountRoute(app.handleSweeps))
+	http.HandleFunc("POST /accounts/{id}/sweeps", accountRoute(app.handleCreateSweep))
+	http.HandleFunc("DELETE /accounts/{id}/sweeps/{sweep_id}", sweepRoute(app.handleDeleteSweep))
+	http.HandleFunc("GET /accounts/{id}/sweeps/{sweep_id}/executions", sweepRoute(app.handleSweepExecutions))
+	http.HandleFunc("GET /accounts/{id}/deposits", accountRoute(app.handleDeposits))
+	http.HandleFunc("POST /accounts/{id}/deposits", accountRoute(app.handleOpenDeposit))
+	http.HandleFunc("POST /accounts/{id}/deposits/{deposit_id}/withdraw", depositRoute(app.handleWithdrawDeposit))
+	http.HandleFunc("GET /transactions", app.handleListTransactions)
+	http.HandleFunc("POST /transactions", app.requireSignature(app.withIdempotency(app.withTransferQuota(app.handleTransfer))))
+	http.HandleFunc("POST /transactions/batch", app.requireSignature(app.withIdempotency(app.handleBatchTransfer)))
+	http.HandleFunc("POST /transactions/quote", app.handleQuote)
+	http.HandleFunc("POST /transactions/prepare", app.requireSignature(app.withIdempotency(app.withTransferQuota(app.handlePrepareTransfer))))
+	http.HandleFunc("POST /transactions/confirm", app.requireSignature(app.withIdempotency(app.handleConfirmPrepared)))
+	http.HandleFunc("POST /transactions/abort", app.withIdempotency(app.handleAbortPrepared))
+	http.HandleFunc("POST /transactions/pain001", app.handleImportPain001)
+	http.HandleFunc("GET /transactions/export", app.handleExportTransactions)
+	http.HandleFunc("GET /transactions/{id}", transactionRoute(app.handleGetTransaction))
+	http.HandleFunc("PATCH /transactions/{id}", transactionRoute(app.handleUpdateTransaction))
+	http.HandleFunc("GET /transactions/{id}/mt103", transactionRoute(app.handleMT103))
+	http.HandleFunc("POST /transactions/{id}/confirm", transactionRoute(app.handleConfirmTransfer))
+	http.HandleFunc("POST /transactions/{id}/approve", transactionRoute(app.handleApprove))
+	http.HandleFunc("POST /transactions/{id}/reject", transactionRoute(app.handleReject))
+	http.HandleFunc("POST /transactions/{id}/disputes", app.withIdempotency(transactionRoute(app.handleOpenDispute)))
+	http.HandleFunc("GET /disputes/{id}", disputeRoute(app.handleGetDispute))
+	http.HandleFunc("GET /transactions/{id}/refunds", transactionRoute(app.handleListRefunds))
+	http.HandleFunc("POST /transactions/{id}/refunds", app.requireSignature(app.withIdempotency(transactionRoute(app.handleRefund))))
+	http.HandleFunc("POST /escrows", app.requireSignature(app.withIdempotency(app.withTransferQuota(app.handleCreateEscrow))))
+	http.HandleFunc("GET /escrows/{id}", escrowRoute(app.handleGetEscrow))
+	http.HandleFunc("POST /escrows/{id}/release", app.withIdempotency(escrowRoute(app.handleReleaseEscrow)))
+	http.HandleFunc("POST /escrows/{id}/refund", app.withIdempotency(escrowRoute(app.handleRefundEscrow)))
+	http.HandleFunc("POST /customers", app.handleCreateCustomer)
+	http.HandleFunc("GET /customers/{id}", app.customerRoute(app.handleGetCustomer))
+	http.HandleFunc("GET /customers/{id}/accounts", app.customerRoute(app.handleCustomerAccounts))
+	http.HandleFunc("GET /customers/{id}/notifications", app.customerRoute(app.handleNotificationPreferences))
+	http.HandleFunc("PUT /customers/{id}/notifications", app.customerRoute(app.handleNotificationPreferences))
+	http.HandleFunc("GET /customers/{id}/export", app.customerRoute(app.handleCustomerExport))
+	http.HandleFunc("POST /customers/{id}/erase", customerIDRoute(app.handleCustomerErasure))
+	http.HandleFunc("/exports/ach", app.handleExportACH)
+	http.HandleFunc("/approvals", app.handleListApprovals)
+	http.HandleFunc("/reports/", app.handleReport)
+	http.HandleFunc("/ws", app.handleWebSocket)
+	http.HandleFunc("GET /errors", app.handleCodes)
+	http.HandleFunc("GET /quota", app.handleQuota)
+	http.HandleFunc("/admin/reconciliation", app.handleReconciliation)
+	http.HandleFunc("GET /admin/trial-balance", app.handleTrialBalance)
+	http.HandleFunc("/admin/adjustments", app.handleAdjustment)
+	http.HandleFunc("/admin/audit", app.handleAudit)
+	http.HandleFunc("/admin/audit/verify", app.handleAuditVerify)
+	http.HandleFunc("/admin/access-log", app.handleAccessLog)
+	http.HandleFunc("/admin/reports/most-active", app.handleMostActive)
+	http.HandleFunc("GET /admin/dead-letters", app.handleDeadLetters)
+	http.HandleFunc("POST /admin/dead-letters/{id}/{action}", app.handleResolveDeadLetter)
+	http.HandleFunc("GET /admin/disputes", app.handleDisputes)
+	http.HandleFunc("POST /admin/disputes/{id}/{action}", app.withIdempotency(app.handleResolveDispute))
+	http.Handle("/admin/debug/", app.diagnosticsHandler())
+	http.HandleFunc("POST /webhooks", app.handleCreateWebhook)
+	http.HandleFunc("GET /webhooks", app.handleWebhooks)
+	http.HandleFunc("DELETE /webhooks/{id}", webhookRoute(app.handleDeleteWebhook))
+	http.HandleFunc("GET /webhooks/{id}/deliveries", webhookRoute(app.handleWebhookDeliveries))
+	http.HandleFunc("GET /webhooks/{id}/deliveries/{delivery_id}", app.webhookDeliveryRoute(app.handleWebhookDelivery))
+	http.HandleFunc("POST /webhooks/{id}/deliveries/{delivery_id}/redeliver", app.webhookDeliveryRoute(app.handleRedeliverWebhook))
+	http.HandleFunc("/admin/faults", app.handleFaults)
+	http.HandleFunc("GET /admin/flags", app.handleFlags)
+	http.HandleFunc("PUT /admin/flags/{name}", app.handleSetFlag)
+	http.HandleFunc("DELETE /admin/flags/{name}", app.handleSetFlag)
+	http.HandleFunc("/admin/maintenance", app.handleMaintenance)
+	http.HandleFunc("GET /admin/jobs", app.handleJobs)
+	http.HandleFunc("PUT /admin/jobs/{name}", app.handleSetJob)
+	http.HandleFunc("GET /admin/jobs/{name}/runs", app.handleJobRuns)
+	http.Handle(dashboardPrefix, app.dashboardHandler())
+	http.HandleFunc("GET "+dashboardPrefix+"api/accounts", app.handleDashboardAccounts)
+	http.HandleFunc("GET "+dashboardPrefix+"api/transfers", app.handleDashboardTransfers)
+	http.Handle("/metrics", promhttp.Handler())
+
+	log.Printf("server starting on %s", cfg.Server.Addr)
+	handler := app.withTenant(withoutDefaultDebug(newAPIRouter(http.DefaultServeMux)))
+	handler = app.withRequestQuota(handler)
+	handler = app.withAuth(handler)
+	handler = app.withAccessLog(handler)
+	handler = app.withMaintenance(handler)
+	handler = app.withBreaker(handler)
+	handler = app.withRequestTimeout(handler)
+	handler = app.withBodyLimit(handler)
+	handler = app.withAPIVersion(handler)
+	handler = app.withCORS(handler)
+	handler = withRecovery(handler)
+	handler = withContentNegotiation(handler)
+	handler = app.withCompression(handler)
+	log.Fatal(app.serve(app.newServer(handler)))
 }
 
 func (a *App) handleCreateAccount(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		writeJSONError(w, "Only POST method is allowed", 1001, http.StatusMethodNotAllowed)
+	var req CreateAccountRequest
+	if apiErr := decodeJSON(r, &req, 1002, "account_id", "initial_balance"); apiErr != nil {
+		writeAPIError(w, apiErr)
 		return
 	}
 
-	var req CreateAccountRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSONError(w, "Invalid request payload", 1002, http.StatusBadRequest)
+	iban, _, apiErr := a.createAccount(r.Context(), tenantFromContext(r.Context()), req, false)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
 		return
 	}
 
-	_, err := a.DB.Exec("INSERT INTO accounts (id, balance, last_updated) VALUES ($1, $2, NOW())", req.AccountID, req.InitialBalance)
+	writeJSONSuccess(w, map[string]interface{}{
+		"account_id":      req.AccountID,
+		"initial_balance": req.InitialBalance,
+		"customer_id":     req.CustomerID,
+		"iban":            iban,
+		"account_type":    req.AccountType,
+		"alias":           normalizeAlias(req.Alias),
+		"external_ref":    strings.TrimSpace(req.ExternalRef),
+	}, "Account created", 2001, http.StatusCreated)
+}
+
+// createAccount inserts a new account of tenant and returns its IBAN. With
+// ifAbsent an account that already exists under the same ID is left untouched
+// and created is false.
+func (a *App) createAccount(ctx context.Context, tenant string, req CreateAccountRequest, ifAbsent bool) (iban string, created bool, apiErr *apiError) {
+	req.Alias = normalizeAlias(req.Alias)
+	req.ExternalRef = strings.TrimSpace(req.ExternalRef)
+	if apiErr := req.validate(); apiErr != nil {
+		return "", false, apiErr
+	}
+	if apiErr := a.checkAccountType(req.AccountType); apiErr != nil {
+		return "", false, apiErr
+	}
+
+	iban, err := a.accountIBAN(req)
+	if errors.Is(err, errInvalidIBAN) {
+		return "", false, newAPIError("Invalid IBAN", 1030, http.StatusBadRequest)
+	}
+	if err != nil {
+		return "", false, newAPIError("Account ID cannot be encoded as an IBAN", 1032, http.StatusBadRequest)
+	}
+
+	if req.CustomerID != nil {
+		var exists bool
+		err := a.DB.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM customers WHERE id = $1 AND tenant_id = $2 AND erased_at IS NULL)", *req.CustomerID, tenant).Scan(&exists)
+		if err != nil {
+			return "", false, newAPIError("Failed to create account", 1005, http.StatusInternalServerError)
+		}
+		if !exists {
+			return "", false, newAPIError("Customer not found", 1027, http.StatusNotFound)
+		}
+	}
+
+	query := "INSERT INTO accounts (id, balance, initial_balance, last_updated, customer_id, tenant_id, iban, account_type, alias, external_ref) VALUES ($1, $2, $2, NOW(), $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), NULLIF($8, ''))"
+	if ifAbsent {
+		query += " ON CONFLICT (id) DO NOTHING"
+	}
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", false, dbWriteError(err, newAPIError("Failed to begin transaction", 1013, http.StatusInternalServerError))
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, query, req.AccountID, req.InitialBalance, req.CustomerID, tenant, iban, req.AccountType, req.Alias, req.ExternalRef)
 	if err != nil {
 		if pgErr, ok := err.(*pq.Error); ok {
+			if pgErr.Code == "23505" && pgErr.Constraint == "accounts_iban_key" {
+				return "", false, newAPIError("IBAN already in use", 1031, http.StatusConflict)
+			}
+			if pgErr.Code == "23505" && pgErr.Constraint == "accounts_alias_key" {
+				return "", false, newAPIError("Alias already in use", 1136, http.StatusConflict)
+			}
+			if pgErr.Code == "23505" && pgErr.Constraint == "accounts_external_ref_key" {
+				return "", false, newAPIError("External reference already in use", 1137, http.StatusConflict)
+			}
 			if pgErr.Code == "23505" {
-				writeJSONError(w, "Account already exists", 1003, http.StatusConflict)
-				return
+				return "", false, newAPIError("Account already exists", 1003, http.StatusConflict)
 			}
-			writeJSONError(w, fmt.Sprintf("Database error: %s", pgErr.Message), 1004, http.StatusInternalServerError)
-			return
+			return "", false, dbWriteError(err, newAPIError(fmt.Sprintf("Database error: %s", pgErr.Message), 1004, http.StatusInternalServerError))
 		}
-		writeJSONError(w, "Failed to create account", 1005, http.StatusInternalServerError)
-		return
+		return "", false, dbWriteError(err, newAPIError("Failed to create account", 1005, http.StatusInternalServerError))
 	}
 
-	writeJSONSuccess(w, map[string]interface{}{
-		"account_id":      req.AccountID,
-		"initial_balance": req.InitialBalance,
-	}, "Account created", 2001, http.StatusCreated)
+	if n, _ := result.RowsAffected(); n == 0 {
+		return "", false, nil
+	}
+	if err := a.appendEvents(ctx, tx, AccountEvent{AccountID: req.AccountID, Type: EventAccountCreated, Amount: req.InitialBalance}); err != nil {
+		return "", false, dbWriteError(err, newAPIError("Failed to create account", 1005, http.StatusInternalServerError))
+	}
+	if err := tx.Commit(); err != nil {
+		return "", false, dbWriteError(err, newAPIError("Failed to commit transaction", 1020, http.StatusInternalServerError))
+	}
+	a.auditCommitted(ctx, auditRecord{
+		TenantID:   tenant,
+		Action:     "account.created",
+		EntityType: "account",
+		EntityID:   strconv.Itoa(req.AccountID),
+		After:      map[string]interface{}{"balance": req.InitialBalance, "customer_id": req.CustomerID, "iban": iban, "account_type": req.AccountType, "alias": req.Alias, "external_ref": req.ExternalRef},
+	})
+	return iban, true, nil
 }
 
-func (a *App) handleGetAccount(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		writeJSONError(w, "Only GET method is allowed", 1006, http.StatusMethodNotAllowed)
+// accountRoute adapts a handler of one account to a route with a numeric
+// {id} path parameter
+func accountRoute(h func(http.ResponseWriter, *http.Request, int)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accountID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			writeJSONError(w, "Invalid account ID", 1008, http.StatusBadRequest)
+			return
+		}
+		h(w, r, accountID)
+	}
+}
+
+// handlePutAccount provisions the account idempotently: it is created if
+// absent, otherwise the existing account is returned unchanged
+func (a *App) handlePutAccount(w http.ResponseWriter, r *http.Request) {
+	accountID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, "Invalid account ID", 1008, http.StatusBadRequest)
+		return
+	}
+
+	var req CreateAccountRequest
+	if apiErr := decodeJSON(r, &req, 1002, "initial_balance"); apiErr != nil {
+		writeAPIError(w, apiErr)
 		return
 	}
+	if req.AccountID != 0 && req.AccountID != accountID {
+		writeJSONError(w, "Account ID in body does not match path", 1047, http.StatusBadRequest)
+		return
+	}
+	req.AccountID = accountID
 
-	parts := strings.Split(r.URL.Path, "/")
-	if len(parts) != 3 || parts[2] == "" {
-		writeJSONError(w, "Invalid account ID", 1007, http.StatusBadRequest)
+	tenant := tenantFromContext(r.Context())
+	_, created, apiErr := a.createAccount(r.Context(), tenant, req, true)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
 		return
 	}
 
-	accountID, err := strconv.Atoi(parts[2])
+	acc, err := scanAccount(a.DB.QueryRowContext(r.Context(), "SELECT "+accountColumns+" FROM accounts WHERE id = $1 AND tenant_id = $2", accountID, tenant))
+	if err == sql.ErrNoRows {
+		// the ID is taken by an account of another tenant
+		writeJSONError(w, "Account already exists", 1003, http.StatusConflict)
+		return
+	}
 	if err != nil {
+		writeJSONError(w, "Failed to load account", 1005, http.StatusInternalServerError)
+		return
+	}
+
+	if created {
+		writeAccount(w, r, acc, "Account created", 2001, http.StatusCreated)
+		return
+	}
+	writeAccount(w, r, acc, "Account already exists", 2010, http.StatusOK)
+}
+
+// handleGetAccount serves GET /accounts/{id}, where the path segment is
+// either a numeric account ID or an IBAN
+func (a *App) handleGetAccount(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFromContext(r.Context())
+	var row *sql.Row
+	accountID, err := strconv.Atoi(r.PathValue("id"))
+	byID := err == nil
+	if byID {
+		if acc, ok := a.Cache.get(r.Context(), tenant, accountID); ok {
+			writeAccount(w, r, *acc, "Account retrieved", 2002, http.StatusOK)
+			return
+		}
+		row = a.Stmts.getAccount.QueryRowContext(r.Context(), accountID, tenant)
+	} else if iban, ibanErr := normalizeIBAN(r.PathValue("id")); ibanErr == nil {
+		row = a.Replica.QueryRowContext(r.Context(), "SELECT "+accountColumns+" FROM accounts WHERE iban = $1 AND tenant_id = $2", iban, tenant)
+	} else {
 		writeJSONError(w, "Invalid account ID", 1008, http.StatusBadRequest)
 		return
 	}
 
-	var acc Account
-	err = a.DB.QueryRow("SELECT id, balance, last_updated FROM accounts WHERE id = $1", accountID).Scan(&acc.ID, &acc.Balance, &acc.LastUpdated)
+	acc, err := scanAccount(row)
 	if err != nil {
 		if pgErr, ok := err.(*pq.Error); ok {
 			writeJSONError(w, fmt.Sprintf("Database error: %s", pgErr.Message), 1009, http.StatusInternalServerError)
@@ -146,91 +615,239 @@ func (a *App) handleGetAccount(w http.ResponseWriter, r *http.Request) {
 		writeJSONError(w, "Account not found", 1010, http.StatusNotFound)
 		return
 	}
+	if err := loadWallets(r.Context(), a.Replica, &acc); err != nil {
+		writeJSONError(w, "Failed to load wallets", 1005, http.StatusInternalServerError)
+		return
+	}
+	if byID {
+		a.Cache.set(r.Context(), tenant, acc)
+	}
 
-	writeJSONSuccess(w, acc, "Account retrieved", 2002, http.StatusOK)
+	writeAccount(w, r, acc, "Account retrieved", 2002, http.StatusOK)
 }
 
 func (a *App) handleTransfer(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		writeJSONError(w, "Only POST method is allowed", 1011, http.StatusMethodNotAllowed)
+	var tr TransferRequest
+	if apiErr := decodeJSON(r, &tr, 1012, "amount"); apiErr != nil {
+		writeAPIError(w, apiErr)
 		return
 	}
 
-	var tr TransferRequest
-	if err := json.NewDecoder(r.Body).Decode(&tr); err != nil {
-		writeJSONError(w, "Invalid request payload", 1012, http.StatusBadRequest)
+	result, apiErr := a.executeTransfer(r.Context(), tenantFromContext(r.Context()), tr)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
 		return
 	}
 
-	maxRetries := 3
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		tx, err := a.DB.Begin()
-		if err != nil {
-			writeJSONError(w, "Failed to begin transaction", 1013, http.StatusInternalServerError)
-			return
+	message, code, status := transferOutcome(result)
+	writeJSONSuccess(w, result, message, code, status)
+}
+
+// executeTransfer moves funds between two accounts on behalf of tenant. A
+// transfer that fails is recorded with status failed, and its transaction ID
+// is returned as the error data.
+func (a *App) executeTransfer(ctx context.Context, tenant string, tr TransferRequest) (*TransferResult, *apiError) {
+	tr.Category, tr.Tags = normalizeLabels(tr.Category, tr.Tags)
+	if apiErr := tr.validate(a.Config.Limits); apiErr != nil {
+		return nil, apiErr
+	}
+	// a held transfer is recorded before it is made, so it is only compared
+	// when first submitted
+	if tr.pendingID == 0 {
+		if apiErr := a.findDuplicate(ctx, tenant, tr); apiErr != nil {
+			return nil, apiErr
 		}
-		defer tx.Rollback()
+	}
+	if !tr.verified && a.Config.StepUp.required(tr.Amount) {
+		return a.holdForConfirmation(ctx, tenant, tr)
+	}
+	if !tr.approved && a.Config.Approval.required(tr.Amount) {
+		return a.holdForApproval(ctx, tenant, tr)
+	}
 
-		var from Account
-		err = tx.QueryRow("SELECT id, balance, last_updated FROM accounts WHERE id=$1", tr.FromAccountID).Scan(&from.ID, &from.Balance, &from.LastUpdated)
-		if err != nil {
-			writeJSONError(w, "Source account not found", 1014, http.StatusNotFound)
-			return
+	result, apiErr := a.attemptTransfer(ctx, tenant, tr)
+	if apiErr != nil && apiErr.Code != 1043 {
+		// a compensated external transfer is already recorded as reversed
+		a.recordFailedTransfer(ctx, tenant, tr, apiErr)
+		if data, ok := apiErr.Data.(map[string]interface{}); ok {
+			if id, ok := data["transaction_id"].(int); ok {
+				a.notifyTransfer(id)
+			}
 		}
+	}
+	if result != nil && result.Status == TxCompleted {
+		a.notifyTransfer(result.TransactionID)
+	}
+	return result, apiErr
+}
 
-		if from.Balance < tr.Amount {
-			writeJSONError(w, "Insufficient funds", 1015, http.StatusBadRequest)
-			return
+// attemptTransfer performs the transfer, retrying on optimistic locking
+// conflicts
+func (a *App) attemptTransfer(ctx context.Context, tenant string, tr TransferRequest) (*TransferResult, *apiError) {
+	toTenant, apiErr := a.resolveTransfer(tenant, &tr)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	fee := a.transferFee(tenant, tr.Amount)
+	if tr.preparedID != 0 {
+		fee = tr.preparedFee
+	}
+
+	fault := a.Faults.plan(tenant)
+	if err := fault.inject(ctx); err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to begin transaction", 1013, http.StatusInternalServerError))
+	}
+
+	store := &transferStore{a: a, tr: tr, status: TxCompleted}
+	if tr.External != nil {
+		store.externalStatus = a.initialExternalStatus()
+		if store.externalStatus == ExternalPending {
+			store.status = TxPending
+		}
+	}
+	svc := transfer.Service{
+		Store: store,
+		Check: a.riskCheck(RiskInput{
+			TenantID:    tenant,
+			ToAccountID: tr.ToAccountID,
+			ToTenantID:  toTenant,
+			Amount:      tr.Amount,
+			Fee:         fee,
+			External:    tr.External,
+		}),
+		ForceConflict: fault.conflicts,
+	}
+	if tr.preparedID != 0 {
+		// the checks ran when the transfer was prepared
+		svc.Check = nil
+		store.claim = a.claimPrepared(tr.preparedID)
+		store.link = func(ctx context.Context, tx *sql.Tx, transactionID int) error {
+			_, err := tx.ExecContext(ctx, "UPDATE prepared_transfers SET transaction_id = $1 WHERE id = $2", transactionID, tr.preparedID)
+			return err
 		}
+	}
+	outcome, err := svc.Execute(ctx, transfer.Transfer{
+		Tenant:     tenant,
+		ToTenant:   toTenant,
+		From:       tr.FromAccountID,
+		To:         tr.ToAccountID,
+		Amount:     tr.Amount,
+		Fee:        fee,
+		FeeAccount: a.Config.Fees.AccountID,
+		Settlement: tr.External != nil,
+	})
+	if err != nil {
+		return nil, transferAPIError(err)
+	}
+	transactionID, status, externalStatus := outcome.TransactionID, store.status, store.externalStatus
 
-		result, err := tx.Exec("UPDATE accounts SET balance = balance - $1, last_updated = NOW() WHERE id = $2 AND last_updated = $3", tr.Amount, tr.FromAccountID, from.LastUpdated)
-		rowsAffected, _ := result.RowsAffected()
-		if err != nil || rowsAffected == 0 {
-			if attempt == maxRetries {
-				writeJSONError(w, "Concurrency conflict on debit after retries", 1016, http.StatusConflict)
-				return
-			}
-			tx.Rollback()
-			time.Sleep(50 * time.Millisecond)
-			continue
+	a.Cache.invalidate(ctx, tenant, tr.FromAccountID, a.Config.Fees.AccountID)
+	a.Cache.invalidate(ctx, toTenant, tr.ToAccountID)
+
+	if tr.External != nil && tr.External.Rail == RailWire && a.Config.External.Wire.OutboundDir != "" {
+		a.dropMT103(ctx, tenant, transactionID)
+	}
+
+	if externalStatus == ExternalPending {
+		externalStatus = a.runExternalLeg(ctx, externalLeg{
+			TransactionID: transactionID,
+			TenantID:      tenant,
+			FromAccount:   tr.FromAccountID,
+			Amount:        tr.Amount,
+			Status:        ExternalPending,
+			Attempts:      1,
+			Destination:   *tr.External,
+		})
+		if externalStatus == ExternalCompensated {
+			return nil, newAPIError("External transfer rejected, funds returned to source account", 1043, http.StatusUnprocessableEntity)
 		}
+	}
+
+	return &TransferResult{
+		FromAccountID:  tr.FromAccountID,
+		ToAccountID:    tr.ToAccountID,
+		ToTenantID:     toTenant,
+		Amount:         tr.Amount,
+		Fee:            fee,
+		TransactionID:  transactionID,
+		Status:         status,
+		External:       tr.External,
+		ExternalStatus: externalStatus,
+	}, nil
+}
 
-		var to Account
-		err = tx.QueryRow("SELECT id, balance, last_updated FROM accounts WHERE id=$1", tr.ToAccountID).Scan(&to.ID, &to.Balance, &to.LastUpdated)
+// resolveTransfer checks tr may go to its destination tenant, which it
+// returns, and fills in the account IDs of IBANs and of the settlement
+// account of an external transfer
+func (a *App) resolveTransfer(tenant string, tr *TransferRequest) (string, *apiError) {
+	toTenant := tenant
+	if tr.ToTenantID != "" {
+		toTenant = tr.ToTenantID
+	}
+	if !a.Config.Tenancy.crossTenantAllowed(tenant, toTenant) {
+		return "", newAPIError("Cross-tenant transfer not allowed", 1029, http.StatusForbidden)
+	}
+
+	if tr.FromIBAN != "" {
+		id, err := a.accountIDByIBAN(tr.FromIBAN, tenant)
 		if err != nil {
-			writeJSONError(w, "Destination account not found", 1017, http.StatusNotFound)
-			return
+			return "", newAPIError("Source account not found", 1014, http.StatusNotFound)
 		}
-
-		result, err = tx.Exec("UPDATE accounts SET balance = balance + $1, last_updated = NOW() WHERE id = $2 AND last_updated = $3", tr.Amount, tr.ToAccountID, to.LastUpdated)
-		rowsAffected, _ = result.RowsAffected()
-		if err != nil || rowsAffected == 0 {
-			if attempt == maxRetries {
-				writeJSONError(w, "Concurrency conflict on credit after retries", 1018, http.StatusConflict)
-				return
-			}
-			tx.Rollback()
-			time.Sleep(50 * time.Millisecond)
-			continue
+		tr.FromAccountID = id
+	}
+	if tr.ToIBAN != "" {
+		id, err := a.accountIDByIBAN(tr.ToIBAN, toTenant)
+		if err != nil {
+			return "", newAPIError("Destination account not found", 1017, http.StatusNotFound)
 		}
-
-		_, err = tx.Exec("INSERT INTO transactions (from_account, to_account, amount) VALUES ($1, $2, $3)", tr.FromAccountID, tr.ToAccountID, tr.Amount)
+		tr.ToAccountID = id
+	}
+	if tr.FromAlias != "" {
+		id, err := a.accountIDByAlias(tr.FromAlias, tenant)
 		if err != nil {
-			writeJSONError(w, "Failed to log transaction", 1019, http.StatusInternalServerError)
-			return
+			return "", newAPIError("Source account not found", 1014, http.StatusNotFound)
 		}
-
-		err = tx.Commit()
+		tr.FromAccountID = id
+	}
+	if tr.ToAlias != "" {
+		id, err := a.accountIDByAlias(tr.ToAlias, toTenant)
 		if err != nil {
-			writeJSONError(w, "Failed to commit transaction", 1020, http.StatusInternalServerError)
-			return
+			return "", newAPIError("Destination account not found", 1017, http.StatusNotFound)
 		}
+		tr.ToAccountID = id
+	}
 
-		writeJSONSuccess(w, map[string]interface{}{
-			"source_account_id":      tr.FromAccountID,
-			"destination_account_id": tr.ToAccountID,
-			"amount":                 tr.Amount,
-		}, "Transfer successful", 2003, http.StatusOK)
-		return
+	if tr.External != nil {
+		if a.Config.External.SettlementAccountID == 0 {
+			return "", newAPIError("External transfers are not enabled", 1036, http.StatusBadRequest)
+		}
+		if err := tr.External.validate(); err != nil {
+			return "", newAPIError(fmt.Sprintf("Invalid external destination: %s", err), 1035, http.StatusBadRequest)
+		}
+		// Outbound funds are held in the settlement account, a system
+		// account outside any tenant
+		tr.ToAccountID = a.Config.External.SettlementAccountID
+	}
+	return toTenant, nil
+}
+
+// transferFee returns the fee charged on a transfer of amount by tenant
+func (a *App) transferFee(tenant string, amount float64) float64 {
+	if !a.enabled(tenant, FlagFees) {
+		return 0
 	}
-}
\ No newline at end of file
+	return a.Config.Fees.calculate(amount)
+}
+
+// affectedRows returns the number of rows changed by an Exec, treating a
+// failed statement as having changed none
+func affectedRows(result sql.Result, err error) int64 {
+	if err != nil {
+		return 0
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AccessLogConfig configures the per-request access log. Requests to
+// SyncPaths are recorded before the handler chain returns and are never
+// dropped; all others are queued and dropped when the queue is full.
+type AccessLogConfig struct {
+	QueueSize int      `json:"queue_size"`
+	SyncPaths []string `json:"sync_paths"`
+}
+
+// AccessLogEntry is the record of one API call
+type AccessLogEntry struct {
+	ID         int64     `json:"id"`
+	OccurredAt time.Time `json:"occurred_at"`
+	RequestID  string    `json:"request_id"`
+	Principal  string    `json:"principal"`
+	TenantID   string    `json:"tenant_id"`
+	Method     string    `json:"method"`
+	Route      string    `json:"route"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	DurationMS float64   `json:"duration_ms"`
+	RemoteAddr string    `json:"remote_addr"`
+}
+
+// maxRequestIDLength bounds client-supplied X-Request-ID values
+const maxRequestIDLength = 64
+
+type accessEntryKey struct{}
+
+// accessEntryFromContext returns the access log entry of the request, which
+// inner middleware fill in as they resolve the principal and tenant
+func accessEntryFromContext(ctx context.Context) *AccessLogEntry {
+	e, _ := ctx.Value(accessEntryKey{}).(*AccessLogEntry)
+	return e
+}
+
+// requestIDFromContext returns the ID assigned to the request
+func requestIDFromContext(ctx context.Context) string {
+	if e := accessEntryFromContext(ctx); e != nil {
+		return e.RequestID
+	}
+	return ""
+}
+
+type accessLogger struct {
+	db    *sql.DB
+	sync  map[string]bool
+	queue chan *AccessLogEntry
+}
+
+func newAccessLogger(db *sql.DB, cfg AccessLogConfig) *accessLogger {
+	l := &accessLogger{db: db, sync: map[string]bool{}, queue: make(chan *AccessLogEntry, cfg.QueueSize)}
+	for _, p := range cfg.SyncPaths {
+		l.sync[p] = true
+	}
+	return l
+}
+
+// start writes queued entries until ctx is cancelled
+func (l *accessLogger) start(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-l.queue:
+				l.write(e)
+			}
+		}
+	}()
+}
+
+func (l *accessLogger) record(e *AccessLogEntry) {
+	if l.sync[e.Path] {
+		l.write(e)
+		return
+	}
+	select {
+	case l.queue <- e:
+	default:
+		log.Printf("access log: queue full, dropping %s %s %s", e.RequestID, e.Method, e.Path)
+	}
+}
+
+func (l *accessLogger) write(e *AccessLogEntry) {
+	_, err := l.db.Exec(`INSERT INTO access_log (occurred_at, request_id, principal, tenant_id, method, route, path, status, duration_ms, remote_addr)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		e.OccurredAt, e.RequestID, e.Principal, e.TenantID, e.Method, e.Route, e.Path, e.Status, e.DurationMS, e.RemoteAddr)
+	if err != nil {
+		log.Printf("access log: %s %s %s: %v", e.RequestID, e.Method, e.Path, err)
+	}
+}
+
+// withAccessLog assigns every request an ID, echoed in X-Request-ID, and
+// records the call with its principal, route, outcome and latency
+func (a *App) withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := strings.TrimSpace(r.Header.Get("X-Request-ID"))
+		if requestID == "" || len(requestID) > maxRequestIDLength {
+			requestID = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+
+		start := time.Now()
+		e := &AccessLogEntry{
+			OccurredAt: start.UTC(),
+			RequestID:  requestID,
+			Principal:  anonymous.Name,
+			Method:     r.Method,
+			Route:      routeOf(r.URL.Path),
+			Path:       r.URL.Path,
+			RemoteAddr: r.RemoteAddr,
+		}
+		rec := &responseRecorder{ResponseWriter: w}
+		completed := false
+		defer func() {
+			e.Status = rec.status
+			switch {
+			case !completed:
+				// the handler panicked; withRecovery answers with a 500
+				e.Status = http.StatusInternalServerError
+			case e.Status == 0:
+				e.Status = http.StatusOK
+			}
+			e.DurationMS = float64(time.Since(start).Microseconds()) / 1000
+			a.AccessLog.record(e)
+		}()
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessEntryKey{}, e)))
+		completed = true
+	})
+}
+
+// routeOf replaces the numeric IDs in path with {id} so calls to the same
+// endpoint can be grouped
+func routeOf(path string) string {
+	parts := strings.Split(path, "/")
+	for i, p := range parts {
+		if p != "" && strings.Trim(p, "0123456789") == "" {
+			parts[i] = "{id}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// handleAccessLog serves GET /admin/access-log, the latest 100 API calls
+// filtered by route, principal, request_id, status and a from/to time range
+func (a *App) handleAccessLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, "Only GET method is allowed", 1006, http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+
+	q := r.URL.Query()
+	var from, to interface{}
+	for _, bound := range []struct {
+		param string
+		dst   *interface{}
+	}{{"from", &from}, {"to", &to}} {
+		v := q.Get(bound.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeJSONError(w, "Invalid time range, expected RFC 3339 timestamps", 1073, http.StatusBadRequest)
+			return
+		}
+		*bound.dst = t.UTC()
+	}
+
+	rows, err := a.DB.QueryContext(r.Context(), `SELECT id, occurred_at, request_id, principal, tenant_id, method, route, path, status, duration_ms, remote_addr
+		FROM access_log
+		WHERE (NULLIF($1, '') IS NULL OR route = $1)
+		AND (NULLIF($2, '') IS NULL OR principal = $2)
+		AND (NULLIF($3, '') IS NULL OR request_id = $3)
+		AND (NULLIF($4, '') IS NULL OR status::text = $4)
+		AND ($5::timestamp IS NULL OR occurred_at >= $5)
+		AND ($6::timestamp IS NULL OR occurred_at < $6)
+		ORDER BY id DESC LIMIT 100`,
+		q.Get("route"), q.Get("principal"), q.Get("request_id"), q.Get("status"), from, to)
+	if err != nil {
+		writeJSONError(w, "Failed to list access log", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []AccessLogEntry{}
+	for rows.Next() {
+		var e AccessLogEntry
+		if err := rows.Scan(&e.ID, &e.OccurredAt, &e.RequestID, &e.Principal, &e.TenantID, &e.Method, &e.Route, &e.Path, &e.Status, &e.DurationMS, &e.RemoteAddr); err != nil {
+			writeJSONError(w, "Failed to list access log", 1005, http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, "Failed to list access log", 1005, http.StatusInternalServerError)
+		return
+	}
+	writeJSONSuccess(w, entries, "Access log retrieved", 2026, http.StatusOK)
+}
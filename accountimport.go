@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// importBatchSize is how many accounts each COPY batch of an import loads,
+// in its own transaction
+const importBatchSize = 5000
+
+// AccountImportReport is the outcome of POST /accounts/import
+type AccountImportReport struct {
+	Imported int              `json:"imported"`
+	Failed   int              `json:"failed"`
+	Errors   []ImportRowError `json:"errors"`
+}
+
+// ImportRowError explains why a CSV row was not imported. Line counts the
+// header as line 1.
+type ImportRowError struct {
+	Line      int    `json:"line"`
+	AccountID string `json:"account_id,omitempty"`
+	Error     string `json:"error"`
+}
+
+// importRow is a validated CSV row waiting for its batch
+type importRow struct {
+	line int
+	req  CreateAccountRequest
+	iban string
+}
+
+func (rep *AccountImportReport) reject(line int, accountID, reason string) {
+	rep.Failed++
+	rep.Errors = append(rep.Errors, ImportRowError{Line: line, AccountID: accountID, Error: reason})
+}
+
+// handleImportAccounts serves POST /accounts/import, opening the accounts of a
+// CSV file with the columns account_id and initial_balance and optionally
+// customer_id, iban, account_type and external_ref, named in a header row. Valid rows are loaded with
+// COPY in batches; rows that fail validation or clash with existing accounts
+// are skipped and reported.
+func (a *App) handleImportAccounts(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+
+	cr := csv.NewReader(r.Body)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err != nil {
+		writeAPIError(w, importReadError(err))
+		return
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["account_id"]; !ok {
+		writeJSONError(w, "CSV header must name account_id and initial_balance columns", 1082, http.StatusBadRequest)
+		return
+	}
+	if _, ok := columns["initial_balance"]; !ok {
+		writeJSONError(w, "CSV header must name account_id and initial_balance columns", 1082, http.StatusBadRequest)
+		return
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	ctx := r.Context()
+	tenant := tenantFromContext(ctx)
+	report := AccountImportReport{Errors: []ImportRowError{}}
+	seen := map[int]int{}
+	batch := make([]importRow, 0, importBatchSize)
+	flush := func() *apiError {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := a.importBatch(ctx, tenant, batch, &report)
+		batch = batch[:0]
+		if err != nil {
+			apiErr := dbWriteError(err, newAPIError("Failed to import accounts", 1005, http.StatusInternalServerError))
+			apiErr.Data = report
+			return apiErr
+		}
+		return nil
+	}
+
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			report.reject(parseErr.StartLine, "", parseErr.Err.Error())
+			continue
+		}
+		if err != nil {
+			// rows of earlier batches are already imported
+			apiErr := importReadError(err)
+			apiErr.Data = report
+			writeAPIError(w, apiErr)
+			return
+		}
+		line, _ := cr.FieldPos(0)
+
+		rawID := field(record, "account_id")
+		id, err := strconv.Atoi(rawID)
+		if err != nil {
+			report.reject(line, rawID, "account_id must be an integer")
+			continue
+		}
+		balance, err := strconv.ParseFloat(field(record, "initial_balance"), 64)
+		if err != nil {
+			report.reject(line, rawID, "initial_balance must be a number")
+			continue
+		}
+		req := CreateAccountRequest{AccountID: id, InitialBalance: balance, IBAN: field(record, "iban"), AccountType: field(record, "account_type"), ExternalRef: field(record, "external_ref")}
+		if raw := field(record, "customer_id"); raw != "" {
+			customerID, err := strconv.Atoi(raw)
+			if err != nil {
+				report.reject(line, rawID, "customer_id must be an integer")
+				continue
+			}
+			req.CustomerID = &customerID
+		}
+		apiErr := req.validate()
+		if apiErr == nil {
+			apiErr = a.checkAccountType(req.AccountType)
+		}
+		if apiErr != nil {
+			report.reject(line, rawID, fmt.Sprintf("%s %s", apiErr.Errors[0].Field, apiErr.Errors[0].Message))
+			continue
+		}
+		iban, err := a.accountIBAN(req)
+		if err != nil {
+			report.reject(line, rawID, "invalid IBAN")
+			continue
+		}
+		if first, dup := seen[id]; dup {
+			report.reject(line, rawID, fmt.Sprintf("duplicate of line %d", first))
+			continue
+		}
+		seen[id] = line
+
+		batch = append(batch, importRow{line: line, req: req, iban: iban})
+		if len(batch) == importBatchSize {
+			if apiErr := flush(); apiErr != nil {
+				writeAPIError(w, apiErr)
+				return
+			}
+		}
+	}
+	if apiErr := flush(); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	writeJSONSuccess(w, report, "Accounts imported", 2034, http.StatusOK)
+}
+
+func importReadError(err error) *apiError {
+	if bodyTooLarge(err) {
+		return newAPIError("Request body too large", 1049, http.StatusRequestEntityTooLarge)
+	}
+	return newAPIError("Invalid CSV file", 1082, http.StatusBadRequest)
+}
+
+// importBatch loads the rows into a staging table with COPY and opens the
+// accounts whose customer exists and whose ID and IBAN are free, reporting
+// the others
+func (a *App) importBatch(ctx context.Context, tenant string, rows []importRow, report *AccountImportReport) error {
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `CREATE TEMP TABLE account_import (
+		line INT PRIMARY KEY, id INT NOT NULL, balance NUMERIC NOT NULL, customer_id INT, iban TEXT NOT NULL, account_type TEXT NOT NULL, external_ref TEXT NOT NULL
+	) ON COMMIT DROP`)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("account_import", "line", "id", "balance", "customer_id", "iban", "account_type", "external_ref"))
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row.line, row.req.AccountID, row.req.InitialBalance, row.req.CustomerID, row.iban, row.req.AccountType, row.req.ExternalRef); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	failed := map[int]string{}
+	missing, err := tx.QueryContext(ctx, `DELETE FROM account_import i
+		WHERE customer_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM customers c WHERE c.id = i.customer_id AND c.tenant_id = $1 AND c.erased_at IS NULL)
+		RETURNING line`, tenant)
+	if err != nil {
+		return err
+	}
+	for missing.Next() {
+		var line int
+		if err := missing.Scan(&line); err != nil {
+			missing.Close()
+			return err
+		}
+		failed[line] = "customer not found"
+	}
+	missing.Close()
+	if err := missing.Err(); err != nil {
+		return err
+	}
+
+	inserted, err := tx.QueryContext(ctx, `INSERT INTO accounts (id, balance, initial_balance, last_updated, customer_id, tenant_id, iban, account_type, external_ref)
+		SELECT id, balance, balance, NOW(), customer_id, $1, iban, NULLIF(account_type, ''), NULLIF(external_ref, '') FROM account_import ORDER BY id
+		ON CONFLICT DO NOTHING RETURNING id`, tenant)
+	if err != nil {
+		return err
+	}
+	created := map[int]bool{}
+	var ids []int64
+	for inserted.Next() {
+		var id int
+		if err := inserted.Scan(&id); err != nil {
+			inserted.Close()
+			return err
+		}
+		created[id] = true
+		ids = append(ids, int64(id))
+	}
+	inserted.Close()
+	if err := inserted.Err(); err != nil {
+		return err
+	}
+
+	if a.Config.EventSourcing.Enabled && len(ids) > 0 {
+		_, err = tx.ExecContext(ctx, `INSERT INTO account_events (account_id, tenant_id, version, type, amount)
+			SELECT id, tenant_id, 1, $1, initial_balance FROM accounts WHERE id = ANY($2)`, EventAccountCreated, pq.Array(ids))
+		if err != nil {
+			return err
+		}
+	}
+	err = a.audit(ctx, tx, auditRecord{
+		TenantID:   tenant,
+		Action:     "account.imported",
+		EntityType: "account_import",
+		EntityID:   requestIDFromContext(ctx),
+		After:      map[string]interface{}{"accounts": ids, "first_line": rows[0].line, "last_line": rows[len(rows)-1].line},
+	})
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	report.Imported += len(ids)
+	for _, row := range rows {
+		switch {
+		case failed[row.line] != "":
+			report.reject(row.line, strconv.Itoa(row.req.AccountID), failed[row.line])
+		case !created[row.req.AccountID]:
+			report.reject(row.line, strconv.Itoa(row.req.AccountID), "account ID, IBAN or external_ref already in use")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import "fmt"
+
+// AccountTypeConfig configures the rules of the accounts opened with a type,
+// such as a regulated savings product
+type AccountTypeConfig struct {
+	// MinimumBalance is the balance transfers may not take an account of
+	// the type below
+	MinimumBalance float64 `json:"minimum_balance"`
+}
+
+func (c AccountTypeConfig) validate() error {
+	if c.MinimumBalance < 0 {
+		return fmt.Errorf("minimum_balance must not be negative")
+	}
+	return nil
+}
+
+// minimumBalance is the minimum balance of accounts of accountType, 0 for
+// untyped accounts and types no longer configured
+func (cfg *Config) minimumBalance(accountType string) float64 {
+	return cfg.AccountTypes[accountType].MinimumBalance
+}
+
+// checkAccountType rejects an account type not configured
+func (a *App) checkAccountType(accountType string) *apiError {
+	var v validator
+	_, ok := a.Config.AccountTypes[accountType]
+	v.check(accountType == "" || ok, "account_type", "must be a configured account type")
+	return v.err()
+}
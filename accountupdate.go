@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// accountColumns is the column list read by scanAccount
+const accountColumns = "id, balance, last_updated, customer_id, iban, closed_at, account_type, alias, external_ref"
+
+// nextVersion is the last_updated of a changed account. NOW() is the start of
+// the transaction, so it is bumped past the current value to make sure the
+// ETag moves.
+const nextVersion = "GREATEST(NOW(), last_updated + INTERVAL '1 microsecond')"
+
+func scanAccount(row rowScanner) (Account, error) {
+	var acc Account
+	err := row.Scan(&acc.ID, &acc.Balance, &acc.LastUpdated, &acc.CustomerID, &acc.IBAN, &acc.ClosedAt, &acc.AccountType, &acc.Alias, &acc.ExternalRef)
+	return acc, err
+}
+
+// UpdateAccountRequest represents the JSON body of PATCH /accounts/{id}
+type UpdateAccountRequest struct {
+	CustomerID int `json:"customer_id"`
+}
+
+// accountETag is the entity tag of an account. Every change of an account
+// moves its last_updated, so the tag changes with it.
+func accountETag(acc Account) string {
+	return `"` + strconv.FormatInt(acc.LastUpdated.UnixMicro(), 36) + `"`
+}
+
+// etagMatches reports whether an If-Match or If-None-Match header value
+// lists etag or is *
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeAccount writes the account with its ETag, or 304 when the client's
+// If-None-Match shows it already has this version
+func writeAccount(w http.ResponseWriter, r *http.Request, acc Account, message string, code int, statusCode int) {
+	etag := accountETag(acc)
+	w.Header().Set("ETag", etag)
+	if r.Method == http.MethodGet {
+		if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	writeJSONSuccess(w, acc, message, code, statusCode)
+}
+
+// changeAccount runs change on the account locked in a transaction after
+// checking the If-Match precondition against its current version, and
+// returns the changed account
+func (a *App) changeAccount(r *http.Request, accountID int, action string, change func(ctx context.Context, tx *sql.Tx, acc Account) (*apiError, error)) (Account, *apiError) {
+	ctx := r.Context()
+	tenant := tenantFromContext(ctx)
+
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return Account{}, dbWriteError(err, newAPIError("Failed to begin transaction", 1013, http.StatusInternalServerError))
+	}
+	defer tx.Rollback()
+
+	if err := a.lockAccounts(ctx, tx, tenant, accountID); err != nil {
+		return Account{}, dbWriteError(err, newAPIError("Failed to lock accounts", 1013, http.StatusInternalServerError))
+	}
+	before, err := scanAccount(tx.QueryRowContext(ctx, "SELECT "+accountColumns+" FROM accounts WHERE id = $1 AND tenant_id = $2 FOR UPDATE", accountID, tenant))
+	if err == sql.ErrNoRows {
+		return Account{}, newAPIError("Account not found", 1010, http.StatusNotFound)
+	}
+	if err == nil {
+		err = loadWallets(ctx, tx, &before)
+	}
+	if err != nil {
+		return Account{}, dbWriteError(err, newAPIError("Failed to load account", 1005, http.StatusInternalServerError))
+	}
+	if im := r.Header.Get("If-Match"); im != "" && !etagMatches(im, accountETag(before)) {
+		return Account{}, newAPIError("Account was modified; fetch it again and retry", 1084, http.StatusPreconditionFailed)
+	}
+	if before.ClosedAt != nil {
+		return Account{}, newAPIError("Account is closed", 1086, http.StatusConflict)
+	}
+
+	if apiErr, err := change(ctx, tx, before); apiErr != nil || err != nil {
+		return Account{}, dbWriteError(err, apiErr)
+	}
+	after, err := scanAccount(tx.QueryRowContext(ctx, "SELECT "+accountColumns+" FROM accounts WHERE id = $1", accountID))
+	if err == nil {
+		err = loadWallets(ctx, tx, &after)
+	}
+	if err != nil {
+		return Account{}, dbWriteError(err, newAPIError("Failed to load account", 1005, http.StatusInternalServerError))
+	}
+	err = a.audit(ctx, tx, auditRecord{
+		TenantID:   tenant,
+		Action:     action,
+		EntityType: "account",
+		EntityID:   strconv.Itoa(accountID),
+		Before:     before,
+		After:      after,
+	})
+	if err != nil {
+		return Account{}, dbWriteError(err, newAPIError("Failed to update account", 1005, http.StatusInternalServerError))
+	}
+	if err := tx.Commit(); err != nil {
+		return Account{}, dbWriteError(err, newAPIError("Failed to commit transaction", 1020, http.StatusInternalServerError))
+	}
+	a.Cache.invalidate(ctx, tenant, accountID)
+	return after, nil
+}
+
+// handlePatchAccount serves PATCH /accounts/{id}, moving the account to
+// another customer of the tenant
+func (a *App) handlePatchAccount(w http.ResponseWriter, r *http.Request, accountID int) {
+	var req UpdateAccountRequest
+	if apiErr := decodeJSON(r, &req, 1002, "customer_id"); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	acc, apiErr := a.changeAccount(r, accountID, "account.updated", func(ctx context.Context, tx *sql.Tx, acc Account) (*apiError, error) {
+		var exists bool
+		err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM customers WHERE id = $1 AND tenant_id = $2 AND erased_at IS NULL)", req.CustomerID, tenantFromContext(ctx)).Scan(&exists)
+		if err != nil {
+			return newAPIError("Failed to update account", 1005, http.StatusInternalServerError), err
+		}
+		if !exists {
+			return newAPIError("Customer not found", 1027, http.StatusNotFound), nil
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE accounts SET customer_id = $1, last_updated = "+nextVersion+" WHERE id = $2", req.CustomerID, acc.ID)
+		if err != nil {
+			return newAPIError("Failed to update account", 1005, http.StatusInternalServerError), err
+		}
+		return nil, nil
+	})
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	writeAccount(w, r, acc, "Account updated", 2035, http.StatusOK)
+}
+
+// handleCloseAccount serves DELETE /accounts/{id}. Accounts keep their
+// ledger history, so closing marks the account closed rather than deleting
+// it; closed accounts take no further transfers or adjustments.
+func (a *App) handleCloseAccount(w http.ResponseWriter, r *http.Request, accountID int) {
+	acc, apiErr := a.changeAccount(r, accountID, "account.closed", func(ctx context.Context, tx *sql.Tx, acc Account) (*apiError, error) {
+		if acc.Balance != 0 {
+			return newAPIError("Account balance must be zero to close it", 1085, http.StatusConflict), nil
+		}
+		_, err := tx.ExecContext(ctx, "UPDATE accounts SET closed_at = NOW(), last_updated = "+nextVersion+" WHERE id = $1", acc.ID)
+		if err != nil {
+			return newAPIError("Failed to close account", 1005, http.StatusInternalServerError), err
+		}
+		return nil, nil
+	})
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	writeAccount(w, r, acc, "Account closed", 2036, http.StatusOK)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Directions of a manual adjustment
+const (
+	AdjustmentCredit = "credit"
+	AdjustmentDebit  = "debit"
+)
+
+// adjustmentReasons are the reason codes operations can post adjustments under
+var adjustmentReasons = []string{"correction", "write_off", "goodwill", "fee_refund", "interest", "chargeback"}
+
+// AdjustmentConfig configures manual balance adjustments. Adjustments are
+// booked against AccountID, a system account like the fee-income account, and
+// are disabled while it is 0.
+type AdjustmentConfig struct {
+	AccountID int `json:"account_id"`
+}
+
+// AdjustmentRequest is the JSON body of POST /admin/adjustments
+type AdjustmentRequest struct {
+	AccountID  int     `json:"account_id"`
+	Direction  string  `json:"direction"`
+	Amount     float64 `json:"amount"`
+	ReasonCode string  `json:"reason_code"`
+	Note       string  `json:"note"`
+}
+
+// Adjustment is a posted manual adjustment
+type Adjustment struct {
+	ID            int       `json:"adjustment_id"`
+	TransactionID int       `json:"transaction_id"`
+	AccountID     int       `json:"account_id"`
+	Direction     string    `json:"direction"`
+	Amount        float64   `json:"amount"`
+	ReasonCode    string    `json:"reason_code"`
+	Note          string    `json:"note,omitempty"`
+	PostedBy      string    `json:"posted_by"`
+	BalanceBefore float64   `json:"balance_before"`
+	BalanceAfter  float64   `json:"balance_after"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func (req *AdjustmentRequest) validate() *apiError {
+	var v validator
+	v.check(req.AccountID > 0, "account_id", "must be a positive integer")
+	v.check(req.Direction == AdjustmentCredit || req.Direction == AdjustmentDebit, "direction", "must be credit or debit")
+	v.amount("amount", req.Amount)
+	known := false
+	for _, r := range adjustmentReasons {
+		known = known || r == req.ReasonCode
+	}
+	v.check(known, "reason_code", "must be one of "+strings.Join(adjustmentReasons, ", "))
+	v.check(len(req.Note) <= maxMemoLength, "note", fmt.Sprintf("must be at most %d characters", maxMemoLength))
+	return v.err()
+}
+
+// handleAdjustment serves POST /admin/adjustments, crediting or debiting an
+// account of the tenant outside a transfer
+func (a *App) handleAdjustment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, "Only POST method is allowed", 1001, http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+	if a.Config.Adjustments.AccountID == 0 {
+		writeJSONError(w, "Adjustments are not enabled", 1071, http.StatusBadRequest)
+		return
+	}
+
+	var req AdjustmentRequest
+	if apiErr := decodeJSON(r, &req, 1002, "account_id", "direction", "amount", "reason_code"); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	req.Note = strings.TrimSpace(req.Note)
+	if apiErr := req.validate(); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	adj, apiErr := a.postAdjustment(r.Context(), tenantFromContext(r.Context()), req)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	writeJSONSuccess(w, adj, "Adjustment posted", 2023, http.StatusCreated)
+}
+
+// postAdjustment books an adjustment like a transfer: the account is updated
+// under the same optimistic lock, the movement is recorded in transactions
+// against the adjustment account, and the adjustment itself is kept with the
+// balances before and after it
+func (a *App) postAdjustment(ctx context.Context, tenant string, req AdjustmentRequest) (*Adjustment, *apiError) {
+	system := a.Config.Adjustments.AccountID
+	principal := principalFromContext(ctx).Name
+	delta := req.Amount
+	from, to := system, req.AccountID
+	if req.Direction == AdjustmentDebit {
+		delta = -req.Amount
+		from, to = req.AccountID, system
+	}
+
+	maxRetries := 3
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		tx, err := a.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return nil, dbWriteError(err, newAPIError("Failed to begin transaction", 1013, http.StatusInternalServerError))
+		}
+		defer tx.Rollback()
+
+		if err := a.lockAccounts(ctx, tx, tenant, req.AccountID); err != nil {
+			return nil, dbWriteError(err, newAPIError("Failed to lock accounts", 1013, http.StatusInternalServerError))
+		}
+		var acc Account
+		var reserved float64
+		err = tx.QueryRow("SELECT id, balance, last_updated, "+reservedFunds+" FROM accounts WHERE id = $1 AND tenant_id = $2 AND closed_at IS NULL", req.AccountID, tenant).
+			Scan(&acc.ID, &acc.Balance, &acc.LastUpdated, &reserved)
+		if err == sql.ErrNoRows {
+			return nil, newAPIError("Account not found", 1010, http.StatusNotFound)
+		}
+		if err != nil {
+			return nil, dbWriteError(err, newAPIError("Failed to post adjustment", 1005, http.StatusInternalServerError))
+		}
+		// a debit cannot take the funds set aside in wallets
+		if acc.Balance-reserved+delta < 0 {
+			return nil, newAPIError("Insufficient funds", 1015, http.StatusBadRequest)
+		}
+
+		result, err := tx.Exec("UPDATE accounts SET balance = balance + $1, last_updated = NOW() WHERE id = $2 AND ($3::timestamp IS NULL OR last_updated = $3)", delta, req.AccountID, a.versionGuard(acc.LastUpdated))
+		if dbUnavailable(err) {
+			return nil, dbWriteError(err, nil)
+		}
+		if affectedRows(result, err) == 0 {
+			if attempt == maxRetries {
+				return nil, newAPIError("Concurrency conflict after retries", 1016, http.StatusConflict)
+			}
+			tx.Rollback()
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+
+		// the adjustment account is a hot system account, updated relatively
+		result, err = tx.Exec("UPDATE accounts SET balance = balance - $1, last_updated = NOW() WHERE id = $2", delta, system)
+		if err != nil {
+			return nil, dbWriteError(err, newAPIError("Failed to post adjustment", 1005, http.StatusInternalServerError))
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return nil, newAPIError("Adjustment account not found", 1072, http.StatusInternalServerError)
+		}
+
+		adj := &Adjustment{
+			AccountID:     req.AccountID,
+			Direction:     req.Direction,
+			Amount:        req.Amount,
+			ReasonCode:    req.ReasonCode,
+			Note:          req.Note,
+			PostedBy:      principal,
+			BalanceBefore: acc.Balance,
+			BalanceAfter:  roundCents(acc.Balance + delta),
+		}
+		err = tx.QueryRow(`INSERT INTO transactions (from_account, to_account, amount, tenant_id, to_tenant_id, status, completed_at, reference, memo)
+			VALUES ($1, $2, $3, $4, $4, $5, NOW(), $6, NULLIF($7, '')) RETURNING id`,
+			from, to, req.Amount, tenant, TxCompleted, "ADJ-"+req.ReasonCode, req.Note).Scan(&adj.TransactionID)
+		if err != nil {
+			return nil, dbWriteError(err, newAPIError("Failed to log transaction", 1019, http.StatusInternalServerError))
+		}
+		err = tx.QueryRow(`INSERT INTO adjustments (transaction_id, tenant_id, account_id, direction, amount, reason_code, note, posted_by, balance_before, balance_after)
+			VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8, $9, $10) RETURNING id, created_at`,
+			adj.TransactionID, tenant, adj.AccountID, adj.Direction, adj.Amount, adj.ReasonCode, adj.Note, adj.PostedBy, adj.BalanceBefore, adj.BalanceAfter).
+			Scan(&adj.ID, &adj.CreatedAt)
+		if err != nil {
+			return nil, dbWriteError(err, newAPIError("Failed to post adjustment", 1005, http.StatusInternalServerError))
+		}
+		if err := a.appendEvents(ctx, tx, transferEvents(from, to, req.Amount, adj.TransactionID)...); err != nil {
+			return nil, dbWriteError(err, newAPIError("Failed to post adjustment", 1005, http.StatusInternalServerError))
+		}
+		err = a.audit(ctx, tx, auditRecord{
+			TenantID:   tenant,
+			Action:     "adjustment." + adj.Direction,
+			EntityType: "account",
+			EntityID:   strconv.Itoa(adj.AccountID),
+			Before:     map[string]interface{}{"balance": adj.BalanceBefore},
+			After:      adj,
+		})
+		if err != nil {
+			return nil, dbWriteError(err, newAPIError("Failed to post adjustment", 1005, http.StatusInternalServerError))
+		}
+
+		if err := tx.Commit(); err != nil {
+			return nil, dbWriteError(err, newAPIError("Failed to commit transaction", 1020, http.StatusInternalServerError))
+		}
+		a.Cache.invalidate(ctx, tenant, adj.AccountID)
+		log.Printf("adjustment %d: %s %s %.2f on account %d (tenant %s), reason %s, balance %.2f -> %.2f",
+			adj.ID, principal, adj.Direction, adj.Amount, adj.AccountID, tenant, adj.ReasonCode, adj.BalanceBefore, adj.BalanceAfter)
+		return adj, nil
+	}
+	return nil, newAPIError("Concurrency conflict after retries", 1016, http.StatusConflict)
+}
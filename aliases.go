@@ -0,0 +1,60 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+)
+
+// Bounds of account aliases
+const (
+	minAliasLength = 3
+	maxAliasLength = 32
+)
+
+// normalizeAlias returns an alias as stored: aliases are case-insensitive
+func normalizeAlias(alias string) string {
+	return strings.ToLower(strings.TrimSpace(alias))
+}
+
+// validAlias reports whether a normalized alias is 3 to 32 lowercase letters,
+// digits, dots, hyphens and underscores starting with a letter, so it can
+// never be mistaken for an account ID
+func validAlias(alias string) bool {
+	if len(alias) < minAliasLength || len(alias) > maxAliasLength || alias[0] < 'a' || alias[0] > 'z' {
+		return false
+	}
+	for _, c := range alias {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// accountIDByAlias resolves an alias to the ID of an account of tenant
+func (a *App) accountIDByAlias(alias, tenant string) (int, error) {
+	var id int
+	err := a.DB.QueryRow("SELECT id FROM accounts WHERE alias = $1 AND tenant_id = $2", normalizeAlias(alias), tenant).Scan(&id)
+	return id, err
+}
+
+// handleGetAccountByAlias serves GET /accounts/by-alias/{alias}, in the
+// shape of GET /accounts/{id}
+func (a *App) handleGetAccountByAlias(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	acc, err := scanAccount(a.Replica.QueryRowContext(ctx, "SELECT "+accountColumns+" FROM accounts WHERE alias = $1 AND tenant_id = $2",
+		normalizeAlias(r.PathValue("alias")), tenantFromContext(ctx)))
+	if err == sql.ErrNoRows {
+		writeJSONError(w, "Account not found", 1010, http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = loadWallets(ctx, a.Replica, &acc)
+	}
+	if err != nil {
+		writeJSONError(w, "Failed to load account", 1005, http.StatusInternalServerError)
+		return
+	}
+	writeAccount(w, r, acc, "Account retrieved", 2002, http.StatusOK)
+}
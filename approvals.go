@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ApprovalConfig configures maker-checker approval of large transfers
+type ApprovalConfig struct {
+	// Threshold holds transfers above this amount for approval; 0 disables
+	// approvals
+	Threshold float64 `json:"threshold"`
+}
+
+// required reports whether a transfer of amount needs a second approver
+func (c ApprovalConfig) required(amount float64) bool {
+	return c.Threshold > 0 && amount > c.Threshold
+}
+
+// PendingApproval is a held transfer awaiting a decision
+type PendingApproval struct {
+	TransactionID int             `json:"transaction_id"`
+	RequestedBy   string          `json:"requested_by"`
+	RequestedAt   time.Time       `json:"requested_at"`
+	Request       json.RawMessage `json:"request"`
+}
+
+// ApprovalDecisionRequest is the optional JSON body of approve and reject
+type ApprovalDecisionRequest struct {
+	Reason string `json:"reason"`
+}
+
+// holdForApproval records the transfer as pending_approval without moving
+// funds. The request is stored so it can be executed once approved.
+func (a *App) holdForApproval(ctx context.Context, tenant string, tr TransferRequest) (*TransferResult, *apiError) {
+	payload, err := json.Marshal(tr)
+	if err != nil {
+		return nil, newAPIError("Failed to hold transfer for approval", 1005, http.StatusInternalServerError)
+	}
+
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, newAPIError("Failed to begin transaction", 1013, http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	result, err := a.holdTransfer(ctx, tx, tenant, tr, TxPendingApproval)
+	if err != nil {
+		return nil, newAPIError("Failed to log transaction", 1019, http.StatusInternalServerError)
+	}
+
+	_, err = tx.Exec("INSERT INTO transfer_approvals (transaction_id, tenant_id, request, requested_by) VALUES ($1, $2, $3, $4)",
+		result.TransactionID, tenant, payload, principalFromContext(ctx).Name)
+	if err != nil {
+		return nil, newAPIError("Failed to hold transfer for approval", 1005, http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, newAPIError("Failed to commit transaction", 1020, http.StatusInternalServerError)
+	}
+	return result, nil
+}
+
+// handleApprove serves POST /transactions/{id}/approve
+func (a *App) handleApprove(w http.ResponseWriter, r *http.Request, transactionID int) {
+	a.handleApprovalDecision(w, r, transactionID, true)
+}
+
+// handleReject serves POST /transactions/{id}/reject
+func (a *App) handleReject(w http.ResponseWriter, r *http.Request, transactionID int) {
+	a.handleApprovalDecision(w, r, transactionID, false)
+}
+
+// handleApprovalDecision approves or rejects a held transfer. The approver
+// must hold the approver role and must not be the principal who requested the
+// transfer.
+func (a *App) handleApprovalDecision(w http.ResponseWriter, r *http.Request, transactionID int, approve bool) {
+	if !requireRole(w, r, RoleApprover) {
+		return
+	}
+
+	var req ApprovalDecisionRequest
+	if r.ContentLength != 0 {
+		if apiErr := decodeJSON(r, &req, 1002); apiErr != nil {
+			writeAPIError(w, apiErr)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	tenant := tenantFromContext(ctx)
+	approver := principalFromContext(ctx).Name
+
+	var payload []byte
+	var requestedBy string
+	var decision sql.NullString
+	err := a.DB.QueryRowContext(ctx, "SELECT request, requested_by, decision FROM transfer_approvals WHERE transaction_id = $1 AND tenant_id = $2",
+		transactionID, tenant).Scan(&payload, &requestedBy, &decision)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, "Transfer is not awaiting approval", 1054, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "Failed to load approval", 1005, http.StatusInternalServerError)
+		return
+	}
+	if requestedBy == approver {
+		writeJSONError(w, "Transfers cannot be approved by their requester", 1055, http.StatusForbidden)
+		return
+	}
+
+	outcome := "rejected"
+	if approve {
+		outcome = "approved"
+	}
+	// The guarded update makes concurrent decisions on the same transfer
+	// mutually exclusive
+	result, err := a.DB.ExecContext(ctx, `UPDATE transfer_approvals SET decision = $1, decided_by = $2, decided_at = NOW(), reason = NULLIF($3, '')
+		WHERE transaction_id = $4 AND decision IS NULL`, outcome, approver, strings.TrimSpace(req.Reason), transactionID)
+	if err != nil {
+		writeJSONError(w, "Failed to record decision", 1005, http.StatusInternalServerError)
+		return
+	}
+	if affectedRows(result, nil) == 0 {
+		writeJSONError(w, "Transfer has already been decided", 1056, http.StatusConflict)
+		return
+	}
+
+	if !approve {
+		reason := "Rejected by approver"
+		if req.Reason != "" {
+			reason = req.Reason
+		}
+		_, err := a.DB.ExecContext(ctx, "UPDATE transactions SET status = $1, failure_reason = $2 WHERE id = $3", TxRejected, reason, transactionID)
+		if err != nil {
+			writeJSONError(w, "Failed to record decision", 1005, http.StatusInternalServerError)
+			return
+		}
+		a.auditCommitted(ctx, auditRecord{
+			TenantID:   tenant,
+			Action:     "transfer.rejected",
+			EntityType: "transaction",
+			EntityID:   strconv.Itoa(transactionID),
+			Before:     map[string]interface{}{"status": TxPendingApproval},
+			After:      map[string]interface{}{"status": TxRejected, "reason": reason},
+		})
+		writeJSONSuccess(w, map[string]interface{}{"transaction_id": transactionID, "status": TxRejected}, "Transfer rejected", 2013, http.StatusOK)
+		return
+	}
+
+	var tr TransferRequest
+	if err := json.Unmarshal(payload, &tr); err != nil {
+		writeJSONError(w, "Failed to load approval", 1005, http.StatusInternalServerError)
+		return
+	}
+	// held transfers are verified before they reach the approval queue
+	tr.pendingID = transactionID
+	tr.verified = true
+	tr.approved = true
+
+	transfer, apiErr := a.executeTransfer(ctx, tenant, tr)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	writeJSONSuccess(w, transfer, "Transfer approved", 2012, http.StatusOK)
+}
+
+// handleListApprovals serves GET /approvals, the tenant's transfers awaiting
+// a decision
+func (a *App) handleListApprovals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, "Only GET method is allowed", 1006, http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireRole(w, r, RoleApprover) {
+		return
+	}
+
+	rows, err := a.DB.QueryContext(r.Context(), `SELECT p.transaction_id, p.requested_by, t.created_at, p.request
+		FROM transfer_approvals p JOIN transactions t ON t.id = p.transaction_id
+		WHERE p.tenant_id = $1 AND p.decision IS NULL ORDER BY p.transaction_id`, tenantFromContext(r.Context()))
+	if err != nil {
+		writeJSONError(w, "Failed to list approvals", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	approvals := []PendingApproval{}
+	for rows.Next() {
+		var p PendingApproval
+		if err := rows.Scan(&p.TransactionID, &p.RequestedBy, &p.RequestedAt, &p.Request); err != nil {
+			writeJSONError(w, "Failed to list approvals", 1005, http.StatusInternalServerError)
+			return
+		}
+		approvals = append(approvals, p)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, "Failed to list approvals", 1005, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSONSuccess(w, approvals, "Pending approvals retrieved", 2014, http.StatusOK)
+}
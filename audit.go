@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// auditLockID is the advisory lock serializing appends to the audit chain
+const auditLockID = 7240_1001
+
+// auditActorSystem is the actor of changes made by background jobs
+const auditActorSystem = "system"
+
+// auditRecord describes a state change to append to the audit log. Actor
+// defaults to the principal of the context.
+type auditRecord struct {
+	Actor      string
+	TenantID   string
+	Action     string
+	EntityType string
+	EntityID   string
+	Before     interface{}
+	After      interface{}
+}
+
+// AuditEntry is a row of the audit log. Each row's hash covers its content and
+// the hash of the previous row, so changing or deleting any row breaks the
+// chain from there on.
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Actor      string          `json:"actor"`
+	TenantID   string          `json:"tenant_id"`
+	Action     string          `json:"action"`
+	EntityType string          `json:"entity_type"`
+	EntityID   string          `json:"entity_id"`
+	Before     json.RawMessage `json:"before"`
+	After      json.RawMessage `json:"after"`
+	PrevHash   string          `json:"prev_hash"`
+	Hash       string          `json:"hash"`
+}
+
+// computeHash hashes the entry with length-prefixed fields so no two entries
+// share an encoding
+func (e *AuditEntry) computeHash() string {
+	h := sha256.New()
+	for _, f := range []string{
+		strconv.FormatInt(e.ID, 10),
+		e.OccurredAt.UTC().Format(time.RFC3339Nano),
+		e.Actor, e.TenantID, e.Action, e.EntityType, e.EntityID,
+		string(e.Before), string(e.After), e.PrevHash,
+	} {
+		fmt.Fprintf(h, "%d:%s;", len(f), f)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// audit appends rec to the audit log within tx, so the entry commits or rolls
+// back with the change it records. Appends are serialized until tx ends.
+func (a *App) audit(ctx context.Context, tx *sql.Tx, rec auditRecord) error {
+	if rec.Actor == "" {
+		rec.Actor = principalFromContext(ctx).Name
+	}
+	before, err := json.Marshal(rec.Before)
+	if err != nil {
+		return err
+	}
+	after, err := json.Marshal(rec.After)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", auditLockID); err != nil {
+		return err
+	}
+	e := AuditEntry{
+		// the column has microsecond precision
+		OccurredAt: time.Now().UTC().Truncate(time.Microsecond),
+		Actor:      rec.Actor,
+		TenantID:   rec.TenantID,
+		Action:     rec.Action,
+		EntityType: rec.EntityType,
+		EntityID:   rec.EntityID,
+		Before:     before,
+		After:      after,
+	}
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE((SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1), ''), nextval('audit_log_id_seq')").Scan(&e.PrevHash, &e.ID)
+	if err != nil {
+		return err
+	}
+	e.Hash = e.computeHash()
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO audit_log (id, occurred_at, actor, tenant_id, action, entity_type, entity_id, before, after, prev_hash, hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		e.ID, e.OccurredAt, e.Actor, e.TenantID, e.Action, e.EntityType, e.EntityID, string(e.Before), string(e.After), e.PrevHash, e.Hash)
+	return err
+}
+
+// auditCommitted appends rec in a transaction of its own, for changes that
+// were committed without one. Failures are logged.
+func (a *App) auditCommitted(ctx context.Context, rec auditRecord) {
+	err := func() error {
+		tx, err := a.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := a.audit(ctx, tx, rec); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		log.Printf("audit: %s %s %s: %v", rec.Action, rec.EntityType, rec.EntityID, err)
+	}
+}
+
+// AuditVerification is the result of checking the audit chain
+type AuditVerification struct {
+	Valid          bool   `json:"valid"`
+	EntriesChecked int    `json:"entries_checked"`
+	FirstInvalidID int64  `json:"first_invalid_id,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+}
+
+// handleAuditVerify serves GET /admin/audit/verify, recomputing the hash chain
+// over the whole audit log
+func (a *App) handleAuditVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, "Only GET method is allowed", 1006, http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+
+	rows, err := a.DB.QueryContext(r.Context(), "SELECT "+auditColumns+" FROM audit_log ORDER BY id")
+	if err != nil {
+		writeJSONError(w, "Failed to verify audit log", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	result := AuditVerification{Valid: true}
+	prev := ""
+	for rows.Next() {
+		e, err := scanAuditEntry(rows)
+		if err != nil {
+			writeJSONError(w, "Failed to verify audit log", 1005, http.StatusInternalServerError)
+			return
+		}
+		result.EntriesChecked++
+		switch {
+		case e.PrevHash != prev:
+			result.Reason = "previous hash does not match the preceding entry"
+		case e.computeHash() != e.Hash:
+			result.Reason = "entry content does not match its hash"
+		default:
+			prev = e.Hash
+			continue
+		}
+		result.Valid = false
+		result.FirstInvalidID = e.ID
+		break
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, "Failed to verify audit log", 1005, http.StatusInternalServerError)
+		return
+	}
+	writeJSONSuccess(w, result, "Audit log verified", 2025, http.StatusOK)
+}
+
+// handleAudit serves GET /admin/audit?entity_type=&entity_id=, the audit
+// entries newest first, optionally of one entity, a page at a time
+func (a *App) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, "Only GET method is allowed", 1006, http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+
+	page, apiErr := parsePage(r, true)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	cond, orderLimit, key := page.keyset("id", 3)
+
+	q := r.URL.Query()
+	rows, err := a.DB.QueryContext(r.Context(), "SELECT "+auditColumns+` FROM audit_log
+		WHERE (NULLIF($1, '') IS NULL OR entity_type = $1) AND (NULLIF($2, '') IS NULL OR entity_id = $2) AND `+cond+" "+orderLimit,
+		q.Get("entity_type"), q.Get("entity_id"), key)
+	if err != nil {
+		writeJSONError(w, "Failed to list audit log", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		e, err := scanAuditEntry(rows)
+		if err != nil {
+			writeJSONError(w, "Failed to list audit log", 1005, http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, "Failed to list audit log", 1005, http.StatusInternalServerError)
+		return
+	}
+	entries, pagination := paginate(page, entries, func(e AuditEntry) int64 { return e.ID })
+	writeJSONPage(w, entries, &pagination, "Audit log retrieved", 2024, http.StatusOK)
+}
+
+// auditColumns is the column list read by scanAuditEntry
+const auditColumns = "id, occurred_at, actor, tenant_id, action, entity_type, entity_id, before, after, prev_hash, hash"
+
+func scanAuditEntry(row rowScanner) (AuditEntry, error) {
+	var e AuditEntry
+	var before, after string
+	err := row.Scan(&e.ID, &e.OccurredAt, &e.Actor, &e.TenantID, &e.Action, &e.EntityType, &e.EntityID, &before, &after, &e.PrevHash, &e.Hash)
+	e.Before, e.After = json.RawMessage(before), json.RawMessage(after)
+	return e, err
+}
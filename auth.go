@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Roles granted to API keys
+const (
+	RoleApprover = "approver"
+	RoleAdmin    = "admin"
+)
+
+// AuthConfig configures API key authentication. Authentication is disabled
+// while no keys are configured and every request is then anonymous.
+type AuthConfig struct {
+	APIKeys []APIKey      `json:"api_keys"`
+	Signing SigningConfig `json:"signing"`
+}
+
+// APIKey grants a principal its roles. When Tenant is set the key can only act
+// on that tenant, regardless of the tenant header.
+type APIKey struct {
+	Key       string   `json:"key"`
+	Principal string   `json:"principal"`
+	Roles     []string `json:"roles"`
+	Tenant    string   `json:"tenant"`
+	// Quota caps the calls and transfers of the key per day and month
+	Quota QuotaConfig `json:"quota"`
+}
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	Name   string
+	Roles  []string
+	Tenant string
+	Quota  QuotaConfig
+}
+
+// anonymous is the principal of requests when authentication is disabled
+var anonymous = &Principal{Name: "anonymous"}
+
+func (p *Principal) hasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// principalFromContext returns the authenticated caller of the request
+func principalFromContext(ctx context.Context) *Principal {
+	if p, ok := ctx.Value(principalKey{}).(*Principal); ok {
+		return p
+	}
+	return anonymous
+}
+
+// withAuth authenticates requests by the API key in the Authorization bearer
+// token, the X-API-Key header or, for browsers, the basic auth password
+func (a *App) withAuth(next http.Handler) http.Handler {
+	keys := a.Config.Auth.APIKeys
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(keys) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		presented := r.Header.Get("X-API-Key")
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			presented = bearer
+		} else if _, password, ok := r.BasicAuth(); ok {
+			presented = password
+		}
+
+		var principal *Principal
+		for _, k := range keys {
+			if subtle.ConstantTimeCompare([]byte(presented), []byte(k.Key)) == 1 {
+				principal = &Principal{Name: k.Principal, Roles: k.Roles, Tenant: k.Tenant, Quota: k.Quota}
+			}
+		}
+		if presented == "" || principal == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			// lets the browser prompt for the key of the admin web UI
+			if strings.HasPrefix(r.URL.Path, dashboardPrefix) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="fundtransfer admin", charset="UTF-8"`)
+			}
+			writeJSONError(w, "Missing or invalid API key", 1052, http.StatusUnauthorized)
+			return
+		}
+
+		if e := accessEntryFromContext(r.Context()); e != nil {
+			e.Principal = principal.Name
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	})
+}
+
+// requireRole writes a 403 response and returns false unless the caller has
+// role
+func requireRole(w http.ResponseWriter, r *http.Request, role string) bool {
+	if !principalFromContext(r.Context()).hasRole(role) {
+		writeJSONError(w, "Insufficient permissions", 1053, http.StatusForbidden)
+		return false
+	}
+	return true
+}
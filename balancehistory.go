@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+)
+
+// Granularities of a balance history
+const (
+	HistoryPerTransaction = "transaction"
+	HistoryPerDay         = "day"
+)
+
+// Bounds of a balance history request
+const (
+	defaultHistoryWindow = 30 * 24 * time.Hour
+	maxHistoryWindow     = 366 * 24 * time.Hour
+	maxHistoryPoints     = 1000
+)
+
+// BalanceHistory is the balance of an account over a window, for charts
+type BalanceHistory struct {
+	AccountID      int            `json:"account_id"`
+	From           time.Time      `json:"from"`
+	To             time.Time      `json:"to"`
+	Interval       string         `json:"interval"`
+	OpeningBalance float64        `json:"opening_balance"`
+	Points         []BalancePoint `json:"points"`
+	// Truncated marks a per-transaction history cut off after
+	// maxHistoryPoints points; ask again from just after the last one for more
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// BalancePoint is the balance after a transaction, or at the end of the UTC
+// day starting at At
+type BalancePoint struct {
+	At            time.Time `json:"at"`
+	Balance       float64   `json:"balance"`
+	TransactionID int       `json:"transaction_id,omitempty"`
+}
+
+// handleBalanceHistory serves GET /accounts/{id}/balance-history?from=&to=&interval=,
+// the balance after every movement in [from, to), or at the end of every
+// day. The window defaults to the last 30 days and spans at most 366.
+func (a *App) handleBalanceHistory(w http.ResponseWriter, r *http.Request, accountID int) {
+	q := r.URL.Query()
+	h := BalanceHistory{AccountID: accountID, To: time.Now().UTC(), Interval: HistoryPerDay, Points: []BalancePoint{}}
+	if v := q.Get("to"); v != "" {
+		t, err := parseExportBound(v, true)
+		if err != nil {
+			writeJSONError(w, "Invalid to parameter, expected a date or RFC 3339 timestamp", 1067, http.StatusBadRequest)
+			return
+		}
+		h.To = t.UTC()
+	}
+	h.From = h.To.Add(-defaultHistoryWindow)
+	if v := q.Get("from"); v != "" {
+		t, err := parseExportBound(v, false)
+		if err != nil {
+			writeJSONError(w, "Invalid from parameter, expected a date or RFC 3339 timestamp", 1067, http.StatusBadRequest)
+			return
+		}
+		h.From = t.UTC()
+	}
+	if v := q.Get("interval"); v != "" {
+		h.Interval = v
+	}
+	var v validator
+	v.check(h.Interval == HistoryPerTransaction || h.Interval == HistoryPerDay, "interval", "must be transaction or day")
+	v.check(h.From.Before(h.To), "from", "must be before to")
+	v.check(h.To.Sub(h.From) <= maxHistoryWindow, "to", "must be at most 366 days after from")
+	if apiErr := v.err(); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	ctx := r.Context()
+	tenant := tenantFromContext(ctx)
+	tx, err := a.Replica.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		writeJSONError(w, "Failed to load balance history", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// timestamps have microsecond precision
+	h.OpeningBalance, err = a.balanceAt(ctx, tx, tenant, accountID, h.From.Add(-time.Microsecond))
+	if err == sql.ErrNoRows {
+		writeJSONError(w, "Account not found", 1010, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "Failed to load balance history", 1005, http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT id, created_at, "+signedAmount+" FROM ledger_transactions WHERE "+movementFilter+
+		" AND created_at >= $6 AND created_at < $7 ORDER BY created_at, id",
+		accountID, tenant, movingStatuses[0], movingStatuses[1], movingStatuses[2], h.From, h.To)
+	if err != nil {
+		writeJSONError(w, "Failed to load balance history", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	running := h.OpeningBalance
+	day := h.From.Truncate(24 * time.Hour)
+	// closeDays adds the points of the days ending up to before
+	closeDays := func(before time.Time) {
+		for next := day.AddDate(0, 0, 1); !before.Before(next); next = day.AddDate(0, 0, 1) {
+			h.Points = append(h.Points, BalancePoint{At: day, Balance: running})
+			day = next
+		}
+	}
+	for rows.Next() {
+		var id int
+		var at time.Time
+		var amount float64
+		if err := rows.Scan(&id, &at, &amount); err != nil {
+			writeJSONError(w, "Failed to load balance history", 1005, http.StatusInternalServerError)
+			return
+		}
+		if h.Interval == HistoryPerDay {
+			closeDays(at)
+		} else if len(h.Points) == maxHistoryPoints {
+			h.Truncated = true
+			break
+		}
+		running = roundCents(running + amount)
+		if h.Interval == HistoryPerTransaction {
+			h.Points = append(h.Points, BalancePoint{At: at, Balance: running, TransactionID: id})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, "Failed to load balance history", 1005, http.StatusInternalServerError)
+		return
+	}
+	if h.Interval == HistoryPerDay {
+		closeDays(h.To)
+		// the day the window ends in, up to its end
+		if day.Before(h.To) {
+			h.Points = append(h.Points, BalancePoint{At: day, Balance: running})
+		}
+	}
+	writeJSONSuccess(w, h, "Balance history retrieved", 2071, http.StatusOK)
+}
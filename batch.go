@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// maxBatchTransfers bounds the transfers of one batch
+const maxBatchTransfers = 500
+
+// Outcomes of the transfers of a batch
+const (
+	BatchItemSucceeded = "succeeded"
+	BatchItemFailed    = "failed"
+)
+
+// BatchTransferRequest holds transfers, each the body of POST /transactions.
+// They are decoded one by one so a malformed one only fails itself.
+type BatchTransferRequest struct {
+	Transfers []json.RawMessage `json:"transfers"`
+}
+
+// BatchTransferItem is the outcome of one transfer of a batch, with the code
+// and message POST /transactions would have answered it with
+type BatchTransferItem struct {
+	Index       int             `json:"index"`
+	Status      string          `json:"status"`
+	Code        int             `json:"code"`
+	Message     string          `json:"message"`
+	Transaction *TransferResult `json:"transaction,omitempty"`
+	Errors      []FieldError    `json:"errors,omitempty"`
+	Data        interface{}     `json:"data,omitempty"`
+}
+
+// BatchTransferResult reports every transfer of a batch in request order
+type BatchTransferResult struct {
+	Succeeded int                 `json:"succeeded"`
+	Failed    int                 `json:"failed"`
+	Results   []BatchTransferItem `json:"results"`
+}
+
+// transferOutcome is the message, code and HTTP status POST /transactions
+// answers a transfer made or held with
+func transferOutcome(result *TransferResult) (string, int, int) {
+	switch {
+	case result.Status == TxPendingConfirmation:
+		return "Transfer awaiting OTP confirmation", 2015, http.StatusAccepted
+	case result.Status == TxPendingApproval:
+		return "Transfer awaiting approval", 2011, http.StatusAccepted
+	case result.ExternalStatus == ExternalPending:
+		return "Transfer pending at external institution", 2007, http.StatusAccepted
+	}
+	return "Transfer successful", 2003, http.StatusOK
+}
+
+// handleBatchTransfer serves POST /transactions/batch for payout runs: each
+// transfer is made on its own, in order, and one failing does not stop the
+// rest. Each counts against the transfer quota, and a transfer over it fails
+// with 1105.
+func (a *App) handleBatchTransfer(w http.ResponseWriter, r *http.Request) {
+	var req BatchTransferRequest
+	if apiErr := decodeJSON(r, &req, 1012, "transfers"); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	var v validator
+	v.check(len(req.Transfers) >= 1 && len(req.Transfers) <= maxBatchTransfers, "transfers", fmt.Sprintf("must hold 1 to %d transfers", maxBatchTransfers))
+	if apiErr := v.err(); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	ctx := r.Context()
+	tenant := tenantFromContext(ctx)
+	principal := principalFromContext(ctx)
+	batch := BatchTransferResult{Results: make([]BatchTransferItem, 0, len(req.Transfers))}
+	for i, raw := range req.Transfers {
+		item := BatchTransferItem{Index: i}
+		var tr TransferRequest
+		apiErr := decodeBody(raw, &tr, 1012, "amount")
+		if apiErr == nil {
+			var u *QuotaUsage
+			if u, apiErr = a.consumeQuota(ctx, principal, QuotaTransfers); u != nil {
+				setRateLimitHeaders(w.Header(), *u)
+			}
+		}
+		if apiErr == nil {
+			item.Transaction, apiErr = a.executeTransfer(ctx, tenant, tr)
+		}
+
+		if apiErr != nil {
+			batch.Failed++
+			item.Status, item.Code, item.Message = BatchItemFailed, apiErr.Code, apiErr.Message
+			item.Errors, item.Data = apiErr.Errors, apiErr.Data
+		} else {
+			batch.Succeeded++
+			item.Status = BatchItemSucceeded
+			item.Message, item.Code, _ = transferOutcome(item.Transaction)
+		}
+		batch.Results = append(batch.Results, item)
+	}
+	writeJSONSuccess(w, batch, "Batch processed", 2082, http.StatusOK)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BreakerConfig configures the circuit breaker guarding each database
+type BreakerConfig struct {
+	// FailureThreshold consecutive failed connection attempts open the
+	// breaker; 0 disables it
+	FailureThreshold int `json:"failure_threshold"`
+	// OpenSeconds is how long the breaker stays open before a connection
+	// attempt probes the database again
+	OpenSeconds int `json:"open_seconds"`
+}
+
+// errCircuitOpen is returned instead of connecting while the breaker is open
+var errCircuitOpen = errors.New("database circuit breaker is open")
+
+// circuitBreaker fails connection attempts fast once the database has been
+// unreachable for FailureThreshold attempts in a row. After OpenSeconds one
+// attempt is let through as a probe: success closes the breaker, failure
+// keeps it open for another OpenSeconds.
+type circuitBreaker struct {
+	name      string
+	threshold int
+	open      time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time // zero while closed
+	probing   bool
+}
+
+// newCircuitBreaker returns nil when the breaker is disabled
+func newCircuitBreaker(name string, cfg BreakerConfig) *circuitBreaker {
+	if cfg.FailureThreshold == 0 {
+		return nil
+	}
+	return &circuitBreaker{name: name, threshold: cfg.FailureThreshold, open: time.Duration(cfg.OpenSeconds) * time.Second}
+}
+
+// allow reports whether a connection attempt may proceed
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return nil
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return errCircuitOpen
+	}
+	b.probing = true
+	return nil
+}
+
+// record updates the breaker with the outcome of an allowed attempt
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasOpen := !b.openUntil.IsZero()
+	b.probing = false
+	if err == nil {
+		if wasOpen {
+			log.Printf("%s database: circuit breaker closed", b.name)
+		}
+		b.failures, b.openUntil = 0, time.Time{}
+		return
+	}
+	b.failures++
+	if wasOpen || b.failures >= b.threshold {
+		if !wasOpen {
+			log.Printf("%s database: circuit breaker opened after %d failed connection attempts: %v", b.name, b.failures, err)
+		}
+		b.openUntil = time.Now().Add(b.open)
+	}
+}
+
+// release ends an allowed attempt that ended without telling whether the
+// database is reachable, such as one cancelled by its caller
+func (b *circuitBreaker) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+// retryAfter reports whether requests should be turned away and for how long
+func (b *circuitBreaker) retryAfter() (time.Duration, bool) {
+	if b == nil {
+		return 0, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return 0, false
+	}
+	wait := time.Until(b.openUntil)
+	if wait <= 0 && !b.probing {
+		return 0, false // the next request probes
+	}
+	return max(wait, time.Second), true
+}
+
+// probe pings db every OpenSeconds while the breaker is open so it closes
+// again without waiting for traffic
+func (b *circuitBreaker) probe(ctx context.Context, db *sql.DB) {
+	if b == nil {
+		return
+	}
+	ticker := time.NewTicker(b.open)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.mu.Lock()
+			tripped := !b.openUntil.IsZero()
+			b.mu.Unlock()
+			// the ping connects, and so probes, once the open period is over
+			if tripped && db.PingContext(ctx) == nil {
+				b.record(nil)
+			}
+		}
+	}
+}
+
+// breakerConnector guards the connection attempts of a driver.Connector and
+// tracks the connections it opens for failover and slow queries
+type breakerConnector struct {
+	driver.Connector
+	breaker   *circuitBreaker
+	slowQuery time.Duration
+}
+
+func (c breakerConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil && ctx.Err() != nil {
+		c.breaker.release()
+		return nil, err
+	}
+	c.breaker.record(err)
+	if err != nil {
+		return nil, err
+	}
+	return trackConn(conn, c.slowQuery), nil
+}
+
+// withBreaker turns requests away with 503 and Retry-After while the
+// breaker of the primary database is open, instead of letting them wait on
+// connection attempts
+func (a *App) withBreaker(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metrics" {
+			if wait, open := a.Breaker.retryAfter(); open {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeJSONError(w, "Database unavailable, retry later", 1079, http.StatusServiceUnavailable)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// CacheConfig configures the Redis cache of account reads. The cache is
+// disabled while RedisAddr is empty.
+type CacheConfig struct {
+	RedisAddr     string `json:"redis_addr"`
+	RedisPassword string `json:"redis_password"`
+	RedisDB       int    `json:"redis_db"`
+	TTLSeconds    int    `json:"ttl_seconds"`
+}
+
+// accountCacheTimeout bounds every cache call so a slow Redis degrades to
+// database reads rather than stalling requests
+const accountCacheTimeout = 100 * time.Millisecond
+
+// accountCache caches GET /accounts/{id} responses. Entries are invalidated
+// after every balance change through the account_balances notifications, and
+// expire after the TTL in case a notification is lost.
+type accountCache struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// newAccountCache returns nil when no Redis address is configured
+func newAccountCache(cfg CacheConfig) *accountCache {
+	if cfg.RedisAddr == "" {
+		return nil
+	}
+	return &accountCache{
+		client: redis.NewClient(&redis.Options{Addr: cfg.RedisAddr, Password: cfg.RedisPassword, DB: cfg.RedisDB}),
+		ttl:    time.Duration(cfg.TTLSeconds) * time.Second,
+	}
+}
+
+// cachedAccount keeps last_updated, which the API hides, for the ETag
+type cachedAccount struct {
+	Account
+	LastUpdated time.Time `json:"last_updated"`
+}
+
+func accountCacheKey(tenant string, accountID int) string {
+	return fmt.Sprintf("fundtransfer:account:%s:%d", tenant, accountID)
+}
+
+// get returns the cached account; misses and errors both report false
+func (c *accountCache) get(ctx context.Context, tenant string, accountID int) (*Account, bool) {
+	if c == nil {
+		return nil, false
+	}
+	ctx, cancel := context.WithTimeout(ctx, accountCacheTimeout)
+	defer cancel()
+	data, err := c.client.Get(ctx, accountCacheKey(tenant, accountID)).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			log.Printf("account cache: %v", err)
+		}
+		return nil, false
+	}
+	var cached cachedAccount
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return nil, false
+	}
+	cached.Account.LastUpdated = cached.LastUpdated
+	return &cached.Account, true
+}
+
+func (c *accountCache) set(ctx context.Context, tenant string, acc Account) {
+	if c == nil {
+		return
+	}
+	data, err := json.Marshal(cachedAccount{Account: acc, LastUpdated: acc.LastUpdated})
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, accountCacheTimeout)
+	defer cancel()
+	if err := c.client.Set(ctx, accountCacheKey(tenant, acc.ID), data, c.ttl).Err(); err != nil {
+		log.Printf("account cache: %v", err)
+	}
+}
+
+// invalidate drops the cached account. It is also called by the replica that
+// made the change, so its own clients read their writes.
+func (c *accountCache) invalidate(ctx context.Context, tenant string, accountIDs ...int) {
+	if c == nil || len(accountIDs) == 0 {
+		return
+	}
+	keys := make([]string, len(accountIDs))
+	for i, id := range accountIDs {
+		keys[i] = accountCacheKey(tenant, id)
+	}
+	ctx, cancel := context.WithTimeout(ctx, accountCacheTimeout)
+	defer cancel()
+	if err := c.client.Del(ctx, keys...).Err(); err != nil {
+		log.Printf("account cache: %v", err)
+	}
+}
+
+// flush drops every cached account, for when invalidations may have been
+// missed
+func (c *accountCache) flush(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	iter := c.client.Scan(ctx, 0, "fundtransfer:account:*", 1000).Iterator()
+	for iter.Next(ctx) {
+		if err := c.client.Del(ctx, iter.Val()).Err(); err != nil {
+			log.Printf("account cache: flush: %v", err)
+			return
+		}
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("account cache: flush: %v", err)
+	}
+}
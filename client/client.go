@@ -0,0 +1,432 @@
+// Package client is the Go client of the fund transfer API. It covers
+// accounts, transfers, transactions and reconciliation, retries requests the
+// server turned away, and retries transfers safely under idempotency keys.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client calls the versioned API of one server. It is safe for concurrent
+// use.
+type Client struct {
+	baseURL    string
+	apiKey     string
+	tenant     string
+	httpClient *http.Client
+	maxRetries int
+	backoff    time.Duration
+
+	mu        sync.Mutex
+	rateLimit *RateLimit
+}
+
+// RateLimit is the quota of the API key as the server last reported it in
+// the X-RateLimit headers
+type RateLimit struct {
+	Limit     int
+	Remaining int
+	// Reset is when the period of the limit ends
+	Reset time.Time
+}
+
+// RateLimit returns the quota reported on the latest response, or nil when
+// the server reported none. Callers can pace themselves on Remaining instead
+// of running into 429s.
+func (c *Client) RateLimit() *RateLimit {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rateLimit == nil {
+		return nil
+	}
+	rl := *c.rateLimit
+	return &rl
+}
+
+// recordRateLimit keeps the quota reported in the response headers h
+func (c *Client) recordRateLimit(h http.Header) {
+	limit, err1 := strconv.Atoi(h.Get("X-RateLimit-Limit"))
+	remaining, err2 := strconv.Atoi(h.Get("X-RateLimit-Remaining"))
+	reset, err3 := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return
+	}
+	c.mu.Lock()
+	c.rateLimit = &RateLimit{Limit: limit, Remaining: remaining, Reset: time.Unix(reset, 0)}
+	c.mu.Unlock()
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithAPIKey authenticates every request with key
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithTenant sends every request on behalf of tenant
+func WithTenant(tenant string) Option {
+	return func(c *Client) { c.tenant = tenant }
+}
+
+// WithHTTPClient replaces the default client with a 30 second timeout
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithRetries sets how often a failed request is retried and the initial
+// backoff, which doubles on every attempt unless the server sends
+// Retry-After. 0 retries disables retrying.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) { c.maxRetries, c.backoff = n, backoff }
+}
+
+// New returns a client of the server at baseURL, e.g. http://localhost:8081
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		maxRetries: 3,
+		backoff:    500 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// CreateAccount opens an account
+func (c *Client) CreateAccount(ctx context.Context, req CreateAccountRequest) (*Account, error) {
+	var acc Account
+	if _, err := c.do(ctx, http.MethodPost, "/accounts", "", req, &acc); err != nil {
+		return nil, err
+	}
+	return &acc, nil
+}
+
+// GetAccount returns an account and its balance
+func (c *Client) GetAccount(ctx context.Context, id int) (*Account, error) {
+	var acc Account
+	if _, err := c.do(ctx, http.MethodGet, "/accounts/"+strconv.Itoa(id), "", nil, &acc); err != nil {
+		return nil, err
+	}
+	return &acc, nil
+}
+
+// GetAccountByAlias returns the account with an alias
+func (c *Client) GetAccountByAlias(ctx context.Context, alias string) (*Account, error) {
+	var acc Account
+	if _, err := c.do(ctx, http.MethodGet, "/accounts/by-alias/"+url.PathEscape(alias), "", nil, &acc); err != nil {
+		return nil, err
+	}
+	return &acc, nil
+}
+
+// Transfer moves funds between accounts. It is sent with an idempotency key,
+// so it is retried on network and server errors without the risk of moving
+// the funds twice.
+func (c *Client) Transfer(ctx context.Context, req TransferRequest) (*TransferResult, error) {
+	key := req.IdempotencyKey
+	if key == "" {
+		var err error
+		if key, err = newIdempotencyKey(); err != nil {
+			return nil, err
+		}
+	}
+	var res TransferResult
+	resp, err := c.do(ctx, http.MethodPost, "/transactions", key, req, &res)
+	if err != nil {
+		return nil, err
+	}
+	res.Replayed = resp.replayed
+	return &res, nil
+}
+
+// BatchTransfer makes each transfer on its own, so some may fail while the
+// others succeed. The batch is sent with idempotencyKey, a random one when
+// empty; the keys of the requests are not used.
+func (c *Client) BatchTransfer(ctx context.Context, transfers []TransferRequest, idempotencyKey string) (*BatchResult, error) {
+	if idempotencyKey == "" {
+		var err error
+		if idempotencyKey, err = newIdempotencyKey(); err != nil {
+			return nil, err
+		}
+	}
+	var res BatchResult
+	resp, err := c.do(ctx, http.MethodPost, "/transactions/batch", idempotencyKey, map[string]interface{}{"transfers": transfers}, &res)
+	if err != nil {
+		return nil, err
+	}
+	res.Replayed = resp.replayed
+	return &res, nil
+}
+
+// Quote previews a transfer without moving funds: its fee, the balances it
+// would leave and the warnings of what would hold it up or turn it down
+func (c *Client) Quote(ctx context.Context, req TransferRequest) (*TransferQuote, error) {
+	var q TransferQuote
+	if _, err := c.do(ctx, http.MethodPost, "/transactions/quote", "", req, &q); err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// GetTransaction returns a transaction; includeArchived also searches the
+// archive
+func (c *Client) GetTransaction(ctx context.Context, id int, includeArchived bool) (*Transaction, error) {
+	path := "/transactions/" + strconv.Itoa(id)
+	if includeArchived {
+		path += "?include_archived=true"
+	}
+	var tx Transaction
+	if _, err := c.do(ctx, http.MethodGet, path, "", nil, &tx); err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
+
+// UpdateTransaction sets the category or tags of a transaction
+func (c *Client) UpdateTransaction(ctx context.Context, id int, req UpdateTransactionRequest) (*Transaction, error) {
+	var tx Transaction
+	if _, err := c.do(ctx, http.MethodPatch, "/transactions/"+strconv.Itoa(id), "", req, &tx); err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
+
+// ListTransactions returns a page of the transactions matching opts, newest
+// first unless sorted otherwise
+func (c *Client) ListTransactions(ctx context.Context, opts ListTransactionsOptions) (*TransactionPage, error) {
+	q := url.Values{}
+	if opts.Reference != "" {
+		q.Set("reference", opts.Reference)
+	}
+	if opts.SourceAccountID != 0 {
+		q.Set("source_account_id", strconv.Itoa(opts.SourceAccountID))
+	}
+	if opts.DestinationAccountID != 0 {
+		q.Set("destination_account_id", strconv.Itoa(opts.DestinationAccountID))
+	}
+	if len(opts.Statuses) > 0 {
+		q.Set("status", strings.Join(opts.Statuses, ","))
+	}
+	if !opts.From.IsZero() {
+		q.Set("from", opts.From.Format(time.RFC3339))
+	}
+	if !opts.To.IsZero() {
+		q.Set("to", opts.To.Format(time.RFC3339))
+	}
+	if opts.MinAmount != nil {
+		q.Set("min_amount", strconv.FormatFloat(*opts.MinAmount, 'f', -1, 64))
+	}
+	if opts.MaxAmount != nil {
+		q.Set("max_amount", strconv.FormatFloat(*opts.MaxAmount, 'f', -1, 64))
+	}
+	if opts.Category != "" {
+		q.Set("category", opts.Category)
+	}
+	if len(opts.Tags) > 0 {
+		q.Set("tag", strings.Join(opts.Tags, ","))
+	}
+	if opts.Sort != "" {
+		q.Set("sort", opts.Sort)
+	}
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Cursor != "" {
+		q.Set("cursor", opts.Cursor)
+	}
+	if opts.IncludeArchived {
+		q.Set("include_archived", "true")
+	}
+	page := &TransactionPage{Transactions: []Transaction{}}
+	resp, err := c.do(ctx, http.MethodGet, "/transactions?"+q.Encode(), "", nil, &page.Transactions)
+	if err != nil {
+		return nil, err
+	}
+	if p := resp.env.Pagination; p != nil {
+		page.NextCursor, page.PrevCursor = p.NextCursor, p.PrevCursor
+	}
+	return page, nil
+}
+
+// Reconcile runs a reconciliation and returns its report. It needs an admin
+// key.
+func (c *Client) Reconcile(ctx context.Context) (*ReconciliationRun, error) {
+	var run ReconciliationRun
+	if _, err := c.do(ctx, http.MethodPost, "/admin/reconciliation", "", nil, &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// ReconciliationReport returns the report of a reconciliation run, or of the
+// latest one when runID is 0. It needs an admin key.
+func (c *Client) ReconciliationReport(ctx context.Context, runID int) (*ReconciliationRun, error) {
+	path := "/admin/reconciliation"
+	if runID != 0 {
+		path += "?run_id=" + strconv.Itoa(runID)
+	}
+	var run ReconciliationRun
+	if _, err := c.do(ctx, http.MethodGet, path, "", nil, &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// Quota returns the limits of the client's API key and their usage in the
+// current periods
+func (c *Client) Quota(ctx context.Context) ([]QuotaUsage, error) {
+	var usage []QuotaUsage
+	if _, err := c.do(ctx, http.MethodGet, "/quota", "", nil, &usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// Codes returns the catalog of the codes the API answers with
+func (c *Client) Codes(ctx context.Context) ([]CodeInfo, error) {
+	var codes []CodeInfo
+	if _, err := c.do(ctx, http.MethodGet, "/errors", "", nil, &codes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// envelope is the response envelope of every API call
+type envelope struct {
+	Status     string          `json:"status"`
+	Code       int             `json:"code"`
+	Message    string          `json:"message"`
+	Data       json.RawMessage `json:"data"`
+	Errors     []FieldError    `json:"errors"`
+	Pagination *struct {
+		NextCursor string `json:"next_cursor"`
+		PrevCursor string `json:"prev_cursor"`
+	} `json:"pagination"`
+}
+
+type response struct {
+	env      envelope
+	replayed bool
+}
+
+// do sends body as JSON to path under /v1, retrying while the failure allows
+// it, and decodes the data of the successful response into out
+func (c *Client) do(ctx context.Context, method, path, idempotencyKey string, body, out interface{}) (*response, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	// reads and requests under an idempotency key can be repeated safely
+	safe := idempotencyKey != "" || method == http.MethodGet
+	wait := c.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, path, idempotencyKey, payload)
+		if err == nil {
+			if out != nil && len(resp.env.Data) > 0 {
+				if err := json.Unmarshal(resp.env.Data, out); err != nil {
+					return nil, fmt.Errorf("decode response: %w", err)
+				}
+			}
+			return resp, nil
+		}
+		if attempt >= c.maxRetries || ctx.Err() != nil {
+			return nil, err
+		}
+		var apiErr *Error
+		if errors.As(err, &apiErr) {
+			if !apiErr.retryable(safe) {
+				return nil, err
+			}
+			if apiErr.RetryAfter > 0 {
+				wait = apiErr.RetryAfter
+			}
+		} else if !safe {
+			// the request may have been applied before the connection broke
+			return nil, err
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		wait *= 2
+	}
+}
+
+// send makes a single attempt of a request
+func (c *Client) send(ctx context.Context, method, path, idempotencyKey string, payload []byte) (*response, error) {
+	var reader io.Reader
+	if payload != nil {
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+"/v1"+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	if c.tenant != "" {
+		req.Header.Set("X-Tenant-ID", c.tenant)
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	// the server gives up when the caller does rather than finishing work
+	// whose answer would be discarded
+	if deadline, ok := ctx.Deadline(); ok {
+		ms := max(time.Until(deadline).Milliseconds(), 1)
+		req.Header.Set("X-Request-Timeout", strconv.FormatInt(ms, 10)+"ms")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	c.recordRateLimit(resp.Header)
+	var env envelope
+	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+		return nil, &Error{StatusCode: resp.StatusCode, Message: "unexpected response: " + http.StatusText(resp.StatusCode)}
+	}
+	if resp.StatusCode >= 400 || env.Status != "success" {
+		apiErr := &Error{StatusCode: resp.StatusCode, Code: env.Code, Message: env.Message, Fields: env.Errors}
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			apiErr.RetryAfter = time.Duration(secs) * time.Second
+		}
+		return nil, apiErr
+	}
+	return &response{env: env, replayed: resp.Header.Get("Idempotent-Replayed") == "true"}, nil
+}
+
+// newIdempotencyKey returns a random key for one logical request
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
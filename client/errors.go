@@ -0,0 +1,77 @@
+package client
+
+import (
+	"fmt"
+	"time"
+)
+
+// Error is an error response of the API. Errors compare equal under
+// errors.Is when their codes match, so callers can test for the sentinels
+// below.
+type Error struct {
+	StatusCode int
+	Code       int
+	Message    string
+	Fields     []FieldError
+	// RetryAfter is the wait the server asked for, if any
+	RetryAfter time.Duration
+}
+
+// FieldError describes a field that failed validation
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s (code %d, HTTP %d)", e.Message, e.Code, e.StatusCode)
+	for _, f := range e.Fields {
+		msg += fmt.Sprintf("; %s: %s", f.Field, f.Message)
+	}
+	return msg
+}
+
+// Is matches errors with the same API code
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Errors callers commonly handle. Compare with errors.Is; the responses carry
+// the details.
+var (
+	ErrAccountExists         = &Error{Code: 1003, Message: "Account already exists"}
+	ErrAccountNotFound       = &Error{Code: 1010, Message: "Account not found"}
+	ErrSourceNotFound        = &Error{Code: 1014, Message: "Source account not found"}
+	ErrInsufficientFunds     = &Error{Code: 1015, Message: "Insufficient funds"}
+	ErrConcurrentDebit       = &Error{Code: 1016, Message: "Concurrency error on debit"}
+	ErrDestinationNotFound   = &Error{Code: 1017, Message: "Destination account not found"}
+	ErrConcurrentCredit      = &Error{Code: 1018, Message: "Concurrency error on credit"}
+	ErrUnknownTenant         = &Error{Code: 1028, Message: "Unknown tenant"}
+	ErrTransactionNotFound   = &Error{Code: 1044, Message: "Transaction not found"}
+	ErrValidation            = &Error{Code: 1048, Message: "Validation failed"}
+	ErrUnauthorized          = &Error{Code: 1052, Message: "Missing or invalid API key"}
+	ErrForbidden             = &Error{Code: 1053, Message: "Insufficient permissions"}
+	ErrRiskRejected          = &Error{Code: 1063, Message: "Transfer rejected by risk check"}
+	ErrDatabaseUnavailable   = &Error{Code: 1079, Message: "Database unavailable, retry later"}
+	ErrReadOnly              = &Error{Code: 1080, Message: "Database unavailable for writes, retry later"}
+	ErrAccountClosed         = &Error{Code: 1086, Message: "Account is closed"}
+	ErrMaintenance           = &Error{Code: 1092, Message: "Service is in maintenance"}
+	ErrIdempotencyKeyReused  = &Error{Code: 1101, Message: "Idempotency-Key was used for a different request"}
+	ErrIdempotencyInProgress = &Error{Code: 1102, Message: "A request with this Idempotency-Key is in progress"}
+	ErrQuotaExceeded         = &Error{Code: 1105, Message: "Quota exceeded"}
+)
+
+// retryable reports whether the request may be sent again. Requests turned
+// away before they ran are always retried; others only when safe, i.e. reads
+// and requests under an idempotency key, which lets the server answer a retry
+// of a completed request with its original response.
+func (e *Error) retryable(safe bool) bool {
+	switch e.Code {
+	case 1079, 1092:
+		return true
+	case 1016, 1018, 1080, 1102:
+		return safe
+	}
+	return safe && e.StatusCode >= 500
+}
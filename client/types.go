@@ -0,0 +1,223 @@
+package client
+
+import "time"
+
+// Account is an account and its balance
+type Account struct {
+	ID          int        `json:"account_id"`
+	Balance     float64    `json:"balance"`
+	IBAN        *string    `json:"iban,omitempty"`
+	Alias       *string    `json:"alias,omitempty"`
+	ExternalRef *string    `json:"external_ref,omitempty"`
+	CustomerID  *int       `json:"customer_id,omitempty"`
+	ClosedAt    *time.Time `json:"closed_at,omitempty"`
+}
+
+// CreateAccountRequest is the body of CreateAccount
+type CreateAccountRequest struct {
+	AccountID      int     `json:"account_id"`
+	InitialBalance float64 `json:"initial_balance"`
+	CustomerID     *int    `json:"customer_id,omitempty"`
+	// IBAN is generated by the server when empty
+	IBAN string `json:"iban,omitempty"`
+	// Alias is a unique handle the account can be addressed by
+	Alias string `json:"alias,omitempty"`
+	// ExternalRef is the identifier of the account in another system
+	ExternalRef string `json:"external_ref,omitempty"`
+}
+
+// TransferRequest is the body of Transfer
+type TransferRequest struct {
+	FromAccountID int     `json:"source_account_id,omitempty"`
+	ToAccountID   int     `json:"destination_account_id,omitempty"`
+	Amount        float64 `json:"amount"`
+	// FromIBAN and ToIBAN address the accounts by IBAN instead of ID
+	FromIBAN string `json:"source_iban,omitempty"`
+	ToIBAN   string `json:"destination_iban,omitempty"`
+	// FromAlias and ToAlias address the accounts by alias instead of ID
+	FromAlias string `json:"source_alias,omitempty"`
+	ToAlias   string `json:"destination_alias,omitempty"`
+	// ToTenantID addresses a destination account of another tenant
+	ToTenantID string `json:"destination_tenant_id,omitempty"`
+	// External sends the funds to an account at another institution
+	External  *ExternalDestination `json:"external_destination,omitempty"`
+	Reference string               `json:"reference,omitempty"`
+	Memo      string               `json:"memo,omitempty"`
+	// Category and Tags label the transaction for budgeting
+	Category string   `json:"category,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	// AllowDuplicate makes the transfer even when the server saw an
+	// identical one within its duplicate window
+	AllowDuplicate bool `json:"allow_duplicate,omitempty"`
+
+	// IdempotencyKey makes retries of the transfer safe; a random key is used
+	// when empty, so set it to retry a transfer across calls
+	IdempotencyKey string `json:"-"`
+}
+
+// ExternalDestination is the beneficiary of an external transfer
+type ExternalDestination struct {
+	Rail          string `json:"rail"`
+	RoutingNumber string `json:"routing_number,omitempty"`
+	AccountNumber string `json:"account_number,omitempty"`
+	AccountType   string `json:"account_type,omitempty"`
+	BIC           string `json:"bic,omitempty"`
+	IBAN          string `json:"iban,omitempty"`
+	Name          string `json:"name"`
+}
+
+// TransferResult is the outcome of a transfer. Status is pending when the
+// transfer waits for approval or an OTP confirmation.
+type TransferResult struct {
+	TransactionID  int                  `json:"transaction_id"`
+	FromAccountID  int                  `json:"source_account_id"`
+	ToAccountID    int                  `json:"destination_account_id"`
+	ToTenantID     string               `json:"destination_tenant_id"`
+	Amount         float64              `json:"amount"`
+	Fee            float64              `json:"fee"`
+	Status         string               `json:"status"`
+	ChallengeID    string               `json:"challenge_id,omitempty"`
+	External       *ExternalDestination `json:"external_destination,omitempty"`
+	ExternalStatus string               `json:"external_status,omitempty"`
+
+	// Replayed is set when the server answered with the stored result of an
+	// earlier request with the same idempotency key
+	Replayed bool `json:"-"`
+}
+
+// BatchResult is the outcome of BatchTransfer, one result per transfer in
+// request order
+type BatchResult struct {
+	Succeeded int         `json:"succeeded"`
+	Failed    int         `json:"failed"`
+	Results   []BatchItem `json:"results"`
+	Replayed  bool        `json:"-"`
+}
+
+// BatchItem is the outcome of one transfer of a batch. Status is succeeded
+// or failed; Code and Message are those Transfer would have got.
+type BatchItem struct {
+	Index       int             `json:"index"`
+	Status      string          `json:"status"`
+	Code        int             `json:"code"`
+	Message     string          `json:"message"`
+	Transaction *TransferResult `json:"transaction,omitempty"`
+	Errors      []FieldError    `json:"errors,omitempty"`
+}
+
+// TransferQuote is the preview of a transfer
+type TransferQuote struct {
+	FromAccountID     int     `json:"source_account_id"`
+	ToAccountID       int     `json:"destination_account_id"`
+	ToTenantID        string  `json:"destination_tenant_id"`
+	Amount            float64 `json:"amount"`
+	Fee               float64 `json:"fee"`
+	TotalDebit        float64 `json:"total_debit"`
+	FXRate            float64 `json:"fx_rate"`
+	DestinationAmount float64 `json:"destination_amount"`
+	SourceBalance     float64 `json:"source_balance_after"`
+	// DestinationBalance is nil for external transfers
+	DestinationBalance *float64             `json:"destination_balance_after,omitempty"`
+	External           *ExternalDestination `json:"external_destination,omitempty"`
+	Warnings           []QuoteWarning       `json:"warnings"`
+}
+
+// QuoteWarning is a reason a quoted transfer would not complete right away.
+// Code is the code the transfer would be answered with, such as 1015 for
+// insufficient funds or 2011 when it would await approval.
+type QuoteWarning struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Transaction is a recorded transaction
+type Transaction struct {
+	ID            int        `json:"transaction_id"`
+	FromAccountID *int       `json:"source_account_id"`
+	ToAccountID   *int       `json:"destination_account_id"`
+	Amount        float64    `json:"amount"`
+	Status        string     `json:"status"`
+	CreatedAt     time.Time  `json:"created_at"`
+	CompletedAt   *time.Time `json:"completed_at,omitempty"`
+	FailureReason *string    `json:"failure_reason,omitempty"`
+	Reference     *string    `json:"reference,omitempty"`
+	Memo          *string    `json:"memo,omitempty"`
+	Category      *string    `json:"category,omitempty"`
+	Tags          []string   `json:"tags,omitempty"`
+}
+
+// UpdateTransactionRequest is the body of UpdateTransaction. Nil fields are
+// left as they are; an empty Category clears it, and Tags replaces the tags.
+type UpdateTransactionRequest struct {
+	Category *string   `json:"category,omitempty"`
+	Tags     *[]string `json:"tags,omitempty"`
+}
+
+// ListTransactionsOptions selects a page of ListTransactions
+type ListTransactionsOptions struct {
+	Reference            string
+	SourceAccountID      int
+	DestinationAccountID int
+	// Statuses keeps transactions in any of the statuses
+	Statuses []string
+	// From and To bound the creation time, To exclusive
+	From, To             time.Time
+	MinAmount, MaxAmount *float64
+	// Category keeps transactions of the category, and Tags those carrying
+	// all of the tags
+	Category string
+	Tags     []string
+	// Sort is created_at, -created_at (the default), amount or -amount
+	Sort   string
+	Limit  int
+	Cursor string
+	// IncludeArchived also searches transactions moved to the archive
+	IncludeArchived bool
+}
+
+// TransactionPage is a page of transactions with the cursors of its
+// neighbours; an empty NextCursor marks the last page
+type TransactionPage struct {
+	Transactions []Transaction `json:"transactions"`
+	NextCursor   string        `json:"next_cursor,omitempty"`
+	PrevCursor   string        `json:"prev_cursor,omitempty"`
+}
+
+// ReconciliationRun is the report of one reconciliation
+type ReconciliationRun struct {
+	ID              int           `json:"run_id"`
+	StartedAt       time.Time     `json:"started_at"`
+	FinishedAt      time.Time     `json:"finished_at"`
+	AccountsChecked int           `json:"accounts_checked"`
+	Discrepancies   []Discrepancy `json:"discrepancies"`
+}
+
+// Discrepancy is an account whose stored balance disagrees with its ledger
+type Discrepancy struct {
+	AccountID       int     `json:"account_id"`
+	TenantID        string  `json:"tenant_id"`
+	StoredBalance   float64 `json:"stored_balance"`
+	ComputedBalance float64 `json:"computed_balance"`
+	Difference      float64 `json:"difference"`
+}
+
+// CodeInfo describes one code of the response envelope
+type CodeInfo struct {
+	Code int `json:"code"`
+	// Type is success or error
+	Type        string `json:"type"`
+	HTTPStatus  int    `json:"http_status"`
+	Description string `json:"description"`
+}
+
+// QuotaUsage is a limit of the API key and how much of it the current period
+// has used
+type QuotaUsage struct {
+	// Metric is requests or transfers, Period day or month
+	Metric    string    `json:"metric"`
+	Period    string    `json:"period"`
+	Limit     int       `json:"limit"`
+	Used      int       `json:"used"`
+	Remaining int       `json:"remaining"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
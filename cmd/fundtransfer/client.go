@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"internal-transfers/client"
+)
+
+// requestTimeout bounds every API call of the CLI
+const requestTimeout = 60 * time.Second
+
+// newClient returns an API client for the active profile
+func newClient() (*client.Client, error) {
+	p, err := activeProfile()
+	if err != nil {
+		return nil, err
+	}
+	return client.New(p.Server,
+		client.WithAPIKey(p.APIKey),
+		client.WithTenant(p.Tenant),
+		client.WithHTTPClient(&http.Client{Timeout: requestTimeout}),
+	), nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"internal-transfers/client"
+)
+
+func parseID(arg, what string) (int, error) {
+	id, err := strconv.Atoi(arg)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", what, arg)
+	}
+	return id, nil
+}
+
+func parseAmount(arg string) (float64, error) {
+	v, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", arg)
+	}
+	return v, nil
+}
+
+func renderAccount(acc *client.Account) error {
+	t := newTable("ACCOUNT", "BALANCE", "IBAN", "CUSTOMER", "CLOSED")
+	t.row(strconv.Itoa(acc.ID), money(acc.Balance), optionalString(acc.IBAN), optionalInt(acc.CustomerID), optionalTime(acc.ClosedAt))
+	return render(t, acc)
+}
+
+func renderTransactions(txs []client.Transaction, v interface{}) error {
+	t := newTable("TRANSACTION", "FROM", "TO", "AMOUNT", "STATUS", "CREATED", "REFERENCE")
+	for _, tx := range txs {
+		t.row(strconv.Itoa(tx.ID), optionalInt(tx.FromAccountID), optionalInt(tx.ToAccountID), money(tx.Amount), tx.Status,
+			tx.CreatedAt.Format(time.RFC3339), optionalString(tx.Reference))
+	}
+	return render(t, v)
+}
+
+func accountsCommand() *cobra.Command {
+	cmd := &cobra.Command{Use: "accounts", Short: "Create and inspect accounts"}
+
+	var customerID int
+	var iban string
+	create := &cobra.Command{
+		Use:   "create ACCOUNT_ID INITIAL_BALANCE",
+		Short: "Create an account",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := parseID(args[0], "account ID")
+			if err != nil {
+				return err
+			}
+			balance, err := parseAmount(args[1])
+			if err != nil {
+				return err
+			}
+			req := client.CreateAccountRequest{AccountID: id, InitialBalance: balance, IBAN: iban}
+			if customerID != 0 {
+				req.CustomerID = &customerID
+			}
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			acc, err := c.CreateAccount(context.Background(), req)
+			if err != nil {
+				return err
+			}
+			return renderAccount(acc)
+		},
+	}
+	create.Flags().IntVar(&customerID, "customer", 0, "owning customer ID")
+	create.Flags().StringVar(&iban, "iban", "", "IBAN; generated when omitted")
+
+	get := &cobra.Command{
+		Use:     "get ACCOUNT_ID",
+		Aliases: []string{"balance"},
+		Short:   "Show an account and its balance",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := parseID(args[0], "account ID")
+			if err != nil {
+				return err
+			}
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			acc, err := c.GetAccount(context.Background(), id)
+			if err != nil {
+				return err
+			}
+			return renderAccount(acc)
+		},
+	}
+
+	cmd.AddCommand(create, get)
+	return cmd
+}
+
+func transferCommand() *cobra.Command {
+	var reference, memo, key string
+	cmd := &cobra.Command{
+		Use:   "transfer FROM_ACCOUNT TO_ACCOUNT AMOUNT",
+		Short: "Transfer funds between two accounts",
+		Args:  cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			from, err := parseID(args[0], "source account ID")
+			if err != nil {
+				return err
+			}
+			to, err := parseID(args[1], "destination account ID")
+			if err != nil {
+				return err
+			}
+			amount, err := parseAmount(args[2])
+			if err != nil {
+				return err
+			}
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			res, err := c.Transfer(context.Background(), client.TransferRequest{
+				FromAccountID:  from,
+				ToAccountID:    to,
+				Amount:         amount,
+				Reference:      reference,
+				Memo:           memo,
+				IdempotencyKey: key,
+			})
+			if err != nil {
+				return err
+			}
+			if outputFlag == outputTable && res.Replayed {
+				fmt.Fprintln(os.Stderr, "already submitted under this idempotency key")
+			}
+			t := newTable("TRANSACTION", "FROM", "TO", "AMOUNT", "FEE", "STATUS")
+			t.row(strconv.Itoa(res.TransactionID), strconv.Itoa(res.FromAccountID), strconv.Itoa(res.ToAccountID), money(res.Amount), money(res.Fee), res.Status)
+			return render(t, res)
+		},
+	}
+	cmd.Flags().StringVar(&reference, "reference", "", "payment reference, e.g. an invoice number")
+	cmd.Flags().StringVar(&memo, "memo", "", "memo stored with the transaction")
+	cmd.Flags().StringVar(&key, "idempotency-key", "", "key making a repeated submission return the first result; random when omitted")
+	return cmd
+}
+
+func transactionsCommand() *cobra.Command {
+	cmd := &cobra.Command{Use: "transactions", Short: "Inspect transactions"}
+
+	var archived bool
+	get := &cobra.Command{
+		Use:   "get TRANSACTION_ID",
+		Short: "Show a transaction",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := parseID(args[0], "transaction ID")
+			if err != nil {
+				return err
+			}
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			tx, err := c.GetTransaction(context.Background(), id, archived)
+			if err != nil {
+				return err
+			}
+			return renderTransactions([]client.Transaction{*tx}, tx)
+		},
+	}
+	get.Flags().BoolVar(&archived, "archived", false, "include archived transactions")
+
+	var reference, cursor, from, to, sort string
+	var statuses []string
+	var source, destination, limit int
+	var minAmount, maxAmount float64
+	var listArchived bool
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "Search transactions, newest first unless sorted otherwise",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts := client.ListTransactionsOptions{
+				Reference:            reference,
+				SourceAccountID:      source,
+				DestinationAccountID: destination,
+				Statuses:             statuses,
+				Sort:                 sort,
+				Limit:                limit,
+				Cursor:               cursor,
+				IncludeArchived:      listArchived,
+			}
+			for _, bound := range []struct {
+				flag  string
+				value string
+				into  *time.Time
+			}{{"from", from, &opts.From}, {"to", to, &opts.To}} {
+				if bound.value == "" {
+					continue
+				}
+				t, err := time.Parse(time.RFC3339, bound.value)
+				if err != nil {
+					return fmt.Errorf("invalid --%s %q, expected an RFC 3339 timestamp", bound.flag, bound.value)
+				}
+				*bound.into = t
+			}
+			if cmd.Flags().Changed("min-amount") {
+				opts.MinAmount = &minAmount
+			}
+			if cmd.Flags().Changed("max-amount") {
+				opts.MaxAmount = &maxAmount
+			}
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			page, err := c.ListTransactions(context.Background(), opts)
+			if err != nil {
+				return err
+			}
+			if outputFlag == outputTable && page.NextCursor != "" {
+				defer fmt.Fprintln(os.Stderr, "more: --cursor", page.NextCursor)
+			}
+			return renderTransactions(page.Transactions, page)
+		},
+	}
+	list.Flags().StringVar(&reference, "reference", "", "payment reference to look up")
+	list.Flags().IntVar(&source, "source", 0, "source account ID")
+	list.Flags().IntVar(&destination, "destination", 0, "destination account ID")
+	list.Flags().StringSliceVar(&statuses, "status", nil, "statuses to keep, comma separated")
+	list.Flags().StringVar(&from, "from", "", "created at or after this RFC 3339 time")
+	list.Flags().StringVar(&to, "to", "", "created before this RFC 3339 time")
+	list.Flags().Float64Var(&minAmount, "min-amount", 0, "smallest amount")
+	list.Flags().Float64Var(&maxAmount, "max-amount", 0, "largest amount")
+	list.Flags().StringVar(&sort, "sort", "", "created_at, -created_at, amount or -amount")
+	list.Flags().IntVar(&limit, "limit", 0, "page size")
+	list.Flags().StringVar(&cursor, "cursor", "", "cursor of the page to fetch")
+	list.Flags().BoolVar(&listArchived, "archived", false, "include archived transactions")
+
+	cmd.AddCommand(get, list)
+	return cmd
+}
+
+func reconcileCommand() *cobra.Command {
+	var reportOnly bool
+	var runID int
+	cmd := &cobra.Command{
+		Use:   "reconcile",
+		Short: "Run a reconciliation and show its discrepancies (admin)",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			var run *client.ReconciliationRun
+			if reportOnly || runID != 0 {
+				run, err = c.ReconciliationReport(context.Background(), runID)
+			} else {
+				run, err = c.Reconcile(context.Background())
+			}
+			if err != nil {
+				return err
+			}
+			if outputFlag == outputTable {
+				fmt.Fprintf(os.Stderr, "run %d at %s: %d accounts checked, %d discrepancies\n",
+					run.ID, run.FinishedAt.Format(time.RFC3339), run.AccountsChecked, len(run.Discrepancies))
+			}
+			t := newTable("ACCOUNT", "TENANT", "STORED", "LEDGER", "DIFFERENCE")
+			for _, d := range run.Discrepancies {
+				t.row(strconv.Itoa(d.AccountID), d.TenantID, money(d.StoredBalance), money(d.ComputedBalance), money(d.Difference))
+			}
+			return render(t, run)
+		},
+	}
+	cmd.Flags().BoolVar(&reportOnly, "report", false, "show the latest report instead of running a reconciliation")
+	cmd.Flags().IntVar(&runID, "run-id", 0, "show the report of this run")
+	return cmd
+}
@@ -0,0 +1,47 @@
+// Command fundtransfer administers the fund transfer service through its
+// HTTP API: accounts, balances, transfers, transactions and reconciliation.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// Global flags; empty values fall back to the selected profile
+var (
+	profileName string
+	serverFlag  string
+	apiKeyFlag  string
+	tenantFlag  string
+	outputFlag  string
+)
+
+func main() {
+	root := &cobra.Command{
+		Use:           "fundtransfer",
+		Short:         "Administer the fund transfer service",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if outputFlag != outputTable && outputFlag != outputJSON {
+				return fmt.Errorf("unknown output format %q, expected table or json", outputFlag)
+			}
+			return nil
+		},
+	}
+	flags := root.PersistentFlags()
+	flags.StringVarP(&profileName, "profile", "p", os.Getenv("FUNDTRANSFER_PROFILE"), "profile to use instead of the current one")
+	flags.StringVar(&serverFlag, "server", "", "base URL of the service, e.g. http://localhost:8081")
+	flags.StringVar(&apiKeyFlag, "api-key", "", "API key to authenticate with")
+	flags.StringVar(&tenantFlag, "tenant", "", "tenant to act on")
+	flags.StringVarP(&outputFlag, "output", "o", outputTable, "output format: table or json")
+
+	root.AddCommand(accountsCommand(), transferCommand(), transactionsCommand(), reconcileCommand(), profileCommand())
+
+	if err := root.Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+// defaultServer is used when neither a flag nor the profile names one
+const defaultServer = "http://localhost:8081"
+
+// Profile is a named server configuration
+type Profile struct {
+	Server string `json:"server"`
+	APIKey string `json:"api_key,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// profileFile is the CLI configuration file holding the profiles
+type profileFile struct {
+	Current  string             `json:"current"`
+	Profiles map[string]Profile `json:"profiles"`
+}
+
+// profilePath returns FUNDTRANSFER_CONFIG or the config.json in the user's
+// configuration directory
+func profilePath() (string, error) {
+	if path := os.Getenv("FUNDTRANSFER_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "fundtransfer", "config.json"), nil
+}
+
+// loadProfiles reads the configuration file; a missing file has no profiles
+func loadProfiles() (*profileFile, error) {
+	f := &profileFile{Profiles: map[string]Profile{}}
+	path, err := profilePath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if f.Profiles == nil {
+		f.Profiles = map[string]Profile{}
+	}
+	return f, nil
+}
+
+// save writes the file readable by the user only, as it holds API keys
+func (f *profileFile) save() error {
+	path, err := profilePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o600)
+}
+
+// activeProfile returns the selected profile with the global flags applied
+func activeProfile() (Profile, error) {
+	f, err := loadProfiles()
+	if err != nil {
+		return Profile{}, err
+	}
+	name := profileName
+	if name == "" {
+		name = f.Current
+	}
+	p, ok := f.Profiles[name]
+	if !ok && profileName != "" {
+		return Profile{}, fmt.Errorf("unknown profile %q", profileName)
+	}
+	if serverFlag != "" {
+		p.Server = serverFlag
+	}
+	if apiKeyFlag != "" {
+		p.APIKey = apiKeyFlag
+	}
+	if tenantFlag != "" {
+		p.Tenant = tenantFlag
+	}
+	if p.Server == "" {
+		p.Server = defaultServer
+	}
+	return p, nil
+}
+
+func profileCommand() *cobra.Command {
+	cmd := &cobra.Command{Use: "profile", Short: "Manage server profiles"}
+
+	var p Profile
+	set := &cobra.Command{
+		Use:   "set NAME",
+		Short: "Create or update a profile and make it current",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f, err := loadProfiles()
+			if err != nil {
+				return err
+			}
+			existing := f.Profiles[args[0]]
+			if cmd.Flags().Changed("server") {
+				existing.Server = p.Server
+			}
+			if cmd.Flags().Changed("key") {
+				existing.APIKey = p.APIKey
+			}
+			if cmd.Flags().Changed("tenant-id") {
+				existing.Tenant = p.Tenant
+			}
+			f.Profiles[args[0]] = existing
+			f.Current = args[0]
+			return f.save()
+		},
+	}
+	set.Flags().StringVar(&p.Server, "server", "", "base URL of the service")
+	set.Flags().StringVar(&p.APIKey, "key", "", "API key")
+	set.Flags().StringVar(&p.Tenant, "tenant-id", "", "tenant")
+
+	use := &cobra.Command{
+		Use:   "use NAME",
+		Short: "Make a profile current",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f, err := loadProfiles()
+			if err != nil {
+				return err
+			}
+			if _, ok := f.Profiles[args[0]]; !ok {
+				return fmt.Errorf("unknown profile %q", args[0])
+			}
+			f.Current = args[0]
+			return f.save()
+		},
+	}
+
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List the profiles",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f, err := loadProfiles()
+			if err != nil {
+				return err
+			}
+			names := make([]string, 0, len(f.Profiles))
+			for name := range f.Profiles {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			t := newTable("CURRENT", "NAME", "SERVER", "TENANT")
+			for _, name := range names {
+				current := ""
+				if name == f.Current {
+					current = "*"
+				}
+				t.row(current, name, f.Profiles[name].Server, f.Profiles[name].Tenant)
+			}
+			// API keys are never printed
+			return render(t, names)
+		},
+	}
+
+	cmd.AddCommand(set, use, list)
+	return cmd
+}
@@ -0,0 +1,276 @@
+package main
+
+import "net/http"
+
+// Code types of the response envelope
+const (
+	CodeSuccess = "success"
+	CodeError   = "error"
+)
+
+// CodeInfo describes one code of the response envelope
+type CodeInfo struct {
+	Code        int    `json:"code"`
+	Type        string `json:"type"`
+	HTTPStatus  int    `json:"http_status"`
+	Description string `json:"description"`
+}
+
+// codeCatalog registers every code the API answers with and the HTTP status
+// it is sent with. Add the code of a new response here; TestCodeCatalog fails
+// for codes used in the handlers but missing from it.
+var codeCatalog = []CodeInfo{
+	{2001, CodeSuccess, http.StatusCreated, "Account created"},
+	{2002, CodeSuccess, http.StatusOK, "Account retrieved"},
+	{2003, CodeSuccess, http.StatusOK, "Transfer successful"},
+	{2004, CodeSuccess, http.StatusCreated, "Customer created"},
+	{2005, CodeSuccess, http.StatusOK, "Customer retrieved"},
+	{2006, CodeSuccess, http.StatusOK, "Customer accounts retrieved"},
+	{2007, CodeSuccess, http.StatusAccepted, "Transfer pending at external institution"},
+	{2008, CodeSuccess, http.StatusOK, "Transaction retrieved"},
+	{2009, CodeSuccess, http.StatusOK, "Transactions retrieved"},
+	{2010, CodeSuccess, http.StatusOK, "Account already exists (idempotent provisioning)"},
+	{2011, CodeSuccess, http.StatusAccepted, "Transfer awaiting approval"},
+	{2012, CodeSuccess, http.StatusOK, "Transfer approved"},
+	{2013, CodeSuccess, http.StatusOK, "Transfer rejected"},
+	{2014, CodeSuccess, http.StatusOK, "Pending approvals retrieved"},
+	{2015, CodeSuccess, http.StatusAccepted, "Transfer awaiting OTP confirmation"},
+	{2016, CodeSuccess, http.StatusOK, "Transfer confirmed"},
+	{2017, CodeSuccess, http.StatusOK, "Notification preferences retrieved"},
+	{2018, CodeSuccess, http.StatusOK, "Notification preferences updated"},
+	{2019, CodeSuccess, http.StatusOK, "Statement retrieved"},
+	{2020, CodeSuccess, http.StatusOK, "Balance retrieved"},
+	{2021, CodeSuccess, http.StatusOK, "Snapshots retrieved"},
+	{2022, CodeSuccess, http.StatusOK, "Reconciliation report retrieved"},
+	{2023, CodeSuccess, http.StatusCreated, "Adjustment posted"},
+	{2024, CodeSuccess, http.StatusOK, "Audit log retrieved"},
+	{2025, CodeSuccess, http.StatusOK, "Audit log verified"},
+	{2026, CodeSuccess, http.StatusOK, "Access log retrieved"},
+	{2027, CodeSuccess, http.StatusOK, "Account replayed"},
+	{2028, CodeSuccess, http.StatusOK, "Report retrieved"},
+	{2029, CodeSuccess, http.StatusOK, "Most active accounts retrieved"},
+	{2030, CodeSuccess, http.StatusOK, "Dead letters retrieved"},
+	{2031, CodeSuccess, http.StatusOK, "Dead letter requeued"},
+	{2032, CodeSuccess, http.StatusOK, "Dead letter cancelled"},
+	{2033, CodeSuccess, http.StatusCreated, "Dump written"},
+	{2034, CodeSuccess, http.StatusOK, "Accounts imported"},
+	{2035, CodeSuccess, http.StatusOK, "Account updated"},
+	{2036, CodeSuccess, http.StatusOK, "Account closed"},
+	{2037, CodeSuccess, http.StatusOK, "Sandbox reset"},
+	{2038, CodeSuccess, http.StatusOK, "Fault retrieved"},
+	{2039, CodeSuccess, http.StatusOK, "Fault injected"},
+	{2040, CodeSuccess, http.StatusOK, "Fault cleared"},
+	{2041, CodeSuccess, http.StatusOK, "Feature flags retrieved"},
+	{2042, CodeSuccess, http.StatusOK, "Feature flag updated"},
+	{2043, CodeSuccess, http.StatusOK, "Feature flag override removed"},
+	{2044, CodeSuccess, http.StatusOK, "Maintenance state retrieved"},
+	{2045, CodeSuccess, http.StatusOK, "Maintenance mode started"},
+	{2046, CodeSuccess, http.StatusOK, "Maintenance mode ended"},
+	{2047, CodeSuccess, http.StatusOK, "Customer data exported"},
+	{2048, CodeSuccess, http.StatusOK, "Customer erased"},
+	{2049, CodeSuccess, http.StatusOK, "Reconciliation run completed"},
+	{2050, CodeSuccess, http.StatusOK, "Accounts found"},
+	{2051, CodeSuccess, http.StatusOK, "Transfers retrieved"},
+	{2052, CodeSuccess, http.StatusOK, "Account transactions retrieved"},
+	{2053, CodeSuccess, http.StatusOK, "Code catalog retrieved"},
+	{2054, CodeSuccess, http.StatusOK, "Quota retrieved"},
+	{2055, CodeSuccess, http.StatusOK, "Transfer quoted"},
+	{2056, CodeSuccess, http.StatusCreated, "Escrow created"},
+	{2057, CodeSuccess, http.StatusOK, "Escrow retrieved"},
+	{2058, CodeSuccess, http.StatusOK, "Escrow released"},
+	{2059, CodeSuccess, http.StatusOK, "Escrow refunded"},
+	{2060, CodeSuccess, http.StatusOK, "Wallets retrieved"},
+	{2061, CodeSuccess, http.StatusCreated, "Wallet created"},
+	{2062, CodeSuccess, http.StatusOK, "Wallet deleted"},
+	{2063, CodeSuccess, http.StatusOK, "Wallet move completed"},
+	{2064, CodeSuccess, http.StatusCreated, "Dispute opened"},
+	{2065, CodeSuccess, http.StatusOK, "Dispute retrieved"},
+	{2066, CodeSuccess, http.StatusOK, "Disputes retrieved"},
+	{2067, CodeSuccess, http.StatusOK, "Dispute reversed"},
+	{2068, CodeSuccess, http.StatusOK, "Dispute released"},
+	{2069, CodeSuccess, http.StatusCreated, "Refund completed"},
+	{2070, CodeSuccess, http.StatusOK, "Refunds retrieved"},
+	{2071, CodeSuccess, http.StatusOK, "Balance history retrieved"},
+	{2072, CodeSuccess, http.StatusOK, "Trial balance retrieved"},
+	{2073, CodeSuccess, http.StatusOK, "Jobs retrieved"},
+	{2074, CodeSuccess, http.StatusOK, "Job updated"},
+	{2075, CodeSuccess, http.StatusOK, "Job runs retrieved"},
+	{2076, CodeSuccess, http.StatusCreated, "Webhook created"},
+	{2077, CodeSuccess, http.StatusOK, "Webhooks retrieved"},
+	{2078, CodeSuccess, http.StatusOK, "Webhook deleted"},
+	{2079, CodeSuccess, http.StatusOK, "Webhook deliveries retrieved"},
+	{2080, CodeSuccess, http.StatusOK, "Webhook delivery retrieved"},
+	{2081, CodeSuccess, http.StatusAccepted, "Webhook redelivery scheduled"},
+	{2082, CodeSuccess, http.StatusOK, "Batch processed"},
+	{2083, CodeSuccess, http.StatusOK, "Sweep rules retrieved"},
+	{2084, CodeSuccess, http.StatusCreated, "Sweep rule created"},
+	{2085, CodeSuccess, http.StatusOK, "Sweep rule deleted"},
+	{2086, CodeSuccess, http.StatusOK, "Sweep executions retrieved"},
+	{2087, CodeSuccess, http.StatusOK, "Accounts retrieved"},
+	{2088, CodeSuccess, http.StatusCreated, "Transfer prepared"},
+	{2089, CodeSuccess, http.StatusOK, "Prepared transfer confirmed"},
+	{2090, CodeSuccess, http.StatusOK, "Prepared transfer aborted"},
+	{2091, CodeSuccess, http.StatusOK, "Term deposits retrieved"},
+	{2092, CodeSuccess, http.StatusCreated, "Term deposit opened"},
+	{2093, CodeSuccess, http.StatusOK, "Term deposit withdrawn"},
+	{2094, CodeSuccess, http.StatusOK, "Transaction updated"},
+
+	{1001, CodeError, http.StatusMethodNotAllowed, "Method not allowed"},
+	{1002, CodeError, http.StatusBadRequest, "Invalid request payload"},
+	{1003, CodeError, http.StatusConflict, "Account already exists"},
+	{1004, CodeError, http.StatusInternalServerError, "Database error"},
+	{1005, CodeError, http.StatusInternalServerError, "General DB error"},
+	{1006, CodeError, http.StatusMethodNotAllowed, "Method not allowed"},
+	{1008, CodeError, http.StatusBadRequest, "Invalid account ID"},
+	{1009, CodeError, http.StatusInternalServerError, "Database error on read"},
+	{1010, CodeError, http.StatusNotFound, "Account not found"},
+	{1012, CodeError, http.StatusBadRequest, "Invalid transfer payload"},
+	{1013, CodeError, http.StatusInternalServerError, "Failed to begin transaction"},
+	{1014, CodeError, http.StatusNotFound, "Source account not found"},
+	{1015, CodeError, http.StatusBadRequest, "Insufficient funds"},
+	{1016, CodeError, http.StatusConflict, "Concurrency error on debit"},
+	{1017, CodeError, http.StatusNotFound, "Destination account not found"},
+	{1018, CodeError, http.StatusConflict, "Concurrency error on credit"},
+	{1019, CodeError, http.StatusInternalServerError, "Failed to log transaction"},
+	{1020, CodeError, http.StatusInternalServerError, "Failed to commit transaction"},
+	{1021, CodeError, http.StatusInternalServerError, "Failed to credit fee account"},
+	{1022, CodeError, http.StatusInternalServerError, "Fee account not found"},
+	{1025, CodeError, http.StatusConflict, "Customer email already exists"},
+	{1026, CodeError, http.StatusBadRequest, "Invalid customer ID"},
+	{1027, CodeError, http.StatusNotFound, "Customer not found"},
+	{1028, CodeError, http.StatusForbidden, "Unknown tenant"},
+	{1029, CodeError, http.StatusForbidden, "Cross-tenant transfer not allowed"},
+	{1030, CodeError, http.StatusBadRequest, "Invalid IBAN"},
+	{1031, CodeError, http.StatusConflict, "IBAN already in use"},
+	{1032, CodeError, http.StatusBadRequest, "Account ID cannot be encoded as an IBAN"},
+	{1034, CodeError, http.StatusBadRequest, "Invalid pain.001 document"},
+	{1035, CodeError, http.StatusBadRequest, "Invalid external destination"},
+	{1036, CodeError, http.StatusBadRequest, "External transfers are not enabled"},
+	{1037, CodeError, http.StatusBadRequest, "Invalid date"},
+	{1038, CodeError, http.StatusInternalServerError, "Failed to credit settlement account"},
+	{1039, CodeError, http.StatusInternalServerError, "Settlement account not found"},
+	{1040, CodeError, http.StatusNotFound, "Not found"},
+	{1041, CodeError, http.StatusBadRequest, "Invalid transaction ID"},
+	{1042, CodeError, http.StatusNotFound, "Wire transfer not found"},
+	{1043, CodeError, http.StatusUnprocessableEntity, "External transfer rejected, funds returned"},
+	{1044, CodeError, http.StatusNotFound, "Transaction not found"},
+	{1046, CodeError, http.StatusBadRequest, "Reference query parameter missing"},
+	{1047, CodeError, http.StatusBadRequest, "Account ID in body does not match path"},
+	{1048, CodeError, http.StatusBadRequest, "Validation failed (see errors)"},
+	{1049, CodeError, http.StatusRequestEntityTooLarge, "Request body too large"},
+	{1050, CodeError, http.StatusInternalServerError, "Internal server error"},
+	{1051, CodeError, http.StatusForbidden, "CORS origin not allowed"},
+	{1052, CodeError, http.StatusUnauthorized, "Missing or invalid API key"},
+	{1053, CodeError, http.StatusForbidden, "Insufficient permissions"},
+	{1054, CodeError, http.StatusNotFound, "Transfer is not awaiting approval"},
+	{1055, CodeError, http.StatusForbidden, "Transfers cannot be approved by their requester"},
+	{1056, CodeError, http.StatusConflict, "Transfer has already been decided"},
+	{1057, CodeError, http.StatusBadGateway, "Failed to deliver OTP"},
+	{1058, CodeError, http.StatusNotFound, "OTP challenge not found"},
+	{1059, CodeError, http.StatusGone, "OTP challenge expired"},
+	{1060, CodeError, http.StatusTooManyRequests, "Too many OTP attempts"},
+	{1061, CodeError, http.StatusForbidden, "Invalid OTP"},
+	{1062, CodeError, http.StatusConflict, "OTP challenge has already been used"},
+	{1063, CodeError, http.StatusForbidden, "Transfer rejected by risk check"},
+	{1064, CodeError, http.StatusServiceUnavailable, "Risk check unavailable"},
+	{1065, CodeError, http.StatusBadRequest, "Invalid statement period"},
+	{1066, CodeError, http.StatusBadRequest, "Statement period has not ended"},
+	{1067, CodeError, http.StatusBadRequest, "Invalid export date range"},
+	{1068, CodeError, http.StatusBadRequest, "Invalid as_of timestamp"},
+	{1069, CodeError, http.StatusBadRequest, "Invalid date range"},
+	{1070, CodeError, http.StatusNotFound, "Reconciliation run not found"},
+	{1071, CodeError, http.StatusBadRequest, "Adjustments are not enabled"},
+	{1072, CodeError, http.StatusInternalServerError, "Adjustment account not found"},
+	{1073, CodeError, http.StatusBadRequest, "Invalid time range"},
+	{1074, CodeError, http.StatusNotFound, "Event sourcing is not enabled"},
+	{1075, CodeError, http.StatusBadRequest, "Invalid group_by"},
+	{1076, CodeError, http.StatusBadRequest, "Invalid report parameters"},
+	{1077, CodeError, http.StatusNotFound, "Dead letter not found"},
+	{1078, CodeError, http.StatusConflict, "Dead letter has already been resolved"},
+	{1079, CodeError, http.StatusServiceUnavailable, "Database unavailable, retry later"},
+	{1080, CodeError, http.StatusServiceUnavailable, "Database unavailable for writes, retry later"},
+	{1081, CodeError, http.StatusBadRequest, "Profile must be goroutine or heap"},
+	{1082, CodeError, http.StatusBadRequest, "Invalid CSV file"},
+	{1083, CodeError, http.StatusBadRequest, "Invalid pagination parameters"},
+	{1084, CodeError, http.StatusPreconditionFailed, "Account was modified (If-Match precondition failed)"},
+	{1085, CodeError, http.StatusConflict, "Account balance must be zero to close it"},
+	{1086, CodeError, http.StatusConflict, "Account is closed"},
+	{1087, CodeError, http.StatusNotFound, "Unknown API version"},
+	{1088, CodeError, http.StatusBadRequest, "Unknown sandbox scenario"},
+	{1089, CodeError, http.StatusNotImplemented, "Not available in sandbox mode"},
+	{1090, CodeError, http.StatusBadRequest, "Invalid fault"},
+	{1091, CodeError, http.StatusNotFound, "Unknown feature flag"},
+	{1092, CodeError, http.StatusServiceUnavailable, "Service is in maintenance"},
+	{1093, CodeError, http.StatusBadRequest, "Invalid include_archived parameter"},
+	{1094, CodeError, http.StatusConflict, "Customer has open accounts"},
+	{1095, CodeError, http.StatusConflict, "Customer already erased"},
+	{1096, CodeError, http.StatusUnauthorized, "Missing or malformed request signature"},
+	{1097, CodeError, http.StatusUnauthorized, "Stale request signature timestamp"},
+	{1098, CodeError, http.StatusUnauthorized, "Invalid request signature"},
+	{1099, CodeError, http.StatusConflict, "Replayed request signature"},
+	{1100, CodeError, http.StatusBadRequest, "Idempotency-Key is too long"},
+	{1101, CodeError, http.StatusUnprocessableEntity, "Idempotency-Key was used for a different request"},
+	{1102, CodeError, http.StatusConflict, "A request with this Idempotency-Key is in progress"},
+	{1103, CodeError, http.StatusBadRequest, "Account search query missing"},
+	{1104, CodeError, http.StatusBadRequest, "Invalid code type"},
+	{1105, CodeError, http.StatusTooManyRequests, "Quota exceeded"},
+	{1106, CodeError, http.StatusBadRequest, "Escrows are not enabled"},
+	{1107, CodeError, http.StatusBadRequest, "Invalid escrow ID"},
+	{1108, CodeError, http.StatusNotFound, "Escrow not found"},
+	{1109, CodeError, http.StatusConflict, "Escrow already settled"},
+	{1110, CodeError, http.StatusConflict, "Escrow release time not reached"},
+	{1111, CodeError, http.StatusUnprocessableEntity, "Escrow amount requires approval or confirmation"},
+	{1112, CodeError, http.StatusInternalServerError, "Escrow account not found"},
+	{1113, CodeError, http.StatusConflict, "Wallet already exists"},
+	{1114, CodeError, http.StatusNotFound, "Wallet not found"},
+	{1115, CodeError, http.StatusConflict, "Wallet balance must be zero to delete it"},
+	{1116, CodeError, http.StatusBadRequest, "Invalid dispute ID"},
+	{1117, CodeError, http.StatusConflict, "Transaction cannot be disputed"},
+	{1118, CodeError, http.StatusUnprocessableEntity, "Dispute amount exceeds what is left of the transfer"},
+	{1119, CodeError, http.StatusConflict, "Transaction already has an open dispute"},
+	{1120, CodeError, http.StatusNotFound, "Dispute not found"},
+	{1121, CodeError, http.StatusConflict, "Dispute already resolved"},
+	{1122, CodeError, http.StatusConflict, "Transaction cannot be refunded"},
+	{1123, CodeError, http.StatusUnprocessableEntity, "Refund amount exceeds the refundable amount"},
+	{1124, CodeError, http.StatusConflict, "Duplicate transfer"},
+	{1125, CodeError, http.StatusNotFound, "Unknown job"},
+	{1126, CodeError, http.StatusBadRequest, "Message has no message ID"},
+	{1127, CodeError, http.StatusConflict, "Command outcome unknown"},
+	{1128, CodeError, http.StatusNotFound, "Webhook not found"},
+	{1129, CodeError, http.StatusNotFound, "Webhook delivery not found"},
+	{1130, CodeError, http.StatusConflict, "Webhook has been deleted"},
+	{1131, CodeError, http.StatusConflict, "Webhook delivery is already pending"},
+	{1132, CodeError, http.StatusBadRequest, "Invalid request timeout"},
+	{1133, CodeError, http.StatusGatewayTimeout, "Request timeout exceeded"},
+	{1134, CodeError, http.StatusBadRequest, "Transfer would take the account below its minimum balance"},
+	{1135, CodeError, http.StatusNotFound, "Sweep rule not found"},
+	{1136, CodeError, http.StatusConflict, "Alias already in use"},
+	{1137, CodeError, http.StatusConflict, "External reference already in use"},
+	{1138, CodeError, http.StatusNotFound, "Prepared transfer not found"},
+	{1139, CodeError, http.StatusConflict, "Prepared transfer is no longer pending"},
+	{1140, CodeError, http.StatusUnprocessableEntity, "Prepared transfer amount requires approval or confirmation"},
+	{1141, CodeError, http.StatusNotFound, "Term deposit not found"},
+	{1142, CodeError, http.StatusConflict, "Term deposit has not matured"},
+	{1143, CodeError, http.StatusBadRequest, "Term deposits are not enabled"},
+	{1144, CodeError, http.StatusConflict, "Term deposit is not active"},
+	{1145, CodeError, http.StatusInternalServerError, "Interest account not found"},
+	{1146, CodeError, http.StatusUnprocessableEntity, "Sweep amount requires approval or confirmation"},
+}
+
+// handleCodes serves GET /errors, the code catalog, so clients can map the
+// codes of responses programmatically. ?type=success|error narrows it to one
+// type.
+func (a *App) handleCodes(w http.ResponseWriter, r *http.Request) {
+	codeType := r.URL.Query().Get("type")
+	if codeType != "" && codeType != CodeSuccess && codeType != CodeError {
+		writeJSONError(w, "Invalid type parameter, expected success or error", 1104, http.StatusBadRequest)
+		return
+	}
+	codes := []CodeInfo{}
+	for _, c := range codeCatalog {
+		if codeType == "" || c.Type == codeType {
+			codes = append(codes, c)
+		}
+	}
+	writeJSONSuccess(w, codes, "Code catalog retrieved", 2053, http.StatusOK)
+}
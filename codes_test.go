@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// literalCode matches a code written with the HTTP status it is sent with,
+// as in writeJSONError(w, "Not found", 1040, http.StatusNotFound)
+var literalCode = regexp.MustCompile(`\b([12]\d{3}), http\.(Status\w+)`)
+
+// decodedCode matches the payload error code handed to decodeJSON
+var decodedCode = regexp.MustCompile(`decodeJSON\([^,]+, [^,]+, ([12]\d{3})`)
+
+// TestCodeCatalog checks every code the handlers answer with is registered in
+// codeCatalog with the status it is sent with
+func TestCodeCatalog(t *testing.T) {
+	catalog := map[int]CodeInfo{}
+	for _, c := range codeCatalog {
+		if _, dup := catalog[c.Code]; dup {
+			t.Errorf("code %d is registered twice", c.Code)
+		}
+		want := CodeSuccess
+		if c.HTTPStatus >= 400 {
+			want = CodeError
+		}
+		if c.Type != want {
+			t.Errorf("code %d sent with %d has type %s, want %s", c.Code, c.HTTPStatus, c.Type, want)
+		}
+		catalog[c.Code] = c
+	}
+
+	statuses := map[string]int{}
+	for s := 100; s < 600; s++ {
+		if text := http.StatusText(s); text != "" {
+			statuses["Status"+strings.NewReplacer(" ", "", "-", "").Replace(text)] = s
+		}
+	}
+
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		src, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range literalCode.FindAllStringSubmatch(string(src), -1) {
+			status, ok := statuses[m[2]]
+			if !ok {
+				t.Errorf("%s: unknown status http.%s", file, m[2])
+				continue
+			}
+			checkCode(t, catalog, file, m[1], status)
+		}
+		for _, m := range decodedCode.FindAllStringSubmatch(string(src), -1) {
+			checkCode(t, catalog, file, m[1], http.StatusBadRequest)
+		}
+	}
+}
+
+func checkCode(t *testing.T, catalog map[int]CodeInfo, file, code string, status int) {
+	t.Helper()
+	n, _ := strconv.Atoi(code)
+	c, ok := catalog[n]
+	switch {
+	case !ok:
+		t.Errorf("%s: code %s is missing from codeCatalog", file, code)
+	case c.HTTPStatus != status:
+		t.Errorf("%s: code %s is sent with %d but registered with %d", file, code, status, c.HTTPStatus)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionConfig configures compression of response bodies negotiated
+// through Accept-Encoding
+type CompressionConfig struct {
+	// Encodings lists the content codings offered (gzip, zstd) in order of
+	// preference; empty disables compression
+	Encodings []string `json:"encodings"`
+	// MinBytes is the body size below which responses are sent uncompressed
+	MinBytes int `json:"min_bytes"`
+}
+
+// validate checks every configured coding is supported
+func (c CompressionConfig) validate() error {
+	for _, e := range c.Encodings {
+		if encoderPools[e] == nil {
+			return fmt.Errorf("unsupported encoding %q", e)
+		}
+	}
+	if c.MinBytes < 0 {
+		return fmt.Errorf("min_bytes must not be negative")
+	}
+	return nil
+}
+
+// encoder is the part of gzip.Writer and zstd.Encoder a response uses
+type encoder interface {
+	io.Writer
+	Flush() error
+	Close() error
+	Reset(io.Writer)
+}
+
+// encoderPools reuse encoders, which allocate large windows, across responses
+var encoderPools = map[string]*sync.Pool{
+	"gzip": {New: func() interface{} { return gzip.NewWriter(nil) }},
+	"zstd": {New: func() interface{} {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return enc
+	}},
+}
+
+// incompressibleTypes are content types that are already compressed or must
+// reach the client unbuffered
+var incompressibleTypes = []string{"text/event-stream", "image/", "audio/", "video/", "application/zip", "application/gzip", "application/octet-stream"}
+
+// negotiateEncoding picks the offered coding with the highest q-value in an
+// Accept-Encoding header, the earliest offered on ties, or "" for none
+func negotiateEncoding(header string, offered []string) string {
+	best, bestQ := "", 0.0
+	for _, e := range offered {
+		if q := encodingQuality(header, e); q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	return best
+}
+
+func encodingQuality(header, encoding string) float64 {
+	q := 0.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.TrimSpace(name)
+		if !strings.EqualFold(name, encoding) && name != "*" {
+			continue
+		}
+		v := 1.0
+		if p, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if v, err = strconv.ParseFloat(p, 64); err != nil {
+				continue
+			}
+		}
+		// an explicit entry overrides the wildcard
+		if strings.EqualFold(name, encoding) {
+			return v
+		}
+		q = v
+	}
+	return q
+}
+
+// withCompression compresses response bodies of at least MinBytes with the
+// coding negotiated from Accept-Encoding. Bodies are buffered until they
+// reach MinBytes or the handler flushes, so streamed exports are compressed
+// batch by batch.
+func (a *App) withCompression(next http.Handler) http.Handler {
+	cfg := a.Config.Server.Compression
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(cfg.Encodings) == 0 || r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), cfg.Encodings)
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minBytes: cfg.MinBytes}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter holds back the status line until it knows whether the body
+// is large enough to compress
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minBytes int
+	status   int
+	buf      []byte
+	decided  bool
+	enc      encoder
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 && status >= http.StatusOK {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if cw.decided {
+		if cw.enc != nil {
+			return cw.enc.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= cw.minBytes {
+		if err := cw.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// FlushError sends what has been written so far; http.ResponseController
+// calls it
+func (cw *compressWriter) FlushError() error {
+	if !cw.decided {
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		if err := cw.start(true); err != nil {
+			return err
+		}
+	}
+	if cw.enc != nil {
+		if err := cw.enc.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// start writes the status line, compressing the body from here on if asked
+// to and the response allows it, then the buffered body
+func (cw *compressWriter) start(compress bool) error {
+	cw.decided = true
+	h := cw.Header()
+	if compress && cw.compressible() {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		// the encoded bytes differ from the representation the tag names
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		cw.enc = encoderPools[cw.encoding].Get().(encoder)
+		cw.enc.Reset(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (cw *compressWriter) compressible() bool {
+	if cw.status == http.StatusNoContent || cw.status == http.StatusNotModified {
+		return false
+	}
+	h := cw.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	contentType := h.Get("Content-Type")
+	for _, t := range incompressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// close sends a body that stayed below MinBytes as is, or finishes the
+// compressed stream
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		if cw.status != 0 {
+			cw.start(false)
+		}
+		return
+	}
+	if cw.enc != nil {
+		cw.enc.Close()
+		cw.enc.Reset(nil)
+		encoderPools[cw.encoding].Put(cw.enc)
+		cw.enc = nil
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// Config holds the runtime configuration of the service
+type Config struct {
+	Database DatabaseConfig `json:"database"`
+	Fees     FeeConfig      `json:"fees"`
+	Tenancy  TenancyConfig  `json:"tenancy"`
+	IBAN     IBANConfig     `json:"iban"`
+	External ExternalConfig `json:"external"`
+	Limits   LimitsConfig   `json:"limits"`
+	Server   ServerConfig   `json:"server"`
+	CORS     CORSConfig     `json:"cors"`
+	Auth     AuthConfig     `json:"auth"`
+	Approval ApprovalConfig `json:"approval"`
+	StepUp   StepUpConfig   `json:"step_up"`
+	Risk     RiskConfig     `json:"risk"`
+
+	Notifications  NotificationConfig   `json:"notifications"`
+	Reconciliation ReconciliationConfig `json:"reconciliation"`
+	Retention      RetentionConfig      `json:"retention"`
+	Partitions     PartitionConfig      `json:"partitions"`
+	Adjustments    AdjustmentConfig     `json:"adjustments"`
+	Escrow         EscrowConfig         `json:"escrow"`
+	AccessLog      AccessLogConfig      `json:"access_log"`
+	EventSourcing  EventSourcingConfig  `json:"event_sourcing"`
+	ReadModel      ReadModelConfig      `json:"read_model"`
+	Locking        LockingConfig        `json:"locking"`
+	Leader         LeaderConfig         `json:"leader"`
+	Scheduler      SchedulerConfig      `json:"scheduler"`
+	Cache          CacheConfig          `json:"cache"`
+	Diagnostics    DiagnosticsConfig    `json:"diagnostics"`
+	Sandbox        SandboxConfig        `json:"sandbox"`
+	Seed           SeedConfig           `json:"seed"`
+	FaultInjection FaultInjectionConfig `json:"fault_injection"`
+	Flags          FeatureFlagConfig    `json:"feature_flags"`
+	Messaging      MessagingConfig      `json:"messaging"`
+	Kafka          KafkaConfig          `json:"kafka"`
+	RabbitMQ       RabbitMQConfig       `json:"rabbitmq"`
+	Webhooks       WebhookConfig        `json:"webhooks"`
+
+	// AccountTypes configures the rules of each account type accounts may be
+	// opened with; accounts opened without a type have none
+	AccountTypes map[string]AccountTypeConfig `json:"account_types"`
+
+	PreparedTransfers PreparedTransferConfig `json:"prepared_transfers"`
+	TermDeposits      TermDepositConfig      `json:"term_deposits"`
+}
+
+// DatabaseConfig configures the database connections besides the primary
+type DatabaseConfig struct {
+	// DSN is the connection string of the primary, without credentials
+	DSN string `json:"dsn"`
+	// Credentials fills in the user and password of both DSNs
+	Credentials CredentialsConfig `json:"credentials"`
+	// ReplicaDSN names a read replica serving account and transaction history
+	// reads; empty sends them to the primary
+	ReplicaDSN string `json:"replica_dsn"`
+	// MaxOpenConns, MaxIdleConns and ConnMaxLifetimeSeconds size each pool;
+	// 0 means unlimited open connections or lifetime
+	MaxOpenConns           int `json:"max_open_conns"`
+	MaxIdleConns           int `json:"max_idle_conns"`
+	ConnMaxLifetimeSeconds int `json:"conn_max_lifetime_seconds"`
+	// Breaker guards the primary and the replica separately
+	Breaker BreakerConfig `json:"breaker"`
+	// SlowQueryMillis is the duration above which statements are logged and
+	// counted as slow; 0 disables slow query logging
+	SlowQueryMillis int `json:"slow_query_millis"`
+}
+
+// validate checks the pool limits are consistent
+func (c DatabaseConfig) validate() error {
+	if c.MaxOpenConns < 0 || c.MaxIdleConns < 0 || c.ConnMaxLifetimeSeconds < 0 || c.SlowQueryMillis < 0 {
+		return errors.New("pool limits and slow_query_millis must not be negative")
+	}
+	if c.MaxOpenConns > 0 && c.MaxIdleConns > c.MaxOpenConns {
+		return errors.New("max_idle_conns must not exceed max_open_conns")
+	}
+	if c.Breaker.FailureThreshold < 0 {
+		return errors.New("breaker failure_threshold must not be negative")
+	}
+	if c.Breaker.FailureThreshold > 0 && c.Breaker.OpenSeconds < 1 {
+		return errors.New("breaker open_seconds must be at least 1")
+	}
+	if c.DSN == "" {
+		return errors.New("dsn is required")
+	}
+	return c.Credentials.validate()
+}
+
+// defaultConfig returns the configuration used when no config file is given
+func defaultConfig() *Config {
+	return &Config{
+		Database: DatabaseConfig{
+			DSN: "user=postgres dbname=bank sslmode=disable connect_timeout=5",
+			Credentials: CredentialsConfig{
+				Source:      CredentialsEnv,
+				UserEnv:     "DB_USER",
+				PasswordEnv: "DB_PASSWORD",
+			},
+			MaxOpenConns:           25,
+			MaxIdleConns:           10,
+			ConnMaxLifetimeSeconds: 1800,
+			Breaker:                BreakerConfig{FailureThreshold: 5, OpenSeconds: 10},
+			SlowQueryMillis:        200,
+		},
+		Server: ServerConfig{
+			Addr:                     ":8081",
+			ReadHeaderTimeoutSeconds: 5,
+			ReadTimeoutSeconds:       60,
+			WriteTimeoutSeconds:      60,
+			IdleTimeoutSeconds:       120,
+			MaxHeaderBytes:           64 << 10,
+			MaxBodyBytes:             1 << 20,
+			MaxImportBodyBytes:       10 << 20,
+			MaxRequestTimeoutSeconds: 60,
+			Compression:              CompressionConfig{Encodings: []string{"gzip"}, MinBytes: 1024},
+		},
+		CORS: CORSConfig{
+			AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions},
+			AllowedHeaders: []string{"Content-Type", "Authorization", "If-Match", "If-None-Match", "Idempotency-Key"},
+			ExposedHeaders: []string{"ETag", "Deprecation", "Sunset", "Link", "Idempotent-Replayed", "Retry-After", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"},
+			MaxAgeSeconds:  600,
+		},
+		Tenancy: TenancyConfig{
+			Header:        "X-Tenant-ID",
+			DefaultTenant: "default",
+		},
+		IBAN: IBANConfig{
+			CountryCode:   "DE",
+			BankCode:      "37040044",
+			AccountDigits: 10,
+		},
+		Notifications: NotificationConfig{
+			SMTP:                 SMTPConfig{Port: 587},
+			Workers:              2,
+			QueueSize:            1000,
+			MaxAttempts:          3,
+			RetryIntervalSeconds: 5,
+		},
+		Reconciliation: ReconciliationConfig{IntervalSeconds: 3600},
+		Retention:      RetentionConfig{IntervalSeconds: 3600, BatchSize: 1000},
+		Partitions:     PartitionConfig{MonthsAhead: 3},
+		ReadModel:      ReadModelConfig{IntervalSeconds: 1},
+		Locking:        LockingConfig{Mode: LockOptimistic},
+		Leader:         LeaderConfig{LeaseSeconds: 30},
+		Scheduler:      SchedulerConfig{MaxRunSeconds: 21600},
+		Cache:          CacheConfig{TTLSeconds: 60},
+		Flags:          FeatureFlagConfig{RefreshSeconds: 30},
+		Messaging:      MessagingConfig{Principal: "broker", MaxAttempts: 3, RetryIntervalSeconds: 5, RetentionDays: 7},
+		Kafka:          KafkaConfig{Topic: "transfer-commands", GroupID: "fundtransfer", DLQTopic: "transfer-commands-dlq", EventsTopic: "transfer-events"},
+		RabbitMQ:       RabbitMQConfig{CommandQueue: "transfer-commands", DeadLetterQueue: "transfer-commands-dlq", EventExchange: "transfer-events"},
+		Webhooks: WebhookConfig{
+			TimeoutSeconds:          10,
+			MaxAttempts:             8,
+			RetryIntervalSeconds:    30,
+			MaxRetryIntervalSeconds: 3600,
+			Workers:                 4,
+			RetentionDays:           30,
+		},
+		Sandbox: SandboxConfig{
+			Accounts: 10,
+			Scenarios: map[string]string{
+				"0.51": ScenarioInsufficientFunds,
+				"0.52": ScenarioConflict,
+				"0.53": ScenarioTimeout,
+			},
+			TimeoutSeconds: 5,
+		},
+		Seed: SeedConfig{
+			Accounts:       100,
+			FirstAccountID: 900000,
+			InitialBalance: 1000,
+			Transactions:   500,
+			MaxAmount:      100,
+			RandomSeed:     1,
+		},
+		AccessLog: AccessLogConfig{
+			QueueSize: 1000,
+			SyncPaths: []string{"/transactions"},
+		},
+		Auth: AuthConfig{Signing: SigningConfig{ToleranceSeconds: 300}},
+		StepUp: StepUpConfig{
+			Provider:    OTPProviderLog,
+			CodeDigits:  6,
+			TTLSeconds:  300,
+			MaxAttempts: 3,
+		},
+		PreparedTransfers: PreparedTransferConfig{TTLSeconds: 300},
+		External: ExternalConfig{
+			Wire: WireConfig{Currency: "USD"},
+			Gateway: GatewayConfig{
+				TimeoutSeconds:       10,
+				MaxAttempts:          5,
+				RetryIntervalSeconds: 30,
+				Workers:              4,
+			},
+		},
+	}
+}
+
+// loadConfig reads the JSON config file named by the CONFIG_FILE environment
+// variable on top of the defaults. A missing CONFIG_FILE means defaults only.
+func loadConfig() (*Config, error) {
+	cfg := defaultConfig()
+
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parse config file: %w", err)
+	}
+	if err := cfg.Database.validate(); err != nil {
+		return nil, fmt.Errorf("invalid database config: %w", err)
+	}
+	if err := cfg.Server.validate(); err != nil {
+		return nil, fmt.Errorf("invalid server config: %w", err)
+	}
+	if _, err := cfg.Server.sunset(); err != nil {
+		return nil, fmt.Errorf("invalid server config: %w", err)
+	}
+	if err := cfg.Server.Compression.validate(); err != nil {
+		return nil, fmt.Errorf("invalid compression config: %w", err)
+	}
+	if err := cfg.Fees.validate(); err != nil {
+		return nil, fmt.Errorf("invalid fee config: %w", err)
+	}
+	if err := cfg.IBAN.validate(); err != nil {
+		return nil, fmt.Errorf("invalid IBAN config: %w", err)
+	}
+	if err := cfg.Auth.Signing.validate(); err != nil {
+		return nil, fmt.Errorf("invalid signing config: %w", err)
+	}
+	for _, k := range cfg.Auth.APIKeys {
+		if err := k.Quota.validate(); err != nil {
+			return nil, fmt.Errorf("invalid quota of %s: %w", k.Principal, err)
+		}
+	}
+	if cfg.Limits.DuplicateWindowSeconds < 0 {
+		return nil, fmt.Errorf("invalid limits config: duplicate_window_seconds must not be negative")
+	}
+	if err := cfg.StepUp.validate(); err != nil {
+		return nil, fmt.Errorf("invalid step-up config: %w", err)
+	}
+	if err := cfg.Risk.validate(); err != nil {
+		return nil, fmt.Errorf("invalid risk config: %w", err)
+	}
+	if err := cfg.Locking.validate(); err != nil {
+		return nil, fmt.Errorf("invalid locking config: %w", err)
+	}
+	if cfg.External.Gateway.URL != "" && cfg.External.Gateway.Workers < 1 {
+		return nil, fmt.Errorf("invalid gateway config: workers must be at least 1")
+	}
+	if cfg.Leader.LeaseSeconds < 3 {
+		return nil, fmt.Errorf("invalid leader config: lease_seconds must be at least 3")
+	}
+	if err := cfg.Scheduler.validate(); err != nil {
+		return nil, fmt.Errorf("invalid scheduler config: %w", err)
+	}
+	if err := cfg.Messaging.validate(); err != nil {
+		return nil, fmt.Errorf("invalid messaging config: %w", err)
+	}
+	switch cfg.Messaging.Transport {
+	case TransportKafka:
+		err = cfg.Kafka.validate()
+	case TransportRabbitMQ:
+		err = cfg.RabbitMQ.validate()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s config: %w", cfg.Messaging.Transport, err)
+	}
+	if err := cfg.Webhooks.validate(); err != nil {
+		return nil, fmt.Errorf("invalid webhook config: %w", err)
+	}
+	for name, t := range cfg.AccountTypes {
+		if err := t.validate(); err != nil {
+			return nil, fmt.Errorf("invalid account type %s: %w", name, err)
+		}
+	}
+	if err := cfg.PreparedTransfers.validate(); err != nil {
+		return nil, fmt.Errorf("invalid prepared transfer config: %w", err)
+	}
+	if err := cfg.TermDeposits.validate(); err != nil {
+		return nil, fmt.Errorf("invalid term deposit config: %w", err)
+	}
+	if cfg.Cache.RedisAddr != "" && cfg.Cache.TTLSeconds < 1 {
+		return nil, fmt.Errorf("invalid cache config: ttl_seconds must be at least 1")
+	}
+	if err := cfg.Flags.validate(cfg.knownFlags()); err != nil {
+		return nil, fmt.Errorf("invalid feature flag config: %w", err)
+	}
+	if err := cfg.Sandbox.validate(); err != nil {
+		return nil, fmt.Errorf("invalid sandbox config: %w", err)
+	}
+	if err := cfg.Seed.validate(); err != nil {
+		return nil, fmt.Errorf("invalid seed config: %w", err)
+	}
+	if err := cfg.Retention.validate(); err != nil {
+		return nil, fmt.Errorf("invalid retention config: %w", err)
+	}
+	if err := cfg.Partitions.validate(); err != nil {
+		return nil, fmt.Errorf("invalid partition config: %w", err)
+	}
+	if cfg.ReadModel.IntervalSeconds < 1 {
+		return nil, fmt.Errorf("invalid read model config: interval_seconds must be at least 1")
+	}
+	if cfg.Approval.Threshold > 0 && len(cfg.Auth.APIKeys) == 0 {
+		return nil, fmt.Errorf("approval threshold requires auth api_keys to identify approvers")
+	}
+	return cfg, nil
+}
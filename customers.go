@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// KYC statuses a customer can be in
+const (
+	KYCPending  = "pending"
+	KYCVerified = "verified"
+	KYCRejected = "rejected"
+)
+
+// Customer represents a customer record that owns accounts
+type Customer struct {
+	ID        int        `json:"customer_id"`
+	Name      string     `json:"name"`
+	Email     string     `json:"email"`
+	KYCStatus string     `json:"kyc_status"`
+	CreatedAt time.Time  `json:"created_at"`
+	ErasedAt  *time.Time `json:"erased_at,omitempty"`
+}
+
+// CreateCustomerRequest represents the JSON body for creating a new customer
+type CreateCustomerRequest struct {
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	KYCStatus string `json:"kyc_status"`
+}
+
+func validKYCStatus(status string) bool {
+	switch status {
+	case KYCPending, KYCVerified, KYCRejected:
+		return true
+	}
+	return false
+}
+
+func (a *App) handleCreateCustomer(w http.ResponseWriter, r *http.Request) {
+	var req CreateCustomerRequest
+	if apiErr := decodeJSON(r, &req, 1002, "name", "email"); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	req.Email = strings.TrimSpace(req.Email)
+	if req.KYCStatus == "" {
+		req.KYCStatus = KYCPending
+	}
+	if apiErr := req.validate(); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	c := Customer{Name: req.Name, Email: req.Email, KYCStatus: req.KYCStatus}
+	err := a.DB.QueryRow("INSERT INTO customers (name, email, kyc_status, tenant_id) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
+		c.Name, c.Email, c.KYCStatus, tenantFromContext(r.Context())).Scan(&c.ID, &c.CreatedAt)
+	if err != nil {
+		if pgErr, ok := err.(*pq.Error); ok {
+			if pgErr.Code == "23505" {
+				writeJSONError(w, "Customer with this email already exists", 1025, http.StatusConflict)
+				return
+			}
+			writeJSONError(w, fmt.Sprintf("Database error: %s", pgErr.Message), 1004, http.StatusInternalServerError)
+			return
+		}
+		writeJSONError(w, "Failed to create customer", 1005, http.StatusInternalServerError)
+		return
+	}
+	a.auditCommitted(r.Context(), auditRecord{
+		TenantID:   tenantFromContext(r.Context()),
+		Action:     "customer.created",
+		EntityType: "customer",
+		EntityID:   strconv.Itoa(c.ID),
+		After:      c,
+	})
+
+	writeJSONSuccess(w, c, "Customer created", 2004, http.StatusCreated)
+}
+
+// customerIDRoute adapts a handler of one customer to a route with an {id}
+// path parameter
+func customerIDRoute(h func(http.ResponseWriter, *http.Request, int)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		customerID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			writeJSONError(w, "Invalid customer ID", 1026, http.StatusBadRequest)
+			return
+		}
+		h(w, r, customerID)
+	}
+}
+
+// customerRoute is customerIDRoute for handlers that need the customer
+// record, answering 404 when the tenant has no such customer
+func (a *App) customerRoute(h func(http.ResponseWriter, *http.Request, Customer)) http.HandlerFunc {
+	return customerIDRoute(func(w http.ResponseWriter, r *http.Request, customerID int) {
+		var c Customer
+		err := a.DB.QueryRow("SELECT id, name, email, kyc_status, created_at, erased_at FROM customers WHERE id = $1 AND tenant_id = $2", customerID, tenantFromContext(r.Context())).
+			Scan(&c.ID, &c.Name, &c.Email, &c.KYCStatus, &c.CreatedAt, &c.ErasedAt)
+		if err != nil {
+			if pgErr, ok := err.(*pq.Error); ok {
+				writeJSONError(w, fmt.Sprintf("Database error: %s", pgErr.Message), 1009, http.StatusInternalServerError)
+				return
+			}
+			writeJSONError(w, "Customer not found", 1027, http.StatusNotFound)
+			return
+		}
+		h(w, r, c)
+	})
+}
+
+// handleGetCustomer serves GET /customers/{id}
+func (a *App) handleGetCustomer(w http.ResponseWriter, r *http.Request, c Customer) {
+	writeJSONSuccess(w, c, "Customer retrieved", 2005, http.StatusOK)
+}
+
+// handleCustomerAccounts serves GET /customers/{id}/accounts
+func (a *App) handleCustomerAccounts(w http.ResponseWriter, r *http.Request, c Customer) {
+	page, apiErr := parsePage(r, false)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	cond, orderLimit, key := page.keyset("id", 3)
+	rows, err := a.Replica.Query("SELECT id, balance, last_updated, customer_id FROM read_accounts WHERE customer_id = $1 AND tenant_id = $2 AND "+cond+" "+orderLimit, c.ID, tenantFromContext(r.Context()), key)
+	if err != nil {
+		writeJSONError(w, "Failed to list accounts", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	accounts := []Account{}
+	for rows.Next() {
+		var acc Account
+		if err := rows.Scan(&acc.ID, &acc.Balance, &acc.LastUpdated, &acc.CustomerID); err != nil {
+			writeJSONError(w, "Failed to list accounts", 1005, http.StatusInternalServerError)
+			return
+		}
+		accounts = append(accounts, acc)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, "Failed to list accounts", 1005, http.StatusInternalServerError)
+		return
+	}
+
+	accounts, pagination := paginate(page, accounts, func(acc Account) int64 { return int64(acc.ID) })
+	writeJSONPage(w, accounts, &pagination, "Customer accounts retrieved", 2006, http.StatusOK)
+}
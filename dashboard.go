@@ -0,0 +1,128 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// dashboardFiles is the admin web UI, served under /admin/dashboard/. It
+// reads the admin API of the same server, so it needs no backend of its own
+// besides the account search and transfer lists below.
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboardPrefix is where the admin web UI is served
+const dashboardPrefix = "/admin/dashboard/"
+
+// dashboardListLimit bounds the rows of the dashboard lists
+const dashboardListLimit = 50
+
+// dashboardHandler serves the embedded UI to admins. Browsers authenticate
+// with HTTP basic auth using the API key as the password.
+func (a *App) dashboardHandler() http.Handler {
+	static, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	files := http.StripPrefix(dashboardPrefix, http.FileServer(http.FS(static)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeJSONError(w, "Only GET method is allowed", 1006, http.StatusMethodNotAllowed)
+			return
+		}
+		if !requireRole(w, r, RoleAdmin) {
+			return
+		}
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		files.ServeHTTP(w, r)
+	})
+}
+
+// handleDashboardAccounts serves GET /admin/dashboard/api/accounts?q=...,
+// finding the tenant's accounts by ID, IBAN, or the name or email of their
+// customer
+func (a *App) handleDashboardAccounts(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		writeJSONError(w, "The q query parameter is required", 1103, http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.Atoi(q)
+	if err != nil {
+		id = 0
+	}
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q) + "%"
+
+	rows, err := a.Replica.QueryContext(r.Context(), `SELECT a.id, a.balance, a.last_updated, a.customer_id, a.iban, a.closed_at FROM accounts a
+		LEFT JOIN customers c ON c.id = a.customer_id
+		WHERE a.tenant_id = $1 AND (a.id = $2 OR a.iban = UPPER(REPLACE($3, ' ', '')) OR c.name ILIKE $4 OR c.email ILIKE $4)
+		ORDER BY a.id LIMIT $5`,
+		tenantFromContext(r.Context()), id, q, pattern, dashboardListLimit)
+	if err != nil {
+		writeJSONError(w, "Failed to search accounts", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	accounts := []Account{}
+	for rows.Next() {
+		acc, err := scanAccount(rows)
+		if err != nil {
+			writeJSONError(w, "Failed to search accounts", 1005, http.StatusInternalServerError)
+			return
+		}
+		accounts = append(accounts, acc)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, "Failed to search accounts", 1005, http.StatusInternalServerError)
+		return
+	}
+	writeJSONSuccess(w, accounts, "Accounts found", 2050, http.StatusOK)
+}
+
+// handleDashboardTransfers serves GET /admin/dashboard/api/transfers, the
+// tenant's latest transfers from the read model; failed=true lists only the
+// failed, rejected and reversed ones
+func (a *App) handleDashboardTransfers(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+	var statuses []string
+	if r.URL.Query().Get("failed") == "true" {
+		statuses = []string{TxFailed, TxReversed, TxRejected}
+	}
+
+	rows, err := a.Replica.QueryContext(r.Context(), "SELECT "+tenantTransactionColumns("$1")+` FROM read_transactions
+		WHERE (tenant_id = $1 OR to_tenant_id = $1) AND ($2::text[] IS NULL OR status = ANY($2)) ORDER BY id DESC LIMIT $3`,
+		tenantFromContext(r.Context()), pq.Array(statuses), dashboardListLimit)
+	if err != nil {
+		writeJSONError(w, "Failed to list transfers", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	transactions := []Transaction{}
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			writeJSONError(w, "Failed to list transfers", 1005, http.StatusInternalServerError)
+			return
+		}
+		transactions = append(transactions, t)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, "Failed to list transfers", 1005, http.StatusInternalServerError)
+		return
+	}
+	writeJSONSuccess(w, transactions, "Transfers retrieved", 2051, http.StatusOK)
+}
@@ -0,0 +1,113 @@
+"use strict";
+
+// The dashboard reads the admin API of the server it is served from. The
+// browser sends the basic auth credentials it was asked for with every call.
+
+const $ = (id) => document.getElementById(id);
+
+async function api(path) {
+  const headers = { Accept: "application/json" };
+  const tenant = $("tenant").value.trim();
+  if (tenant) headers["X-Tenant-ID"] = tenant;
+  const resp = await fetch(path, { headers, credentials: "same-origin" });
+  const body = await resp.json().catch(() => ({}));
+  if (!resp.ok || body.status !== "success") {
+    const err = new Error(`${body.message || resp.statusText} (code ${body.code || resp.status})`);
+    err.code = body.code;
+    throw err;
+  }
+  return body.data;
+}
+
+function cell(text, className) {
+  const td = document.createElement("td");
+  td.textContent = text == null ? "" : String(text);
+  if (className) td.className = className;
+  return td;
+}
+
+function fill(tbody, rows, columns, emptyText) {
+  tbody.replaceChildren();
+  if (rows.length === 0) {
+    const tr = document.createElement("tr");
+    const td = cell(emptyText, "empty");
+    td.colSpan = columns;
+    tr.append(td);
+    tbody.append(tr);
+    return;
+  }
+  for (const cells of rows) {
+    const tr = document.createElement("tr");
+    tr.append(...cells);
+    tbody.append(tr);
+  }
+}
+
+const money = (v) => cell(Number(v).toFixed(2), "number");
+const time = (v) => cell(v ? new Date(v).toLocaleString() : "");
+const status = (v) => cell(v, "status-" + v);
+
+function showError(err) {
+  $("error").textContent = err.message;
+  $("error").hidden = false;
+}
+
+async function searchAccounts(event) {
+  event.preventDefault();
+  const q = $("query").value.trim();
+  const accounts = await api("/v1/admin/dashboard/api/accounts?q=" + encodeURIComponent(q));
+  fill($("accounts"), accounts.map((a) => [
+    cell(a.account_id), money(a.balance), cell(a.iban), cell(a.customer_id), time(a.closed_at),
+  ]), 5, "No accounts found");
+}
+
+async function loadTransfers() {
+  const recent = await api("/v1/admin/dashboard/api/transfers");
+  fill($("recent"), recent.map((t) => [
+    cell(t.transaction_id), cell(t.source_account_id), cell(t.destination_account_id),
+    money(t.amount), status(t.status), time(t.created_at),
+  ]), 6, "No transfers");
+
+  const failed = await api("/v1/admin/dashboard/api/transfers?failed=true");
+  fill($("failed"), failed.map((t) => [
+    cell(t.transaction_id), cell(t.source_account_id), cell(t.destination_account_id),
+    money(t.amount), status(t.status), cell(t.failure_reason),
+  ]), 6, "No failed transfers");
+}
+
+async function loadDeadLetters() {
+  const letters = await api("/v1/admin/dead-letters");
+  fill($("dead-letters"), letters.map((d) => [
+    cell(d.dead_letter_id), cell(d.transaction_id), cell(d.reason), cell(d.attempts), time(d.created_at),
+  ]), 5, "No open dead letters");
+}
+
+async function loadReconciliation() {
+  let run;
+  try {
+    run = await api("/v1/admin/reconciliation");
+  } catch (err) {
+    if (err.code !== 1070) throw err;
+    $("reconciliation").textContent = "No reconciliation has run yet.";
+    fill($("discrepancies"), [], 4, "");
+    return;
+  }
+  const found = run.discrepancies.length;
+  $("reconciliation").textContent = `Run ${run.run_id} finished ${new Date(run.finished_at).toLocaleString()}: ` +
+    `${run.accounts_checked} accounts checked, ${found} ${found === 1 ? "discrepancy" : "discrepancies"}.`;
+  fill($("discrepancies"), run.discrepancies.map((d) => [
+    cell(d.account_id), money(d.stored_balance), money(d.computed_balance), money(d.difference),
+  ]), 4, "Balances match the ledger");
+}
+
+async function refresh() {
+  $("error").hidden = true;
+  const results = await Promise.allSettled([loadTransfers(), loadDeadLetters(), loadReconciliation()]);
+  const failure = results.find((r) => r.status === "rejected");
+  if (failure) showError(failure.reason);
+}
+
+$("search").addEventListener("submit", (event) => searchAccounts(event).catch(showError));
+$("refresh").addEventListener("click", refresh);
+$("tenant").addEventListener("change", refresh);
+refresh();
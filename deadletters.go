@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Resolutions of a dead letter
+const (
+	DeadLetterRequeued  = "requeued"
+	DeadLetterCancelled = "cancelled"
+)
+
+// DeadLetter is an external leg that ran out of delivery attempts. Its funds
+// stay in the settlement account until an admin requeues or cancels it.
+type DeadLetter struct {
+	ID            int        `json:"dead_letter_id"`
+	TransactionID int        `json:"transaction_id"`
+	Reason        string     `json:"reason"`
+	Attempts      int        `json:"attempts"`
+	CreatedAt     time.Time  `json:"created_at"`
+	Resolution    string     `json:"resolution,omitempty"`
+	ResolvedBy    string     `json:"resolved_by,omitempty"`
+	ResolvedAt    *time.Time `json:"resolved_at,omitempty"`
+}
+
+// deadLetterLeg parks a pending leg whose attempts are exhausted instead of
+// compensating it, so a gateway outage does not bounce every transfer
+func (a *App) deadLetterLeg(ctx context.Context, leg externalLeg, cause error) error {
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "UPDATE external_transfers SET status = $1, last_error = $2, updated_at = NOW() WHERE transaction_id = $3 AND status = $4",
+		ExternalDeadLettered, cause.Error(), leg.TransactionID, ExternalPending)
+	if err != nil {
+		return err
+	}
+	if affectedRows(result, nil) == 0 {
+		return nil // resolved elsewhere
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO dead_letters (transaction_id, tenant_id, reason, attempts) VALUES ($1, $2, $3, $4)",
+		leg.TransactionID, leg.TenantID, cause.Error(), leg.Attempts)
+	if err != nil {
+		return err
+	}
+	err = a.audit(ctx, tx, auditRecord{
+		Actor:      auditActorSystem,
+		TenantID:   leg.TenantID,
+		Action:     "external_leg." + ExternalDeadLettered,
+		EntityType: "transaction",
+		EntityID:   strconv.Itoa(leg.TransactionID),
+		Before:     map[string]interface{}{"external_status": ExternalPending},
+		After:      map[string]interface{}{"external_status": ExternalDeadLettered, "last_error": cause.Error(), "attempts": leg.Attempts},
+	})
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	deadLettered.Inc()
+	log.Printf("saga: transaction %d dead-lettered after %d attempts: %v", leg.TransactionID, leg.Attempts, cause)
+	return nil
+}
+
+// handleResolveDeadLetter serves POST /admin/dead-letters/{id}/requeue|cancel
+func (a *App) handleResolveDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+	action := r.PathValue("action")
+	if action != "requeue" && action != "cancel" {
+		writeJSONError(w, "Not found", 1040, http.StatusNotFound)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, "Dead letter not found", 1077, http.StatusNotFound)
+		return
+	}
+	a.resolveDeadLetter(w, r, id, action == "requeue")
+}
+
+// handleDeadLetters serves GET /admin/dead-letters?resolved=true|false
+func (a *App) handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+	resolved := r.URL.Query().Get("resolved") == "true"
+
+	rows, err := a.DB.QueryContext(r.Context(), `SELECT id, transaction_id, reason, attempts, created_at, COALESCE(resolution, ''), COALESCE(resolved_by, ''), resolved_at
+		FROM dead_letters WHERE tenant_id = $1 AND (resolved_at IS NOT NULL) = $2 ORDER BY id DESC LIMIT 100`,
+		tenantFromContext(r.Context()), resolved)
+	if err != nil {
+		writeJSONError(w, "Failed to list dead letters", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	letters := []DeadLetter{}
+	for rows.Next() {
+		var d DeadLetter
+		if err := rows.Scan(&d.ID, &d.TransactionID, &d.Reason, &d.Attempts, &d.CreatedAt, &d.Resolution, &d.ResolvedBy, &d.ResolvedAt); err != nil {
+			writeJSONError(w, "Failed to list dead letters", 1005, http.StatusInternalServerError)
+			return
+		}
+		letters = append(letters, d)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, "Failed to list dead letters", 1005, http.StatusInternalServerError)
+		return
+	}
+	writeJSONSuccess(w, letters, "Dead letters retrieved", 2030, http.StatusOK)
+}
+
+// resolveDeadLetter requeues a dead-lettered leg for delivery with fresh
+// attempts, or cancels it, which fails the leg and refunds the source account
+func (a *App) resolveDeadLetter(w http.ResponseWriter, r *http.Request, id int, requeue bool) {
+	ctx := r.Context()
+	tenant := tenantFromContext(ctx)
+	resolution, next := DeadLetterCancelled, ExternalFailed
+	if requeue {
+		resolution, next = DeadLetterRequeued, ExternalPending
+	}
+
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		writeJSONError(w, "Failed to begin transaction", 1013, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// The guarded update makes concurrent resolutions mutually exclusive
+	var transactionID int
+	err = tx.QueryRowContext(ctx, `UPDATE dead_letters SET resolution = $1, resolved_by = $2, resolved_at = NOW()
+		WHERE id = $3 AND tenant_id = $4 AND resolved_at IS NULL RETURNING transaction_id`,
+		resolution, principalFromContext(ctx).Name, id, tenant).Scan(&transactionID)
+	if err == sql.ErrNoRows {
+		var exists bool
+		if err := a.DB.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM dead_letters WHERE id = $1 AND tenant_id = $2)", id, tenant).Scan(&exists); err == nil && exists {
+			writeJSONError(w, "Dead letter has already been resolved", 1078, http.StatusConflict)
+			return
+		}
+		writeJSONError(w, "Dead letter not found", 1077, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "Failed to resolve dead letter", 1005, http.StatusInternalServerError)
+		return
+	}
+
+	// a requeued leg starts over and is picked up by the next recovery pass
+	_, err = tx.ExecContext(ctx, `UPDATE external_transfers SET status = $1, attempts = CASE WHEN $1 = 'pending' THEN 0 ELSE attempts END,
+		updated_at = CASE WHEN $1 = 'pending' THEN 'epoch'::timestamp ELSE NOW() END
+		WHERE transaction_id = $2 AND status = $3`, next, transactionID, ExternalDeadLettered)
+	if err != nil {
+		writeJSONError(w, "Failed to resolve dead letter", 1005, http.StatusInternalServerError)
+		return
+	}
+	err = a.audit(ctx, tx, auditRecord{
+		TenantID:   tenant,
+		Action:     "dead_letter." + resolution,
+		EntityType: "transaction",
+		EntityID:   strconv.Itoa(transactionID),
+		Before:     map[string]interface{}{"external_status": ExternalDeadLettered},
+		After:      map[string]interface{}{"external_status": next},
+	})
+	if err != nil {
+		writeJSONError(w, "Failed to resolve dead letter", 1005, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeJSONError(w, "Failed to commit transaction", 1020, http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{"dead_letter_id": id, "transaction_id": transactionID, "external_status": next}
+	if requeue {
+		writeJSONSuccess(w, data, "Dead letter requeued", 2031, http.StatusOK)
+		return
+	}
+
+	leg, err := a.externalLegByTransaction(ctx, transactionID)
+	if err == nil {
+		err = a.compensateExternalLeg(ctx, leg)
+	}
+	if err != nil {
+		// the recovery loop compensates failed legs it finds
+		log.Printf("saga: compensating transaction %d: %v", transactionID, err)
+	} else {
+		data["external_status"] = ExternalCompensated
+		a.notifyTransfer(transactionID)
+	}
+	writeJSONSuccess(w, data, "Dead letter cancelled", 2032, http.StatusOK)
+}
+
+// externalLegByTransaction loads the leg of a transaction for compensation
+func (a *App) externalLegByTransaction(ctx context.Context, transactionID int) (externalLeg, error) {
+	var leg externalLeg
+	err := a.DB.QueryRowContext(ctx, `SELECT e.transaction_id, e.tenant_id, t.from_account, t.amount, e.status, e.attempts
+		FROM external_transfers e JOIN transactions t ON t.id = e.transaction_id WHERE e.transaction_id = $1`, transactionID).
+		Scan(&leg.TransactionID, &leg.TenantID, &leg.FromAccount, &leg.Amount, &leg.Status, &leg.Attempts)
+	return leg, err
+}
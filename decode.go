@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// decodeJSON strictly decodes the request body into dst, a pointer to a
+// struct. Unknown fields, missing required fields, mistyped values and
+// trailing data are reported as field errors under the given error code.
+func decodeJSON(r *http.Request, dst interface{}, code int, required ...string) *apiError {
+	body, err := io.ReadAll(r.Body)
+	if bodyTooLarge(err) {
+		return newAPIError("Request body too large", 1049, http.StatusRequestEntityTooLarge)
+	}
+	if err != nil {
+		return newAPIError("Invalid request payload", code, http.StatusBadRequest)
+	}
+	return decodeBody(body, dst, code, required...)
+}
+
+// decodeBody decodes body into dst as decodeJSON does
+func decodeBody(body []byte, dst interface{}, code int, required ...string) *apiError {
+	var v validator
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		v.check(false, "", "body must be a single JSON object")
+		return payloadError(code, v)
+	}
+
+	known := jsonFieldNames(dst)
+	for name := range fields {
+		v.check(known[name], name, "is not a recognized field")
+	}
+	for _, name := range required {
+		raw, ok := fields[name]
+		v.check(ok && string(raw) != "null", name, "is required")
+	}
+	if len(v.errors) == 0 {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(dst); err != nil {
+			v.errors = append(v.errors, decodeFieldError(err))
+		}
+	}
+	return payloadError(code, v)
+}
+
+// payloadError returns the invalid payload error for the collected field
+// errors, or nil when there are none
+func payloadError(code int, v validator) *apiError {
+	apiErr := v.err()
+	if apiErr != nil {
+		apiErr.Message = "Invalid request payload"
+		apiErr.Code = code
+	}
+	return apiErr
+}
+
+// decodeFieldError describes a json decoding error as a field error
+func decodeFieldError(err error) FieldError {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return FieldError{Field: typeErr.Field, Message: "must be of type " + typeErr.Type.String()}
+	}
+	// nested unknown fields are only reported through the error text
+	if msg := err.Error(); strings.HasPrefix(msg, "json: unknown field ") {
+		name, _ := strconv.Unquote(strings.TrimPrefix(msg, "json: unknown field "))
+		return FieldError{Field: name, Message: "is not a recognized field"}
+	}
+	return FieldError{Message: "malformed JSON"}
+}
+
+// jsonFieldNames returns the top-level JSON keys of the struct dst points to
+func jsonFieldNames(dst interface{}) map[string]bool {
+	names := map[string]bool{}
+	t := reflect.TypeOf(dst).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		names[name] = true
+	}
+	return names
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	rpprof "runtime/pprof"
+	"strings"
+	"time"
+)
+
+// DiagnosticsConfig configures the profiling and runtime diagnostics
+// endpoints under /admin/debug/
+type DiagnosticsConfig struct {
+	Enabled bool `json:"enabled"`
+	// DumpDir receives the dumps written by POST /admin/debug/dump; empty
+	// means the system temporary directory
+	DumpDir string `json:"dump_dir"`
+}
+
+// dumpProfiles are the profiles POST /admin/debug/dump can write, with the
+// pprof debug level each is written at
+var dumpProfiles = map[string]int{
+	"goroutine": 2, // every goroutine's stack as text
+	"heap":      0,
+}
+
+// DumpRequest represents the JSON body of POST /admin/debug/dump
+type DumpRequest struct {
+	Profile string `json:"profile"`
+}
+
+// Dump describes a written dump
+type Dump struct {
+	Profile string    `json:"profile"`
+	Path    string    `json:"path"`
+	Bytes   int64     `json:"bytes"`
+	TakenAt time.Time `json:"taken_at"`
+}
+
+// diagnosticsHandler serves net/http/pprof and expvar, which expect to be
+// mounted at /debug/, under /admin/debug/
+func (a *App) diagnosticsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/dump", a.handleDump)
+	debug := http.StripPrefix("/admin", mux)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.Config.Diagnostics.Enabled {
+			writeJSONError(w, "Not found", 1040, http.StatusNotFound)
+			return
+		}
+		if !requireRole(w, r, RoleAdmin) {
+			return
+		}
+		debug.ServeHTTP(w, r)
+	})
+}
+
+// handleDump serves POST /admin/debug/dump, writing a goroutine or heap dump
+// to the dump directory for later analysis with go tool pprof
+func (a *App) handleDump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, "Only POST method is allowed", 1001, http.StatusMethodNotAllowed)
+		return
+	}
+	var req DumpRequest
+	if apiErr := decodeJSON(r, &req, 1002, "profile"); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	level, ok := dumpProfiles[req.Profile]
+	if !ok {
+		writeJSONError(w, "Profile must be goroutine or heap", 1081, http.StatusBadRequest)
+		return
+	}
+
+	dir := a.Config.Diagnostics.DumpDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	d := Dump{Profile: req.Profile, TakenAt: time.Now().UTC()}
+	d.Path = filepath.Join(dir, fmt.Sprintf("fundtransfer-%s-%s.pprof", d.Profile, d.TakenAt.Format("20060102T150405.000000000")))
+	f, err := os.OpenFile(d.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		writeJSONError(w, "Failed to write dump", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if req.Profile == "heap" {
+		runtime.GC() // report live objects as of now
+	}
+	if err := rpprof.Lookup(req.Profile).WriteTo(f, level); err != nil {
+		writeJSONError(w, "Failed to write dump", 1005, http.StatusInternalServerError)
+		return
+	}
+	if info, err := f.Stat(); err == nil {
+		d.Bytes = info.Size()
+	}
+
+	writeJSONSuccess(w, d, "Dump written", 2033, http.StatusCreated)
+}
+
+// withoutDefaultDebug hides the /debug/ handlers that importing
+// net/http/pprof and expvar registers on the default mux, which would serve
+// them without the admin check
+func withoutDefaultDebug(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/debug/") {
+			writeJSONError(w, "Not found", 1040, http.StatusNotFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
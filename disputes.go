@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Dispute statuses
+const (
+	DisputeOpen     = "open"
+	DisputeReversed = "reversed"
+	DisputeReleased = "released"
+)
+
+// disputeHolds selects the funds of an account of accounts held for open
+// disputes
+const disputeHolds = "(SELECT COALESCE(SUM(d.amount), 0) FROM disputes d WHERE d.account_id = accounts.id AND d.status = '" + DisputeOpen + "')"
+
+// disputeHoldsBesides selects disputeHolds without the hold of dispute
+// disputeID
+func disputeHoldsBesides(disputeID int) string {
+	return "(SELECT COALESCE(SUM(d.amount), 0) FROM disputes d WHERE d.account_id = accounts.id AND d.status = '" + DisputeOpen + "' AND d.id <> " + strconv.Itoa(disputeID) + ")"
+}
+
+// Dispute is a challenge of a completed transfer by its sender. While it is
+// open the disputed amount is held on the destination account, which cannot
+// spend it; a reversal pays it back to the source, a release lifts the hold.
+type Dispute struct {
+	ID              int     `json:"dispute_id"`
+	TransactionID   int     `json:"transaction_id"`
+	FromAccountID   int     `json:"source_account_id"`
+	AccountID       int     `json:"held_account_id"`
+	AccountTenantID string  `json:"held_account_tenant_id"`
+	Amount          float64 `json:"amount"`
+	Reason          string  `json:"reason"`
+	Status          string  `json:"status"`
+	// ReversalTransactionID paid the amount back when the dispute was reversed
+	ReversalTransactionID *int       `json:"reversal_transaction_id,omitempty"`
+	OpenedBy              string     `json:"opened_by"`
+	OpenedAt              time.Time  `json:"opened_at"`
+	ResolvedBy            *string    `json:"resolved_by,omitempty"`
+	ResolvedAt            *time.Time `json:"resolved_at,omitempty"`
+}
+
+// disputeColumns is the column list read by scanDispute
+const disputeColumns = "id, transaction_id, from_account, account_id, account_tenant_id, amount, reason, status, reversal_transaction_id, opened_by, opened_at, resolved_by, resolved_at"
+
+func scanDispute(row rowScanner) (Dispute, error) {
+	var d Dispute
+	err := row.Scan(&d.ID, &d.TransactionID, &d.FromAccountID, &d.AccountID, &d.AccountTenantID, &d.Amount, &d.Reason, &d.Status,
+		&d.ReversalTransactionID, &d.OpenedBy, &d.OpenedAt, &d.ResolvedBy, &d.ResolvedAt)
+	return d, err
+}
+
+// OpenDisputeRequest is the JSON body of POST /transactions/{id}/disputes.
+// Amount defaults to what is left of the transfer after refunds and earlier
+// reversals.
+type OpenDisputeRequest struct {
+	Amount float64 `json:"amount,omitempty"`
+	Reason string  `json:"reason"`
+}
+
+func (req *OpenDisputeRequest) validate() *apiError {
+	var v validator
+	if req.Amount != 0 {
+		v.amount("amount", req.Amount)
+	}
+	v.check(strings.TrimSpace(req.Reason) != "", "reason", "is required")
+	v.check(len(req.Reason) <= maxMemoLength, "reason", fmt.Sprintf("must be at most %d characters", maxMemoLength))
+	return v.err()
+}
+
+// systemAccount reports whether id is one of the configured system accounts
+func (a *App) systemAccount(id int) bool {
+	for _, system := range []int{a.Config.Fees.AccountID, a.Config.External.SettlementAccountID, a.Config.Escrow.AccountID} {
+		if system != 0 && id == system {
+			return true
+		}
+	}
+	return false
+}
+
+// disputeRoute adapts a handler of one dispute to a route with an {id} path
+// parameter
+func disputeRoute(h func(http.ResponseWriter, *http.Request, int)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		disputeID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			writeJSONError(w, "Invalid dispute ID", 1116, http.StatusBadRequest)
+			return
+		}
+		h(w, r, disputeID)
+	}
+}
+
+// handleOpenDispute serves POST /transactions/{id}/disputes. Only the tenant
+// that sent a completed transfer between customer accounts can dispute it,
+// and a transfer has at most one open dispute at a time.
+func (a *App) handleOpenDispute(w http.ResponseWriter, r *http.Request, transactionID int) {
+	var req OpenDisputeRequest
+	if apiErr := decodeJSON(r, &req, 1002, "reason"); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if apiErr := req.validate(); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	d, apiErr := a.openDispute(r.Context(), tenantFromContext(r.Context()), transactionID, req)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	writeJSONSuccess(w, d, "Dispute opened", 2064, http.StatusCreated)
+}
+
+func (a *App) openDispute(ctx context.Context, tenant string, transactionID int, req OpenDisputeRequest) (*Dispute, *apiError) {
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to begin transaction", 1013, http.StatusInternalServerError))
+	}
+	defer tx.Rollback()
+
+	t, err := lockPaidTransfer(ctx, tx, transactionID, tenant, false)
+	if err == sql.ErrNoRows {
+		return nil, newAPIError("Transaction not found", 1044, http.StatusNotFound)
+	}
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to load transaction", 1005, http.StatusInternalServerError))
+	}
+	if !a.returnable(t) {
+		return nil, newAPIError("Only completed transfers between customer accounts can be disputed", 1117, http.StatusConflict)
+	}
+	returned, err := returnedAmount(ctx, tx, transactionID)
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to open dispute", 1005, http.StatusInternalServerError))
+	}
+	left := roundCents(t.Amount - returned)
+	d := Dispute{
+		TransactionID:   transactionID,
+		FromAccountID:   t.FromAccountID,
+		AccountID:       t.ToAccountID,
+		AccountTenantID: t.ToTenantID,
+		Amount:          req.Amount,
+		Reason:          req.Reason,
+		Status:          DisputeOpen,
+		OpenedBy:        principalFromContext(ctx).Name,
+	}
+	if d.Amount == 0 {
+		d.Amount = left
+	}
+	if d.Amount <= 0 || d.Amount > left {
+		return nil, newAPIError("Dispute amount exceeds what is left of the transfer", 1118, http.StatusUnprocessableEntity)
+	}
+
+	err = tx.QueryRowContext(ctx, `INSERT INTO disputes (tenant_id, transaction_id, from_account, account_id, account_tenant_id, amount, reason, status, opened_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id, opened_at`,
+		tenant, d.TransactionID, d.FromAccountID, d.AccountID, d.AccountTenantID, d.Amount, d.Reason, d.Status, d.OpenedBy).Scan(&d.ID, &d.OpenedAt)
+	if pgErr, ok := err.(*pq.Error); ok && pgErr.Code == "23505" {
+		return nil, newAPIError("Transaction already has an open dispute", 1119, http.StatusConflict)
+	}
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to open dispute", 1005, http.StatusInternalServerError))
+	}
+	// the hold lowers what the account can spend, so transfers that read it
+	// before must retry
+	if err := touchAccount(ctx, tx, d.AccountID); err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to open dispute", 1005, http.StatusInternalServerError))
+	}
+	err = a.audit(ctx, tx, auditRecord{
+		TenantID:   tenant,
+		Action:     "dispute." + DisputeOpen,
+		EntityType: "dispute",
+		EntityID:   strconv.Itoa(d.ID),
+		After:      d,
+	})
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to open dispute", 1005, http.StatusInternalServerError))
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to commit transaction", 1020, http.StatusInternalServerError))
+	}
+	a.Cache.invalidate(ctx, d.AccountTenantID, d.AccountID)
+	return &d, nil
+}
+
+// handleGetDispute serves GET /disputes/{id}
+func (a *App) handleGetDispute(w http.ResponseWriter, r *http.Request, disputeID int) {
+	d, err := scanDispute(a.DB.QueryRowContext(r.Context(), "SELECT "+disputeColumns+" FROM disputes WHERE id = $1 AND tenant_id = $2",
+		disputeID, tenantFromContext(r.Context())))
+	if err == sql.ErrNoRows {
+		writeJSONError(w, "Dispute not found", 1120, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "Failed to load dispute", 1005, http.StatusInternalServerError)
+		return
+	}
+	writeJSONSuccess(w, d, "Dispute retrieved", 2065, http.StatusOK)
+}
+
+// handleDisputes serves GET /admin/disputes?status=, the tenant's disputes
+// oldest first; without status it lists the open ones awaiting resolution
+func (a *App) handleDisputes(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = DisputeOpen
+	}
+	if status != DisputeOpen && status != DisputeReversed && status != DisputeReleased {
+		writeJSONError(w, "status must be open, reversed or released", 1002, http.StatusBadRequest)
+		return
+	}
+	page, apiErr := parsePage(r, false)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	cond, orderLimit, cursor := page.keyset("id", 3)
+
+	rows, err := a.DB.QueryContext(r.Context(), "SELECT "+disputeColumns+" FROM disputes WHERE tenant_id = $1 AND status = $2 AND "+cond+" "+orderLimit,
+		tenantFromContext(r.Context()), status, cursor)
+	if err != nil {
+		writeJSONError(w, "Failed to list disputes", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	disputes := []Dispute{}
+	for rows.Next() {
+		d, err := scanDispute(rows)
+		if err != nil {
+			writeJSONError(w, "Failed to list disputes", 1005, http.StatusInternalServerError)
+			return
+		}
+		disputes = append(disputes, d)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, "Failed to list disputes", 1005, http.StatusInternalServerError)
+		return
+	}
+	disputes, pagination := paginate(page, disputes, func(d Dispute) int64 { return int64(d.ID) })
+	writeJSONPage(w, disputes, &pagination, "Disputes retrieved", 2066, http.StatusOK)
+}
+
+// handleResolveDispute serves POST /admin/disputes/{id}/reverse|release
+func (a *App) handleResolveDispute(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+	action := r.PathValue("action")
+	if action != "reverse" && action != "release" {
+		writeJSONError(w, "Not found", 1040, http.StatusNotFound)
+		return
+	}
+	disputeRoute(func(w http.ResponseWriter, r *http.Request, disputeID int) {
+		status, message, code := DisputeReleased, "Dispute released", 2068
+		if action == "reverse" {
+			status, message, code = DisputeReversed, "Dispute reversed", 2067
+		}
+		d, apiErr := a.resolveDispute(r.Context(), tenantFromContext(r.Context()), disputeID, status)
+		if apiErr != nil {
+			writeAPIError(w, apiErr)
+			return
+		}
+		writeJSONSuccess(w, d, message, code, http.StatusOK)
+	})(w, r)
+}
+
+// resolveDispute closes an open dispute, lifting its hold. A reversal also
+// pays the disputed amount from the held account back to the source, which
+// needs the held account to have it outside its wallets. The dispute row is
+// locked, so it is resolved at most once.
+func (a *App) resolveDispute(ctx context.Context, tenant string, disputeID int, status string) (*Dispute, *apiError) {
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to begin transaction", 1013, http.StatusInternalServerError))
+	}
+	defer tx.Rollback()
+
+	d, err := scanDispute(tx.QueryRowContext(ctx, "SELECT "+disputeColumns+" FROM disputes WHERE id = $1 AND tenant_id = $2 FOR UPDATE", disputeID, tenant))
+	if err == sql.ErrNoRows {
+		return nil, newAPIError("Dispute not found", 1120, http.StatusNotFound)
+	}
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to load dispute", 1005, http.StatusInternalServerError))
+	}
+	if d.Status != DisputeOpen {
+		return nil, newAPIError("Dispute already resolved", 1121, http.StatusConflict)
+	}
+
+	var transactionID int
+	if status == DisputeReversed {
+		var apiErr *apiError
+		if transactionID, apiErr = a.reverseDispute(ctx, tx, tenant, d); apiErr != nil {
+			return nil, apiErr
+		}
+		d.ReversalTransactionID = &transactionID
+	} else if err := touchAccount(ctx, tx, d.AccountID); err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to resolve dispute", 1005, http.StatusInternalServerError))
+	}
+
+	resolvedBy := principalFromContext(ctx).Name
+	err = tx.QueryRowContext(ctx, "UPDATE disputes SET status = $1, reversal_transaction_id = $2, resolved_by = $3, resolved_at = NOW() WHERE id = $4 RETURNING resolved_at",
+		status, d.ReversalTransactionID, resolvedBy, d.ID).Scan(&d.ResolvedAt)
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to resolve dispute", 1005, http.StatusInternalServerError))
+	}
+	d.Status, d.ResolvedBy = status, &resolvedBy
+	err = a.audit(ctx, tx, auditRecord{
+		TenantID:   tenant,
+		Action:     "dispute." + status,
+		EntityType: "dispute",
+		EntityID:   strconv.Itoa(d.ID),
+		Before:     map[string]interface{}{"status": DisputeOpen},
+		After:      d,
+	})
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to resolve dispute", 1005, http.StatusInternalServerError))
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to commit transaction", 1020, http.StatusInternalServerError))
+	}
+	a.Cache.invalidate(ctx, d.AccountTenantID, d.AccountID)
+	if status == DisputeReversed {
+		a.Cache.invalidate(ctx, tenant, d.FromAccountID)
+		a.notifyTransfer(transactionID)
+	}
+	return &d, nil
+}
+
+// reverseDispute pays the disputed amount from the held account back to the
+// source, referenced DSP-{id}. The hold being lifted is not counted against
+// the held account, its other holds and wallets are.
+func (a *App) reverseDispute(ctx context.Context, tx *sql.Tx, tenant string, d Dispute) (int, *apiError) {
+	t := paidTransfer{
+		ID:            d.TransactionID,
+		FromAccountID: d.FromAccountID,
+		TenantID:      tenant,
+		ToAccountID:   d.AccountID,
+		ToTenantID:    d.AccountTenantID,
+	}
+	return a.payBack(ctx, tx, t, d.Amount, "DSP-"+strconv.Itoa(d.ID), "", reservedFundsBesides(d.ID))
+}
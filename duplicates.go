@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+)
+
+// findDuplicate looks for a transfer of tenant with the source, destination
+// and amount of tr made within the duplicate window, failed ones aside, and
+// returns the 409 naming it. It is a heuristic against double submissions
+// by clients without Idempotency-Key: two requests racing each other can
+// both pass. External transfers all go to the settlement account, so they
+// are not compared.
+func (a *App) findDuplicate(ctx context.Context, tenant string, tr TransferRequest) *apiError {
+	window := a.Config.Limits.DuplicateWindowSeconds
+	if window == 0 || tr.AllowDuplicate || tr.External != nil {
+		return nil
+	}
+	// errors resolving the accounts are reported by the transfer itself
+	toTenant, apiErr := a.resolveTransfer(tenant, &tr)
+	if apiErr != nil {
+		return nil
+	}
+	var prior struct {
+		ID        int       `json:"transaction_id"`
+		Status    string    `json:"status"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	err := a.DB.QueryRowContext(ctx, `SELECT id, status, created_at FROM transactions
+		WHERE tenant_id = $1 AND to_tenant_id = $2 AND from_account = $3 AND to_account = $4 AND amount = $5 AND status <> $6
+		AND created_at > NOW() - make_interval(secs => $7) ORDER BY id DESC LIMIT 1`,
+		tenant, toTenant, tr.FromAccountID, tr.ToAccountID, tr.Amount, TxFailed, window).Scan(&prior.ID, &prior.Status, &prior.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return dbWriteError(err, newAPIError("Failed to check for duplicate transfers", 1005, http.StatusInternalServerError))
+	}
+	apiErr = newAPIError("Duplicate transfer; set allow_duplicate to make it anyway", 1124, http.StatusConflict)
+	apiErr.Data = prior
+	return apiErr
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"internal-transfers/transfer"
+)
+
+// Escrow statuses
+const (
+	EscrowHeld     = "held"
+	EscrowReleased = "released"
+	EscrowRefunded = "refunded"
+)
+
+// EscrowConfig configures escrows. Held funds sit in AccountID, a system
+// account outside any tenant like the settlement account; escrows are
+// disabled while it is 0.
+type EscrowConfig struct {
+	AccountID int `json:"account_id"`
+}
+
+// EscrowRequest is the JSON body of POST /escrows. The accounts are given as
+// in a transfer; Condition states what has to happen before the funds are
+// released, and ReleaseAfter, when set, is the earliest release time.
+type EscrowRequest struct {
+	FromAccountID int        `json:"source_account_id"`
+	ToAccountID   int        `json:"destination_account_id"`
+	Amount        float64    `json:"amount"`
+	FromIBAN      string     `json:"source_iban,omitempty"`
+	ToIBAN        string     `json:"destination_iban,omitempty"`
+	FromAlias     string     `json:"source_alias,omitempty"`
+	ToAlias       string     `json:"destination_alias,omitempty"`
+	ToTenantID    string     `json:"destination_tenant_id,omitempty"`
+	Reference     string     `json:"reference,omitempty"`
+	Memo          string     `json:"memo,omitempty"`
+	Condition     string     `json:"condition"`
+	ReleaseAfter  *time.Time `json:"release_after,omitempty"`
+}
+
+// transfer returns the transfer funding the escrow
+func (req EscrowRequest) transfer() TransferRequest {
+	return TransferRequest{
+		FromAccountID: req.FromAccountID,
+		ToAccountID:   req.ToAccountID,
+		Amount:        req.Amount,
+		FromIBAN:      req.FromIBAN,
+		ToIBAN:        req.ToIBAN,
+		FromAlias:     req.FromAlias,
+		ToAlias:       req.ToAlias,
+		ToTenantID:    req.ToTenantID,
+		Reference:     req.Reference,
+		Memo:          req.Memo,
+	}
+}
+
+func (req EscrowRequest) validate(limits LimitsConfig) *apiError {
+	var v validator
+	tr := req.transfer()
+	if apiErr := tr.validate(limits); apiErr != nil {
+		v.errors = apiErr.Errors
+	}
+	v.check(strings.TrimSpace(req.Condition) != "", "condition", "is required")
+	v.check(len(req.Condition) <= maxMemoLength, "condition", fmt.Sprintf("must be at most %d characters", maxMemoLength))
+	return v.err()
+}
+
+// Escrow is a held amount with the transactions that hold and settle it
+type Escrow struct {
+	ID            int        `json:"escrow_id"`
+	FromAccountID int        `json:"source_account_id"`
+	ToAccountID   int        `json:"destination_account_id"`
+	ToTenantID    string     `json:"destination_tenant_id"`
+	Amount        float64    `json:"amount"`
+	Fee           float64    `json:"fee"`
+	Condition     string     `json:"condition"`
+	ReleaseAfter  *time.Time `json:"release_after,omitempty"`
+	Status        string     `json:"status"`
+	// HoldTransactionID moved the funds into escrow; SettlementTransactionID
+	// moved them on to the destination or back to the source
+	HoldTransactionID       int        `json:"hold_transaction_id"`
+	SettlementTransactionID *int       `json:"settlement_transaction_id,omitempty"`
+	CreatedBy               string     `json:"created_by"`
+	CreatedAt               time.Time  `json:"created_at"`
+	SettledBy               *string    `json:"settled_by,omitempty"`
+	SettledAt               *time.Time `json:"settled_at,omitempty"`
+}
+
+// escrowColumns is the column list read by scanEscrow
+const escrowColumns = "id, from_account, to_account, to_tenant_id, amount, fee, condition, release_after, status, hold_transaction_id, settlement_transaction_id, created_by, created_at, settled_by, settled_at"
+
+func scanEscrow(row rowScanner) (Escrow, error) {
+	var e Escrow
+	err := row.Scan(&e.ID, &e.FromAccountID, &e.ToAccountID, &e.ToTenantID, &e.Amount, &e.Fee, &e.Condition, &e.ReleaseAfter, &e.Status,
+		&e.HoldTransactionID, &e.SettlementTransactionID, &e.CreatedBy, &e.CreatedAt, &e.SettledBy, &e.SettledAt)
+	return e, err
+}
+
+// escrowRoute adapts a handler of one escrow to a route with an {id} path
+// parameter
+func escrowRoute(h func(http.ResponseWriter, *http.Request, int)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		escrowID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			writeJSONError(w, "Invalid escrow ID", 1107, http.StatusBadRequest)
+			return
+		}
+		h(w, r, escrowID)
+	}
+}
+
+// handleCreateEscrow serves POST /escrows, moving the amount from the source
+// into the escrow account until the escrow is released or refunded
+func (a *App) handleCreateEscrow(w http.ResponseWriter, r *http.Request) {
+	var req EscrowRequest
+	if apiErr := decodeJSON(r, &req, 1012, "amount", "condition"); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	e, apiErr := a.holdEscrow(r.Context(), tenantFromContext(r.Context()), req)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	writeJSONSuccess(w, e, "Escrow created", 2056, http.StatusCreated)
+}
+
+// holdEscrow funds an escrow with a transfer from the source account into
+// the escrow account, charged and risk checked like any transfer. The escrow
+// is recorded in the same transaction.
+func (a *App) holdEscrow(ctx context.Context, tenant string, req EscrowRequest) (*Escrow, *apiError) {
+	escrowAccount := a.Config.Escrow.AccountID
+	if escrowAccount == 0 {
+		return nil, newAPIError("Escrows are not enabled", 1106, http.StatusBadRequest)
+	}
+	if apiErr := req.validate(a.Config.Limits); apiErr != nil {
+		return nil, apiErr
+	}
+	// a release moves the funds without another check, so escrows must not
+	// become a way around the holds of large transfers
+	if a.Config.StepUp.required(req.Amount) || a.Config.Approval.required(req.Amount) {
+		return nil, newAPIError("Escrow amount requires approval or confirmation", 1111, http.StatusUnprocessableEntity)
+	}
+
+	tr := req.transfer()
+	toTenant, apiErr := a.resolveTransfer(tenant, &tr)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	// the destination is only credited on release, so check it exists now
+	var exists bool
+	err := a.DB.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM accounts WHERE id = $1 AND tenant_id = $2 AND closed_at IS NULL)", tr.ToAccountID, toTenant).Scan(&exists)
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to load accounts", 1009, http.StatusInternalServerError))
+	}
+	if !exists {
+		return nil, newAPIError("Destination account not found", 1017, http.StatusNotFound)
+	}
+	fee := a.transferFee(tenant, tr.Amount)
+	e := &Escrow{
+		FromAccountID: tr.FromAccountID,
+		ToAccountID:   tr.ToAccountID,
+		ToTenantID:    toTenant,
+		Amount:        tr.Amount,
+		Fee:           fee,
+		Condition:     strings.TrimSpace(req.Condition),
+		ReleaseAfter:  req.ReleaseAfter,
+		Status:        EscrowHeld,
+		CreatedBy:     principalFromContext(ctx).Name,
+	}
+
+	store := &transferStore{a: a, tr: tr, status: TxCompleted}
+	store.link = func(ctx context.Context, tx *sql.Tx, transactionID int) error {
+		e.HoldTransactionID = transactionID
+		err := tx.QueryRowContext(ctx, `INSERT INTO escrows (tenant_id, from_account, to_account, to_tenant_id, amount, fee, condition, release_after, status, hold_transaction_id, created_by)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id, created_at`,
+			tenant, e.FromAccountID, e.ToAccountID, e.ToTenantID, e.Amount, e.Fee, e.Condition, e.ReleaseAfter, e.Status, e.HoldTransactionID, e.CreatedBy).
+			Scan(&e.ID, &e.CreatedAt)
+		if err != nil {
+			return err
+		}
+		return a.audit(ctx, tx, auditRecord{
+			TenantID:   tenant,
+			Action:     "escrow." + EscrowHeld,
+			EntityType: "escrow",
+			EntityID:   strconv.Itoa(e.ID),
+			After:      e,
+		})
+	}
+	svc := transfer.Service{
+		Store: store,
+		Check: a.riskCheck(RiskInput{
+			TenantID:    tenant,
+			ToAccountID: tr.ToAccountID,
+			ToTenantID:  toTenant,
+			Amount:      tr.Amount,
+			Fee:         fee,
+		}),
+	}
+	_, err = svc.Execute(ctx, transfer.Transfer{
+		Tenant:     tenant,
+		ToTenant:   tenant,
+		From:       tr.FromAccountID,
+		To:         escrowAccount,
+		Amount:     tr.Amount,
+		Fee:        fee,
+		FeeAccount: a.Config.Fees.AccountID,
+		Settlement: true,
+	})
+	if err != nil {
+		if transfer.StepOf(err) == transfer.StepSettlement && errors.Unwrap(err) == nil {
+			return nil, newAPIError("Escrow account not found", 1112, http.StatusInternalServerError)
+		}
+		return nil, transferAPIError(err)
+	}
+	a.Cache.invalidate(ctx, tenant, tr.FromAccountID, a.Config.Fees.AccountID)
+	a.notifyTransfer(e.HoldTransactionID)
+	return e, nil
+}
+
+// handleGetEscrow serves GET /escrows/{id}
+func (a *App) handleGetEscrow(w http.ResponseWriter, r *http.Request, escrowID int) {
+	e, err := scanEscrow(a.DB.QueryRowContext(r.Context(), "SELECT "+escrowColumns+" FROM escrows WHERE id = $1 AND tenant_id = $2",
+		escrowID, tenantFromContext(r.Context())))
+	if err == sql.ErrNoRows {
+		writeJSONError(w, "Escrow not found", 1108, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "Failed to load escrow", 1005, http.StatusInternalServerError)
+		return
+	}
+	writeJSONSuccess(w, e, "Escrow retrieved", 2057, http.StatusOK)
+}
+
+// handleReleaseEscrow serves POST /escrows/{id}/release, paying the held
+// amount to the destination
+func (a *App) handleReleaseEscrow(w http.ResponseWriter, r *http.Request, escrowID int) {
+	e, apiErr := a.settleEscrow(r.Context(), tenantFromContext(r.Context()), escrowID, EscrowReleased)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	writeJSONSuccess(w, e, "Escrow released", 2058, http.StatusOK)
+}
+
+// handleRefundEscrow serves POST /escrows/{id}/refund, returning the held
+// amount to the source. The fee is not refunded.
+func (a *App) handleRefundEscrow(w http.ResponseWriter, r *http.Request, escrowID int) {
+	e, apiErr := a.settleEscrow(r.Context(), tenantFromContext(r.Context()), escrowID, EscrowRefunded)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	writeJSONSuccess(w, e, "Escrow refunded", 2059, http.StatusOK)
+}
+
+// settleEscrow moves a held escrow out of the escrow account, to the
+// destination when status is released and back to the source when it is
+// refunded. The escrow row is locked, so it is settled at most once.
+func (a *App) settleEscrow(ctx context.Context, tenant string, escrowID int, status string) (*Escrow, *apiError) {
+	escrowAccount := a.Config.Escrow.AccountID
+	if escrowAccount == 0 {
+		return nil, newAPIError("Escrows are not enabled", 1106, http.StatusBadRequest)
+	}
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to begin transaction", 1013, http.StatusInternalServerError))
+	}
+	defer tx.Rollback()
+
+	e, err := scanEscrow(tx.QueryRowContext(ctx, "SELECT "+escrowColumns+" FROM escrows WHERE id = $1 AND tenant_id = $2 FOR UPDATE", escrowID, tenant))
+	if err == sql.ErrNoRows {
+		return nil, newAPIError("Escrow not found", 1108, http.StatusNotFound)
+	}
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to load escrow", 1005, http.StatusInternalServerError))
+	}
+	if e.Status != EscrowHeld {
+		return nil, newAPIError("Escrow already settled", 1109, http.StatusConflict)
+	}
+	if status == EscrowReleased && e.ReleaseAfter != nil && time.Now().Before(*e.ReleaseAfter) {
+		return nil, newAPIError("Escrow cannot be released before its release time", 1110, http.StatusConflict)
+	}
+
+	to, toTenant := e.ToAccountID, e.ToTenantID
+	missing := newAPIError("Destination account not found", 1017, http.StatusNotFound)
+	if status == EscrowRefunded {
+		to, toTenant = e.FromAccountID, tenant
+		missing = newAPIError("Source account not found", 1014, http.StatusNotFound)
+	}
+	if err := a.lockAccounts(ctx, tx, toTenant, to); err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to lock accounts", 1013, http.StatusInternalServerError))
+	}
+	// the new version fails the guarded updates of transfers that read the
+	// account before
+	result, err := tx.ExecContext(ctx, "UPDATE accounts SET balance = balance + $1, last_updated = "+nextVersion+" WHERE id = $2 AND tenant_id = $3 AND closed_at IS NULL",
+		e.Amount, to, toTenant)
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to settle escrow", 1005, http.StatusInternalServerError))
+	}
+	if affectedRows(result, nil) == 0 {
+		return nil, missing
+	}
+	// the escrow account is a hot system account, updated relatively
+	result, err = tx.ExecContext(ctx, "UPDATE accounts SET balance = balance - $1, last_updated = NOW() WHERE id = $2", e.Amount, escrowAccount)
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to settle escrow", 1005, http.StatusInternalServerError))
+	}
+	if affectedRows(result, nil) == 0 {
+		return nil, newAPIError("Escrow account not found", 1112, http.StatusInternalServerError)
+	}
+
+	var transactionID int
+	err = tx.StmtContext(ctx, a.Stmts.insertTransaction).QueryRowContext(ctx,
+		escrowAccount, to, e.Amount, tenant, toTenant, TxCompleted, "ESC-"+strconv.Itoa(e.ID), "").Scan(&transactionID)
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to log transaction", 1019, http.StatusInternalServerError))
+	}
+	if err := a.appendEvents(ctx, tx, transferEvents(escrowAccount, to, e.Amount, transactionID)...); err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to settle escrow", 1005, http.StatusInternalServerError))
+	}
+
+	settledBy := principalFromContext(ctx).Name
+	err = tx.QueryRowContext(ctx, "UPDATE escrows SET status = $1, settlement_transaction_id = $2, settled_by = $3, settled_at = NOW() WHERE id = $4 RETURNING settled_at",
+		status, transactionID, settledBy, e.ID).Scan(&e.SettledAt)
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to settle escrow", 1005, http.StatusInternalServerError))
+	}
+	e.Status, e.SettlementTransactionID, e.SettledBy = status, &transactionID, &settledBy
+	err = a.audit(ctx, tx, auditRecord{
+		TenantID:   tenant,
+		Action:     "escrow." + status,
+		EntityType: "escrow",
+		EntityID:   strconv.Itoa(e.ID),
+		Before:     map[string]interface{}{"status": EscrowHeld},
+		After:      e,
+	})
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to settle escrow", 1005, http.StatusInternalServerError))
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to commit transaction", 1020, http.StatusInternalServerError))
+	}
+	a.Cache.invalidate(ctx, toTenant, to)
+	a.notifyTransfer(transactionID)
+	return &e, nil
+}
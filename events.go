@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Postgres notification channels the database triggers publish on
+const (
+	balanceChannel  = "account_balances"
+	transferChannel = "account_transfers"
+)
+
+// Types of account events
+const (
+	EventBalance  = "balance"
+	EventTransfer = "transfer"
+)
+
+// sseHeartbeat is how often an idle event stream sends a keepalive comment
+const sseHeartbeat = 15 * time.Second
+
+// BalanceEvent is a change of an account's balance
+type BalanceEvent struct {
+	AccountID   int       `json:"account_id"`
+	TenantID    string    `json:"tenant_id"`
+	Balance     float64   `json:"balance"`
+	LastUpdated time.Time `json:"last_updated"`
+}
+
+// TransferEvent is a transaction recorded or changing status
+type TransferEvent struct {
+	TransactionID        int     `json:"transaction_id"`
+	SourceAccountID      *int    `json:"source_account_id"`
+	DestinationAccountID *int    `json:"destination_account_id"`
+	TenantID             string  `json:"tenant_id"`
+	ToTenantID           string  `json:"to_tenant_id"`
+	Amount               float64 `json:"amount"`
+	Status               string  `json:"status"`
+}
+
+// accountEvent is an event routed to the subscribers of one account
+type accountEvent struct {
+	Type string
+	Data json.RawMessage
+}
+
+type accountKey struct {
+	tenant string
+	id     int
+}
+
+// subscriber receives the events of the accounts it is subscribed to.
+// Overflow is closed the first time an event is dropped because the
+// subscriber fell behind.
+type subscriber struct {
+	events   chan accountEvent
+	overflow chan struct{}
+	once     sync.Once
+}
+
+func newSubscriber(buffer int) *subscriber {
+	return &subscriber{events: make(chan accountEvent, buffer), overflow: make(chan struct{})}
+}
+
+// accountHub fans account events out to their subscribers
+type accountHub struct {
+	mu   sync.Mutex
+	subs map[accountKey]map[*subscriber]struct{}
+
+	// onBalance and onReconnect, when set before listen, observe every
+	// balance change and every listener reconnect
+	onBalance   func(BalanceEvent)
+	onReconnect func()
+}
+
+func newAccountHub() *accountHub {
+	return &accountHub{subs: map[accountKey]map[*subscriber]struct{}{}}
+}
+
+// subscribe routes the account's events to s until the returned function is
+// called
+func (h *accountHub) subscribe(s *subscriber, tenant string, accountID int) func() {
+	key := accountKey{tenant, accountID}
+
+	h.mu.Lock()
+	if h.subs[key] == nil {
+		h.subs[key] = map[*subscriber]struct{}{}
+	}
+	h.subs[key][s] = struct{}{}
+	h.mu.Unlock()
+
+	return func() {
+		h.mu.Lock()
+		delete(h.subs[key], s)
+		if len(h.subs[key]) == 0 {
+			delete(h.subs, key)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// publish delivers an event to every subscriber of the account without
+// blocking on slow ones
+func (h *accountHub) publish(tenant string, accountID int, e accountEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs[accountKey{tenant, accountID}] {
+		select {
+		case s.events <- e:
+		default:
+			s.once.Do(func() { close(s.overflow) })
+		}
+	}
+}
+
+// listen relays the account notifications of the database to the hub until
+// ctx is cancelled. Using LISTEN/NOTIFY instead of publishing from the
+// handlers makes changes committed by other replicas visible too. The DSN is
+// resolved again whenever the listener fails to connect, so it follows
+// rotated credentials.
+func (h *accountHub) listen(ctx context.Context, resolve func(context.Context) (string, error)) {
+	for {
+		dsn, err := resolve(ctx)
+		if err != nil {
+			log.Printf("account events: %v", err)
+		} else {
+			h.listenOn(ctx, dsn)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+		// notifications sent meanwhile are lost
+		if h.onReconnect != nil {
+			h.onReconnect()
+		}
+	}
+}
+
+// listenOn relays notifications over one listener until ctx is cancelled or
+// a connection attempt fails. Closing the listener then also releases Listen,
+// which waits for a connection.
+func (h *accountHub) listenOn(ctx context.Context, dsn string) {
+	failed := make(chan struct{}, 1)
+	listener := pq.NewListener(dsn, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("account events: %v", err)
+		}
+		if ev == pq.ListenerEventConnectionAttemptFailed {
+			select {
+			case failed <- struct{}{}:
+			default:
+			}
+		}
+	})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-failed:
+		case <-done:
+		}
+		listener.Close()
+	}()
+	for _, channel := range []string{balanceChannel, transferChannel} {
+		if err := listener.Listen(channel); err != nil {
+			log.Printf("account events: listen %s: %v", channel, err)
+			return
+		}
+	}
+
+	for n := range listener.Notify {
+		if n == nil {
+			// reconnected; notifications sent meanwhile are lost
+			if h.onReconnect != nil {
+				h.onReconnect()
+			}
+			continue
+		}
+		if err := h.relay(n.Channel, []byte(n.Extra)); err != nil {
+			log.Printf("account events: decode %s: %v", n.Channel, err)
+		}
+	}
+}
+
+func (h *accountHub) relay(channel string, payload []byte) error {
+	switch channel {
+	case balanceChannel:
+		var e BalanceEvent
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return err
+		}
+		if h.onBalance != nil {
+			h.onBalance(e)
+		}
+		h.publish(e.TenantID, e.AccountID, accountEvent{Type: EventBalance, Data: payload})
+	case transferChannel:
+		var e TransferEvent
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return err
+		}
+		ev := accountEvent{Type: EventTransfer, Data: payload}
+		if e.SourceAccountID != nil {
+			h.publish(e.TenantID, *e.SourceAccountID, ev)
+		}
+		if e.DestinationAccountID != nil {
+			h.publish(e.ToTenantID, *e.DestinationAccountID, ev)
+		}
+	}
+	return nil
+}
+
+// handleAccountEvents serves GET /accounts/{id}/events, a Server-Sent Events
+// stream that starts with the current balance and pushes every change
+func (a *App) handleAccountEvents(w http.ResponseWriter, r *http.Request, accountID int) {
+	ctx := r.Context()
+	tenant := tenantFromContext(ctx)
+
+	// subscribe before reading the balance so no change slips in between.
+	// Each balance event carries the full balance, so events dropped while
+	// the client lags are made up for by the next one.
+	sub := newSubscriber(16)
+	defer a.Events.subscribe(sub, tenant, accountID)()
+
+	current := BalanceEvent{AccountID: accountID, TenantID: tenant}
+	err := a.DB.QueryRowContext(ctx, "SELECT balance, last_updated FROM accounts WHERE id = $1 AND tenant_id = $2", accountID, tenant).
+		Scan(&current.Balance, &current.LastUpdated)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, "Account not found", 1010, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "Failed to load account", 1005, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+
+	data, err := json.Marshal(current)
+	if err != nil {
+		return
+	}
+	// the stream outlives the server's write timeout, so every write gets
+	// its own
+	a.extendWriteDeadline(rc)
+	if err := writeSSE(w, EventBalance, data); err != nil || rc.Flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-sub.events:
+			if e.Type != EventBalance {
+				continue
+			}
+			a.extendWriteDeadline(rc)
+			err = writeSSE(w, e.Type, e.Data)
+		case <-heartbeat.C:
+			a.extendWriteDeadline(rc)
+			_, err = fmt.Fprint(w, ": ping\n\n")
+		}
+		if err != nil || rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+func writeSSE(w http.ResponseWriter, event string, data []byte) error {
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Account event types
+const (
+	EventAccountCreated = "AccountCreated"
+	EventFundsDebited   = "FundsDebited"
+	EventFundsCredited  = "FundsCredited"
+)
+
+// EventSourcingConfig enables the account event store. Every balance change is
+// then also appended as an event, and the balance column of accounts becomes a
+// projection that can be rebuilt by replaying the events.
+type EventSourcingConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+// queryer is implemented by *sql.DB and *sql.Tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// AccountEvent is one change to an account in its event stream. Version
+// numbers the events of an account from 1.
+type AccountEvent struct {
+	AccountID     int       `json:"account_id"`
+	Version       int       `json:"version"`
+	Type          string    `json:"type"`
+	Amount        float64   `json:"amount"`
+	TransactionID *int      `json:"transaction_id,omitempty"`
+	OccurredAt    time.Time `json:"occurred_at"`
+}
+
+// AccountState is an account as derived by replaying its events
+type AccountState struct {
+	AccountID   int       `json:"account_id"`
+	Balance     float64   `json:"balance"`
+	Version     int       `json:"version"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastEventAt time.Time `json:"last_event_at"`
+}
+
+// apply folds e into the state
+func (s *AccountState) apply(e AccountEvent) {
+	switch e.Type {
+	case EventAccountCreated:
+		s.Balance = e.Amount
+		s.CreatedAt = e.OccurredAt
+	case EventFundsDebited:
+		s.Balance = roundCents(s.Balance - e.Amount)
+	case EventFundsCredited:
+		s.Balance = roundCents(s.Balance + e.Amount)
+	}
+	s.Version = e.Version
+	s.LastEventAt = e.OccurredAt
+}
+
+// appendEvents appends events within tx, after the account rows were updated
+// so that their row locks serialize the versions of each stream. It does
+// nothing while event sourcing is disabled.
+func (a *App) appendEvents(ctx context.Context, tx *sql.Tx, events ...AccountEvent) error {
+	if !a.Config.EventSourcing.Enabled {
+		return nil
+	}
+	for _, e := range events {
+		_, err := tx.ExecContext(ctx, `INSERT INTO account_events (account_id, tenant_id, version, type, amount, transaction_id)
+			SELECT id, tenant_id, COALESCE((SELECT MAX(version) FROM account_events WHERE account_id = $1), 0) + 1, $2, $3, $4
+			FROM accounts WHERE id = $1`, e.AccountID, e.Type, e.Amount, e.TransactionID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transferEvents returns the debit of from and credit of to for a movement
+// recorded under transactionID
+func transferEvents(from, to int, amount float64, transactionID int) []AccountEvent {
+	return []AccountEvent{
+		{AccountID: from, Type: EventFundsDebited, Amount: amount, TransactionID: &transactionID},
+		{AccountID: to, Type: EventFundsCredited, Amount: amount, TransactionID: &transactionID},
+	}
+}
+
+// seedAccountEvents starts the streams of accounts that predate event
+// sourcing with an AccountCreated event carrying their current balance.
+// Writers are locked out meanwhile so no balance changes unrecorded.
+func (a *App) seedAccountEvents(ctx context.Context) error {
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "LOCK TABLE accounts IN SHARE MODE"); err != nil {
+		return err
+	}
+	result, err := tx.ExecContext(ctx, `INSERT INTO account_events (account_id, tenant_id, version, type, amount)
+		SELECT id, tenant_id, 1, $1, balance FROM accounts a
+		WHERE NOT EXISTS (SELECT 1 FROM account_events e WHERE e.account_id = a.id)`, EventAccountCreated)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("event store: seeded %d existing accounts", n)
+	}
+	return tx.Commit()
+}
+
+// accountEvents returns the events of an account up to and including at
+func accountEvents(ctx context.Context, q queryer, tenant string, accountID int, at time.Time) ([]AccountEvent, error) {
+	rows, err := q.QueryContext(ctx, `SELECT account_id, version, type, amount, transaction_id, occurred_at FROM account_events
+		WHERE account_id = $1 AND tenant_id = $2 AND occurred_at <= $3 ORDER BY version`, accountID, tenant, at)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AccountEvent{}
+	for rows.Next() {
+		var e AccountEvent
+		var transactionID sql.NullInt64
+		if err := rows.Scan(&e.AccountID, &e.Version, &e.Type, &e.Amount, &transactionID, &e.OccurredAt); err != nil {
+			return nil, err
+		}
+		if transactionID.Valid {
+			id := int(transactionID.Int64)
+			e.TransactionID = &id
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// replayAccount derives the state of an account at an instant from its
+// events. It returns sql.ErrNoRows when the stream does not reach back to at.
+func replayAccount(ctx context.Context, q queryer, tenant string, accountID int, at time.Time) (*AccountState, []AccountEvent, error) {
+	events, err := accountEvents(ctx, q, tenant, accountID, at)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(events) == 0 {
+		return nil, nil, sql.ErrNoRows
+	}
+	state := &AccountState{AccountID: accountID}
+	for _, e := range events {
+		state.apply(e)
+	}
+	return state, events, nil
+}
+
+// AccountReplay is the response of the replay endpoint
+type AccountReplay struct {
+	AsOf   time.Time      `json:"as_of"`
+	State  *AccountState  `json:"state"`
+	Events []AccountEvent `json:"events"`
+}
+
+// handleAccountReplay serves GET /accounts/{id}/replay?as_of=TIMESTAMP, the
+// account's events up to as_of (default now) and the state they fold into
+func (a *App) handleAccountReplay(w http.ResponseWriter, r *http.Request, accountID int) {
+	if !a.Config.EventSourcing.Enabled {
+		writeJSONError(w, "Event sourcing is not enabled", 1074, http.StatusNotFound)
+		return
+	}
+	result := AccountReplay{AsOf: time.Now().UTC()}
+	if v := r.URL.Query().Get("as_of"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			writeJSONError(w, "Invalid as_of, expected an RFC 3339 timestamp", 1068, http.StatusBadRequest)
+			return
+		}
+		result.AsOf = t
+	}
+
+	var err error
+	result.State, result.Events, err = replayAccount(r.Context(), a.DB, tenantFromContext(r.Context()), accountID, result.AsOf)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, "Account not found", 1010, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "Failed to replay account", 1005, http.StatusInternalServerError)
+		return
+	}
+	writeJSONSuccess(w, result, "Account replayed", 2027, http.StatusOK)
+}
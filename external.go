@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Payment rails for transfers leaving the bank
+const (
+	RailACH  = "ach"
+	RailWire = "wire" // international wire, sent as a SWIFT MT103
+)
+
+// ExternalConfig configures transfers to accounts at other institutions.
+// Outbound funds are debited from the source and credited to the settlement
+// account until the payment file is settled with the clearing house.
+type ExternalConfig struct {
+	SettlementAccountID int           `json:"settlement_account_id"`
+	ACH                 ACHConfig     `json:"ach"`
+	Wire                WireConfig    `json:"wire"`
+	Gateway             GatewayConfig `json:"gateway"`
+}
+
+// ExternalDestination identifies the beneficiary of an outbound transfer
+type ExternalDestination struct {
+	Rail          string `json:"rail"`
+	RoutingNumber string `json:"routing_number,omitempty"`
+	AccountNumber string `json:"account_number,omitempty"`
+	AccountType   string `json:"account_type,omitempty"` // checking or savings
+	BIC           string `json:"bic,omitempty"`
+	IBAN          string `json:"iban,omitempty"`
+	Name          string `json:"name"`
+}
+
+// validate checks the beneficiary details required by the rail
+func (d *ExternalDestination) validate() error {
+	if d.Rail == "" {
+		d.Rail = RailACH
+	}
+	d.Name = strings.TrimSpace(d.Name)
+	if d.Name == "" {
+		return fmt.Errorf("beneficiary name is required")
+	}
+
+	switch d.Rail {
+	case RailACH:
+		if !validRoutingNumber(d.RoutingNumber) {
+			return fmt.Errorf("invalid routing number")
+		}
+		if d.AccountNumber == "" || len(d.AccountNumber) > 17 {
+			return fmt.Errorf("account number must be 1 to 17 characters")
+		}
+		if d.AccountType == "" {
+			d.AccountType = "checking"
+		}
+		if d.AccountType != "checking" && d.AccountType != "savings" {
+			return fmt.Errorf("account type must be checking or savings")
+		}
+	case RailWire:
+		d.BIC = strings.ToUpper(d.BIC)
+		if !validBIC(d.BIC) {
+			return fmt.Errorf("invalid BIC")
+		}
+		if d.IBAN != "" {
+			iban, err := normalizeIBAN(d.IBAN)
+			if err != nil {
+				return err
+			}
+			d.IBAN = iban
+		} else if d.AccountNumber == "" || len(d.AccountNumber) > 34 {
+			return fmt.Errorf("an IBAN or an account number of up to 34 characters is required")
+		}
+	default:
+		return fmt.Errorf("unknown rail %q", d.Rail)
+	}
+	return nil
+}
+
+// validRoutingNumber verifies the ABA routing number checksum
+func validRoutingNumber(rn string) bool {
+	if len(rn) != 9 {
+		return false
+	}
+	weights := [9]int{3, 7, 1, 3, 7, 1, 3, 7, 1}
+	sum := 0
+	for i, ch := range rn {
+		if ch < '0' || ch > '9' {
+			return false
+		}
+		sum += int(ch-'0') * weights[i]
+	}
+	return sum%10 == 0
+}
+
+// validBIC checks the shape of an ISO 9362 business identifier code: 4 letter
+// institution, 2 letter country, 2 character location and optional 3
+// character branch
+func validBIC(bic string) bool {
+	if len(bic) != 8 && len(bic) != 11 {
+		return false
+	}
+	return isUpperAlpha(bic[:6]) && isAlphanumeric(bic[6:])
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// maxExternalRefLength bounds the identifiers of accounts in other systems
+const maxExternalRefLength = 64
+
+// handleListAccounts serves GET /accounts?external_ref=, the accounts of the
+// tenant carrying the identifier of another system, such as a core banking
+// system. External references are unique per tenant, so at most one account
+// is returned.
+func (a *App) handleListAccounts(w http.ResponseWriter, r *http.Request) {
+	ref := strings.TrimSpace(r.URL.Query().Get("external_ref"))
+	var v validator
+	v.check(ref != "", "external_ref", "is required")
+	if apiErr := v.err(); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	ctx := r.Context()
+	rows, err := a.Replica.QueryContext(ctx, "SELECT "+accountColumns+" FROM accounts WHERE external_ref = $1 AND tenant_id = $2", ref, tenantFromContext(ctx))
+	if err != nil {
+		writeJSONError(w, "Failed to list accounts", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	accounts := []Account{}
+	for rows.Next() {
+		acc, err := scanAccount(rows)
+		if err != nil {
+			writeJSONError(w, "Failed to list accounts", 1005, http.StatusInternalServerError)
+			return
+		}
+		accounts = append(accounts, acc)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, "Failed to list accounts", 1005, http.StatusInternalServerError)
+		return
+	}
+	writeJSONSuccess(w, accounts, "Accounts retrieved", 2087, http.StatusOK)
+}
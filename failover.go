@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// dbUnavailable reports whether err means the database could not be reached
+// or is not accepting writes, as during a primary failover, rather than
+// that the statement itself failed
+func dbUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errCircuitOpen) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "57P01", "57P02", "57P03": // admin shutdown, crash shutdown, cannot connect now
+			return true
+		case "25006": // read-only transaction: the server was demoted to a standby
+			return true
+		}
+		return pqErr.Code.Class() == "08" // connection exception
+	}
+	return false
+}
+
+// dbWriteError returns fallback, or code 1080 when err shows the database is
+// unavailable so clients can tell an outage from a failed write and retry
+func dbWriteError(err error, fallback *apiError) *apiError {
+	if dbUnavailable(err) {
+		return newAPIError("Database unavailable for writes, retry later", 1080, http.StatusServiceUnavailable)
+	}
+	return fallback
+}
+
+// pqConn is the set of driver interfaces lib/pq connections implement
+type pqConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.ExecerContext
+	driver.QueryerContext
+	driver.Pinger
+	driver.SessionResetter
+	driver.Validator
+}
+
+type pqStmt interface {
+	driver.Stmt
+	driver.StmtExecContext
+	driver.StmtQueryContext
+}
+
+// trackedConn retires a connection once it fails with an unavailability
+// error: lib/pq only discards connections with broken sockets, not ones left
+// pointing at a demoted primary or at a server being shut down. Reads outside
+// a transaction that fail this way return driver.ErrBadConn, which makes
+// database/sql retry them on another connection.
+type trackedConn struct {
+	pqConn
+	inTx  bool
+	stale bool
+	slow  time.Duration // slow query threshold, 0 when disabled
+}
+
+// trackConn wraps conn when it is a lib/pq connection
+func trackConn(conn driver.Conn, slow time.Duration) driver.Conn {
+	if c, ok := conn.(pqConn); ok {
+		return &trackedConn{pqConn: c, slow: slow}
+	}
+	return conn
+}
+
+// check marks the connection stale when err shows the database is unavailable
+func (c *trackedConn) check(err error) error {
+	if dbUnavailable(err) {
+		c.stale = true
+	}
+	return err
+}
+
+// checkRead is check for a query that may be retried elsewhere
+func (c *trackedConn) checkRead(query string, err error) error {
+	if c.check(err) != nil && c.stale && !c.inTx && isReadQuery(query) {
+		return driver.ErrBadConn
+	}
+	return err
+}
+
+// isReadQuery reports whether query is a plain SELECT, safe to run twice
+func isReadQuery(query string) bool {
+	q := strings.TrimSpace(query)
+	return len(q) >= 6 && strings.EqualFold(q[:6], "select")
+}
+
+func (c *trackedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *trackedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	st, err := c.pqConn.PrepareContext(ctx, query)
+	if err != nil {
+		// preparing has no effects, so it can always move to another
+		// connection outside a transaction
+		if c.check(err); c.stale && !c.inTx {
+			return nil, driver.ErrBadConn
+		}
+		return nil, err
+	}
+	if s, ok := st.(pqStmt); ok {
+		return &trackedStmt{pqStmt: s, conn: c, query: query}, nil
+	}
+	return st, nil
+}
+
+func (c *trackedConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *trackedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	tx, err := c.pqConn.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, c.check(err)
+	}
+	c.inTx = true
+	return &trackedTx{Tx: tx, conn: c}, nil
+}
+
+func (c *trackedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	defer c.observe(query, args, time.Now())
+	res, err := c.pqConn.ExecContext(ctx, query, args)
+	return res, c.check(err)
+}
+
+func (c *trackedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	defer c.observe(query, args, time.Now())
+	rows, err := c.pqConn.QueryContext(ctx, query, args)
+	return rows, c.checkRead(query, err)
+}
+
+func (c *trackedConn) Ping(ctx context.Context) error {
+	if err := c.check(c.pqConn.Ping(ctx)); err != nil {
+		if c.stale {
+			return driver.ErrBadConn
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *trackedConn) ResetSession(ctx context.Context) error {
+	if c.stale {
+		return driver.ErrBadConn
+	}
+	return c.pqConn.ResetSession(ctx)
+}
+
+func (c *trackedConn) IsValid() bool {
+	return !c.stale && c.pqConn.IsValid()
+}
+
+type trackedTx struct {
+	driver.Tx
+	conn *trackedConn
+}
+
+func (t *trackedTx) Commit() error {
+	t.conn.inTx = false
+	return t.conn.check(t.Tx.Commit())
+}
+
+func (t *trackedTx) Rollback() error {
+	t.conn.inTx = false
+	return t.conn.check(t.Tx.Rollback())
+}
+
+type trackedStmt struct {
+	pqStmt
+	conn  *trackedConn
+	query string
+}
+
+func (s *trackedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	defer s.conn.observe(s.query, args, time.Now())
+	res, err := s.pqStmt.ExecContext(ctx, args)
+	return res, s.conn.check(err)
+}
+
+func (s *trackedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	defer s.conn.observe(s.query, args, time.Now())
+	rows, err := s.pqStmt.QueryContext(ctx, args)
+	return rows, s.conn.checkRead(s.query, err)
+}
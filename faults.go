@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DB errors a fault can inject
+const (
+	FaultDBUnavailable = "unavailable"
+	FaultDBError       = "error"
+)
+
+// FaultInjectionConfig enables the /admin/faults API. It is meant for test
+// environments only: while enabled, admins can make transfers slow or fail.
+type FaultInjectionConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+// Fault describes the failures injected into the transfers of a tenant
+type Fault struct {
+	// LatencyMillis delays every affected transfer before it starts
+	LatencyMillis int `json:"latency_ms,omitempty"`
+	// DBError fails affected transfers as if the database were unavailable
+	// or had returned an error
+	DBError string `json:"db_error,omitempty"`
+	// Conflicts is the number of debit attempts of an affected transfer that
+	// hit an optimistic-lock conflict; from 3 on, the transfer fails
+	Conflicts int `json:"conflicts,omitempty"`
+	// Probability is the share of transfers affected; 0 affects all
+	Probability float64 `json:"probability,omitempty"`
+	// Count is the number of transfers left to affect; 0 is unlimited
+	Count int `json:"count,omitempty"`
+}
+
+func (f Fault) validate() *apiError {
+	var v validator
+	v.check(f.LatencyMillis >= 0 && f.LatencyMillis <= 60000, "latency_ms", "must be between 0 and 60000")
+	v.check(f.DBError == "" || f.DBError == FaultDBUnavailable || f.DBError == FaultDBError, "db_error", "must be unavailable or error")
+	v.check(f.Conflicts >= 0, "conflicts", "must not be negative")
+	v.check(f.Probability >= 0 && f.Probability <= 1, "probability", "must be between 0 and 1")
+	v.check(f.Count >= 0, "count", "must not be negative")
+	return v.err()
+}
+
+// faultInjector holds the active fault of each tenant
+type faultInjector struct {
+	mu     sync.Mutex
+	faults map[string]*Fault
+}
+
+// newFaultInjector returns nil unless fault injection is enabled
+func newFaultInjector(cfg FaultInjectionConfig) *faultInjector {
+	if !cfg.Enabled {
+		return nil
+	}
+	log.Printf("fault injection is enabled; do not run this configuration in production")
+	return &faultInjector{faults: map[string]*Fault{}}
+}
+
+// plan decides whether a transfer of tenant is affected and returns the
+// fault it suffers, or nil
+func (fi *faultInjector) plan(tenant string) *Fault {
+	if fi == nil {
+		return nil
+	}
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	f := fi.faults[tenant]
+	if f == nil || f.Probability > 0 && rand.Float64() >= f.Probability {
+		return nil
+	}
+	planned := *f
+	if f.Count > 0 {
+		if f.Count--; f.Count == 0 {
+			delete(fi.faults, tenant)
+		}
+	}
+	return &planned
+}
+
+// errFaultInjected is the DB error of FaultDBError
+var errFaultInjected = errors.New("injected fault")
+
+// inject delays the transfer and returns the DB error it fails with, if any
+func (f *Fault) inject(ctx context.Context) error {
+	if f == nil {
+		return nil
+	}
+	if f.LatencyMillis > 0 {
+		select {
+		case <-time.After(time.Duration(f.LatencyMillis) * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	switch f.DBError {
+	case FaultDBUnavailable:
+		return fmt.Errorf("%w: %w", errFaultInjected, driver.ErrBadConn)
+	case FaultDBError:
+		return errFaultInjected
+	}
+	return nil
+}
+
+// conflicts reports whether debit attempt (from 1) is forced to conflict
+func (f *Fault) conflicts(attempt int) bool {
+	return f != nil && attempt <= f.Conflicts
+}
+
+// handleFaults serves GET, PUT and DELETE /admin/faults, the fault injected
+// into the transfers of the caller's tenant
+func (a *App) handleFaults(w http.ResponseWriter, r *http.Request) {
+	if a.Faults == nil {
+		writeJSONError(w, "Not found", 1040, http.StatusNotFound)
+		return
+	}
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+	tenant := tenantFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		a.Faults.mu.Lock()
+		f := a.Faults.faults[tenant]
+		var current Fault
+		if f != nil {
+			current = *f
+		}
+		a.Faults.mu.Unlock()
+		writeJSONSuccess(w, current, "Fault retrieved", 2038, http.StatusOK)
+	case http.MethodPut:
+		var f Fault
+		if apiErr := decodeJSON(r, &f, 1090); apiErr != nil {
+			writeAPIError(w, apiErr)
+			return
+		}
+		if apiErr := f.validate(); apiErr != nil {
+			writeAPIError(w, apiErr)
+			return
+		}
+		a.Faults.mu.Lock()
+		a.Faults.faults[tenant] = &f
+		a.Faults.mu.Unlock()
+		log.Printf("fault injection: tenant %s: %+v", tenant, f)
+		writeJSONSuccess(w, f, "Fault injected", 2039, http.StatusOK)
+	case http.MethodDelete:
+		a.Faults.mu.Lock()
+		delete(a.Faults.faults, tenant)
+		a.Faults.mu.Unlock()
+		writeJSONSuccess(w, Fault{}, "Fault cleared", 2040, http.StatusOK)
+	default:
+		writeJSONError(w, "Only GET, PUT and DELETE methods are allowed", 1001, http.StatusMethodNotAllowed)
+	}
+}
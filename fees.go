@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Fee rule types
+const (
+	FeeTypeFlat       = "flat"
+	FeeTypePercentage = "percentage"
+	FeeTypeTiered     = "tiered"
+)
+
+// FeeConfig configures the fees charged on transfers. Fees are debited from
+// the source account on top of the transfer amount and credited to AccountID.
+type FeeConfig struct {
+	AccountID int       `json:"account_id"`
+	Rules     []FeeRule `json:"rules"`
+}
+
+// FeeRule describes a single fee component. The fee for a transfer is the sum
+// of all configured rules.
+type FeeRule struct {
+	Type    string    `json:"type"`
+	Amount  float64   `json:"amount,omitempty"`  // flat
+	Percent float64   `json:"percent,omitempty"` // percentage
+	Min     float64   `json:"min,omitempty"`     // percentage lower bound
+	Max     float64   `json:"max,omitempty"`     // percentage upper bound, 0 means unbounded
+	Tiers   []FeeTier `json:"tiers,omitempty"`   // tiered
+}
+
+// FeeTier is one band of a tiered rule. The first tier whose UpTo is greater
+// than or equal to the amount applies; UpTo of 0 matches any amount.
+type FeeTier struct {
+	UpTo    float64 `json:"up_to"`
+	Flat    float64 `json:"flat,omitempty"`
+	Percent float64 `json:"percent,omitempty"`
+}
+
+// enabled reports whether any fee rule is configured
+func (c FeeConfig) enabled() bool {
+	return len(c.Rules) > 0
+}
+
+// validate checks the fee configuration for obvious mistakes at startup
+func (c FeeConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if c.AccountID == 0 {
+		return errors.New("account_id is required when fee rules are configured")
+	}
+	for i, rule := range c.Rules {
+		switch rule.Type {
+		case FeeTypeFlat, FeeTypePercentage:
+		case FeeTypeTiered:
+			if len(rule.Tiers) == 0 {
+				return fmt.Errorf("rule %d: tiered rule needs at least one tier", i)
+			}
+		default:
+			return fmt.Errorf("rule %d: unknown fee type %q", i, rule.Type)
+		}
+	}
+	return nil
+}
+
+// calculate returns the total fee for transferring amount
+func (c FeeConfig) calculate(amount float64) float64 {
+	var fee float64
+	for _, rule := range c.Rules {
+		fee += rule.calculate(amount)
+	}
+	return roundCents(fee)
+}
+
+func (r FeeRule) calculate(amount float64) float64 {
+	switch r.Type {
+	case FeeTypeFlat:
+		return r.Amount
+	case FeeTypePercentage:
+		fee := amount * r.Percent / 100
+		if fee < r.Min {
+			fee = r.Min
+		}
+		if r.Max > 0 && fee > r.Max {
+			fee = r.Max
+		}
+		return fee
+	case FeeTypeTiered:
+		for _, tier := range r.Tiers {
+			if tier.UpTo == 0 || amount <= tier.UpTo {
+				return tier.Flat + amount*tier.Percent/100
+			}
+		}
+	}
+	return 0
+}
+
+// roundCents rounds an amount to two decimal places
+func roundCents(v float64) float64 {
+	return math.Round(v*100) / 100
+}
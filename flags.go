@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Feature flags
+const (
+	// FlagPessimisticLocking takes advisory locks on the accounts of a
+	// transfer, as in the advisory locking mode
+	FlagPessimisticLocking = "pessimistic_locking"
+	// FlagFees charges the configured transfer fees
+	FlagFees = "fees"
+	// FlagRiskChecks runs the risk checkers before transfers commit
+	FlagRiskChecks = "risk_checks"
+)
+
+// knownFlags are the flags that can be set, with their built-in defaults
+func (c *Config) knownFlags() map[string]bool {
+	return map[string]bool{
+		FlagPessimisticLocking: c.Locking.Mode == LockAdvisory,
+		FlagFees:               true,
+		FlagRiskChecks:         true,
+	}
+}
+
+// FeatureFlagConfig sets the defaults of the feature flags. Overrides stored
+// with PUT /admin/flags/{name} take precedence and are reloaded every
+// RefreshSeconds, so flags change without a redeploy.
+type FeatureFlagConfig struct {
+	// Flags overrides the built-in defaults for every tenant
+	Flags map[string]bool `json:"flags"`
+	// Tenants overrides them for single tenants
+	Tenants        map[string]map[string]bool `json:"tenants"`
+	RefreshSeconds int                        `json:"refresh_seconds"`
+}
+
+// validate checks only known flags are configured
+func (c FeatureFlagConfig) validate(known map[string]bool) error {
+	check := func(flags map[string]bool) error {
+		for name := range flags {
+			if _, ok := known[name]; !ok {
+				return fmt.Errorf("unknown flag %q", name)
+			}
+		}
+		return nil
+	}
+	if err := check(c.Flags); err != nil {
+		return err
+	}
+	for tenant, flags := range c.Tenants {
+		if err := check(flags); err != nil {
+			return fmt.Errorf("tenant %s: %w", tenant, err)
+		}
+	}
+	if c.RefreshSeconds < 1 {
+		return fmt.Errorf("refresh_seconds must be at least 1")
+	}
+	return nil
+}
+
+// Flag sources, from the highest precedence
+const (
+	flagSourceTenantOverride = "tenant_override"
+	flagSourceGlobalOverride = "global_override"
+	flagSourceTenantConfig   = "tenant_config"
+	flagSourceConfig         = "config"
+	flagSourceDefault        = "default"
+)
+
+// FeatureFlag is the value of a flag for a tenant and where it came from
+type FeatureFlag struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Source  string `json:"source"`
+}
+
+type flagKey struct {
+	name   string
+	tenant string // "" for every tenant
+}
+
+// featureFlags resolves flags from the overrides in the database, the config
+// and the built-in defaults
+type featureFlags struct {
+	db       *sql.DB
+	cfg      FeatureFlagConfig
+	defaults map[string]bool
+
+	mu        sync.RWMutex
+	overrides map[flagKey]bool
+}
+
+func newFeatureFlags(db *sql.DB, cfg *Config) *featureFlags {
+	return &featureFlags{db: db, cfg: cfg.Flags, defaults: cfg.knownFlags(), overrides: map[flagKey]bool{}}
+}
+
+// refresh reloads the overrides; it runs periodically so changes made through
+// other replicas are picked up
+func (f *featureFlags) refresh(ctx context.Context) error {
+	rows, err := f.db.QueryContext(ctx, "SELECT name, tenant_id, enabled FROM feature_flags")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	overrides := map[flagKey]bool{}
+	for rows.Next() {
+		var k flagKey
+		var enabled bool
+		if err := rows.Scan(&k.name, &k.tenant, &enabled); err != nil {
+			return err
+		}
+		overrides[k] = enabled
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.overrides = overrides
+	f.mu.Unlock()
+	return nil
+}
+
+// lookup returns the value of a flag for tenant. Without a flag layer, as in
+// sandbox mode, every flag has its built-in default.
+func (f *featureFlags) lookup(tenant, name string) FeatureFlag {
+	if f == nil {
+		return FeatureFlag{Name: name, Source: flagSourceDefault}
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if v, ok := f.overrides[flagKey{name, tenant}]; ok {
+		return FeatureFlag{name, v, flagSourceTenantOverride}
+	}
+	if v, ok := f.overrides[flagKey{name, ""}]; ok {
+		return FeatureFlag{name, v, flagSourceGlobalOverride}
+	}
+	if v, ok := f.cfg.Tenants[tenant][name]; ok {
+		return FeatureFlag{name, v, flagSourceTenantConfig}
+	}
+	if v, ok := f.cfg.Flags[name]; ok {
+		return FeatureFlag{name, v, flagSourceConfig}
+	}
+	return FeatureFlag{name, f.defaults[name], flagSourceDefault}
+}
+
+// enabled reports whether a flag is on for tenant
+func (a *App) enabled(tenant, name string) bool {
+	if a.Flags == nil {
+		return a.Config.knownFlags()[name]
+	}
+	return a.Flags.lookup(tenant, name).Enabled
+}
+
+// FlagUpdate represents the JSON body of PUT /admin/flags/{name}
+type FlagUpdate struct {
+	Enabled *bool `json:"enabled"`
+	// AllTenants sets the override of every tenant instead of the caller's
+	AllTenants bool `json:"all_tenants"`
+}
+
+// handleFlags serves GET /admin/flags, the flags of the caller's tenant
+func (a *App) handleFlags(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+	tenant := tenantFromContext(r.Context())
+	names := make([]string, 0, len(a.Flags.defaults))
+	for n := range a.Flags.defaults {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	flags := make([]FeatureFlag, len(names))
+	for i, n := range names {
+		flags[i] = a.Flags.lookup(tenant, n)
+	}
+	writeJSONSuccess(w, flags, "Feature flags retrieved", 2041, http.StatusOK)
+}
+
+// handleSetFlag serves PUT and DELETE /admin/flags/{name}, which set and
+// remove overrides
+func (a *App) handleSetFlag(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+	tenant := tenantFromContext(r.Context())
+	name := r.PathValue("name")
+	if _, ok := a.Flags.defaults[name]; !ok {
+		writeJSONError(w, "Unknown feature flag", 1091, http.StatusNotFound)
+		return
+	}
+
+	scope := tenant
+	var query string
+	var args []interface{}
+	var after interface{}
+	action := "feature_flag.set"
+	switch r.Method {
+	case http.MethodPut:
+		var req FlagUpdate
+		if apiErr := decodeJSON(r, &req, 1002, "enabled"); apiErr != nil {
+			writeAPIError(w, apiErr)
+			return
+		}
+		if req.AllTenants {
+			scope = ""
+		}
+		query = `INSERT INTO feature_flags (name, tenant_id, enabled, updated_at) VALUES ($1, $2, $3, NOW())
+			ON CONFLICT (name, tenant_id) DO UPDATE SET enabled = EXCLUDED.enabled, updated_at = NOW()`
+		args = []interface{}{name, scope, *req.Enabled}
+		after = map[string]interface{}{"enabled": *req.Enabled, "all_tenants": req.AllTenants}
+	case http.MethodDelete:
+		if r.URL.Query().Get("all_tenants") == "true" {
+			scope = ""
+		}
+		action = "feature_flag.unset"
+		query = "DELETE FROM feature_flags WHERE name = $1 AND tenant_id = $2"
+		args = []interface{}{name, scope}
+	}
+
+	if _, err := a.DB.ExecContext(r.Context(), query, args...); err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to update feature flag", 1005, http.StatusInternalServerError)))
+		return
+	}
+	if err := a.Flags.refresh(r.Context()); err != nil {
+		log.Printf("feature flags: %v", err)
+	}
+	entityID := name
+	if scope == "" {
+		entityID += ":*"
+	}
+	a.auditCommitted(r.Context(), auditRecord{
+		TenantID:   tenant,
+		Action:     action,
+		EntityType: "feature_flag",
+		EntityID:   entityID,
+		After:      after,
+	})
+
+	if r.Method == http.MethodDelete {
+		writeJSONSuccess(w, a.Flags.lookup(tenant, name), "Feature flag override removed", 2043, http.StatusOK)
+		return
+	}
+	writeJSONSuccess(w, a.Flags.lookup(tenant, name), "Feature flag updated", 2042, http.StatusOK)
+}
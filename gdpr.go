@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Outcomes of an erasure request
+const (
+	ErasureCompleted = "completed"
+	ErasureRejected  = "rejected"
+)
+
+// erasedName replaces the name of erased customers
+const erasedName = "Erased customer"
+
+// ErasureRequest represents the JSON body of POST /customers/{id}/erase
+type ErasureRequest struct {
+	Reason string `json:"reason"`
+}
+
+// ErasureRecord is a row of the erasure request trail of a customer
+type ErasureRecord struct {
+	ID          int       `json:"erasure_id"`
+	CustomerID  int       `json:"customer_id"`
+	RequestedBy string    `json:"requested_by"`
+	Reason      string    `json:"reason"`
+	Outcome     string    `json:"outcome"`
+	Detail      string    `json:"detail,omitempty"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+// CustomerExport is everything held about a customer: personal data,
+// preferences, accounts, the transactions on them and past erasure requests
+type CustomerExport struct {
+	Customer        Customer                 `json:"customer"`
+	Notifications   *NotificationPreferences `json:"notification_preferences,omitempty"`
+	Accounts        []Account                `json:"accounts"`
+	Transactions    []Transaction            `json:"transactions"`
+	ErasureRequests []ErasureRecord          `json:"erasure_requests"`
+	ExportedAt      time.Time                `json:"exported_at"`
+}
+
+// handleCustomerExport serves GET /customers/{id}/export, the data subject
+// access bundle of the customer
+func (a *App) handleCustomerExport(w http.ResponseWriter, r *http.Request, c Customer) {
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+	ctx := r.Context()
+	tenant := tenantFromContext(ctx)
+
+	// one snapshot, so the transactions match the exported balances
+	tx, err := a.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		writeJSONError(w, "Failed to export customer data", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	export, err := exportCustomer(ctx, tx, tenant, c)
+	if err != nil {
+		writeJSONError(w, "Failed to export customer data", 1005, http.StatusInternalServerError)
+		return
+	}
+	a.auditCommitted(ctx, auditRecord{
+		TenantID:   tenant,
+		Action:     "customer.exported",
+		EntityType: "customer",
+		EntityID:   strconv.Itoa(c.ID),
+	})
+	writeJSONSuccess(w, export, "Customer data exported", 2047, http.StatusOK)
+}
+
+// exportCustomer collects the export bundle of c
+func exportCustomer(ctx context.Context, tx *sql.Tx, tenant string, c Customer) (*CustomerExport, error) {
+	export := &CustomerExport{Customer: c, Accounts: []Account{}, Transactions: []Transaction{}, ErasureRequests: []ErasureRecord{}, ExportedAt: time.Now().UTC()}
+
+	prefs := NotificationPreferences{Events: []string{}}
+	err := tx.QueryRowContext(ctx, "SELECT email, sms, COALESCE(phone, ''), events FROM notification_preferences WHERE customer_id = $1", c.ID).
+		Scan(&prefs.Email, &prefs.SMS, &prefs.Phone, pq.Array(&prefs.Events))
+	if err == nil {
+		export.Notifications = &prefs
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT "+accountColumns+" FROM accounts WHERE customer_id = $1 AND tenant_id = $2 ORDER BY id", c.ID, tenant)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for rows.Next() {
+		acc, err := scanAccount(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		export.Accounts = append(export.Accounts, acc)
+		ids = append(ids, int64(acc.ID))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// archived transactions are data held about the customer too
+	rows, err = tx.QueryContext(ctx, "SELECT "+tenantTransactionColumns("$2")+` FROM ledger_transactions
+		WHERE (from_account = ANY($1) AND tenant_id = $2) OR (to_account = ANY($1) AND to_tenant_id = $2) ORDER BY id`, pq.Array(ids), tenant)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		export.Transactions = append(export.Transactions, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `SELECT id, customer_id, requested_by, reason, outcome, COALESCE(detail, ''), requested_at
+		FROM erasure_requests WHERE customer_id = $1 ORDER BY id`, c.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e ErasureRecord
+		if err := rows.Scan(&e.ID, &e.CustomerID, &e.RequestedBy, &e.Reason, &e.Outcome, &e.Detail, &e.RequestedAt); err != nil {
+			return nil, err
+		}
+		export.ErasureRequests = append(export.ErasureRequests, e)
+	}
+	return export, rows.Err()
+}
+
+// handleCustomerErasure serves POST /customers/{id}/erase. Once every
+// account of the customer is closed, the name, email and notification
+// preferences are anonymized; accounts and transactions stay untouched, so
+// the ledger still balances. Every request is recorded, including the
+// rejected ones.
+func (a *App) handleCustomerErasure(w http.ResponseWriter, r *http.Request, customerID int) {
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+	var req ErasureRequest
+	if apiErr := decodeJSON(r, &req, 1002, "reason"); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	var v validator
+	v.check(req.Reason != "", "reason", "is required")
+	v.check(len(req.Reason) <= maxMemoLength, "reason", "is too long")
+	if apiErr := v.err(); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	ctx := r.Context()
+	tenant := tenantFromContext(ctx)
+	record, apiErr := a.eraseCustomer(ctx, tenant, customerID, req.Reason)
+	if apiErr != nil {
+		if apiErr.Code == 1094 || apiErr.Code == 1095 {
+			a.recordRejectedErasure(ctx, tenant, customerID, req.Reason, apiErr.Message)
+		}
+		writeAPIError(w, apiErr)
+		return
+	}
+	writeJSONSuccess(w, record, "Customer erased", 2048, http.StatusOK)
+}
+
+// eraseCustomer anonymizes the customer and records the erasure in one
+// transaction
+func (a *App) eraseCustomer(ctx context.Context, tenant string, customerID int, reason string) (*ErasureRecord, *apiError) {
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to begin transaction", 1013, http.StatusInternalServerError))
+	}
+	defer tx.Rollback()
+
+	var erasedAt *time.Time
+	err = tx.QueryRowContext(ctx, "SELECT erased_at FROM customers WHERE id = $1 AND tenant_id = $2 FOR UPDATE", customerID, tenant).Scan(&erasedAt)
+	if err == sql.ErrNoRows {
+		return nil, newAPIError("Customer not found", 1027, http.StatusNotFound)
+	}
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to load customer", 1005, http.StatusInternalServerError))
+	}
+	if erasedAt != nil {
+		return nil, newAPIError("Customer is already erased", 1095, http.StatusConflict)
+	}
+	var open int
+	err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM accounts WHERE customer_id = $1 AND tenant_id = $2 AND closed_at IS NULL", customerID, tenant).Scan(&open)
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to erase customer", 1005, http.StatusInternalServerError))
+	}
+	if open > 0 {
+		return nil, newAPIError(fmt.Sprintf("Customer has %d open accounts; close them before erasure", open), 1094, http.StatusConflict)
+	}
+
+	// the email stays unique within the tenant
+	_, err = tx.ExecContext(ctx, "UPDATE customers SET name = $1, email = 'erased-' || id || '@invalid', erased_at = NOW() WHERE id = $2", erasedName, customerID)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "DELETE FROM notification_preferences WHERE customer_id = $1", customerID)
+	}
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to erase customer", 1005, http.StatusInternalServerError))
+	}
+	record := &ErasureRecord{CustomerID: customerID, RequestedBy: principalFromContext(ctx).Name, Reason: reason, Outcome: ErasureCompleted}
+	err = tx.QueryRowContext(ctx, `INSERT INTO erasure_requests (tenant_id, customer_id, requested_by, reason, outcome) VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, requested_at`, tenant, customerID, record.RequestedBy, reason, record.Outcome).Scan(&record.ID, &record.RequestedAt)
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to erase customer", 1005, http.StatusInternalServerError))
+	}
+	// the audit entry must not carry the erased data itself
+	err = a.audit(ctx, tx, auditRecord{
+		TenantID:   tenant,
+		Action:     "customer.erased",
+		EntityType: "customer",
+		EntityID:   strconv.Itoa(customerID),
+		After:      record,
+	})
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to erase customer", 1005, http.StatusInternalServerError))
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to commit transaction", 1020, http.StatusInternalServerError))
+	}
+	return record, nil
+}
+
+// recordRejectedErasure adds a refused erasure request to the trail
+func (a *App) recordRejectedErasure(ctx context.Context, tenant string, customerID int, reason, detail string) {
+	_, err := a.DB.ExecContext(ctx, `INSERT INTO erasure_requests (tenant_id, customer_id, requested_by, reason, outcome, detail) VALUES ($1, $2, $3, $4, $5, $6)`,
+		tenant, customerID, principalFromContext(ctx).Name, reason, ErasureRejected, detail)
+	if err != nil {
+		log.Printf("failed to record rejected erasure: %v", err)
+	}
+}
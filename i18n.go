@@ -0,0 +1,77 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// localeFiles holds a message bundle per language, named after its language
+// and mapping the English messages to their translations
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// defaultLanguage is the language the messages are written in
+const defaultLanguage = "en"
+
+// messageBundles maps each supported language to its translations
+var messageBundles = mustLoadBundles()
+
+func mustLoadBundles() map[string]map[string]string {
+	bundles := map[string]map[string]string{defaultLanguage: {}}
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(fmt.Sprintf("read message bundles: %v", err))
+	}
+	for _, f := range files {
+		data, err := localeFiles.ReadFile(path.Join("locales", f.Name()))
+		if err != nil {
+			panic(fmt.Sprintf("read message bundle %s: %v", f.Name(), err))
+		}
+		bundle := map[string]string{}
+		if err := json.Unmarshal(data, &bundle); err != nil {
+			panic(fmt.Sprintf("parse message bundle %s: %v", f.Name(), err))
+		}
+		bundles[strings.TrimSuffix(f.Name(), ".json")] = bundle
+	}
+	return bundles
+}
+
+// negotiateLanguage picks the supported language with the highest quality in
+// an Accept-Language header, in the client's order on ties. Tags match by
+// their primary subtag, so de-AT gets the de bundle; anything else gets
+// English.
+func negotiateLanguage(acceptLanguage string) string {
+	best, bestQ := defaultLanguage, 0.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		language, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if _, ok := messageBundles[language]; !ok {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = language, q
+		}
+	}
+	return best
+}
+
+// localize translates message into language. Messages without a translation,
+// such as those carrying database errors, stay in English.
+func localize(language, message string) string {
+	if translated, ok := messageBundles[language][message]; ok {
+		return translated
+	}
+	return message
+}
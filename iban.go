@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// IBANConfig configures the IBANs generated for new accounts. The BBAN is the
+// bank code followed by the account ID left-padded to AccountDigits.
+type IBANConfig struct {
+	CountryCode   string `json:"country_code"`
+	BankCode      string `json:"bank_code"`
+	AccountDigits int    `json:"account_digits"`
+}
+
+var errInvalidIBAN = errors.New("invalid IBAN")
+
+// generate builds the IBAN for accountID
+func (c IBANConfig) generate(accountID int) (string, error) {
+	number := strconv.Itoa(accountID)
+	if accountID < 0 || len(number) > c.AccountDigits {
+		return "", fmt.Errorf("account ID %d does not fit in %d IBAN digits", accountID, c.AccountDigits)
+	}
+	bban := c.BankCode + strings.Repeat("0", c.AccountDigits-len(number)) + number
+	check := 98 - ibanMod97(bban+c.CountryCode+"00")
+	return fmt.Sprintf("%s%02d%s", c.CountryCode, check, bban), nil
+}
+
+// validate checks the configured country and bank codes at startup
+func (c IBANConfig) validate() error {
+	if len(c.CountryCode) != 2 || !isUpperAlpha(c.CountryCode) {
+		return errors.New("country_code must be two upper-case letters")
+	}
+	if !isAlphanumeric(c.BankCode) {
+		return errors.New("bank_code must be upper-case alphanumeric")
+	}
+	if c.AccountDigits <= 0 {
+		return errors.New("account_digits must be positive")
+	}
+	if n := 4 + len(c.BankCode) + c.AccountDigits; n < 15 || n > 34 {
+		return fmt.Errorf("generated IBANs would be %d characters, must be 15 to 34", n)
+	}
+	return nil
+}
+
+// normalizeIBAN strips spaces, upper-cases the IBAN and verifies its check
+// digits
+func normalizeIBAN(s string) (string, error) {
+	iban := strings.ToUpper(strings.ReplaceAll(s, " ", ""))
+	if len(iban) < 15 || len(iban) > 34 || !isAlphanumeric(iban) {
+		return "", errInvalidIBAN
+	}
+	if !isUpperAlpha(iban[:2]) || iban[2] < '0' || iban[2] > '9' || iban[3] < '0' || iban[3] > '9' {
+		return "", errInvalidIBAN
+	}
+	if ibanMod97(iban[4:]+iban[:4]) != 1 {
+		return "", errInvalidIBAN
+	}
+	return iban, nil
+}
+
+// ibanMod97 computes the ISO 7064 MOD 97-10 remainder of s, with letters
+// expanded to two-digit numbers (A=10 ... Z=35)
+func ibanMod97(s string) int {
+	rem := 0
+	for _, ch := range s {
+		switch {
+		case ch >= '0' && ch <= '9':
+			rem = (rem*10 + int(ch-'0')) % 97
+		case ch >= 'A' && ch <= 'Z':
+			rem = (rem*100 + int(ch-'A'+10)) % 97
+		}
+	}
+	return rem
+}
+
+func isUpperAlpha(s string) bool {
+	for _, ch := range s {
+		if ch < 'A' || ch > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlphanumeric(s string) bool {
+	for _, ch := range s {
+		if (ch < 'A' || ch > 'Z') && (ch < '0' || ch > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// accountIBAN returns the IBAN to store for a new account: the validated IBAN
+// from the request, or one generated from the configuration
+func (a *App) accountIBAN(req CreateAccountRequest) (string, error) {
+	if req.IBAN != "" {
+		return normalizeIBAN(req.IBAN)
+	}
+	return a.Config.IBAN.generate(req.AccountID)
+}
+
+// accountIDByIBAN resolves an IBAN to the ID of an account of tenant
+func (a *App) accountIDByIBAN(iban, tenant string) (int, error) {
+	iban, err := normalizeIBAN(iban)
+	if err != nil {
+		return 0, err
+	}
+	var id int
+	err = a.DB.QueryRow("SELECT id FROM accounts WHERE iban = $1 AND tenant_id = $2", iban, tenant).Scan(&id)
+	return id, err
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// idempotencyTTL is how long a key and its response are kept
+const idempotencyTTL = 24 * time.Hour
+
+// maxIdempotencyKeyLength bounds the Idempotency-Key header
+const maxIdempotencyKeyLength = 255
+
+// idempotencyWriter keeps a copy of the response while writing it through
+type idempotencyWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (iw *idempotencyWriter) WriteHeader(status int) {
+	if iw.status == 0 {
+		iw.status = status
+	}
+	iw.ResponseWriter.WriteHeader(status)
+}
+
+func (iw *idempotencyWriter) Write(b []byte) (int, error) {
+	if iw.status == 0 {
+		iw.status = http.StatusOK
+	}
+	iw.body.Write(b)
+	return iw.ResponseWriter.Write(b)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController and the
+// content negotiation
+func (iw *idempotencyWriter) Unwrap() http.ResponseWriter {
+	return iw.ResponseWriter
+}
+
+// replayable reports whether a response is final for its key. Server errors,
+// conflicts and rate limits are worth retrying, so their keys are released.
+func replayable(status int) bool {
+	return status < 500 && status != http.StatusConflict && status != http.StatusTooManyRequests
+}
+
+// withIdempotency makes POST requests carrying an Idempotency-Key header safe
+// to retry: the first request with a key runs next, and later ones with the
+// same key and body get its response replayed instead of running again
+func (a *App) withIdempotency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeJSONError(w, "Idempotency-Key is too long", 1100, http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if bodyTooLarge(err) {
+			writeJSONError(w, "Request body too large", 1049, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, "Invalid request payload", 1012, http.StatusBadRequest)
+			return
+		}
+		sum := sha256.Sum256(append([]byte(r.URL.Path+"\n"), body...))
+		hash := hex.EncodeToString(sum[:])
+		ctx := r.Context()
+		tenant := tenantFromContext(ctx)
+
+		// an expired key is claimed again as if it were new
+		now := time.Now().UTC()
+		res, err := a.DB.ExecContext(ctx, `INSERT INTO idempotency_keys (tenant_id, key, request_hash, expires_at) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (tenant_id, key) DO UPDATE SET request_hash = EXCLUDED.request_hash, expires_at = EXCLUDED.expires_at, status = NULL, content_type = NULL, body = NULL
+			WHERE idempotency_keys.expires_at < $5`,
+			tenant, key, hash, now.Add(idempotencyTTL), now)
+		if err != nil {
+			writeAPIError(w, dbWriteError(err, newAPIError("Failed to record idempotency key", 1005, http.StatusInternalServerError)))
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			a.replayIdempotent(ctx, w, tenant, key, hash)
+			return
+		}
+
+		iw := &idempotencyWriter{ResponseWriter: w}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		completed := false
+		defer func() {
+			// a panic or a retryable failure releases the key
+			if !completed {
+				if _, err := a.DB.ExecContext(context.WithoutCancel(ctx), "DELETE FROM idempotency_keys WHERE tenant_id = $1 AND key = $2", tenant, key); err != nil {
+					log.Printf("idempotency: release %s: %v", key, err)
+				}
+			}
+		}()
+		next(iw, r)
+
+		if iw.status == 0 || !replayable(iw.status) {
+			return
+		}
+		_, err = a.DB.ExecContext(context.WithoutCancel(ctx), "UPDATE idempotency_keys SET status = $1, content_type = $2, body = $3 WHERE tenant_id = $4 AND key = $5",
+			iw.status, w.Header().Get("Content-Type"), iw.body.Bytes(), tenant, key)
+		if err != nil {
+			log.Printf("idempotency: store %s: %v", key, err)
+			return
+		}
+		completed = true
+	}
+}
+
+// replayIdempotent answers a repeated key with the stored response
+func (a *App) replayIdempotent(ctx context.Context, w http.ResponseWriter, tenant, key, hash string) {
+	var storedHash string
+	var status sql.NullInt64
+	var contentType sql.NullString
+	var body []byte
+	err := a.DB.QueryRowContext(ctx, "SELECT request_hash, status, content_type, body FROM idempotency_keys WHERE tenant_id = $1 AND key = $2",
+		tenant, key).Scan(&storedHash, &status, &contentType, &body)
+	if err == sql.ErrNoRows {
+		// released meanwhile by a failed first request
+		w.Header().Set("Retry-After", "1")
+		writeJSONError(w, "A request with this Idempotency-Key is in progress", 1102, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to load idempotency key", 1005, http.StatusInternalServerError)))
+		return
+	}
+	if storedHash != hash {
+		writeJSONError(w, "Idempotency-Key was used for a different request", 1101, http.StatusUnprocessableEntity)
+		return
+	}
+	if !status.Valid {
+		w.Header().Set("Retry-After", "1")
+		writeJSONError(w, "A request with this Idempotency-Key is in progress", 1102, http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", contentType.String)
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(int(status.Int64))
+	w.Write(body)
+}
+
+// pruneIdempotencyKeys forgets expired keys
+func (a *App) pruneIdempotencyKeys(ctx context.Context) error {
+	_, err := a.DB.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at < $1", time.Now().UTC())
+	return err
+}
@@ -0,0 +1,305 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+)
+
+// The integration tests run against a disposable PostgreSQL container:
+//
+//	go test -tags integration -run Integration ./...
+//
+// They need a Docker daemon; DOCKER_HOST selects another than the local one.
+
+// integrationDSN is the connection string of the test database, set by
+// TestMain
+var integrationDSN string
+
+func TestMain(m *testing.M) {
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		log.Fatalf("connect to docker: %v", err)
+	}
+	resource, err := pool.RunWithOptions(&dockertest.RunOptions{
+		Repository: "postgres",
+		Tag:        "16-alpine",
+		Env:        []string{"POSTGRES_PASSWORD=postgres", "POSTGRES_DB=bank"},
+	}, func(hc *docker.HostConfig) {
+		hc.AutoRemove = true
+		hc.RestartPolicy = docker.RestartPolicy{Name: "no"}
+	})
+	if err != nil {
+		log.Fatalf("start postgres: %v", err)
+	}
+	// a crashed run must not leave the container behind for long
+	resource.Expire(600)
+
+	integrationDSN = fmt.Sprintf("postgres://postgres:postgres@%s/bank?sslmode=disable", resource.GetHostPort("5432/tcp"))
+	pool.MaxWait = 2 * time.Minute
+	err = pool.Retry(func() error {
+		db, err := sql.Open("postgres", integrationDSN)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		return db.Ping()
+	})
+	if err != nil {
+		pool.Purge(resource)
+		log.Fatalf("wait for postgres: %v", err)
+	}
+
+	code := m.Run()
+	if err := pool.Purge(resource); err != nil {
+		log.Printf("remove postgres: %v", err)
+	}
+	os.Exit(code)
+}
+
+// newIntegrationApp returns an App on the migrated test database, wired like
+// main does for the transfer path, with the given locking mode
+func newIntegrationApp(t *testing.T, mode string) *App {
+	t.Helper()
+	db, err := sql.Open("postgres", integrationDSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(20)
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := defaultConfig()
+	cfg.Locking.Mode = mode
+	a := &App{DB: db, Replica: db, Config: cfg, Events: newAccountHub()}
+	if a.Stmts, err = a.prepareStatements(); err != nil {
+		t.Fatal(err)
+	}
+	a.Flags = newFeatureFlags(db, cfg)
+	a.Maintenance = newMaintenanceMode(db)
+	return a
+}
+
+// openAccounts opens n accounts of tenant with balance each and returns
+// their IDs
+func openAccounts(t *testing.T, a *App, tenant string, firstID, n int, balance float64) []int {
+	t.Helper()
+	ids := make([]int, n)
+	for i := range ids {
+		ids[i] = firstID + i
+		_, err := a.DB.Exec("INSERT INTO accounts (id, balance, initial_balance, last_updated, tenant_id) VALUES ($1, $2, $2, NOW(), $3)",
+			ids[i], balance, tenant)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ids
+}
+
+// tenantTotal sums the stored balances of tenant's accounts
+func tenantTotal(t *testing.T, a *App, tenant string) float64 {
+	t.Helper()
+	var total float64
+	if err := a.DB.QueryRow("SELECT COALESCE(SUM(balance), 0) FROM accounts WHERE tenant_id = $1", tenant).Scan(&total); err != nil {
+		t.Fatal(err)
+	}
+	return total
+}
+
+// assertLedgerMatches fails the test if any account of tenant disagrees
+// with its ledger or is overdrawn
+func assertLedgerMatches(t *testing.T, a *App, tenant string) {
+	t.Helper()
+	rows, err := a.DB.Query(ledgerBalances+" WHERE a.tenant_id = $4", movingStatuses[0], movingStatuses[1], movingStatuses[2], tenant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var tenantID string
+		var stored, computed float64
+		if err := rows.Scan(&id, &tenantID, &stored, &computed); err != nil {
+			t.Fatal(err)
+		}
+		if roundCents(stored) != roundCents(computed) {
+			t.Errorf("account %d: stored balance %.2f, ledger %.2f", id, stored, computed)
+		}
+		if stored < 0 {
+			t.Errorf("account %d is overdrawn: %.2f", id, stored)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestIntegrationConcurrentTransfersConserveMoney runs random transfers
+// between a few accounts from many goroutines. Whatever fails under the
+// contention, no money may appear or vanish.
+func TestIntegrationConcurrentTransfersConserveMoney(t *testing.T) {
+	for i, mode := range []string{LockOptimistic, LockAdvisory} {
+		t.Run(mode, func(t *testing.T) {
+			a := newIntegrationApp(t, mode)
+			tenant := "conserve-" + mode
+			ids := openAccounts(t, a, tenant, 810000+i*100, 5, 500)
+			before := tenantTotal(t, a, tenant)
+
+			const workers, transfersEach = 20, 25
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			completed, failed := 0, map[int]int{}
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(seed int64) {
+					defer wg.Done()
+					rng := rand.New(rand.NewSource(seed))
+					for n := 0; n < transfersEach; n++ {
+						from := ids[rng.Intn(len(ids))]
+						to := ids[rng.Intn(len(ids))]
+						if from == to {
+							continue
+						}
+						amount := roundCents(1 + rng.Float64()*99)
+						_, apiErr := a.executeTransfer(context.Background(), tenant, TransferRequest{FromAccountID: from, ToAccountID: to, Amount: amount})
+						mu.Lock()
+						if apiErr == nil {
+							completed++
+						} else {
+							failed[apiErr.Code]++
+						}
+						mu.Unlock()
+					}
+				}(int64(w))
+			}
+			wg.Wait()
+			t.Logf("%d transfers completed, failures by code: %v", completed, failed)
+
+			if completed == 0 {
+				t.Fatal("no transfer completed")
+			}
+			for code := range failed {
+				// only running out of funds or, optimistically, of retries is expected
+				if code != 1015 && !(mode == LockOptimistic && (code == 1016 || code == 1018)) {
+					t.Errorf("unexpected failure code %d", code)
+				}
+			}
+			if after := tenantTotal(t, a, tenant); roundCents(after) != roundCents(before) {
+				t.Errorf("total balance changed from %.2f to %.2f", before, after)
+			}
+			var recorded int
+			err := a.DB.QueryRow("SELECT COUNT(*) FROM transactions WHERE tenant_id = $1 AND status = $2", tenant, TxCompleted).Scan(&recorded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if recorded != completed {
+				t.Errorf("%d completed transactions recorded, %d transfers reported success", recorded, completed)
+			}
+			assertLedgerMatches(t, a, tenant)
+		})
+	}
+}
+
+// TestIntegrationConcurrentDebitsNeverOverdraw drains one account from many
+// goroutines at once: no more transfers than the balance covers may succeed,
+// and with advisory locks, which never give up on a conflict, exactly as many
+func TestIntegrationConcurrentDebitsNeverOverdraw(t *testing.T) {
+	for i, mode := range []string{LockOptimistic, LockAdvisory} {
+		t.Run(mode, func(t *testing.T) {
+			a := newIntegrationApp(t, mode)
+			tenant := "drain-" + mode
+			ids := openAccounts(t, a, tenant, 820000+i*100, 2, 0)
+			if _, err := a.DB.Exec("UPDATE accounts SET balance = 100, initial_balance = 100 WHERE id = $1", ids[0]); err != nil {
+				t.Fatal(err)
+			}
+
+			const attempts = 30
+			var wg sync.WaitGroup
+			results := make(chan *apiError, attempts)
+			for n := 0; n < attempts; n++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, apiErr := a.executeTransfer(context.Background(), tenant, TransferRequest{FromAccountID: ids[0], ToAccountID: ids[1], Amount: 10})
+					results <- apiErr
+				}()
+			}
+			wg.Wait()
+			close(results)
+
+			succeeded := 0
+			for apiErr := range results {
+				switch {
+				case apiErr == nil:
+					succeeded++
+				case apiErr.Code == 1015:
+				case mode == LockOptimistic && (apiErr.Code == 1016 || apiErr.Code == 1018):
+				default:
+					t.Errorf("unexpected failure: %s (code %d)", apiErr.Message, apiErr.Code)
+				}
+			}
+			if succeeded > 10 || mode == LockAdvisory && succeeded != 10 {
+				t.Errorf("%d transfers of 10.00 succeeded from a balance of 100.00", succeeded)
+			}
+			var drained, credited float64
+			if err := a.DB.QueryRow("SELECT balance FROM accounts WHERE id = $1", ids[0]).Scan(&drained); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.DB.QueryRow("SELECT balance FROM accounts WHERE id = $1", ids[1]).Scan(&credited); err != nil {
+				t.Fatal(err)
+			}
+			if want := float64(10 * succeeded); drained != 100-want || credited != want {
+				t.Errorf("balances after %d transfers: %.2f and %.2f, want %.2f and %.2f", succeeded, drained, credited, 100-want, want)
+			}
+			assertLedgerMatches(t, a, tenant)
+		})
+	}
+}
+
+// TestIntegrationEarlyWithdrawalPaysPenaltyFromDeposit withdraws a deposit
+// locking the whole balance early: the penalty is paid out of the freed
+// funds and the interest is forfeited.
+func TestIntegrationEarlyWithdrawalPaysPenaltyFromDeposit(t *testing.T) {
+	a := newIntegrationApp(t, LockAdvisory)
+	tenant := "deposits"
+	ids := openAccounts(t, a, tenant, 830000, 2, 1000)
+	a.Config.TermDeposits = TermDepositConfig{InterestAccountID: ids[1], Terms: map[int]float64{180: 0.03}, AllowEarlyWithdrawal: true, EarlyWithdrawalPenalty: 0.01}
+
+	d, err := scanTermDeposit(a.DB.QueryRow(`INSERT INTO term_deposits (tenant_id, account_id, amount, rate, term_days, interest, status, created_by, matures_at)
+		VALUES ($1, $2, 1000, 0.03, 180, 14.79, $3, 'test', NOW() + INTERVAL '180 days') RETURNING `+termDepositColumns, tenant, ids[0], DepositActive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed, apiErr := a.closeDeposit(context.Background(), d, true)
+	if apiErr != nil {
+		t.Fatalf("withdraw: %s (code %d)", apiErr.Message, apiErr.Code)
+	}
+	if closed.Status != DepositWithdrawn || closed.Interest != 0 || closed.Penalty != 10 {
+		t.Errorf("withdrawn deposit %+v, want no interest and a penalty of 10", closed)
+	}
+
+	var balance, interestAccount float64
+	if err := a.DB.QueryRow("SELECT balance FROM accounts WHERE id = $1", ids[0]).Scan(&balance); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.DB.QueryRow("SELECT balance FROM accounts WHERE id = $1", ids[1]).Scan(&interestAccount); err != nil {
+		t.Fatal(err)
+	}
+	if balance != 990 || interestAccount != 1010 {
+		t.Errorf("balances %.2f and %.2f, want 990 and 1010", balance, interestAccount)
+	}
+	assertLedgerMatches(t, a, tenant)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// runPeriodically runs job right away and then every interval until ctx is
+// cancelled, logging its failures under name
+func runPeriodically(ctx context.Context, name string, interval time.Duration, job func(context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := job(ctx); err != nil {
+			log.Printf("%s: %v", name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// queryAccounts returns the accounts selected by a query of tenant_id, id
+// pairs. The keys are read up front so callers can query per account
+// without holding the result set open.
+func (a *App) queryAccounts(ctx context.Context, query string, args ...interface{}) ([]accountKey, error) {
+	rows, err := a.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []accountKey
+	for rows.Next() {
+		var k accountKey
+		if err := rows.Scan(&k.tenant, &k.id); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
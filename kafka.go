@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaConfig configures the Kafka transport
+type KafkaConfig struct {
+	Brokers []string `json:"brokers"`
+	// Topic carries the transfer commands
+	Topic string `json:"topic"`
+	// GroupID is the consumer group the replicas share the partitions of
+	// the topic in
+	GroupID string `json:"group_id"`
+	// DLQTopic receives the commands that did not result in a transfer
+	DLQTopic string `json:"dlq_topic"`
+	// EventsTopic receives the transfer events, keyed by transaction ID so
+	// the events of a transaction stay in order
+	EventsTopic string `json:"events_topic"`
+}
+
+func (c KafkaConfig) validate() error {
+	if len(c.Brokers) == 0 {
+		return fmt.Errorf("brokers are required")
+	}
+	if c.Topic == "" || c.GroupID == "" || c.DLQTopic == "" || c.EventsTopic == "" {
+		return fmt.Errorf("topic, group_id, dlq_topic and events_topic are required")
+	}
+	if c.Topic == c.DLQTopic || c.Topic == c.EventsTopic {
+		return fmt.Errorf("dlq_topic and events_topic must differ from topic")
+	}
+	return nil
+}
+
+// kafkaTransport consumes commands in a consumer group. Offsets are
+// committed by ack, and committing an offset commits the earlier ones of its
+// partition.
+type kafkaTransport struct {
+	reader *kafka.Reader
+	dlq    *kafka.Writer
+	events *kafka.Writer
+}
+
+func newKafkaTransport(cfg KafkaConfig) *kafkaTransport {
+	return &kafkaTransport{
+		reader: kafka.NewReader(kafka.ReaderConfig{Brokers: cfg.Brokers, GroupID: cfg.GroupID, Topic: cfg.Topic}),
+		dlq:    &kafka.Writer{Addr: kafka.TCP(cfg.Brokers...), Topic: cfg.DLQTopic, Balancer: &kafka.Hash{}, RequiredAcks: kafka.RequireAll},
+		events: &kafka.Writer{Addr: kafka.TCP(cfg.Brokers...), Topic: cfg.EventsTopic, Balancer: &kafka.Hash{}, RequiredAcks: kafka.RequireAll},
+	}
+}
+
+func (k *kafkaTransport) fetch(ctx context.Context) (brokerMessage, error) {
+	msg, err := k.reader.FetchMessage(ctx)
+	if err != nil {
+		return brokerMessage{}, err
+	}
+	return brokerMessage{
+		messageID: kafkaHeader(msg, headerMessageID),
+		tenant:    kafkaHeader(msg, headerTenantID),
+		body:      msg.Value,
+		raw:       msg,
+	}, nil
+}
+
+func (k *kafkaTransport) ack(ctx context.Context, msg brokerMessage) error {
+	return k.reader.CommitMessages(ctx, msg.raw.(kafka.Message))
+}
+
+func (k *kafkaTransport) deadLetter(ctx context.Context, msg brokerMessage, rejection *apiError) error {
+	m := msg.raw.(kafka.Message)
+	headers := append(m.Headers[:len(m.Headers):len(m.Headers)],
+		kafka.Header{Key: headerErrorCode, Value: []byte(strconv.Itoa(rejection.Code))},
+		kafka.Header{Key: headerErrorMessage, Value: []byte(rejection.Message)})
+	return k.dlq.WriteMessages(ctx, kafka.Message{Key: m.Key, Value: m.Value, Headers: headers})
+}
+
+func (k *kafkaTransport) publish(ctx context.Context, events []transferEventMessage) error {
+	msgs := make([]kafka.Message, len(events))
+	for i, e := range events {
+		msgs[i] = kafka.Message{
+			Key:     []byte(strconv.Itoa(e.Event.TransactionID)),
+			Value:   e.Payload,
+			Headers: []kafka.Header{{Key: headerMessageID, Value: []byte(strconv.FormatInt(e.Seq, 10))}, {Key: headerTenantID, Value: []byte(e.Event.TenantID)}},
+		}
+	}
+	return k.events.WriteMessages(ctx, msgs...)
+}
+
+func (k *kafkaTransport) close() error {
+	k.events.Close()
+	k.dlq.Close()
+	return k.reader.Close()
+}
+
+// kafkaHeader returns the value of the last header of msg named key
+func kafkaHeader(msg kafka.Message, key string) string {
+	value := ""
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			value = string(h.Value)
+		}
+	}
+	return value
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Bounds of the category and tags of a transaction
+const (
+	maxCategoryLength = 64
+	maxTags           = 10
+	maxTagLength      = 32
+)
+
+// normalizeLabels returns a category and tags as stored: both are
+// case-insensitive, and repeated tags are kept once, in the order given
+func normalizeLabels(category string, tags []string) (string, []string) {
+	var normalized []string
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !slices.Contains(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(category)), normalized
+}
+
+// labels validates a normalized category and tags
+func (v *validator) labels(category string, tags []string) {
+	v.check(len(category) <= maxCategoryLength, "category", fmt.Sprintf("must be at most %d characters", maxCategoryLength))
+	v.check(len(tags) <= maxTags, "tags", fmt.Sprintf("must hold at most %d tags", maxTags))
+	for _, tag := range tags {
+		v.check(tag != "" && len(tag) <= maxTagLength, "tags", fmt.Sprintf("must be 1 to %d characters each", maxTagLength))
+	}
+}
+
+// labelTransaction stores the category and tags of a transaction recorded
+// without them
+func labelTransaction(ctx context.Context, tx *sql.Tx, transactionID int, category string, tags []string) error {
+	_, err := tx.ExecContext(ctx, "UPDATE transactions SET category = NULLIF($1, ''), tags = $2 WHERE id = $3",
+		category, pq.Array(nonNilTags(tags)), transactionID)
+	return err
+}
+
+// nonNilTags keeps the tags column NOT NULL: a nil slice is stored as NULL
+func nonNilTags(tags []string) []string {
+	if tags == nil {
+		return []string{}
+	}
+	return tags
+}
+
+// UpdateTransactionRequest is the JSON body of PATCH /transactions/{id}.
+// Absent fields are left as they are; an empty category clears it, and tags
+// replaces the tags.
+type UpdateTransactionRequest struct {
+	Category *string   `json:"category"`
+	Tags     *[]string `json:"tags"`
+}
+
+// handleUpdateTransaction serves PATCH /transactions/{id}, labelling a
+// transaction the tenant sent for budgeting. Archived transactions cannot be
+// changed.
+func (a *App) handleUpdateTransaction(w http.ResponseWriter, r *http.Request, transactionID int) {
+	var req UpdateTransactionRequest
+	if apiErr := decodeJSON(r, &req, 1002); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	var v validator
+	v.check(req.Category != nil || req.Tags != nil, "", "category or tags is required")
+	if apiErr := v.err(); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	ctx := r.Context()
+	tenant := tenantFromContext(ctx)
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to begin transaction", 1013, http.StatusInternalServerError)))
+		return
+	}
+	defer tx.Rollback()
+	before, err := scanTransaction(tx.QueryRowContext(ctx, "SELECT "+transactionColumns+" FROM transactions WHERE id = $1 AND tenant_id = $2 FOR UPDATE",
+		transactionID, tenant))
+	if err == sql.ErrNoRows {
+		writeJSONError(w, "Transaction not found", 1044, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to update transaction", 1005, http.StatusInternalServerError)))
+		return
+	}
+
+	category, tags := "", before.Tags
+	if before.Category != nil {
+		category = *before.Category
+	}
+	if req.Category != nil {
+		category = *req.Category
+	}
+	if req.Tags != nil {
+		tags = *req.Tags
+	}
+	category, tags = normalizeLabels(category, tags)
+	v.labels(category, tags)
+	if apiErr := v.err(); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	if err := labelTransaction(ctx, tx, transactionID, category, tags); err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to update transaction", 1005, http.StatusInternalServerError)))
+		return
+	}
+	after := before
+	after.Category, after.Tags = nil, tags
+	if category != "" {
+		after.Category = &category
+	}
+	if err := a.audit(ctx, tx, auditRecord{
+		TenantID:   tenant,
+		Action:     "transaction.labeled",
+		EntityType: "transaction",
+		EntityID:   strconv.Itoa(transactionID),
+		Before:     map[string]interface{}{"category": before.Category, "tags": before.Tags},
+		After:      map[string]interface{}{"category": after.Category, "tags": after.Tags},
+	}); err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to update transaction", 1005, http.StatusInternalServerError)))
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to commit transaction", 1020, http.StatusInternalServerError)))
+		return
+	}
+	writeJSONSuccess(w, after, "Transaction updated", 2094, http.StatusOK)
+}
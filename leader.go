@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// LeaderConfig configures the election of the replica that runs the
+// scheduled jobs
+type LeaderConfig struct {
+	// LeaseSeconds is how long a leader that stops renewing keeps the lease
+	LeaseSeconds int `json:"lease_seconds"`
+}
+
+// leaderLease is the name of the lease the job runner holds
+const leaderLease = "jobs"
+
+// leaderElector holds a lease row in leader_leases while this replica is the
+// leader. The lease is renewed every third of its duration and taken over by
+// another replica once it expires.
+type leaderElector struct {
+	db     *sql.DB
+	id     string
+	lease  time.Duration
+	leader atomic.Bool
+}
+
+func newLeaderElector(db *sql.DB, cfg LeaderConfig) *leaderElector {
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return &leaderElector{
+		db:    db,
+		id:    fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(suffix)),
+		lease: time.Duration(cfg.LeaseSeconds) * time.Second,
+	}
+}
+
+// start campaigns once before returning, so jobs started right after see the
+// outcome, then keeps renewing until ctx is cancelled
+func (l *leaderElector) start(ctx context.Context) {
+	l.campaign(ctx)
+	go func() {
+		ticker := time.NewTicker(l.lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				l.campaign(ctx)
+			}
+		}
+	}()
+}
+
+// campaign takes the lease if it is free or expired, or renews it if held
+func (l *leaderElector) campaign(ctx context.Context) {
+	var holder string
+	err := l.db.QueryRowContext(ctx, `INSERT INTO leader_leases (name, holder, expires_at) VALUES ($1, $2, NOW() + make_interval(secs => $3))
+		ON CONFLICT (name) DO UPDATE SET holder = EXCLUDED.holder, expires_at = EXCLUDED.expires_at
+		WHERE leader_leases.holder = EXCLUDED.holder OR leader_leases.expires_at < NOW()
+		RETURNING holder`, leaderLease, l.id, l.lease.Seconds()).Scan(&holder)
+	leader := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		// without a renewal the lease may lapse, so stop acting as leader
+		log.Printf("leader election: %v", err)
+	}
+	if l.leader.Swap(leader) != leader {
+		log.Printf("leader election: %s is leader: %t", l.id, leader)
+	}
+	if leader {
+		isLeader.Set(1)
+	} else {
+		isLeader.Set(0)
+	}
+}
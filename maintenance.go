@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maintenanceRefreshInterval is how soon replicas notice the maintenance
+// state was changed through another replica
+const maintenanceRefreshInterval = 5 * time.Second
+
+// defaultMaintenanceRetryAfter is the Retry-After sent when none was given
+const defaultMaintenanceRetryAfter = 60
+
+// MaintenanceState describes the maintenance mode of the service
+type MaintenanceState struct {
+	Enabled           bool       `json:"enabled"`
+	Message           string     `json:"message,omitempty"`
+	RetryAfterSeconds int        `json:"retry_after_seconds,omitempty"`
+	StartedAt         *time.Time `json:"started_at,omitempty"`
+	StartedBy         string     `json:"started_by,omitempty"`
+}
+
+// MaintenanceRequest represents the JSON body of PUT /admin/maintenance
+type MaintenanceRequest struct {
+	Message           string `json:"message"`
+	RetryAfterSeconds int    `json:"retry_after_seconds"`
+}
+
+// maintenanceMode keeps the maintenance state stored in the database in
+// memory, so it still applies while a migration makes the database
+// unreachable
+type maintenanceMode struct {
+	db *sql.DB
+
+	mu    sync.RWMutex
+	state MaintenanceState
+}
+
+func newMaintenanceMode(db *sql.DB) *maintenanceMode {
+	return &maintenanceMode{db: db}
+}
+
+// refresh reloads the stored state
+func (m *maintenanceMode) refresh(ctx context.Context) error {
+	var s MaintenanceState
+	err := m.db.QueryRowContext(ctx, "SELECT message, retry_after_seconds, started_at, started_by FROM maintenance").
+		Scan(&s.Message, &s.RetryAfterSeconds, &s.StartedAt, &s.StartedBy)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	s.Enabled = err == nil
+	m.mu.Lock()
+	m.state = s
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *maintenanceMode) current() MaintenanceState {
+	if m == nil {
+		return MaintenanceState{}
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state
+}
+
+// writesBlocked reports whether maintenance mode turns r away. Reads keep
+// working, and admin endpoints stay open so maintenance can be ended.
+func writesBlocked(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return !strings.HasPrefix(r.URL.Path, "/admin/")
+}
+
+// withMaintenance answers writes with 503 and Retry-After while the service
+// is in maintenance mode
+func (a *App) withMaintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s := a.Maintenance.current(); s.Enabled && writesBlocked(r) {
+			w.Header().Set("Retry-After", strconv.Itoa(s.RetryAfterSeconds))
+			message := "Service is in maintenance, retry later"
+			if s.Message != "" {
+				message = s.Message
+			}
+			writeJSONError(w, message, 1092, http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleMaintenance serves GET, PUT and DELETE /admin/maintenance, which
+// report, start and end maintenance mode for every replica
+func (a *App) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+	ctx := r.Context()
+
+	var err error
+	action := ""
+	switch r.Method {
+	case http.MethodGet:
+		writeJSONSuccess(w, a.Maintenance.current(), "Maintenance state retrieved", 2044, http.StatusOK)
+		return
+	case http.MethodPut:
+		var req MaintenanceRequest
+		if apiErr := decodeJSON(r, &req, 1002); apiErr != nil {
+			writeAPIError(w, apiErr)
+			return
+		}
+		var v validator
+		v.check(req.RetryAfterSeconds >= 0, "retry_after_seconds", "must not be negative")
+		v.check(len(req.Message) <= maxMemoLength, "message", "is too long")
+		if apiErr := v.err(); apiErr != nil {
+			writeAPIError(w, apiErr)
+			return
+		}
+		if req.RetryAfterSeconds == 0 {
+			req.RetryAfterSeconds = defaultMaintenanceRetryAfter
+		}
+		action = "maintenance.started"
+		_, err = a.DB.ExecContext(ctx, `INSERT INTO maintenance (id, message, retry_after_seconds, started_at, started_by) VALUES (TRUE, $1, $2, NOW(), $3)
+			ON CONFLICT (id) DO UPDATE SET message = EXCLUDED.message, retry_after_seconds = EXCLUDED.retry_after_seconds`,
+			req.Message, req.RetryAfterSeconds, principalFromContext(ctx).Name)
+	case http.MethodDelete:
+		action = "maintenance.ended"
+		_, err = a.DB.ExecContext(ctx, "DELETE FROM maintenance")
+	default:
+		writeJSONError(w, "Only GET, PUT and DELETE methods are allowed", 1001, http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to update maintenance state", 1005, http.StatusInternalServerError)))
+		return
+	}
+	if err := a.Maintenance.refresh(ctx); err != nil {
+		log.Printf("maintenance: %v", err)
+	}
+	state := a.Maintenance.current()
+	a.auditCommitted(ctx, auditRecord{
+		TenantID:   tenantFromContext(ctx),
+		Action:     action,
+		EntityType: "maintenance",
+		EntityID:   "service",
+		After:      state,
+	})
+	log.Printf("%s by %s", action, principalFromContext(ctx).Name)
+
+	if state.Enabled {
+		writeJSONSuccess(w, state, "Maintenance mode started", 2045, http.StatusOK)
+		return
+	}
+	writeJSONSuccess(w, state, "Maintenance mode ended", 2046, http.StatusOK)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Message transports
+const (
+	TransportKafka    = "kafka"
+	TransportRabbitMQ = "rabbitmq"
+)
+
+// MessagingConfig connects the service to a message broker, which upstream
+// systems submit transfer commands through instead of HTTP and which
+// receives the transfer events
+type MessagingConfig struct {
+	// Transport selects the broker, configured in its own section; empty
+	// disables messaging
+	Transport string `json:"transport"`
+	// Principal is who the transfers of commands are made and audited as
+	Principal string `json:"principal"`
+	// MaxAttempts bounds the attempts at a command whose transfer fails with
+	// a server error before the command is dead-lettered
+	MaxAttempts          int `json:"max_attempts"`
+	RetryIntervalSeconds int `json:"retry_interval_seconds"`
+	// RetentionDays is how long the IDs of processed messages are kept. It
+	// should cover the retention of the command topic or queue, as a message
+	// redelivered after its ID was pruned is executed again.
+	RetentionDays int `json:"retention_days"`
+}
+
+func (c MessagingConfig) validate() error {
+	switch {
+	case c.Transport != "" && c.Transport != TransportKafka && c.Transport != TransportRabbitMQ:
+		return fmt.Errorf("transport must be %s or %s", TransportKafka, TransportRabbitMQ)
+	case c.Principal == "":
+		return fmt.Errorf("principal is required")
+	case c.MaxAttempts < 1:
+		return fmt.Errorf("max_attempts must be at least 1")
+	case c.RetryIntervalSeconds < 1:
+		return fmt.Errorf("retry_interval_seconds must be at least 1")
+	case c.RetentionDays < 1:
+		return fmt.Errorf("retention_days must be at least 1")
+	}
+	return nil
+}
+
+// Metadata of command and event messages, sent as Kafka headers and AMQP
+// message IDs and headers. Dead-lettered commands keep what they were sent
+// with and gain the error headers.
+const (
+	headerMessageID    = "message-id"
+	headerTenantID     = "tenant-id"
+	headerErrorCode    = "error-code"
+	headerErrorMessage = "error-message"
+)
+
+// messageTransport connects the service to a message broker. Commands are
+// fetched one at a time and acknowledged once processed, so they are
+// delivered at least once; events are published at least once too.
+type messageTransport interface {
+	// fetch waits for the next command
+	fetch(ctx context.Context) (brokerMessage, error)
+	// ack acknowledges a processed command so it is not delivered again
+	ack(ctx context.Context, msg brokerMessage) error
+	// deadLetter sends a command to the dead-letter topic or queue with the
+	// error it was rejected with
+	deadLetter(ctx context.Context, msg brokerMessage, rejection *apiError) error
+	// publish sends transfer events in order, returning once the broker has
+	// taken them all
+	publish(ctx context.Context, events []transferEventMessage) error
+	close() error
+}
+
+// newMessageTransport returns the configured transport, or nil when
+// messaging is disabled
+func newMessageTransport(cfg *Config) messageTransport {
+	switch cfg.Messaging.Transport {
+	case TransportKafka:
+		return newKafkaTransport(cfg.Kafka)
+	case TransportRabbitMQ:
+		return newRabbitMQTransport(cfg.RabbitMQ)
+	}
+	return nil
+}
+
+// brokerMessage is a command as received by a transport
+type brokerMessage struct {
+	messageID string
+	tenant    string
+	body      []byte
+	// raw is the message as the transport received it
+	raw interface{}
+}
+
+// transferEventMessage is a transfer event from the outbox. Seq is its
+// message ID; consumers drop the events whose ID they have seen.
+type transferEventMessage struct {
+	Seq     int64
+	Event   TransferEvent
+	Payload []byte
+}
+
+// consumeCommands executes the commands of t until ctx is cancelled. Each
+// step is retried until it succeeds, as a broker acknowledging a later
+// command may acknowledge this one too. Consumption pauses during
+// maintenance mode.
+func (a *App) consumeCommands(ctx context.Context, t messageTransport) {
+	defer t.close()
+	source := a.Config.Messaging.Transport
+	interval := time.Duration(a.Config.Messaging.RetryIntervalSeconds) * time.Second
+	for {
+		var msg brokerMessage
+		ok := retryUntil(ctx, source, interval, func(ctx context.Context) error {
+			var err error
+			msg, err = t.fetch(ctx)
+			return err
+		})
+		for ok && a.Maintenance.current().Enabled {
+			select {
+			case <-ctx.Done():
+				ok = false
+			case <-time.After(maintenanceRefreshInterval):
+			}
+		}
+		if !ok {
+			return
+		}
+
+		name := fmt.Sprintf("%s: message %q", source, msg.messageID)
+		cmd := inboundCommand{source: source, messageID: msg.messageID, tenant: msg.tenant, body: msg.body}
+		var out commandOutcome
+		ok = retryUntil(ctx, name, interval, func(ctx context.Context) error {
+			var err error
+			out, err = a.processCommand(ctx, cmd)
+			return err
+		})
+		if ok && out.rejection != nil {
+			log.Printf("%s: dead-lettered with code %d: %s", name, out.rejection.Code, out.rejection.Message)
+			ok = retryUntil(ctx, name, interval, func(ctx context.Context) error { return t.deadLetter(ctx, msg, out.rejection) })
+		}
+		ok = ok &&
+			retryUntil(ctx, name, interval, func(ctx context.Context) error { return a.finishCommand(ctx, cmd, out) }) &&
+			retryUntil(ctx, name, interval, func(ctx context.Context) error { return t.ack(ctx, msg) })
+		if !ok {
+			return
+		}
+	}
+}
+
+// Statuses of an inbound command
+const (
+	CommandProcessing   = "processing"
+	CommandProcessed    = "processed"
+	CommandDeadLettered = "dead_lettered"
+)
+
+// inboundCommand is a transfer command received from a message broker. Its
+// body is the JSON body of POST /transactions.
+type inboundCommand struct {
+	source    string // the transport
+	messageID string
+	tenant    string
+	body      []byte
+}
+
+// commandOutcome is what processing an inbound command came to
+type commandOutcome struct {
+	// duplicate is set when the message was processed before
+	duplicate bool
+	result    *TransferResult
+	// rejection is the error for the broker to dead-letter the command with
+	rejection *apiError
+}
+
+// processCommand executes a transfer command at most once per message ID,
+// recorded in inbound_commands. A command whose processing was interrupted
+// is not executed again, as its transfer may have been made; it is rejected
+// for a person to check. An error means the command could not be processed
+// and should be delivered again.
+func (a *App) processCommand(ctx context.Context, cmd inboundCommand) (commandOutcome, error) {
+	if cmd.messageID == "" {
+		return commandOutcome{rejection: newAPIError("Message has no message ID", 1126, http.StatusBadRequest)}, nil
+	}
+	if cmd.tenant == "" {
+		cmd.tenant = a.Config.Tenancy.DefaultTenant
+	}
+	result, err := a.DB.ExecContext(ctx, "INSERT INTO inbound_commands (source, message_id, tenant_id, status) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING",
+		cmd.source, cmd.messageID, cmd.tenant, CommandProcessing)
+	if err != nil {
+		return commandOutcome{}, err
+	}
+	if affectedRows(result, nil) == 0 {
+		var status string
+		err := a.DB.QueryRowContext(ctx, "SELECT status FROM inbound_commands WHERE source = $1 AND message_id = $2", cmd.source, cmd.messageID).Scan(&status)
+		if err != nil {
+			return commandOutcome{}, err
+		}
+		if status != CommandProcessing {
+			return commandOutcome{duplicate: true}, nil
+		}
+		return commandOutcome{rejection: newAPIError("Command outcome unknown", 1127, http.StatusConflict)}, nil
+	}
+
+	if !a.Config.Tenancy.knownTenant(cmd.tenant) {
+		return commandOutcome{rejection: newAPIError("Unknown tenant", 1028, http.StatusForbidden)}, nil
+	}
+	var tr TransferRequest
+	if apiErr := decodeBody(cmd.body, &tr, 1012, "amount"); apiErr != nil {
+		return commandOutcome{rejection: apiErr}, nil
+	}
+	ctx = context.WithValue(ctx, principalKey{}, &Principal{Name: a.Config.Messaging.Principal})
+	ctx = context.WithValue(ctx, tenantKey{}, cmd.tenant)
+	for attempt := 1; ; attempt++ {
+		res, apiErr := a.executeTransfer(ctx, cmd.tenant, tr)
+		if apiErr == nil {
+			return commandOutcome{result: res}, nil
+		}
+		if apiErr.Status < 500 || attempt >= a.Config.Messaging.MaxAttempts {
+			return commandOutcome{rejection: apiErr}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return commandOutcome{}, ctx.Err()
+		case <-time.After(time.Duration(attempt*a.Config.Messaging.RetryIntervalSeconds) * time.Second):
+		}
+	}
+}
+
+// finishCommand records the outcome of a processed command, once the broker
+// has dead-lettered a rejected one
+func (a *App) finishCommand(ctx context.Context, cmd inboundCommand, out commandOutcome) error {
+	if cmd.messageID == "" || out.duplicate {
+		return nil
+	}
+	status, code := CommandProcessed, 0
+	var txID sql.NullInt64
+	if out.result != nil {
+		txID = sql.NullInt64{Int64: int64(out.result.TransactionID), Valid: true}
+	}
+	if out.rejection != nil {
+		status, code = CommandDeadLettered, out.rejection.Code
+		if data, ok := out.rejection.Data.(map[string]interface{}); ok {
+			if id, ok := data["transaction_id"].(int); ok {
+				txID = sql.NullInt64{Int64: int64(id), Valid: true}
+			}
+		}
+	}
+	_, err := a.DB.ExecContext(ctx, "UPDATE inbound_commands SET status = $1, code = $2, transaction_id = $3, processed_at = NOW() WHERE source = $4 AND message_id = $5 AND status = $6",
+		status, code, txID, cmd.source, cmd.messageID, CommandProcessing)
+	if err == nil {
+		inboundCommands.WithLabelValues(cmd.source, status).Inc()
+	}
+	return err
+}
+
+// pruneInboundCommands forgets the messages processed more than the
+// configured retention ago
+func (a *App) pruneInboundCommands(ctx context.Context) error {
+	_, err := a.DB.ExecContext(ctx, "DELETE FROM inbound_commands WHERE status <> $1 AND received_at < NOW() - make_interval(days => $2)",
+		CommandProcessing, a.Config.Messaging.RetentionDays)
+	return err
+}
+
+// outboxLockID is the advisory lock held by the one event relay running at a
+// time across replicas
+const outboxLockID = 7240_1003
+
+// outboxBatchSize is the number of events published per transaction
+const outboxBatchSize = 500
+
+// relayEvents publishes the transfer events queued in transfer_outbox by the
+// transactions trigger, queues them for webhook subscriptions and deletes
+// them once t has taken them. Without a transport the events only go to
+// webhooks.
+func (a *App) relayEvents(ctx context.Context, t messageTransport) error {
+	for {
+		n, err := a.relayEventBatch(ctx, t)
+		if err != nil || n < outboxBatchSize {
+			return err
+		}
+	}
+}
+
+func (a *App) relayEventBatch(ctx context.Context, t messageTransport) (int, error) {
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRowContext(ctx, "SELECT pg_try_advisory_xact_lock($1)", outboxLockID).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, nil // another replica is relaying
+	}
+
+	// The events are queued for the webhook subscriptions of the tenants on
+	// either side in the same statement
+	rows, err := tx.QueryContext(ctx, `WITH batch AS (
+			DELETE FROM transfer_outbox
+			WHERE seq IN (SELECT seq FROM transfer_outbox ORDER BY seq LIMIT $1) RETURNING seq, payload),
+		fanout AS (
+			INSERT INTO webhook_deliveries (subscription_id, event_id, payload, status)
+			SELECT s.id, b.seq, b.payload, $2 FROM batch b
+			JOIN webhook_subscriptions s ON s.deleted_at IS NULL
+				AND s.tenant_id IN (b.payload->>'tenant_id', b.payload->>'to_tenant_id')
+			ORDER BY b.seq, s.id)
+		SELECT seq, payload FROM batch`, outboxBatchSize, DeliveryPending)
+	if err != nil {
+		return 0, err
+	}
+	var events []transferEventMessage
+	for rows.Next() {
+		var e transferEventMessage
+		if err := rows.Scan(&e.Seq, &e.Payload); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if err := json.Unmarshal(e.Payload, &e.Event); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("outbox event %d: %w", e.Seq, err)
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	if t != nil {
+		sort.Slice(events, func(i, k int) bool { return events[i].Seq < events[k].Seq })
+		if err := t.publish(ctx, events); err != nil {
+			return 0, err
+		}
+		eventsPublished.Add(float64(len(events)))
+	}
+	return len(events), tx.Commit()
+}
+
+// retryUntil calls fn every interval until it succeeds or ctx is cancelled,
+// logging its failures under name. It reports whether fn succeeded.
+func retryUntil(ctx context.Context, name string, interval time.Duration, fn func(context.Context) error) bool {
+	for {
+		err := fn(ctx)
+		if err == nil {
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		log.Printf("%s: %v", name, err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(interval):
+		}
+	}
+}
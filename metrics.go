@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics exposed on GET /metrics in the Prometheus text format
+var (
+	reconciliationDiscrepancies = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "fundtransfer_reconciliation_discrepancies",
+		Help: "Accounts whose stored balance disagreed with the ledger in the last reconciliation run.",
+	})
+	reconciliationLastRun = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "fundtransfer_reconciliation_last_run_timestamp_seconds",
+		Help: "Unix time the last reconciliation run finished.",
+	})
+	transactionsArchived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fundtransfer_transactions_archived_total",
+		Help: "Transactions moved into the archive by the retention job.",
+	})
+	isLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "fundtransfer_leader",
+		Help: "1 while this replica holds the lease to run scheduled jobs, else 0.",
+	})
+	deadLettered = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fundtransfer_dead_lettered_transfers_total",
+		Help: "External legs moved to the dead-letter queue after exhausting their attempts.",
+	})
+	jobRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fundtransfer_job_runs_total",
+		Help: "Finished runs of scheduled jobs by job and status.",
+	}, []string{"job", "status"})
+	inboundCommands = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fundtransfer_inbound_commands_total",
+		Help: "Transfer commands received from message brokers by source and outcome.",
+	}, []string{"source", "status"})
+	eventsPublished = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fundtransfer_transfer_events_published_total",
+		Help: "Transfer events published to the message broker.",
+	})
+	webhookAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fundtransfer_webhook_attempts_total",
+		Help: "Webhook delivery attempts by the status of the delivery after them.",
+	}, []string{"status"})
+	sweepExecutions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fundtransfer_sweep_executions_total",
+		Help: "Sweep transfers by outcome: succeeded, held or failed.",
+	}, []string{"status"})
+)
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+// ServerConfig configures the HTTP server
+type ServerConfig struct {
+	// Addr is the TCP address the API listens on; empty serves the Unix
+	// socket only
+	Addr string `json:"addr"`
+	// UnixSocket is the path of a Unix socket to serve the API on as well,
+	// with the octal UnixSocketMode permissions (0660 when unset)
+	UnixSocket     string `json:"unix_socket"`
+	UnixSocketMode string `json:"unix_socket_mode"`
+	// The timeouts bound how long a client may take to send its headers and
+	// body and to read the response, and how long idle keep-alive
+	// connections are kept; 0 disables all but ReadHeaderTimeoutSeconds
+	ReadHeaderTimeoutSeconds int `json:"read_header_timeout_seconds"`
+	ReadTimeoutSeconds       int `json:"read_timeout_seconds"`
+	WriteTimeoutSeconds      int `json:"write_timeout_seconds"`
+	IdleTimeoutSeconds       int `json:"idle_timeout_seconds"`
+	MaxHeaderBytes           int `json:"max_header_bytes"`
+	// TLSCertFile and TLSKeyFile serve HTTPS, with HTTP/2, instead of HTTP
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+	// UnencryptedHTTP2 accepts HTTP/2 with prior knowledge over cleartext,
+	// for service meshes terminating TLS in a sidecar
+	UnencryptedHTTP2 bool `json:"unencrypted_http2"`
+	// MaxBodyBytes caps request bodies; MaxImportBodyBytes applies to file
+	// import endpoints instead
+	MaxBodyBytes       int64 `json:"max_body_bytes"`
+	MaxImportBodyBytes int64 `json:"max_import_body_bytes"`
+	// MaxRequestTimeoutSeconds caps the deadline clients ask for in
+	// X-Request-Timeout
+	MaxRequestTimeoutSeconds int `json:"max_request_timeout_seconds"`
+	// UnversionedSunset is the YYYY-MM-DD date after which paths without a
+	// /v{n} prefix will no longer be served, announced in the Sunset header
+	UnversionedSunset string `json:"unversioned_sunset"`
+	// Compression configures gzip and zstd compression of responses
+	Compression CompressionConfig `json:"compression"`
+}
+
+// importPaths are the endpoints accepting file uploads
+var importPaths = map[string]bool{
+	"/transactions/pain001": true,
+	"/accounts/import":      true,
+}
+
+// withBodyLimit caps the size of request bodies so that a client cannot
+// stream arbitrarily large payloads into the decoders
+func (a *App) withBodyLimit(next http.Handler) http.Handler {
+	cfg := a.Config.Server
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := cfg.MaxBodyBytes
+		if importPaths[r.URL.Path] {
+			limit = cfg.MaxImportBodyBytes
+		}
+		if r.ContentLength > limit {
+			writeJSONError(w, "Request body too large", 1049, http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withRequestTimeout gives the request context the deadline the client sent
+// in X-Request-Timeout or Request-Timeout, capped at the server maximum, so
+// retries and queries stop once the client has stopped waiting. A server
+// error written after the deadline passed is answered with 504 instead.
+func (a *App) withRequestTimeout(next http.Handler) http.Handler {
+	max := seconds(a.Config.Server.MaxRequestTimeoutSeconds)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw := r.Header.Get("X-Request-Timeout")
+		if raw == "" {
+			raw = r.Header.Get("Request-Timeout")
+		}
+		if raw == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		timeout, ok := parseRequestTimeout(raw)
+		if !ok {
+			writeJSONError(w, "Invalid request timeout", 1132, http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), min(timeout, max))
+		defer cancel()
+		next.ServeHTTP(&timeoutWriter{ResponseWriter: w, ctx: ctx}, r.WithContext(ctx))
+	})
+}
+
+// parseRequestTimeout parses a positive number of seconds such as 2 or 0.5,
+// or a duration such as 1500ms
+func parseRequestTimeout(raw string) (time.Duration, bool) {
+	if secs, err := strconv.ParseFloat(raw, 64); err == nil {
+		d := time.Duration(min(secs, 1e9) * float64(time.Second))
+		return d, secs > 0 && d > 0
+	}
+	d, err := time.ParseDuration(raw)
+	return d, err == nil && d > 0
+}
+
+// timeoutWriter replaces a server error written once the request deadline
+// has passed, which is only a symptom of the deadline, with 504
+type timeoutWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	timedOut bool
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	if status >= 500 && errors.Is(tw.ctx.Err(), context.DeadlineExceeded) {
+		tw.timedOut = true
+		writeJSONError(tw.ResponseWriter, "Request timeout exceeded", 1133, http.StatusGatewayTimeout)
+		return
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	if tw.timedOut {
+		return len(b), nil
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// Hijack lets WebSocket upgrades take over the connection
+func (tw *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(tw.ResponseWriter).Hijack()
+}
+
+// bodyTooLarge reports whether err was caused by exceeding the body limit
+func bodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// responseRecorder remembers whether the response header was written
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Hijack lets WebSocket upgrades take over the connection, which libraries
+// look up by type assertion rather than through Unwrap
+func (rec *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	rec.status = http.StatusSwitchingProtocols
+	return http.NewResponseController(rec.ResponseWriter).Hijack()
+}
+
+// withRecovery turns a panicking handler into a logged stack trace and a
+// structured 500 response instead of a dropped connection
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			log.Printf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+			if rec.status == 0 {
+				writeJSONError(rec, "Internal server error", 1050, http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
@@ -0,0 +1,771 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations holds the schema changes applied at startup, in order. Each entry
+// runs once inside its own transaction and its index is recorded in
+// schema_migrations. Never edit an applied entry; append a new one instead.
+var migrations = []string{
+	// 1: baseline schema
+	`CREATE TABLE IF NOT EXISTS accounts (
+		id INT PRIMARY KEY,
+		balance NUMERIC NOT NULL,
+		last_updated TIMESTAMP NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS transactions (
+		id SERIAL PRIMARY KEY,
+		from_account INT,
+		to_account INT,
+		amount NUMERIC NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`,
+
+	// 2: customers and account ownership
+	`CREATE TABLE IF NOT EXISTS customers (
+		id SERIAL PRIMARY KEY,
+		name TEXT NOT NULL,
+		email TEXT NOT NULL UNIQUE,
+		kyc_status TEXT NOT NULL DEFAULT 'pending',
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	ALTER TABLE accounts ADD COLUMN IF NOT EXISTS customer_id INT REFERENCES customers(id);
+	CREATE INDEX IF NOT EXISTS accounts_customer_id_idx ON accounts (customer_id);`,
+
+	// 3: tenant dimension; existing rows belong to the default tenant
+	`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+	ALTER TABLE customers ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+	ALTER TABLE transactions ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+	ALTER TABLE transactions ADD COLUMN IF NOT EXISTS to_tenant_id TEXT NOT NULL DEFAULT 'default';
+	ALTER TABLE customers DROP CONSTRAINT IF EXISTS customers_email_key;
+	CREATE UNIQUE INDEX IF NOT EXISTS customers_tenant_email_idx ON customers (tenant_id, email);
+	CREATE INDEX IF NOT EXISTS accounts_tenant_id_idx ON accounts (tenant_id);
+	CREATE INDEX IF NOT EXISTS transactions_tenant_id_idx ON transactions (tenant_id);`,
+
+	// 4: IBANs; accounts created before this migration have none
+	`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS iban TEXT UNIQUE;`,
+
+	// 5: beneficiaries of transfers leaving the bank
+	`CREATE TABLE IF NOT EXISTS external_transfers (
+		transaction_id INT PRIMARY KEY REFERENCES transactions(id),
+		tenant_id TEXT NOT NULL,
+		rail TEXT NOT NULL,
+		routing_number TEXT,
+		account_number TEXT,
+		account_type TEXT,
+		beneficiary_name TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS external_transfers_rail_idx ON external_transfers (rail, tenant_id);`,
+
+	// 6: international wire beneficiaries
+	`ALTER TABLE external_transfers ADD COLUMN IF NOT EXISTS bic TEXT;
+	ALTER TABLE external_transfers ADD COLUMN IF NOT EXISTS iban TEXT;`,
+
+	// 7: saga state of the external leg
+	`ALTER TABLE external_transfers ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'completed';
+	ALTER TABLE external_transfers ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0;
+	ALTER TABLE external_transfers ADD COLUMN IF NOT EXISTS last_error TEXT;
+	ALTER TABLE external_transfers ADD COLUMN IF NOT EXISTS gateway_reference TEXT;
+	ALTER TABLE external_transfers ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
+	CREATE INDEX IF NOT EXISTS external_transfers_status_idx ON external_transfers (status) WHERE status IN ('pending', 'failed');`,
+
+	// 8: transaction status lifecycle
+	`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'completed';
+	ALTER TABLE transactions ADD COLUMN IF NOT EXISTS completed_at TIMESTAMP;
+	ALTER TABLE transactions ADD COLUMN IF NOT EXISTS failure_reason TEXT;
+	UPDATE transactions SET completed_at = created_at WHERE completed_at IS NULL;
+	UPDATE transactions t SET status = 'pending', completed_at = NULL
+		FROM external_transfers e WHERE e.transaction_id = t.id AND e.status IN ('pending', 'failed');
+	UPDATE transactions t SET status = 'reversed', failure_reason = e.last_error
+		FROM external_transfers e WHERE e.transaction_id = t.id AND e.status = 'compensated';`,
+
+	// 9: payment reference and memo
+	`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS reference TEXT;
+	ALTER TABLE transactions ADD COLUMN IF NOT EXISTS memo TEXT;
+	CREATE INDEX IF NOT EXISTS transactions_reference_idx ON transactions (reference) WHERE reference IS NOT NULL;`,
+
+	// 10: maker-checker approvals of held transfers
+	`CREATE TABLE IF NOT EXISTS transfer_approvals (
+		transaction_id INT PRIMARY KEY REFERENCES transactions(id),
+		tenant_id TEXT NOT NULL,
+		request JSONB NOT NULL,
+		requested_by TEXT NOT NULL,
+		decision TEXT,
+		decided_by TEXT,
+		decided_at TIMESTAMP,
+		reason TEXT
+	);
+	CREATE INDEX IF NOT EXISTS transfer_approvals_open_idx ON transfer_approvals (tenant_id) WHERE decision IS NULL;`,
+
+	// 11: OTP challenges of transfers held for step-up verification
+	`CREATE TABLE IF NOT EXISTS transfer_challenges (
+		id TEXT PRIMARY KEY,
+		transaction_id INT NOT NULL UNIQUE REFERENCES transactions(id),
+		tenant_id TEXT NOT NULL,
+		request JSONB NOT NULL,
+		code_hash TEXT NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		expires_at TIMESTAMP NOT NULL,
+		confirmed_at TIMESTAMP,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);`,
+
+	// 12: customer notification opt-ins
+	`CREATE TABLE IF NOT EXISTS notification_preferences (
+		customer_id INT PRIMARY KEY REFERENCES customers(id),
+		email BOOLEAN NOT NULL DEFAULT FALSE,
+		sms BOOLEAN NOT NULL DEFAULT FALSE,
+		phone TEXT,
+		events TEXT[] NOT NULL DEFAULT '{}',
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);`,
+
+	// 13: publish balance changes for event streams
+	`CREATE OR REPLACE FUNCTION notify_account_balance() RETURNS trigger AS $$
+	BEGIN
+		IF TG_OP = 'INSERT' OR NEW.balance IS DISTINCT FROM OLD.balance THEN
+			PERFORM pg_notify('account_balances', json_build_object(
+				'account_id', NEW.id, 'tenant_id', NEW.tenant_id,
+				'balance', NEW.balance,
+				'last_updated', to_char(NEW.last_updated, 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'))::text);
+		END IF;
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;
+	DROP TRIGGER IF EXISTS accounts_balance_notify ON accounts;
+	CREATE TRIGGER accounts_balance_notify AFTER INSERT OR UPDATE OF balance ON accounts
+		FOR EACH ROW EXECUTE FUNCTION notify_account_balance();`,
+
+	// 14: publish transfers for the WebSocket feed
+	`CREATE OR REPLACE FUNCTION notify_account_transfer() RETURNS trigger AS $$
+	BEGIN
+		IF TG_OP = 'INSERT' OR NEW.status IS DISTINCT FROM OLD.status THEN
+			PERFORM pg_notify('account_transfers', json_build_object(
+				'transaction_id', NEW.id,
+				'source_account_id', NEW.from_account, 'destination_account_id', NEW.to_account,
+				'tenant_id', NEW.tenant_id, 'to_tenant_id', NEW.to_tenant_id,
+				'amount', NEW.amount, 'status', NEW.status)::text);
+		END IF;
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;
+	DROP TRIGGER IF EXISTS transactions_notify ON transactions;
+	CREATE TRIGGER transactions_notify AFTER INSERT OR UPDATE OF status ON transactions
+		FOR EACH ROW EXECUTE FUNCTION notify_account_transfer();`,
+
+	// 15: monthly account statements
+	`CREATE TABLE IF NOT EXISTS statements (
+		tenant_id TEXT NOT NULL,
+		account_id INT NOT NULL REFERENCES accounts(id),
+		period TEXT NOT NULL,
+		opening_balance NUMERIC NOT NULL,
+		closing_balance NUMERIC NOT NULL,
+		entries JSONB NOT NULL,
+		generated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (tenant_id, account_id, period)
+	);`,
+
+	// 16: end-of-day balance snapshots
+	`CREATE TABLE IF NOT EXISTS balance_snapshots (
+		tenant_id TEXT NOT NULL,
+		account_id INT NOT NULL REFERENCES accounts(id),
+		snapshot_date DATE NOT NULL,
+		balance NUMERIC NOT NULL,
+		taken_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (tenant_id, account_id, snapshot_date)
+	);`,
+
+	// 17: balance reconciliation; accounts are assumed to be in balance with
+	// their transactions when the initial balance is backfilled
+	`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS initial_balance NUMERIC;
+	UPDATE accounts a SET initial_balance = a.balance - COALESCE((
+		SELECT SUM(CASE WHEN t.from_account = a.id THEN -t.amount ELSE t.amount END) FROM transactions t
+		WHERE (t.from_account = a.id OR t.to_account = a.id) AND t.status IN ('completed', 'pending', 'reversed')), 0)
+	WHERE initial_balance IS NULL;
+	ALTER TABLE accounts ALTER COLUMN initial_balance SET NOT NULL;
+	CREATE TABLE IF NOT EXISTS reconciliation_runs (
+		id SERIAL PRIMARY KEY,
+		started_at TIMESTAMP NOT NULL,
+		finished_at TIMESTAMP NOT NULL,
+		accounts_checked INT NOT NULL,
+		discrepancies INT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS reconciliation_report (
+		run_id INT NOT NULL REFERENCES reconciliation_runs(id),
+		tenant_id TEXT NOT NULL,
+		account_id INT NOT NULL,
+		stored_balance NUMERIC NOT NULL,
+		computed_balance NUMERIC NOT NULL,
+		difference NUMERIC NOT NULL,
+		PRIMARY KEY (run_id, account_id)
+	);`,
+
+	// 18: manual balance adjustments
+	`CREATE TABLE IF NOT EXISTS adjustments (
+		id SERIAL PRIMARY KEY,
+		transaction_id INT NOT NULL REFERENCES transactions(id),
+		tenant_id TEXT NOT NULL,
+		account_id INT NOT NULL,
+		direction TEXT NOT NULL,
+		amount NUMERIC NOT NULL,
+		reason_code TEXT NOT NULL,
+		note TEXT,
+		posted_by TEXT NOT NULL,
+		balance_before NUMERIC NOT NULL,
+		balance_after NUMERIC NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS adjustments_account_idx ON adjustments (tenant_id, account_id);`,
+
+	// 19: hash-chained audit log. before and after keep the exact JSON that
+	// was hashed, and the trigger makes the table append-only.
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id BIGSERIAL PRIMARY KEY,
+		occurred_at TIMESTAMP NOT NULL,
+		actor TEXT NOT NULL,
+		tenant_id TEXT NOT NULL,
+		action TEXT NOT NULL,
+		entity_type TEXT NOT NULL,
+		entity_id TEXT NOT NULL,
+		before TEXT NOT NULL,
+		after TEXT NOT NULL,
+		prev_hash TEXT NOT NULL,
+		hash TEXT NOT NULL UNIQUE
+	);
+	CREATE INDEX IF NOT EXISTS audit_log_entity_idx ON audit_log (entity_type, entity_id);
+	CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+	BEGIN
+		RAISE EXCEPTION 'audit_log is append-only';
+	END;
+	$$ LANGUAGE plpgsql;
+	DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+	CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+		FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+	DROP TRIGGER IF EXISTS audit_log_no_truncate ON audit_log;
+	CREATE TRIGGER audit_log_no_truncate BEFORE TRUNCATE ON audit_log
+		FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only();`,
+
+	// 20: per-request access log
+	`CREATE TABLE IF NOT EXISTS access_log (
+		id BIGSERIAL PRIMARY KEY,
+		occurred_at TIMESTAMP NOT NULL,
+		request_id TEXT NOT NULL,
+		principal TEXT NOT NULL,
+		tenant_id TEXT NOT NULL,
+		method TEXT NOT NULL,
+		route TEXT NOT NULL,
+		path TEXT NOT NULL,
+		status INT NOT NULL,
+		duration_ms DOUBLE PRECISION NOT NULL,
+		remote_addr TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS access_log_occurred_idx ON access_log (occurred_at);
+	CREATE INDEX IF NOT EXISTS access_log_route_idx ON access_log (route, occurred_at);
+	CREATE INDEX IF NOT EXISTS access_log_request_idx ON access_log (request_id);`,
+
+	// 21: account event store; versions number the events of each account
+	`CREATE TABLE IF NOT EXISTS account_events (
+		seq BIGSERIAL PRIMARY KEY,
+		account_id INT NOT NULL,
+		tenant_id TEXT NOT NULL,
+		version INT NOT NULL,
+		type TEXT NOT NULL,
+		amount NUMERIC NOT NULL,
+		transaction_id INT,
+		occurred_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (account_id, version)
+	);`,
+
+	// 22: read model. Triggers queue changed accounts and transactions for
+	// the projector; existing rows are copied over once here.
+	`CREATE TABLE IF NOT EXISTS read_model_changes (
+		seq BIGSERIAL PRIMARY KEY,
+		entity TEXT NOT NULL,
+		entity_id BIGINT NOT NULL
+	);
+	CREATE OR REPLACE FUNCTION read_model_track() RETURNS trigger AS $$
+	BEGIN
+		INSERT INTO read_model_changes (entity, entity_id) VALUES (TG_TABLE_NAME, NEW.id);
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;
+	DROP TRIGGER IF EXISTS accounts_read_model ON accounts;
+	CREATE TRIGGER accounts_read_model AFTER INSERT OR UPDATE ON accounts
+		FOR EACH ROW EXECUTE FUNCTION read_model_track();
+	DROP TRIGGER IF EXISTS transactions_read_model ON transactions;
+	CREATE TRIGGER transactions_read_model AFTER INSERT OR UPDATE ON transactions
+		FOR EACH ROW EXECUTE FUNCTION read_model_track();
+	CREATE TABLE IF NOT EXISTS read_accounts (
+		id INT PRIMARY KEY,
+		tenant_id TEXT NOT NULL,
+		customer_id INT,
+		balance NUMERIC NOT NULL,
+		last_updated TIMESTAMP NOT NULL,
+		iban TEXT
+	);
+	CREATE INDEX IF NOT EXISTS read_accounts_customer_idx ON read_accounts (tenant_id, customer_id);
+	CREATE TABLE IF NOT EXISTS read_transactions (
+		id INT PRIMARY KEY,
+		tenant_id TEXT NOT NULL,
+		to_tenant_id TEXT NOT NULL,
+		from_account INT,
+		to_account INT,
+		amount NUMERIC NOT NULL,
+		status TEXT NOT NULL,
+		created_at TIMESTAMP,
+		completed_at TIMESTAMP,
+		failure_reason TEXT,
+		reference TEXT,
+		memo TEXT
+	);
+	CREATE INDEX IF NOT EXISTS read_transactions_tenant_created_idx ON read_transactions (tenant_id, created_at);
+	CREATE INDEX IF NOT EXISTS read_transactions_to_tenant_created_idx ON read_transactions (to_tenant_id, created_at);
+	CREATE INDEX IF NOT EXISTS read_transactions_reference_idx ON read_transactions (reference) WHERE reference IS NOT NULL;
+	INSERT INTO read_accounts (id, tenant_id, customer_id, balance, last_updated, iban)
+		SELECT id, tenant_id, customer_id, balance, last_updated, iban FROM accounts ON CONFLICT (id) DO NOTHING;
+	INSERT INTO read_transactions (id, tenant_id, to_tenant_id, from_account, to_account, amount, status, created_at, completed_at, failure_reason, reference, memo)
+		SELECT id, tenant_id, to_tenant_id, from_account, to_account, amount, status, created_at, completed_at, failure_reason, reference, memo FROM transactions ON CONFLICT (id) DO NOTHING;`,
+
+	// 23: dead-lettered external legs
+	`CREATE TABLE IF NOT EXISTS dead_letters (
+		id SERIAL PRIMARY KEY,
+		transaction_id INT NOT NULL REFERENCES transactions(id),
+		tenant_id TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		attempts INT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		resolution TEXT,
+		resolved_by TEXT,
+		resolved_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS dead_letters_open_idx ON dead_letters (tenant_id) WHERE resolved_at IS NULL;`,
+
+	// 24: leases for leader election
+	`CREATE TABLE IF NOT EXISTS leader_leases (
+		name TEXT PRIMARY KEY,
+		holder TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);`,
+
+	// 25: closed accounts
+	`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS closed_at TIMESTAMP;`,
+
+	// 26: feature flag overrides; tenant_id is empty for every tenant
+	`CREATE TABLE IF NOT EXISTS feature_flags (
+		name TEXT NOT NULL,
+		tenant_id TEXT NOT NULL DEFAULT '',
+		enabled BOOLEAN NOT NULL,
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (name, tenant_id)
+	);`,
+
+	// 27: maintenance mode; the single row exists while it is on
+	`CREATE TABLE IF NOT EXISTS maintenance (
+		id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+		message TEXT NOT NULL DEFAULT '',
+		retry_after_seconds INT NOT NULL,
+		started_at TIMESTAMP NOT NULL,
+		started_by TEXT NOT NULL
+	);`,
+
+	// 28: archive of transactions past retention. ledger_transactions is
+	// the whole ledger for balance computations.
+	`CREATE TABLE IF NOT EXISTS transactions_archive (
+		id INT PRIMARY KEY,
+		tenant_id TEXT NOT NULL,
+		to_tenant_id TEXT NOT NULL,
+		from_account INT,
+		to_account INT,
+		amount NUMERIC NOT NULL,
+		status TEXT NOT NULL,
+		created_at TIMESTAMP,
+		completed_at TIMESTAMP,
+		failure_reason TEXT,
+		reference TEXT,
+		memo TEXT,
+		archived_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS transactions_archive_tenant_created_idx ON transactions_archive (tenant_id, created_at);
+	CREATE INDEX IF NOT EXISTS transactions_archive_to_tenant_created_idx ON transactions_archive (to_tenant_id, created_at);
+	CREATE INDEX IF NOT EXISTS transactions_archive_reference_idx ON transactions_archive (reference) WHERE reference IS NOT NULL;
+	CREATE INDEX IF NOT EXISTS transactions_archive_from_account_idx ON transactions_archive (from_account);
+	CREATE INDEX IF NOT EXISTS transactions_archive_to_account_idx ON transactions_archive (to_account);
+	CREATE OR REPLACE VIEW ledger_transactions AS
+		SELECT id, tenant_id, to_tenant_id, from_account, to_account, amount, status, created_at, completed_at, failure_reason, reference, memo FROM transactions
+		UNION ALL
+		SELECT id, tenant_id, to_tenant_id, from_account, to_account, amount, status, created_at, completed_at, failure_reason, reference, memo FROM transactions_archive;`,
+
+	// 29: monthly partitions of transactions by created_at. The existing table
+	// is attached as the partition of everything before next month, so no
+	// rows are copied, and the partition job adds the months after it. A
+	// partitioned table can only be referenced through its whole primary key,
+	// so the foreign keys on transaction_id are dropped. Triggers and views
+	// follow the renamed table and are recreated on the new one.
+	`ALTER TABLE external_transfers DROP CONSTRAINT IF EXISTS external_transfers_transaction_id_fkey;
+	ALTER TABLE transfer_approvals DROP CONSTRAINT IF EXISTS transfer_approvals_transaction_id_fkey;
+	ALTER TABLE transfer_challenges DROP CONSTRAINT IF EXISTS transfer_challenges_transaction_id_fkey;
+	ALTER TABLE adjustments DROP CONSTRAINT IF EXISTS adjustments_transaction_id_fkey;
+	ALTER TABLE dead_letters DROP CONSTRAINT IF EXISTS dead_letters_transaction_id_fkey;
+	DROP TRIGGER IF EXISTS transactions_notify ON transactions;
+	DROP TRIGGER IF EXISTS transactions_read_model ON transactions;
+	UPDATE transactions SET created_at = COALESCE(completed_at, CURRENT_TIMESTAMP) WHERE created_at IS NULL;
+	ALTER TABLE transactions ALTER COLUMN created_at SET NOT NULL;
+	ALTER TABLE transactions RENAME TO transactions_legacy;
+	ALTER TABLE transactions_legacy RENAME CONSTRAINT transactions_pkey TO transactions_legacy_pkey;
+	ALTER INDEX transactions_tenant_id_idx RENAME TO transactions_legacy_tenant_id_idx;
+	ALTER INDEX transactions_reference_idx RENAME TO transactions_legacy_reference_idx;
+	CREATE TABLE transactions (LIKE transactions_legacy INCLUDING DEFAULTS INCLUDING CONSTRAINTS) PARTITION BY RANGE (created_at);
+	ALTER SEQUENCE transactions_id_seq OWNED BY transactions.id;
+	ALTER TABLE transactions ADD PRIMARY KEY (id, created_at);
+	CREATE INDEX transactions_tenant_id_idx ON transactions (tenant_id);
+	CREATE INDEX transactions_reference_idx ON transactions (reference) WHERE reference IS NOT NULL;
+	CREATE INDEX transactions_from_account_created_idx ON transactions (from_account, created_at);
+	CREATE INDEX transactions_to_account_created_idx ON transactions (to_account, created_at);
+	ALTER TABLE transactions ATTACH PARTITION transactions_legacy
+		FOR VALUES FROM (MINVALUE) TO (date_trunc('month', LOCALTIMESTAMP) + INTERVAL '1 month');
+	CREATE TABLE transactions_default PARTITION OF transactions DEFAULT;
+	CREATE OR REPLACE FUNCTION read_model_track() RETURNS trigger AS $$
+	BEGIN
+		INSERT INTO read_model_changes (entity, entity_id) VALUES (COALESCE(TG_ARGV[0], TG_TABLE_NAME), NEW.id);
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;
+	CREATE TRIGGER transactions_read_model AFTER INSERT OR UPDATE ON transactions
+		FOR EACH ROW EXECUTE FUNCTION read_model_track('transactions');
+	CREATE TRIGGER transactions_notify AFTER INSERT OR UPDATE OF status ON transactions
+		FOR EACH ROW EXECUTE FUNCTION notify_account_transfer();
+	CREATE OR REPLACE VIEW ledger_transactions AS
+		SELECT id, tenant_id, to_tenant_id, from_account, to_account, amount, status, created_at, completed_at, failure_reason, reference, memo FROM transactions
+		UNION ALL
+		SELECT id, tenant_id, to_tenant_id, from_account, to_account, amount, status, created_at, completed_at, failure_reason, reference, memo FROM transactions_archive;`,
+
+	// 30: erasure of customers' personal data and the trail of requests
+	`ALTER TABLE customers ADD COLUMN IF NOT EXISTS erased_at TIMESTAMP;
+	CREATE TABLE IF NOT EXISTS erasure_requests (
+		id SERIAL PRIMARY KEY,
+		tenant_id TEXT NOT NULL,
+		customer_id INT NOT NULL REFERENCES customers(id),
+		requested_by TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		outcome TEXT NOT NULL,
+		detail TEXT,
+		requested_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS erasure_requests_customer_idx ON erasure_requests (customer_id);`,
+
+	// 31: signatures of signed requests, kept while they could be replayed
+	`CREATE TABLE IF NOT EXISTS request_signatures (
+		client_id TEXT NOT NULL,
+		signature TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (client_id, signature)
+	);
+	CREATE INDEX IF NOT EXISTS request_signatures_expires_idx ON request_signatures (expires_at);`,
+
+	// 32: Idempotency-Key claims and the responses replayed for them
+	`CREATE TABLE IF NOT EXISTS idempotency_keys (
+		tenant_id TEXT NOT NULL,
+		key TEXT NOT NULL,
+		request_hash TEXT NOT NULL,
+		status INT,
+		content_type TEXT,
+		body BYTEA,
+		expires_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (tenant_id, key)
+	);
+	CREATE INDEX IF NOT EXISTS idempotency_keys_expires_idx ON idempotency_keys (expires_at);`,
+
+	// 33: account transaction history pages of the read model
+	`CREATE INDEX IF NOT EXISTS read_transactions_from_account_idx ON read_transactions (from_account, id);
+	CREATE INDEX IF NOT EXISTS read_transactions_to_account_idx ON read_transactions (to_account, id);`,
+
+	// 34: usage counters of the API key quotas
+	`CREATE TABLE IF NOT EXISTS api_quota_usage (
+		principal TEXT NOT NULL,
+		metric TEXT NOT NULL,
+		period TEXT NOT NULL,
+		period_start TIMESTAMP NOT NULL,
+		used INT NOT NULL,
+		PRIMARY KEY (principal, metric, period, period_start)
+	);
+	CREATE INDEX IF NOT EXISTS api_quota_usage_period_start_idx ON api_quota_usage (period_start);`,
+
+	// 35: escrows and the transactions holding and settling them
+	`CREATE TABLE IF NOT EXISTS escrows (
+		id SERIAL PRIMARY KEY,
+		tenant_id TEXT NOT NULL,
+		from_account INT NOT NULL,
+		to_account INT NOT NULL,
+		to_tenant_id TEXT NOT NULL,
+		amount NUMERIC NOT NULL,
+		fee NUMERIC NOT NULL,
+		condition TEXT NOT NULL,
+		release_after TIMESTAMP,
+		status TEXT NOT NULL,
+		hold_transaction_id INT NOT NULL,
+		settlement_transaction_id INT,
+		created_by TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		settled_by TEXT,
+		settled_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS escrows_tenant_status_idx ON escrows (tenant_id, status);`,
+
+	// 36: named wallets splitting the balance of an account
+	`CREATE TABLE IF NOT EXISTS account_wallets (
+		account_id INT NOT NULL REFERENCES accounts(id),
+		name TEXT NOT NULL,
+		balance NUMERIC NOT NULL CHECK (balance >= 0),
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (account_id, name)
+	);`,
+
+	// 37: disputes of transfers and the holds they place
+	`CREATE TABLE IF NOT EXISTS disputes (
+		id SERIAL PRIMARY KEY,
+		tenant_id TEXT NOT NULL,
+		transaction_id INT NOT NULL,
+		from_account INT NOT NULL,
+		account_id INT NOT NULL,
+		account_tenant_id TEXT NOT NULL,
+		amount NUMERIC NOT NULL CHECK (amount > 0),
+		reason TEXT NOT NULL,
+		status TEXT NOT NULL,
+		reversal_transaction_id INT,
+		opened_by TEXT NOT NULL,
+		opened_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		resolved_by TEXT,
+		resolved_at TIMESTAMP
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS disputes_open_transaction_idx ON disputes (transaction_id) WHERE status = 'open';
+	CREATE INDEX IF NOT EXISTS disputes_account_open_idx ON disputes (account_id) WHERE status = 'open';
+	CREATE INDEX IF NOT EXISTS disputes_tenant_status_idx ON disputes (tenant_id, status, id);`,
+
+	// 38: partial refunds of transfers
+	`CREATE TABLE IF NOT EXISTS transaction_refunds (
+		id SERIAL PRIMARY KEY,
+		tenant_id TEXT NOT NULL,
+		transaction_id INT NOT NULL,
+		refund_transaction_id INT NOT NULL,
+		amount NUMERIC NOT NULL CHECK (amount > 0),
+		reason TEXT NOT NULL DEFAULT '',
+		created_by TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS transaction_refunds_transaction_idx ON transaction_refunds (transaction_id);`,
+
+	// 39: transaction searches sorted by amount
+	`CREATE INDEX IF NOT EXISTS read_transactions_tenant_amount_idx ON read_transactions (tenant_id, amount, id);`,
+
+	// 40: scheduled job switches and run history; a job has at most one
+	// running run
+	`CREATE TABLE IF NOT EXISTS scheduled_jobs (
+		name TEXT PRIMARY KEY,
+		enabled BOOLEAN NOT NULL,
+		updated_by TEXT NOT NULL,
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE TABLE IF NOT EXISTS job_runs (
+		id SERIAL PRIMARY KEY,
+		job TEXT NOT NULL,
+		instance TEXT NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		started_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		finished_at TIMESTAMP
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS job_runs_running_idx ON job_runs (job) WHERE status = 'running';
+	CREATE INDEX IF NOT EXISTS job_runs_job_idx ON job_runs (job, id);`,
+
+	// 41: message IDs of transfer commands received from brokers
+	`CREATE TABLE IF NOT EXISTS inbound_commands (
+		source TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		tenant_id TEXT NOT NULL,
+		status TEXT NOT NULL,
+		code INT NOT NULL DEFAULT 0,
+		transaction_id INT,
+		received_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		processed_at TIMESTAMP,
+		PRIMARY KEY (source, message_id)
+	);`,
+
+	// 42: transfer events queued for the message broker alongside the
+	// notification of the WebSocket feed
+	`CREATE TABLE IF NOT EXISTS transfer_outbox (
+		seq BIGSERIAL PRIMARY KEY,
+		payload JSONB NOT NULL
+	);
+	CREATE OR REPLACE FUNCTION notify_account_transfer() RETURNS trigger AS $$
+	DECLARE
+		payload JSON;
+	BEGIN
+		IF TG_OP = 'INSERT' OR NEW.status IS DISTINCT FROM OLD.status THEN
+			payload := json_build_object(
+				'transaction_id', NEW.id,
+				'source_account_id', NEW.from_account, 'destination_account_id', NEW.to_account,
+				'tenant_id', NEW.tenant_id, 'to_tenant_id', NEW.to_tenant_id,
+				'amount', NEW.amount, 'status', NEW.status);
+			PERFORM pg_notify('account_transfers', payload::text);
+			INSERT INTO transfer_outbox (payload) VALUES (payload);
+		END IF;
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;`,
+
+	// 43: webhook subscriptions, the transfer events queued for them and the
+	// log of delivery attempts
+	`CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+		id SERIAL PRIMARY KEY,
+		tenant_id TEXT NOT NULL,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		deleted_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS webhook_subscriptions_tenant_idx ON webhook_subscriptions (tenant_id) WHERE deleted_at IS NULL;
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id BIGSERIAL PRIMARY KEY,
+		subscription_id INT NOT NULL REFERENCES webhook_subscriptions(id),
+		event_id BIGINT NOT NULL,
+		payload JSONB NOT NULL,
+		status TEXT NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		delivered_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_subscription_idx ON webhook_deliveries (subscription_id, id);
+	CREATE TABLE IF NOT EXISTS webhook_attempts (
+		id BIGSERIAL PRIMARY KEY,
+		delivery_id BIGINT NOT NULL REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+		attempted_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		status_code INT NOT NULL,
+		error TEXT NOT NULL,
+		duration_ms BIGINT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS webhook_attempts_delivery_idx ON webhook_attempts (delivery_id, id);`,
+	// 44: the type accounts are opened with, selecting their minimum balance
+	`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS account_type TEXT;`,
+	// 45: sweep rules and the log of the transfers they made
+	`CREATE TABLE IF NOT EXISTS sweep_rules (
+		id SERIAL PRIMARY KEY,
+		tenant_id TEXT NOT NULL,
+		account_id INT NOT NULL,
+		to_account_id INT NOT NULL,
+		threshold NUMERIC NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		deleted_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS sweep_rules_account_idx ON sweep_rules (tenant_id, account_id) WHERE deleted_at IS NULL;
+	CREATE TABLE IF NOT EXISTS sweep_executions (
+		id BIGSERIAL PRIMARY KEY,
+		rule_id INT NOT NULL REFERENCES sweep_rules(id),
+		amount NUMERIC NOT NULL,
+		status TEXT NOT NULL,
+		transaction_id INT,
+		code INT NOT NULL DEFAULT 0,
+		message TEXT NOT NULL DEFAULT '',
+		executed_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS sweep_executions_rule_idx ON sweep_executions (rule_id, id);`,
+	// 46: account aliases, unique per tenant
+	`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS alias TEXT;
+	CREATE UNIQUE INDEX IF NOT EXISTS accounts_alias_key ON accounts (tenant_id, alias);`,
+	// 47: identifiers of accounts in other systems, unique per tenant
+	`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS external_ref TEXT;
+	CREATE UNIQUE INDEX IF NOT EXISTS accounts_external_ref_key ON accounts (tenant_id, external_ref);`,
+	// 48: two-phase transfers, holding funds until confirmed or aborted
+	`CREATE TABLE IF NOT EXISTS prepared_transfers (
+		id SERIAL PRIMARY KEY,
+		token TEXT NOT NULL UNIQUE,
+		tenant_id TEXT NOT NULL,
+		from_account INT NOT NULL,
+		to_account INT NOT NULL,
+		to_tenant_id TEXT NOT NULL,
+		amount NUMERIC NOT NULL,
+		fee NUMERIC NOT NULL,
+		reference TEXT NOT NULL DEFAULT '',
+		memo TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		transaction_id INT,
+		created_by TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		expires_at TIMESTAMP NOT NULL,
+		finished_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS prepared_transfers_from_idx ON prepared_transfers (from_account) WHERE status = 'prepared';`,
+	// 49: term deposits, locking funds of an account until they mature
+	`CREATE TABLE IF NOT EXISTS term_deposits (
+		id SERIAL PRIMARY KEY,
+		tenant_id TEXT NOT NULL,
+		account_id INT NOT NULL,
+		amount NUMERIC NOT NULL,
+		rate NUMERIC NOT NULL,
+		term_days INT NOT NULL,
+		interest NUMERIC NOT NULL,
+		penalty NUMERIC NOT NULL DEFAULT 0,
+		status TEXT NOT NULL,
+		transaction_id INT,
+		created_by TEXT NOT NULL,
+		opened_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		matures_at TIMESTAMP NOT NULL,
+		closed_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS term_deposits_account_idx ON term_deposits (account_id) WHERE status = 'active';
+	CREATE INDEX IF NOT EXISTS term_deposits_maturity_idx ON term_deposits (matures_at) WHERE status = 'active';`,
+	// 50: categories and tags of transactions, kept through the read model,
+	// the archive and prepared transfers
+	`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS category TEXT, ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+	ALTER TABLE read_transactions ADD COLUMN IF NOT EXISTS category TEXT, ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+	ALTER TABLE transactions_archive ADD COLUMN IF NOT EXISTS category TEXT, ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+	ALTER TABLE prepared_transfers ADD COLUMN IF NOT EXISTS category TEXT NOT NULL DEFAULT '', ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+	CREATE INDEX IF NOT EXISTS read_transactions_category_idx ON read_transactions (tenant_id, category) WHERE category IS NOT NULL;
+	CREATE INDEX IF NOT EXISTS read_transactions_tags_idx ON read_transactions USING GIN (tags);
+	CREATE OR REPLACE VIEW ledger_transactions AS
+		SELECT id, tenant_id, to_tenant_id, from_account, to_account, amount, status, created_at, completed_at, failure_reason, reference, memo, category, tags FROM transactions
+		UNION ALL
+		SELECT id, tenant_id, to_tenant_id, from_account, to_account, amount, status, created_at, completed_at, failure_reason, reference, memo, category, tags FROM transactions_archive;`,
+}
+
+// migrate brings the database schema up to date
+func migrate(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	var current int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version) VALUES ($1)", version); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+	}
+	return nil
+}
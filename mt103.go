@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WireConfig configures the SWIFT MT103 messages generated for outbound wires
+type WireConfig struct {
+	SenderBIC string `json:"sender_bic"`
+	Currency  string `json:"currency"`
+	// OutboundDir receives a copy of every generated message when set
+	OutboundDir string `json:"outbound_dir"`
+}
+
+// mt103Data is the transaction data rendered into an MT103
+type mt103Data struct {
+	TransactionID   int
+	CreatedAt       time.Time
+	Amount          float64
+	OrderingAccount string
+	OrderingName    string
+	BIC             string
+	BeneficiaryAcct string
+	BeneficiaryName string
+}
+
+// buildMT103 renders the MT103 of an outbound wire of tenant
+func (a *App) buildMT103(ctx context.Context, tenant string, transactionID int) (string, *apiError) {
+	var d mt103Data
+	var orderingIBAN, orderingName, beneficiaryIBAN, beneficiaryAcct sql.NullString
+	err := a.DB.QueryRowContext(ctx, `SELECT t.id, t.created_at, t.amount, t.from_account, acc.iban, c.name, e.bic, e.iban, e.account_number, e.beneficiary_name
+		FROM external_transfers e
+		JOIN transactions t ON t.id = e.transaction_id
+		JOIN accounts acc ON acc.id = t.from_account
+		LEFT JOIN customers c ON c.id = acc.customer_id
+		WHERE e.transaction_id = $1 AND e.tenant_id = $2 AND e.rail = $3`, transactionID, tenant, RailWire).
+		Scan(&d.TransactionID, &d.CreatedAt, &d.Amount, &d.OrderingAccount, &orderingIBAN, &orderingName, &d.BIC, &beneficiaryIBAN, &beneficiaryAcct, &d.BeneficiaryName)
+	if err == sql.ErrNoRows {
+		return "", newAPIError("Wire transfer not found", 1042, http.StatusNotFound)
+	}
+	if err != nil {
+		return "", newAPIError("Failed to load wire transfer", 1005, http.StatusInternalServerError)
+	}
+
+	if orderingIBAN.Valid {
+		d.OrderingAccount = orderingIBAN.String
+	}
+	d.OrderingName = orderingName.String
+	if d.OrderingName == "" {
+		d.OrderingName = "ACCOUNT " + d.OrderingAccount
+	}
+	d.BeneficiaryAcct = beneficiaryAcct.String
+	if beneficiaryIBAN.String != "" {
+		d.BeneficiaryAcct = beneficiaryIBAN.String
+	}
+
+	return formatMT103(a.Config.External.Wire, d), nil
+}
+
+// dropMT103 writes the MT103 of a committed wire to the outbound directory.
+// Failures are logged; the message can always be fetched again through the
+// API.
+func (a *App) dropMT103(ctx context.Context, tenant string, transactionID int) {
+	msg, apiErr := a.buildMT103(ctx, tenant, transactionID)
+	if apiErr != nil {
+		log.Printf("mt103: transaction %d: %s", transactionID, apiErr.Message)
+		return
+	}
+	path := filepath.Join(a.Config.External.Wire.OutboundDir, fmt.Sprintf("MT103-%d.txt", transactionID))
+	if err := os.WriteFile(path, []byte(msg), 0o640); err != nil {
+		log.Printf("mt103: transaction %d: %v", transactionID, err)
+	}
+}
+
+// formatMT103 renders d as a SWIFT FIN MT103 single customer credit transfer
+func formatMT103(cfg WireConfig, d mt103Data) string {
+	amount := strings.Replace(strconv.FormatFloat(d.Amount, 'f', 2, 64), ".", ",", 1)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "{1:F01%s0000000000}", swiftAddress(cfg.SenderBIC))
+	fmt.Fprintf(&b, "{2:I103%sN}", swiftAddress(d.BIC))
+	b.WriteString("{4:\r\n")
+	fmt.Fprintf(&b, ":20:TXN%d\r\n", d.TransactionID)
+	b.WriteString(":23B:CRED\r\n")
+	fmt.Fprintf(&b, ":32A:%s%s%s\r\n", d.CreatedAt.Format("060102"), cfg.Currency, amount)
+	fmt.Fprintf(&b, ":50K:/%s\r\n%s\r\n", d.OrderingAccount, swiftLine(d.OrderingName))
+	fmt.Fprintf(&b, ":57A:%s\r\n", d.BIC)
+	fmt.Fprintf(&b, ":59:/%s\r\n%s\r\n", d.BeneficiaryAcct, swiftLine(d.BeneficiaryName))
+	b.WriteString(":71A:SHA\r\n")
+	b.WriteString("-}")
+	return b.String()
+}
+
+// swiftAddress expands a BIC to the 12 character logical terminal address
+func swiftAddress(bic string) string {
+	branch := "XXX"
+	if len(bic) == 11 {
+		branch = bic[8:]
+	}
+	if len(bic) < 8 {
+		bic += strings.Repeat("X", 8-len(bic))
+	}
+	return bic[:8] + "X" + branch
+}
+
+// swiftLine upper-cases s and truncates it to the 35 characters of a line
+func swiftLine(s string) string {
+	s = strings.ToUpper(s)
+	if len(s) > 35 {
+		return s[:35]
+	}
+	return s
+}
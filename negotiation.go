@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// responseFormat is an encoding of APIResponse a client can ask for in the
+// Accept header
+type responseFormat int
+
+const (
+	formatJSON responseFormat = iota
+	formatXML
+	formatProtobuf
+)
+
+const protobufContentType = "application/x-protobuf"
+
+// mediaFormats maps the accepted media types to the format served for them
+var mediaFormats = map[string]responseFormat{
+	"application/json":                formatJSON,
+	"application/*":                   formatJSON,
+	"*/*":                             formatJSON,
+	"application/xml":                 formatXML,
+	"text/xml":                        formatXML,
+	protobufContentType:               formatProtobuf,
+	"application/protobuf":            formatProtobuf,
+	"application/vnd.google.protobuf": formatProtobuf,
+}
+
+// negotiateFormat picks the format with the highest quality in an Accept
+// header, in the client's order on ties. Media types we cannot produce are
+// ignored, so they get JSON rather than 406: the same header selects the CSV,
+// NDJSON and PDF representations of the endpoints offering them.
+func negotiateFormat(accept string) responseFormat {
+	best, bestQ := formatJSON, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		format, ok := mediaFormats[mediaType]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// formatWriter carries the negotiated format and message language down to
+// the response helpers
+type formatWriter struct {
+	http.ResponseWriter
+	format   responseFormat
+	language string
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (fw *formatWriter) Unwrap() http.ResponseWriter {
+	return fw.ResponseWriter
+}
+
+// withContentNegotiation records the format of APIResponse bodies chosen by
+// the Accept header and the language of their messages chosen by the
+// Accept-Language header of every request
+func withContentNegotiation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept, Accept-Language")
+		next.ServeHTTP(&formatWriter{
+			ResponseWriter: w,
+			format:         negotiateFormat(r.Header.Get("Accept")),
+			language:       negotiateLanguage(r.Header.Get("Accept-Language")),
+		}, r)
+	})
+}
+
+// negotiated finds the formatWriter through the writers wrapping it, or nil
+// outside withContentNegotiation
+func negotiated(w http.ResponseWriter) *formatWriter {
+	for {
+		switch t := w.(type) {
+		case *formatWriter:
+			return t
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = t.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// formatOf returns the negotiated format
+func formatOf(w http.ResponseWriter) responseFormat {
+	if fw := negotiated(w); fw != nil {
+		return fw.format
+	}
+	return formatJSON
+}
+
+// languageOf returns the negotiated message language
+func languageOf(w http.ResponseWriter) string {
+	if fw := negotiated(w); fw != nil {
+		return fw.language
+	}
+	return defaultLanguage
+}
+
+// writeResponse writes resp in the format and language negotiated for the
+// request. Only the message is translated; the code stays the same in every
+// language.
+func writeResponse(w http.ResponseWriter, statusCode int, resp APIResponse) {
+	language := languageOf(w)
+	resp.Message = localize(language, resp.Message)
+	w.Header().Set("Content-Language", language)
+
+	var contentType string
+	var body []byte
+	var err error
+	switch formatOf(w) {
+	case formatXML:
+		contentType = "application/xml; charset=utf-8"
+		body, err = marshalXML(resp)
+	case formatProtobuf:
+		contentType = protobufContentType
+		body, err = marshalProto(resp)
+	}
+	if err != nil {
+		// fall back to JSON rather than fail the request
+		log.Printf("encode %s response: %v", contentType, err)
+		body = nil
+	}
+	if body == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
+
+// marshalXML encodes the JSON form of resp as XML under a <response> root,
+// so both carry the same field names in the same order. Objects become
+// elements named after their keys, array elements are <item>s and nulls are
+// left out.
+func marshalXML(resp APIResponse) ([]byte, error) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := writeXMLValue(enc, dec, "response"); err != nil {
+		return nil, err
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+func writeXMLValue(enc *xml.Encoder, dec *json.Decoder, name string) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	start := xmlElement(name)
+	switch t := tok.(type) {
+	case nil:
+		return nil
+	case json.Delim:
+		if err := enc.EncodeToken(start); err != nil {
+			return err
+		}
+		for dec.More() {
+			child := "item"
+			if t == '{' {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				child = key.(string)
+			}
+			if err := writeXMLValue(enc, dec, child); err != nil {
+				return err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		return enc.EncodeToken(start.End())
+	default:
+		return enc.EncodeElement(fmt.Sprint(t), start)
+	}
+}
+
+// xmlElement names the element of a JSON key, falling back to
+// <entry key="..."> for keys that are not XML names, such as dates
+func xmlElement(key string) xml.StartElement {
+	if validXMLName(key) {
+		return xml.StartElement{Name: xml.Name{Local: key}}
+	}
+	return xml.StartElement{Name: xml.Name{Local: "entry"}, Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: key}}}
+}
+
+func validXMLName(s string) bool {
+	if s == "" || strings.HasPrefix(strings.ToLower(s), "xml") {
+		return false
+	}
+	for i, r := range s {
+		if r == '_' || unicode.IsLetter(r) || i > 0 && (unicode.IsDigit(r) || r == '-' || r == '.') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// marshalProto encodes resp as the APIResponse message of apiresponse.proto.
+// Data is a google.protobuf.Value built from its JSON form, so it needs no
+// message per endpoint.
+func marshalProto(resp APIResponse) ([]byte, error) {
+	var b []byte
+	b = appendProtoString(b, 1, resp.Status)
+	if resp.Code != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(resp.Code))
+	}
+	b = appendProtoString(b, 3, resp.Message)
+	if resp.Data != nil {
+		data, err := json.Marshal(resp.Data)
+		if err != nil {
+			return nil, err
+		}
+		var generic interface{}
+		if err := json.Unmarshal(data, &generic); err != nil {
+			return nil, err
+		}
+		value, err := structpb.NewValue(generic)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := proto.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendBytes(b, msg)
+	}
+	for _, fe := range resp.Errors {
+		var msg []byte
+		msg = appendProtoString(msg, 1, fe.Field)
+		msg = appendProtoString(msg, 2, fe.Message)
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendBytes(b, msg)
+	}
+	if resp.Pagination != nil {
+		var msg []byte
+		msg = appendProtoString(msg, 1, resp.Pagination.NextCursor)
+		msg = appendProtoString(msg, 2, resp.Pagination.PrevCursor)
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendBytes(b, msg)
+	}
+	return b, nil
+}
+
+// appendProtoString appends a string field, omitting it when empty as proto3
+// does
+func appendProtoString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Notification channels
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+)
+
+// Transfer events customers can subscribe to
+const (
+	EventTransferCompleted = "completed"
+	EventTransferFailed    = "failed"
+)
+
+// NotificationConfig configures the channels and the dispatch queue of
+// transfer notifications. A channel is enabled once its provider is set.
+type NotificationConfig struct {
+	SMTP                 SMTPConfig `json:"smtp"`
+	SMS                  SMSConfig  `json:"sms"`
+	Workers              int        `json:"workers"`
+	QueueSize            int        `json:"queue_size"`
+	MaxAttempts          int        `json:"max_attempts"`
+	RetryIntervalSeconds int        `json:"retry_interval_seconds"`
+}
+
+// SMTPConfig configures email delivery
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+}
+
+// SMSConfig configures SMS delivery through a Twilio-compatible API
+type SMSConfig struct {
+	BaseURL    string `json:"base_url"`
+	AccountSID string `json:"account_sid"`
+	AuthToken  string `json:"auth_token"`
+	From       string `json:"from"`
+}
+
+// Notification is one message to a customer
+type Notification struct {
+	Channel string
+	To      string
+	Subject string
+	Body    string
+}
+
+// Notifier delivers notifications over one channel. Errors are retried.
+type Notifier interface {
+	Send(ctx context.Context, n Notification) error
+}
+
+// NotificationPreferences are a customer's opt-ins; customers without any
+// receive no notifications
+type NotificationPreferences struct {
+	Email  bool     `json:"email"`
+	SMS    bool     `json:"sms"`
+	Phone  string   `json:"phone,omitempty"`
+	Events []string `json:"events"`
+}
+
+func (p *NotificationPreferences) validate() *apiError {
+	var v validator
+	v.check(!p.SMS || p.Phone != "", "phone", "is required when sms is enabled")
+	v.check(len(p.Phone) <= 20, "phone", "must be at most 20 characters")
+	for _, e := range p.Events {
+		v.check(e == EventTransferCompleted || e == EventTransferFailed, "events", fmt.Sprintf("unknown event %q", e))
+	}
+	return v.err()
+}
+
+func (p NotificationPreferences) subscribed(event string) bool {
+	for _, e := range p.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// smtpNotifier sends email through an SMTP relay
+type smtpNotifier struct {
+	cfg SMTPConfig
+}
+
+func (s smtpNotifier) Send(ctx context.Context, n Notification) error {
+	var auth smtp.Auth
+	if s.cfg.Username != "" {
+		auth = smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host)
+	}
+	msg := "From: " + s.cfg.From + "\r\n" +
+		"To: " + n.To + "\r\n" +
+		"Subject: " + n.Subject + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + n.Body + "\r\n"
+	addr := s.cfg.Host + ":" + strconv.Itoa(s.cfg.Port)
+	return smtp.SendMail(addr, auth, s.cfg.From, []string{n.To}, []byte(msg))
+}
+
+// smsNotifier sends SMS through the Messages resource of a Twilio-compatible
+// API
+type smsNotifier struct {
+	cfg    SMSConfig
+	client *http.Client
+}
+
+func (s *smsNotifier) Send(ctx context.Context, n Notification) error {
+	form := url.Values{"To": {n.To}, "From": {s.cfg.From}, "Body": {n.Body}}
+	endpoint := strings.TrimRight(s.cfg.BaseURL, "/") + "/2010-04-01/Accounts/" + url.PathEscape(s.cfg.AccountSID) + "/Messages.json"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(s.cfg.AccountSID, s.cfg.AuthToken)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("SMS provider returned %s", resp.Status)
+	}
+	return nil
+}
+
+// notificationDispatcher sends transfer notifications off the request path
+type notificationDispatcher struct {
+	db        *sql.DB
+	cfg       NotificationConfig
+	notifiers map[string]Notifier
+	queue     chan int
+}
+
+// newNotificationDispatcher returns nil when no channel is configured
+func newNotificationDispatcher(db *sql.DB, cfg NotificationConfig) *notificationDispatcher {
+	notifiers := map[string]Notifier{}
+	if cfg.SMTP.Host != "" {
+		notifiers[ChannelEmail] = smtpNotifier{cfg: cfg.SMTP}
+	}
+	if cfg.SMS.BaseURL != "" {
+		notifiers[ChannelSMS] = &smsNotifier{cfg: cfg.SMS, client: &http.Client{Timeout: 10 * time.Second}}
+	}
+	if len(notifiers) == 0 {
+		return nil
+	}
+	return &notificationDispatcher{db: db, cfg: cfg, notifiers: notifiers, queue: make(chan int, cfg.QueueSize)}
+}
+
+// start runs the dispatch workers until ctx is cancelled
+func (d *notificationDispatcher) start(ctx context.Context) {
+	for i := 0; i < d.cfg.Workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case id := <-d.queue:
+					d.dispatch(ctx, id)
+				}
+			}
+		}()
+	}
+}
+
+// notifyTransfer queues notifications about the outcome of a transaction.
+// Notifications are best effort and dropped when the queue is full.
+func (a *App) notifyTransfer(transactionID int) {
+	if a.Notifications == nil {
+		return
+	}
+	select {
+	case a.Notifications.queue <- transactionID:
+	default:
+		log.Printf("notifications: queue full, dropping transaction %d", transactionID)
+	}
+}
+
+// dispatch notifies the subscribed owners of the accounts of a transaction:
+// the sender of completed and failed transfers, the recipient of completed
+// ones
+func (d *notificationDispatcher) dispatch(ctx context.Context, transactionID int) {
+	t, err := scanTransaction(d.db.QueryRowContext(ctx, "SELECT "+transactionColumns+" FROM transactions WHERE id = $1", transactionID))
+	if err != nil {
+		log.Printf("notifications: transaction %d: %v", transactionID, err)
+		return
+	}
+
+	var event string
+	switch t.Status {
+	case TxCompleted:
+		event = EventTransferCompleted
+	case TxFailed, TxReversed:
+		event = EventTransferFailed
+	default:
+		return
+	}
+
+	if t.FromAccountID != nil {
+		var body string
+		if event == EventTransferCompleted {
+			body = fmt.Sprintf("Your transfer %d of %.2f from account %d has completed.", t.ID, t.Amount, *t.FromAccountID)
+		} else {
+			body = fmt.Sprintf("Your transfer %d of %.2f from account %d has failed", t.ID, t.Amount, *t.FromAccountID)
+			if t.FailureReason != nil {
+				body += ": " + *t.FailureReason
+			}
+			body += "."
+		}
+		d.notifyOwner(ctx, *t.FromAccountID, event, "Transfer "+event, body)
+	}
+	if t.ToAccountID != nil && event == EventTransferCompleted {
+		body := fmt.Sprintf("Account %d has received %.2f (transfer %d).", *t.ToAccountID, t.Amount, t.ID)
+		d.notifyOwner(ctx, *t.ToAccountID, event, "Funds received", body)
+	}
+}
+
+func (d *notificationDispatcher) notifyOwner(ctx context.Context, accountID int, event, subject, body string) {
+	var email string
+	var prefs NotificationPreferences
+	err := d.db.QueryRowContext(ctx, `SELECT c.email, p.email, p.sms, COALESCE(p.phone, ''), p.events
+		FROM accounts a JOIN customers c ON c.id = a.customer_id JOIN notification_preferences p ON p.customer_id = c.id
+		WHERE a.id = $1`, accountID).Scan(&email, &prefs.Email, &prefs.SMS, &prefs.Phone, pq.Array(&prefs.Events))
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		log.Printf("notifications: account %d: %v", accountID, err)
+		return
+	}
+	if !prefs.subscribed(event) {
+		return
+	}
+
+	if prefs.Email {
+		d.send(ctx, Notification{Channel: ChannelEmail, To: email, Subject: subject, Body: body})
+	}
+	if prefs.SMS {
+		d.send(ctx, Notification{Channel: ChannelSMS, To: prefs.Phone, Body: body})
+	}
+}
+
+// send delivers n, retrying provider errors with a growing delay
+func (d *notificationDispatcher) send(ctx context.Context, n Notification) {
+	notifier, ok := d.notifiers[n.Channel]
+	if !ok {
+		return
+	}
+	for attempt := 1; ; attempt++ {
+		err := notifier.Send(ctx, n)
+		if err == nil {
+			return
+		}
+		if attempt >= d.cfg.MaxAttempts {
+			log.Printf("notifications: %s to %s failed after %d attempts: %v", n.Channel, n.To, attempt, err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(attempt*d.cfg.RetryIntervalSeconds) * time.Second):
+		}
+	}
+}
+
+// handleNotificationPreferences serves GET and PUT
+// /customers/{id}/notifications for a customer of the request's tenant
+func (a *App) handleNotificationPreferences(w http.ResponseWriter, r *http.Request, c Customer) {
+	customerID := c.ID
+	switch r.Method {
+	case http.MethodGet:
+		prefs := NotificationPreferences{Events: []string{}}
+		err := a.DB.QueryRowContext(r.Context(), "SELECT email, sms, COALESCE(phone, ''), events FROM notification_preferences WHERE customer_id = $1", customerID).
+			Scan(&prefs.Email, &prefs.SMS, &prefs.Phone, pq.Array(&prefs.Events))
+		if err != nil && err != sql.ErrNoRows {
+			writeJSONError(w, "Failed to load notification preferences", 1005, http.StatusInternalServerError)
+			return
+		}
+		writeJSONSuccess(w, prefs, "Notification preferences retrieved", 2017, http.StatusOK)
+
+	case http.MethodPut:
+		var prefs NotificationPreferences
+		if apiErr := decodeJSON(r, &prefs, 1002); apiErr != nil {
+			writeAPIError(w, apiErr)
+			return
+		}
+		prefs.Phone = strings.TrimSpace(prefs.Phone)
+		if prefs.Events == nil {
+			prefs.Events = []string{}
+		}
+		if apiErr := prefs.validate(); apiErr != nil {
+			writeAPIError(w, apiErr)
+			return
+		}
+
+		_, err := a.DB.ExecContext(r.Context(), `INSERT INTO notification_preferences (customer_id, email, sms, phone, events) VALUES ($1, $2, $3, NULLIF($4, ''), $5)
+			ON CONFLICT (customer_id) DO UPDATE SET email = EXCLUDED.email, sms = EXCLUDED.sms, phone = EXCLUDED.phone, events = EXCLUDED.events, updated_at = NOW()`,
+			customerID, prefs.Email, prefs.SMS, prefs.Phone, pq.Array(prefs.Events))
+		if err != nil {
+			writeJSONError(w, "Failed to save notification preferences", 1005, http.StatusInternalServerError)
+			return
+		}
+		a.auditCommitted(r.Context(), auditRecord{
+			TenantID:   tenantFromContext(r.Context()),
+			Action:     "notification_preferences.updated",
+			EntityType: "customer",
+			EntityID:   strconv.Itoa(customerID),
+			After:      prefs,
+		})
+		writeJSONSuccess(w, prefs, "Notification preferences updated", 2018, http.StatusOK)
+
+	default:
+		writeJSONError(w, "Only GET and PUT methods are allowed", 1006, http.StatusMethodNotAllowed)
+	}
+}
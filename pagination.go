@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Page sizes of list endpoints
+const (
+	defaultPageSize = 100
+	maxPageSize     = 100
+)
+
+// Pagination carries the cursors of the neighbouring pages of a list
+// response. Pass one as the cursor query parameter to fetch that page.
+type Pagination struct {
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"prev_cursor,omitempty"`
+}
+
+// pageCursor is the decoded form of a cursor: the key of the last row of the
+// current page in the requested direction, and its sort value when the list
+// is sorted by another column. Cursors are keyset positions, so rows written
+// meanwhile neither shift nor repeat the pages.
+type pageCursor struct {
+	Key      int64    `json:"k"`
+	Value    *float64 `json:"v,omitempty"`
+	Backward bool     `json:"b,omitempty"`
+}
+
+func (c pageCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// pageRequest is the page a list request asks for
+type pageRequest struct {
+	limit  int
+	cursor *pageCursor
+	desc   bool // whether the list is ordered by descending key
+}
+
+// parsePage reads the limit and cursor query parameters for a list ordered
+// by its key, descending when desc is set
+func parsePage(r *http.Request, desc bool) (pageRequest, *apiError) {
+	p := pageRequest{limit: defaultPageSize, desc: desc}
+	q := r.URL.Query()
+	if raw := q.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxPageSize {
+			return p, newAPIError(fmt.Sprintf("limit must be between 1 and %d", maxPageSize), 1083, http.StatusBadRequest)
+		}
+		p.limit = n
+	}
+	if raw := q.Get("cursor"); raw != "" {
+		data, err := base64.RawURLEncoding.DecodeString(raw)
+		var c pageCursor
+		if err != nil || json.Unmarshal(data, &c) != nil {
+			return p, newAPIError("Invalid cursor", 1083, http.StatusBadRequest)
+		}
+		p.cursor = &c
+	}
+	return p, nil
+}
+
+// keyset returns the condition on column, for placeholder $n, and the ORDER
+// BY clause and LIMIT that select the page; arg binds $n.
+// The query fetches one row beyond the page to tell whether more follow.
+func (p pageRequest) keyset(column string, n int) (cond, orderLimit string, arg interface{}) {
+	// walking backwards through a descending list is walking forwards
+	// through the ascending one, and vice versa
+	ascending := p.desc == (p.cursor != nil && p.cursor.Backward)
+	op, order := "<", "DESC"
+	if ascending {
+		op, order = ">", "ASC"
+	}
+	cond = fmt.Sprintf("($%d::bigint IS NULL OR %s %s $%d)", n, column, op, n)
+	orderLimit = fmt.Sprintf("ORDER BY %s %s LIMIT %d", column, order, p.limit+1)
+	if p.cursor != nil {
+		arg = p.cursor.Key
+	}
+	return cond, orderLimit, arg
+}
+
+// keysetBy is keyset for a list sorted by the numeric column value, ties
+// broken by the key column; value binds $n and key $n+1. A cursor without a
+// value, as from the list sorted by key, starts at the first page.
+func (p pageRequest) keysetBy(value, key string, n int) (cond, orderLimit string, args []interface{}) {
+	ascending := p.desc == (p.cursor != nil && p.cursor.Backward)
+	op, order := "<", "DESC"
+	if ascending {
+		op, order = ">", "ASC"
+	}
+	cond = fmt.Sprintf("($%d::numeric IS NULL OR (%s, %s) %s ($%d, $%d))", n, value, key, op, n, n+1)
+	orderLimit = fmt.Sprintf("ORDER BY %s %s, %s %s LIMIT %d", value, order, key, order, p.limit+1)
+	args = []interface{}{nil, nil}
+	if p.cursor != nil && p.cursor.Value != nil {
+		args = []interface{}{*p.cursor.Value, p.cursor.Key}
+	}
+	return cond, orderLimit, args
+}
+
+// paginate trims the rows fetched with keyset to the page, restores the list
+// order and returns the cursors of the neighbouring pages
+func paginate[T any](p pageRequest, items []T, key func(T) int64) ([]T, Pagination) {
+	return paginateBy(p, items, func(item T) pageCursor { return pageCursor{Key: key(item)} })
+}
+
+// paginateBy is paginate for rows fetched with keysetBy, whose cursors carry
+// the sort value of the row too
+func paginateBy[T any](p pageRequest, items []T, position func(T) pageCursor) ([]T, Pagination) {
+	more := len(items) > p.limit
+	if more {
+		items = items[:p.limit]
+	}
+	backward := p.cursor != nil && p.cursor.Backward
+	if backward {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+
+	var page Pagination
+	if len(items) == 0 {
+		return items, page
+	}
+	// a backward page always has the page it came from after it, a forward
+	// one with a cursor the page it came from before it
+	if more || backward {
+		page.NextCursor = position(items[len(items)-1]).encode()
+	}
+	if backward && more || !backward && p.cursor != nil {
+		prev := position(items[0])
+		prev.Backward = true
+		page.PrevCursor = prev.encode()
+	}
+	return items, page
+}
+
+// keysetSlice is keyset for lists held in memory: it selects from items,
+// sorted by ascending key, the rows the keyset query would fetch
+func keysetSlice[T any](p pageRequest, items []T, key func(T) int64) []T {
+	ascending := p.desc == (p.cursor != nil && p.cursor.Backward)
+	var selected []T
+	for i := range items {
+		item := items[i]
+		if !ascending {
+			item = items[len(items)-1-i]
+		}
+		if p.cursor != nil && (ascending && key(item) <= p.cursor.Key || !ascending && key(item) >= p.cursor.Key) {
+			continue
+		}
+		if selected = append(selected, item); len(selected) > p.limit {
+			break
+		}
+	}
+	return selected
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// pain001Document is the subset of an ISO 20022 pain.001 customer credit
+// transfer initiation that is needed to derive internal transfers
+type pain001Document struct {
+	XMLName xml.Name `xml:"Document"`
+	Initn   struct {
+		GrpHdr struct {
+			MsgID   string  `xml:"MsgId"`
+			NbOfTxs int     `xml:"NbOfTxs"`
+			CtrlSum float64 `xml:"CtrlSum"`
+		} `xml:"GrpHdr"`
+		PmtInf []pain001PaymentInfo `xml:"PmtInf"`
+	} `xml:"CstmrCdtTrfInitn"`
+}
+
+type pain001PaymentInfo struct {
+	PmtInfID   string `xml:"PmtInfId"`
+	DbtrAcctID struct {
+		IBAN string `xml:"IBAN"`
+	} `xml:"DbtrAcct>Id"`
+	CdtTrfTxInf []pain001Transaction `xml:"CdtTrfTxInf"`
+}
+
+type pain001Transaction struct {
+	InstrID    string `xml:"PmtId>InstrId"`
+	EndToEndID string `xml:"PmtId>EndToEndId"`
+	InstdAmt   struct {
+		Ccy   string  `xml:"Ccy,attr"`
+		Value float64 `xml:",chardata"`
+	} `xml:"Amt>InstdAmt"`
+	CdtrAcctID struct {
+		IBAN string `xml:"IBAN"`
+	} `xml:"CdtrAcct>Id"`
+	Ustrd string `xml:"RmtInf>Ustrd"`
+}
+
+// pain002Document is the pain.002 customer payment status report returned for
+// an imported pain.001 file
+type pain002Document struct {
+	XMLName xml.Name `xml:"urn:iso:std:iso:20022:tech:xsd:pain.002.001.03 Document"`
+	Report  struct {
+		GrpHdr struct {
+			MsgID   string `xml:"MsgId"`
+			CreDtTm string `xml:"CreDtTm"`
+		} `xml:"GrpHdr"`
+		OrgnlGrpInfAndSts struct {
+			OrgnlMsgID   string         `xml:"OrgnlMsgId"`
+			OrgnlMsgNmID string         `xml:"OrgnlMsgNmId"`
+			GrpSts       string         `xml:"GrpSts"`
+			StsRsnInf    *pain002Reason `xml:"StsRsnInf,omitempty"`
+		} `xml:"OrgnlGrpInfAndSts"`
+		OrgnlPmtInfAndSts []pain002PaymentStatus `xml:"OrgnlPmtInfAndSts"`
+	} `xml:"CstmrPmtStsRpt"`
+}
+
+type pain002PaymentStatus struct {
+	OrgnlPmtInfID string                  `xml:"OrgnlPmtInfId"`
+	TxInfAndSts   []pain002TransactionSts `xml:"TxInfAndSts"`
+}
+
+type pain002TransactionSts struct {
+	OrgnlInstrID    string         `xml:"OrgnlInstrId,omitempty"`
+	OrgnlEndToEndID string         `xml:"OrgnlEndToEndId"`
+	TxSts           string         `xml:"TxSts"`
+	StsRsnInf       *pain002Reason `xml:"StsRsnInf,omitempty"`
+}
+
+type pain002Reason struct {
+	Cd       string `xml:"Rsn>Cd"`
+	AddtlInf string `xml:"AddtlInf,omitempty"`
+}
+
+// ISO 20022 status codes used in the report
+const (
+	painStatusAccepted = "ACSC" // settlement completed
+	painStatusRejected = "RJCT"
+	painStatusPartial  = "PART"
+	painStatusPending  = "PDNG"
+)
+
+// painReason maps a transfer error onto an ISO 20022 status reason
+func painReason(apiErr *apiError) *pain002Reason {
+	reason := &pain002Reason{Cd: "NARR", AddtlInf: apiErr.Message}
+	switch apiErr.Code {
+	case 1014, 1017, 1030:
+		reason.Cd = "AC01" // incorrect account number
+	case 1015, 1134:
+		reason.Cd = "AM04" // insufficient funds
+	case 1029:
+		reason.Cd = "AG01" // transaction forbidden
+	case 1048:
+		var details []string
+		for _, fe := range apiErr.Errors {
+			if fe.Field == "amount" {
+				reason.Cd = "AM12" // invalid amount
+			}
+			details = append(details, fe.Field+" "+fe.Message)
+		}
+		reason.AddtlInf = strings.Join(details, "; ")
+	}
+	return reason
+}
+
+// validate checks the group header against the payment instructions
+func (d *pain001Document) validate() error {
+	hdr := d.Initn.GrpHdr
+	if strings.TrimSpace(hdr.MsgID) == "" {
+		return fmt.Errorf("GrpHdr/MsgId is required")
+	}
+	count, sum := 0, 0.0
+	for _, pmt := range d.Initn.PmtInf {
+		for _, tx := range pmt.CdtTrfTxInf {
+			count++
+			sum += tx.InstdAmt.Value
+		}
+	}
+	if count == 0 {
+		return fmt.Errorf("file contains no credit transfer instructions")
+	}
+	if hdr.NbOfTxs != count {
+		return fmt.Errorf("GrpHdr/NbOfTxs is %d but file contains %d instructions", hdr.NbOfTxs, count)
+	}
+	if hdr.CtrlSum != 0 && math.Abs(roundCents(sum)-hdr.CtrlSum) > 0.001 {
+		return fmt.Errorf("GrpHdr/CtrlSum is %.2f but instructions sum to %.2f", hdr.CtrlSum, sum)
+	}
+	return nil
+}
+
+// handleImportPain001 accepts a pain.001 file, executes each credit transfer
+// instruction as an internal transfer and responds with a pain.002 report
+func (a *App) handleImportPain001(w http.ResponseWriter, r *http.Request) {
+	var doc pain001Document
+	if err := xml.NewDecoder(r.Body).Decode(&doc); err != nil {
+		if bodyTooLarge(err) {
+			writeJSONError(w, "Request body too large", 1049, http.StatusRequestEntityTooLarge)
+			return
+		}
+		writeJSONError(w, "Invalid pain.001 document", 1034, http.StatusBadRequest)
+		return
+	}
+
+	var report pain002Document
+	report.Report.GrpHdr.MsgID = fmt.Sprintf("STS-%s", doc.Initn.GrpHdr.MsgID)
+	report.Report.GrpHdr.CreDtTm = time.Now().UTC().Format("2006-01-02T15:04:05")
+	report.Report.OrgnlGrpInfAndSts.OrgnlMsgID = doc.Initn.GrpHdr.MsgID
+	report.Report.OrgnlGrpInfAndSts.OrgnlMsgNmID = "pain.001.001.03"
+
+	if err := doc.validate(); err != nil {
+		report.Report.OrgnlGrpInfAndSts.GrpSts = painStatusRejected
+		report.Report.OrgnlGrpInfAndSts.StsRsnInf = &pain002Reason{Cd: "FF01", AddtlInf: err.Error()}
+		writeXML(w, report, http.StatusUnprocessableEntity)
+		return
+	}
+
+	tenant := tenantFromContext(r.Context())
+	accepted, rejected := 0, 0
+	for _, pmt := range doc.Initn.PmtInf {
+		pmtStatus := pain002PaymentStatus{OrgnlPmtInfID: pmt.PmtInfID}
+		for _, tx := range pmt.CdtTrfTxInf {
+			txStatus := pain002TransactionSts{
+				OrgnlInstrID:    tx.InstrID,
+				OrgnlEndToEndID: tx.EndToEndID,
+				TxSts:           painStatusAccepted,
+			}
+
+			result, apiErr := a.executeTransfer(r.Context(), tenant, TransferRequest{
+				FromIBAN:  pmt.DbtrAcctID.IBAN,
+				ToIBAN:    tx.CdtrAcctID.IBAN,
+				Amount:    tx.InstdAmt.Value,
+				Reference: tx.EndToEndID,
+				Memo:      tx.Ustrd,
+			})
+
+			if apiErr != nil {
+				rejected++
+				txStatus.TxSts = painStatusRejected
+				txStatus.StsRsnInf = painReason(apiErr)
+			} else {
+				accepted++
+				if result.Status != TxCompleted {
+					txStatus.TxSts = painStatusPending
+				}
+			}
+			pmtStatus.TxInfAndSts = append(pmtStatus.TxInfAndSts, txStatus)
+		}
+		report.Report.OrgnlPmtInfAndSts = append(report.Report.OrgnlPmtInfAndSts, pmtStatus)
+	}
+
+	switch {
+	case rejected == 0:
+		report.Report.OrgnlGrpInfAndSts.GrpSts = painStatusAccepted
+	case accepted == 0:
+		report.Report.OrgnlGrpInfAndSts.GrpSts = painStatusRejected
+	default:
+		report.Report.OrgnlGrpInfAndSts.GrpSts = painStatusPartial
+	}
+	writeXML(w, report, http.StatusOK)
+}
+
+// writeXML writes v as an XML document
+func writeXML(w http.ResponseWriter, v interface{}, statusCode int) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(statusCode)
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(v)
+}
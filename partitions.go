@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PartitionConfig configures the job creating the monthly partitions of the
+// transactions table ahead of time
+type PartitionConfig struct {
+	// MonthsAhead is how many months after the current one get a partition
+	MonthsAhead int `json:"months_ahead"`
+}
+
+func (c PartitionConfig) validate() error {
+	if c.MonthsAhead < 1 {
+		return errors.New("months_ahead must be at least 1")
+	}
+	return nil
+}
+
+// partitionName names the partition of transactions created in month
+func partitionName(month time.Time) string {
+	return "transactions_" + month.Format("2006_01")
+}
+
+// createPartitions makes sure the months after the current one have a
+// partition, so transfers never land in transactions_default. The current
+// month is taken from the database clock, which created_at defaults to.
+func (a *App) createPartitions(ctx context.Context) error {
+	var month time.Time
+	if err := a.DB.QueryRowContext(ctx, "SELECT date_trunc('month', LOCALTIMESTAMP)").Scan(&month); err != nil {
+		return err
+	}
+	for i := 1; i <= a.Config.Partitions.MonthsAhead; i++ {
+		from := month.AddDate(0, i, 0)
+		to := from.AddDate(0, 1, 0)
+		_, err := a.DB.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF transactions FOR VALUES FROM ('%s') TO ('%s')",
+			partitionName(from), from.Format("2006-01-02"), to.Format("2006-01-02")))
+		if err != nil {
+			return fmt.Errorf("partition %s: %w", partitionName(from), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// poolCheckInterval is how often the connection pools are checked for
+// saturation
+const poolCheckInterval = 10 * time.Second
+
+// openDB opens a pool on dsn, with the configured credentials filled in,
+// whose connection attempts go through breaker and whose statements are
+// timed against the slow query threshold
+func openDB(dsn string, breaker *circuitBreaker, cfg DatabaseConfig) (*sql.DB, error) {
+	connector, err := newCredentialConnector(context.Background(), dsn, cfg.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	slow := time.Duration(cfg.SlowQueryMillis) * time.Millisecond
+	return sql.OpenDB(breakerConnector{Connector: connector, breaker: breaker, slowQuery: slow}), nil
+}
+
+// configurePool applies the pool limits of the configuration to db and
+// exports its statistics as go_sql_* metrics labelled with name
+func configurePool(db *sql.DB, name string, cfg DatabaseConfig) {
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(cfg.ConnMaxLifetimeSeconds) * time.Second)
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
+
+// poolMonitor returns a job reporting an error whenever requests had to wait
+// for a connection of db since the previous run
+func poolMonitor(db *sql.DB) func(context.Context) error {
+	var last sql.DBStats
+	return func(context.Context) error {
+		stats := db.Stats()
+		waits, waited := stats.WaitCount-last.WaitCount, stats.WaitDuration-last.WaitDuration
+		last = stats
+		if waits == 0 {
+			return nil
+		}
+		return fmt.Errorf("saturated: %d waits for a connection totalling %s, %d of %d connections in use",
+			waits, waited.Round(time.Millisecond), stats.InUse, stats.MaxOpenConnections)
+	}
+}
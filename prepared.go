@@ -0,0 +1,53 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// preparedStatements holds the hot statements of the account lookup and
+// transfer paths, prepared once at startup. database/sql prepares each on a
+// pooled connection the first time it is used there and reuses it after, so
+// Postgres does not parse and plan them on every request.
+type preparedStatements struct {
+	// getAccount serves GET /accounts/{id} by ID, on the replica unless the
+	// cache is enabled
+	getAccount *sql.Stmt
+	// lockedAccount, debit, credit, creditUnchecked and insertTransaction
+	// run on the primary inside transfer transactions through Tx.StmtContext
+	lockedAccount     *sql.Stmt
+	debit             *sql.Stmt
+	credit            *sql.Stmt
+	creditUnchecked   *sql.Stmt
+	insertTransaction *sql.Stmt
+}
+
+func (a *App) prepareStatements() (*preparedStatements, error) {
+	// cache fills read the primary so a lagging replica cannot store a
+	// balance that was already invalidated
+	reader := a.Replica
+	if a.Cache != nil {
+		reader = a.DB
+	}
+
+	var s preparedStatements
+	for _, p := range []struct {
+		db    *sql.DB
+		dst   **sql.Stmt
+		query string
+	}{
+		{reader, &s.getAccount, "SELECT " + accountColumns + " FROM accounts WHERE id = $1 AND tenant_id = $2"},
+		{a.DB, &s.lockedAccount, "SELECT id, balance, last_updated, " + reservedFunds + ", COALESCE(account_type, '') FROM accounts WHERE id = $1 AND tenant_id = $2 AND closed_at IS NULL"},
+		{a.DB, &s.debit, "UPDATE accounts SET balance = balance - $1, last_updated = NOW() WHERE id = $2 AND ($3::timestamp IS NULL OR last_updated = $3)"},
+		{a.DB, &s.credit, "UPDATE accounts SET balance = balance + $1, last_updated = NOW() WHERE id = $2 AND ($3::timestamp IS NULL OR last_updated = $3)"},
+		{a.DB, &s.creditUnchecked, "UPDATE accounts SET balance = balance + $1, last_updated = NOW() WHERE id = $2"},
+		{a.DB, &s.insertTransaction, "INSERT INTO transactions (from_account, to_account, amount, tenant_id, to_tenant_id, status, completed_at, reference, memo) VALUES ($1, $2, $3, $4, $5, $6, CASE WHEN $6 = 'completed' THEN NOW() END, NULLIF($7, ''), NULLIF($8, '')) RETURNING id"},
+	} {
+		stmt, err := p.db.Prepare(p.query)
+		if err != nil {
+			return nil, fmt.Errorf("prepare %q: %w", p.query, err)
+		}
+		*p.dst = stmt
+	}
+	return &s, nil
+}
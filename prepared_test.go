@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+)
+
+// benchAccountID is the account the benchmarks read and write
+const benchAccountID = 990001
+
+// openBenchDB connects to the database named by BENCH_DSN, skipping the
+// benchmark when it is unset
+func openBenchDB(b *testing.B) *App {
+	dsn := os.Getenv("BENCH_DSN")
+	if dsn == "" {
+		b.Skip("BENCH_DSN not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+	if err := migrate(db); err != nil {
+		b.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO accounts (id, balance, last_updated, tenant_id) VALUES ($1, 1000000, NOW(), 'bench') ON CONFLICT (id) DO NOTHING", benchAccountID)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	a := &App{DB: db, Replica: db, Config: defaultConfig()}
+	if a.Stmts, err = a.prepareStatements(); err != nil {
+		b.Fatal(err)
+	}
+	return a
+}
+
+func BenchmarkAccountSelectUnprepared(b *testing.B) {
+	a := openBenchDB(b)
+	var acc Account
+	var reserved float64
+	var accountType string
+	for b.Loop() {
+		err := a.DB.QueryRow("SELECT id, balance, last_updated, "+reservedFunds+", COALESCE(account_type, '') FROM accounts WHERE id = $1 AND tenant_id = $2 AND closed_at IS NULL", benchAccountID, "bench").
+			Scan(&acc.ID, &acc.Balance, &acc.LastUpdated, &reserved, &accountType)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAccountSelectPrepared(b *testing.B) {
+	a := openBenchDB(b)
+	var acc Account
+	var reserved float64
+	var accountType string
+	for b.Loop() {
+		err := a.Stmts.lockedAccount.QueryRow(benchAccountID, "bench").Scan(&acc.ID, &acc.Balance, &acc.LastUpdated, &reserved, &accountType)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// The transfer benchmarks debit and credit the same account in one
+// transaction, the statement shape of a transfer without its bookkeeping
+
+func BenchmarkTransferUnprepared(b *testing.B) {
+	a := openBenchDB(b)
+	for b.Loop() {
+		tx, err := a.DB.Begin()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := tx.Exec("UPDATE accounts SET balance = balance - $1, last_updated = NOW() WHERE id = $2 AND ($3::timestamp IS NULL OR last_updated = $3)", 1, benchAccountID, nil); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := tx.Exec("UPDATE accounts SET balance = balance + $1, last_updated = NOW() WHERE id = $2 AND ($3::timestamp IS NULL OR last_updated = $3)", 1, benchAccountID, nil); err != nil {
+			b.Fatal(err)
+		}
+		if err := tx.Rollback(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTransferPrepared(b *testing.B) {
+	a := openBenchDB(b)
+	for b.Loop() {
+		tx, err := a.DB.Begin()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := tx.Stmt(a.Stmts.debit).Exec(1, benchAccountID, nil); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := tx.Stmt(a.Stmts.credit).Exec(1, benchAccountID, nil); err != nil {
+			b.Fatal(err)
+		}
+		if err := tx.Rollback(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PreparedTransferConfig configures the two-phase transfers an external
+// coordinator prepares and then confirms or aborts
+type PreparedTransferConfig struct {
+	// TTLSeconds is how long a prepared transfer holds its funds; an
+	// unconfirmed one then expires and its hold is lifted
+	TTLSeconds int `json:"ttl_seconds"`
+}
+
+func (c PreparedTransferConfig) validate() error {
+	if c.TTLSeconds < 1 || c.TTLSeconds > 86400 {
+		return fmt.Errorf("ttl_seconds must be between 1 and 86400")
+	}
+	return nil
+}
+
+// Statuses of a prepared transfer. Expired is not stored: a prepared
+// transfer past its expiry reads as expired.
+const (
+	PreparedPending   = "prepared"
+	PreparedConfirmed = "confirmed"
+	PreparedAborted   = "aborted"
+	PreparedExpired   = "expired"
+)
+
+// preparedHolds selects the funds of an account of accounts held by its
+// prepared transfers, their amounts and fees
+const preparedHolds = "(SELECT COALESCE(SUM(p.amount + p.fee), 0) FROM prepared_transfers p WHERE p.from_account = accounts.id AND p.status = '" + PreparedPending + "' AND p.expires_at > NOW())"
+
+// errPreparedTransferGone is returned by the transfer confirming a prepared
+// transfer that was confirmed, aborted or expired meanwhile
+var errPreparedTransferGone = errors.New("prepared transfer is no longer pending")
+
+// PreparedTransfer is a transfer whose funds are held until it is confirmed
+// or aborted with its token
+type PreparedTransfer struct {
+	Token         string    `json:"token"`
+	FromAccountID int       `json:"source_account_id"`
+	ToAccountID   int       `json:"destination_account_id"`
+	ToTenantID    string    `json:"destination_tenant_id"`
+	Amount        float64   `json:"amount"`
+	Fee           float64   `json:"fee"`
+	Reference     string    `json:"reference,omitempty"`
+	Memo          string    `json:"memo,omitempty"`
+	Category      string    `json:"category,omitempty"`
+	Tags          []string  `json:"tags,omitempty"`
+	Status        string    `json:"status"`
+	TransactionID *int      `json:"transaction_id,omitempty"`
+	CreatedBy     string    `json:"created_by"`
+	CreatedAt     time.Time `json:"created_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+
+	id int
+}
+
+// PreparedTransferRequest is the JSON body of POST /transactions/confirm and
+// POST /transactions/abort
+type PreparedTransferRequest struct {
+	Token string `json:"token"`
+}
+
+const preparedTransferColumns = `id, token, from_account, to_account, to_tenant_id, amount, fee, reference, memo, category, tags,
+	CASE WHEN status = 'prepared' AND expires_at <= NOW() THEN 'expired' ELSE status END, transaction_id, created_by, created_at, expires_at`
+
+func scanPreparedTransfer(row rowScanner) (PreparedTransfer, error) {
+	var p PreparedTransfer
+	err := row.Scan(&p.id, &p.Token, &p.FromAccountID, &p.ToAccountID, &p.ToTenantID, &p.Amount, &p.Fee, &p.Reference, &p.Memo, &p.Category, pq.Array(&p.Tags),
+		&p.Status, &p.TransactionID, &p.CreatedBy, &p.CreatedAt, &p.ExpiresAt)
+	return p, err
+}
+
+func newPreparedTransferToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "ptx_" + hex.EncodeToString(b), nil
+}
+
+// handlePrepareTransfer serves POST /transactions/prepare. The body is that
+// of POST /transactions.
+func (a *App) handlePrepareTransfer(w http.ResponseWriter, r *http.Request) {
+	var tr TransferRequest
+	if apiErr := decodeJSON(r, &tr, 1012, "amount"); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	p, apiErr := a.prepareTransfer(r.Context(), tenantFromContext(r.Context()), tr)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	writeJSONSuccess(w, p, "Transfer prepared", 2088, http.StatusCreated)
+}
+
+// prepareTransfer vets tr as a transfer would be and holds its amount and fee
+// on the source, so the confirmation cannot fail for want of funds. The
+// source moves to a new version, so transfers that read it before retry
+// against the hold.
+func (a *App) prepareTransfer(ctx context.Context, tenant string, tr TransferRequest) (*PreparedTransfer, *apiError) {
+	tr.Category, tr.Tags = normalizeLabels(tr.Category, tr.Tags)
+	if apiErr := tr.validate(a.Config.Limits); apiErr != nil {
+		return nil, apiErr
+	}
+	if tr.External != nil {
+		var v validator
+		v.check(false, "external_destination", "is not supported by prepared transfers")
+		return nil, v.err()
+	}
+	// a confirmation is not held again, so large transfers cannot be
+	// prepared
+	if a.Config.StepUp.required(tr.Amount) || a.Config.Approval.required(tr.Amount) {
+		return nil, newAPIError("Prepared transfer amount requires approval or confirmation", 1140, http.StatusUnprocessableEntity)
+	}
+	if apiErr := a.findDuplicate(ctx, tenant, tr); apiErr != nil {
+		return nil, apiErr
+	}
+	toTenant, apiErr := a.resolveTransfer(tenant, &tr)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	token, err := newPreparedTransferToken()
+	if err != nil {
+		return nil, newAPIError("Failed to prepare transfer", 1005, http.StatusInternalServerError)
+	}
+	p := &PreparedTransfer{
+		Token:         token,
+		FromAccountID: tr.FromAccountID,
+		ToAccountID:   tr.ToAccountID,
+		ToTenantID:    toTenant,
+		Amount:        tr.Amount,
+		Fee:           a.transferFee(tenant, tr.Amount),
+		Reference:     tr.Reference,
+		Memo:          tr.Memo,
+		Category:      tr.Category,
+		Tags:          tr.Tags,
+		Status:        PreparedPending,
+		CreatedBy:     principalFromContext(ctx).Name,
+	}
+
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to begin transaction", 1013, http.StatusInternalServerError))
+	}
+	defer tx.Rollback()
+	if err := a.lockAccounts(ctx, tx, tenant, p.FromAccountID); err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to lock accounts", 1013, http.StatusInternalServerError))
+	}
+
+	var source Account
+	var reserved float64
+	var accountType string
+	err = tx.QueryRowContext(ctx, "SELECT id, balance, last_updated, "+reservedFunds+", COALESCE(account_type, '') FROM accounts WHERE id = $1 AND tenant_id = $2 AND closed_at IS NULL FOR UPDATE",
+		p.FromAccountID, tenant).Scan(&source.ID, &source.Balance, &source.LastUpdated, &reserved, &accountType)
+	if err == sql.ErrNoRows {
+		return nil, newAPIError("Source account not found", 1014, http.StatusNotFound)
+	}
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to load accounts", 1009, http.StatusInternalServerError))
+	}
+	if source.Balance-reserved < p.Amount+p.Fee {
+		return nil, newAPIError("Insufficient funds", 1015, http.StatusBadRequest)
+	}
+	if source.Balance-reserved-p.Amount-p.Fee < a.Config.minimumBalance(accountType) {
+		return nil, newAPIError("Transfer would take the account below its minimum balance", 1134, http.StatusBadRequest)
+	}
+	var exists bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM accounts WHERE id = $1 AND tenant_id = $2 AND closed_at IS NULL)", p.ToAccountID, toTenant).Scan(&exists)
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to load accounts", 1009, http.StatusInternalServerError))
+	}
+	if !exists {
+		return nil, newAPIError("Destination account not found", 1017, http.StatusNotFound)
+	}
+	if apiErr := a.checkRisk(ctx, tx, RiskInput{
+		TenantID:    tenant,
+		From:        source,
+		ToAccountID: p.ToAccountID,
+		ToTenantID:  toTenant,
+		Amount:      p.Amount,
+		Fee:         p.Fee,
+	}); apiErr != nil {
+		return nil, apiErr
+	}
+
+	if err := touchAccount(ctx, tx, p.FromAccountID); err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to prepare transfer", 1005, http.StatusInternalServerError))
+	}
+	err = tx.QueryRowContext(ctx, `INSERT INTO prepared_transfers (token, tenant_id, from_account, to_account, to_tenant_id, amount, fee, reference, memo, category, tags, status, created_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, NOW() + make_interval(secs => $14)) RETURNING id, created_at, expires_at`,
+		p.Token, tenant, p.FromAccountID, p.ToAccountID, p.ToTenantID, p.Amount, p.Fee, p.Reference, p.Memo, p.Category, pq.Array(nonNilTags(p.Tags)),
+		p.Status, p.CreatedBy, a.Config.PreparedTransfers.TTLSeconds).
+		Scan(&p.id, &p.CreatedAt, &p.ExpiresAt)
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to prepare transfer", 1005, http.StatusInternalServerError))
+	}
+	if err := a.audit(ctx, tx, auditRecord{
+		TenantID:   tenant,
+		Action:     "transfer.prepared",
+		EntityType: "prepared_transfer",
+		EntityID:   strconv.Itoa(p.id),
+		After:      p,
+	}); err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to prepare transfer", 1005, http.StatusInternalServerError))
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to commit transaction", 1020, http.StatusInternalServerError))
+	}
+	a.Cache.invalidate(ctx, tenant, p.FromAccountID)
+	return p, nil
+}
+
+// loadPreparedTransfer decodes the token of a confirm or abort request and
+// returns its prepared transfer
+func (a *App) loadPreparedTransfer(r *http.Request) (PreparedTransfer, *apiError) {
+	var req PreparedTransferRequest
+	if apiErr := decodeJSON(r, &req, 1002, "token"); apiErr != nil {
+		return PreparedTransfer{}, apiErr
+	}
+	ctx := r.Context()
+	p, err := scanPreparedTransfer(a.DB.QueryRowContext(ctx, "SELECT "+preparedTransferColumns+" FROM prepared_transfers WHERE token = $1 AND tenant_id = $2",
+		req.Token, tenantFromContext(ctx)))
+	if err == sql.ErrNoRows {
+		return p, newAPIError("Prepared transfer not found", 1138, http.StatusNotFound)
+	}
+	if err != nil {
+		return p, dbWriteError(err, newAPIError("Failed to load prepared transfer", 1005, http.StatusInternalServerError))
+	}
+	return p, nil
+}
+
+// preparedGone is the error of a confirm or abort finding the prepared
+// transfer in status, if known
+func preparedGone(status string) *apiError {
+	apiErr := newAPIError("Prepared transfer is no longer pending", 1139, http.StatusConflict)
+	if status != "" {
+		apiErr.Data = map[string]interface{}{"status": status}
+	}
+	return apiErr
+}
+
+// handleConfirmPrepared serves POST /transactions/confirm, making a prepared
+// transfer. Its hold is lifted in the transaction that makes it, and the
+// checks it passed when prepared are not run again. Confirming a confirmed
+// transfer returns it unchanged, so a coordinator can retry. A confirmation
+// that fails, such as when the destination was closed meanwhile, leaves the
+// transfer prepared until it is aborted or expires.
+func (a *App) handleConfirmPrepared(w http.ResponseWriter, r *http.Request) {
+	p, apiErr := a.loadPreparedTransfer(r)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	switch p.Status {
+	case PreparedConfirmed:
+		writeJSONSuccess(w, p, "Prepared transfer confirmed", 2089, http.StatusOK)
+		return
+	case PreparedAborted, PreparedExpired:
+		writeAPIError(w, preparedGone(p.Status))
+		return
+	}
+
+	ctx := r.Context()
+	tenant := tenantFromContext(ctx)
+	result, apiErr := a.attemptTransfer(ctx, tenant, TransferRequest{
+		FromAccountID: p.FromAccountID,
+		ToAccountID:   p.ToAccountID,
+		ToTenantID:    p.ToTenantID,
+		Amount:        p.Amount,
+		Reference:     p.Reference,
+		Memo:          p.Memo,
+		Category:      p.Category,
+		Tags:          p.Tags,
+		preparedID:    p.id,
+		preparedFee:   p.Fee,
+	})
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	a.notifyTransfer(result.TransactionID)
+	p.Status, p.TransactionID = PreparedConfirmed, &result.TransactionID
+	writeJSONSuccess(w, p, "Prepared transfer confirmed", 2089, http.StatusOK)
+}
+
+// claimPrepared marks prepared transfer id confirmed within the transaction
+// of the transfer making it, lifting its hold before the source is read
+func (a *App) claimPrepared(id int) func(ctx context.Context, tx *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, "UPDATE prepared_transfers SET status = $1, finished_at = NOW() WHERE id = $2 AND status = $3 AND expires_at > NOW()",
+			PreparedConfirmed, id, PreparedPending)
+		if err != nil {
+			return err
+		}
+		if affectedRows(result, nil) == 0 {
+			return errPreparedTransferGone
+		}
+		return nil
+	}
+}
+
+// handleAbortPrepared serves POST /transactions/abort, lifting the hold of a
+// prepared transfer. Aborting an aborted or expired transfer returns it
+// unchanged.
+func (a *App) handleAbortPrepared(w http.ResponseWriter, r *http.Request) {
+	p, apiErr := a.loadPreparedTransfer(r)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	switch p.Status {
+	case PreparedAborted, PreparedExpired:
+		writeJSONSuccess(w, p, "Prepared transfer aborted", 2090, http.StatusOK)
+		return
+	case PreparedConfirmed:
+		writeAPIError(w, preparedGone(p.Status))
+		return
+	}
+
+	ctx := r.Context()
+	tenant := tenantFromContext(ctx)
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to begin transaction", 1013, http.StatusInternalServerError)))
+		return
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(ctx, "UPDATE prepared_transfers SET status = $1, finished_at = NOW() WHERE id = $2 AND status = $3 AND expires_at > NOW()",
+		PreparedAborted, p.id, PreparedPending)
+	if err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to abort prepared transfer", 1005, http.StatusInternalServerError)))
+		return
+	}
+	if affectedRows(result, nil) == 0 {
+		writeAPIError(w, preparedGone(""))
+		return
+	}
+	p.Status = PreparedAborted
+	if err := a.audit(ctx, tx, auditRecord{
+		TenantID:   tenant,
+		Action:     "transfer.prepare_aborted",
+		EntityType: "prepared_transfer",
+		EntityID:   strconv.Itoa(p.id),
+		After:      p,
+	}); err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to abort prepared transfer", 1005, http.StatusInternalServerError)))
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to commit transaction", 1020, http.StatusInternalServerError)))
+		return
+	}
+	writeJSONSuccess(w, p, "Prepared transfer aborted", 2090, http.StatusOK)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// What quotas count
+const (
+	QuotaRequests  = "requests"
+	QuotaTransfers = "transfers"
+)
+
+// Periods quotas are counted over, in UTC
+const (
+	QuotaDay   = "day"
+	QuotaMonth = "month"
+)
+
+// quotaUsageRetention is how long the counters of past periods are kept
+const quotaUsageRetention = 62 * 24 * time.Hour
+
+var quotaExceeded = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "fundtransfer_quota_exceeded_total",
+	Help: "Requests turned away because the API key used up a quota.",
+}, []string{"metric", "period"})
+
+// QuotaConfig caps what an API key may do per UTC day and calendar month,
+// on top of any per-request limits. 0 leaves a limit off.
+type QuotaConfig struct {
+	RequestsPerDay    int `json:"requests_per_day"`
+	RequestsPerMonth  int `json:"requests_per_month"`
+	TransfersPerDay   int `json:"transfers_per_day"`
+	TransfersPerMonth int `json:"transfers_per_month"`
+}
+
+// quotaLimit is one configured limit
+type quotaLimit struct {
+	metric string
+	period string
+	limit  int
+}
+
+// limits returns the configured limits, of metric only unless it is empty
+func (c QuotaConfig) limits(metric string) []quotaLimit {
+	var limits []quotaLimit
+	for _, l := range []quotaLimit{
+		{QuotaRequests, QuotaDay, c.RequestsPerDay},
+		{QuotaRequests, QuotaMonth, c.RequestsPerMonth},
+		{QuotaTransfers, QuotaDay, c.TransfersPerDay},
+		{QuotaTransfers, QuotaMonth, c.TransfersPerMonth},
+	} {
+		if l.limit > 0 && (metric == "" || l.metric == metric) {
+			limits = append(limits, l)
+		}
+	}
+	return limits
+}
+
+// validate rejects negative limits
+func (c QuotaConfig) validate() error {
+	if c.RequestsPerDay < 0 || c.RequestsPerMonth < 0 || c.TransfersPerDay < 0 || c.TransfersPerMonth < 0 {
+		return errors.New("quota limits must not be negative")
+	}
+	return nil
+}
+
+// quotasEnabled reports whether any API key has a quota
+func (c AuthConfig) quotasEnabled() bool {
+	for _, k := range c.APIKeys {
+		if len(k.Quota.limits("")) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// quotaPeriod returns the start of the period containing t and of the next
+// one
+func quotaPeriod(period string, t time.Time) (time.Time, time.Time) {
+	t = t.UTC()
+	if period == QuotaMonth {
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	}
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// QuotaUsage is a limit of the caller's API key and how much of it the
+// current period has used
+type QuotaUsage struct {
+	Metric    string    `json:"metric"`
+	Period    string    `json:"period"`
+	Limit     int       `json:"limit"`
+	Used      int       `json:"used"`
+	Remaining int       `json:"remaining"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+// consumeQuota counts one use of metric against every limit of p and returns
+// the limit with the least left, or nil when p has none. When a limit is used
+// up nothing is counted, and the error carries that limit.
+func (a *App) consumeQuota(ctx context.Context, p *Principal, metric string) (*QuotaUsage, *apiError) {
+	limits := p.Quota.limits(metric)
+	if len(limits) == 0 {
+		return nil, nil
+	}
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to check quota", 1005, http.StatusInternalServerError))
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	var tightest *QuotaUsage
+	for _, l := range limits {
+		start, end := quotaPeriod(l.period, now)
+		u := QuotaUsage{Metric: l.metric, Period: l.period, Limit: l.limit, ResetsAt: end}
+		err := tx.QueryRowContext(ctx, `INSERT INTO api_quota_usage (principal, metric, period, period_start, used) VALUES ($1, $2, $3, $4, 1)
+			ON CONFLICT (principal, metric, period, period_start) DO UPDATE SET used = api_quota_usage.used + 1
+			WHERE api_quota_usage.used < $5
+			RETURNING used`,
+			p.Name, l.metric, l.period, start, l.limit).Scan(&u.Used)
+		if err == sql.ErrNoRows {
+			quotaExceeded.WithLabelValues(l.metric, l.period).Inc()
+			u.Used = l.limit
+			apiErr := newAPIError("Quota exceeded", 1105, http.StatusTooManyRequests)
+			apiErr.Data = u
+			return &u, apiErr
+		}
+		if err != nil {
+			return nil, dbWriteError(err, newAPIError("Failed to check quota", 1005, http.StatusInternalServerError))
+		}
+		u.Remaining = l.limit - u.Used
+		if tightest == nil || u.Remaining < tightest.Remaining {
+			tightest = &u
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to check quota", 1005, http.StatusInternalServerError))
+	}
+	return tightest, nil
+}
+
+// enforceQuota consumes a use of metric for the caller and reports the
+// tightest limit in the rate limit headers. Once a limit is used up it
+// answers with 429 and Retry-After and returns false.
+func (a *App) enforceQuota(w http.ResponseWriter, r *http.Request, metric string) bool {
+	u, apiErr := a.consumeQuota(r.Context(), principalFromContext(r.Context()), metric)
+	if u != nil {
+		setRateLimitHeaders(w.Header(), *u)
+	}
+	if apiErr == nil {
+		return true
+	}
+	if u != nil {
+		wait := time.Until(u.ResetsAt)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	}
+	writeAPIError(w, apiErr)
+	return false
+}
+
+// setRateLimitHeaders reports a limit in X-RateLimit-Limit, -Remaining and
+// -Reset, the Unix time its period ends. A request counted against several
+// limits, like a transfer, reports the one with the least left.
+func setRateLimitHeaders(h http.Header, u QuotaUsage) {
+	if v := h.Get("X-RateLimit-Remaining"); v != "" {
+		if remaining, err := strconv.Atoi(v); err == nil && remaining <= u.Remaining {
+			return
+		}
+	}
+	h.Set("X-RateLimit-Limit", strconv.Itoa(u.Limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(u.Remaining))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(u.ResetsAt.Unix(), 10))
+}
+
+// withRequestQuota counts every API call against the request quotas of its
+// API key. GET /quota and the operational endpoints are not counted, so a
+// client can always see when it may call again.
+func (a *App) withRequestQuota(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/quota" || isUnversionedPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if a.enforceQuota(w, r, QuotaRequests) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// withTransferQuota counts each transfer request against the transfer
+// quotas of its API key. Rejected transfers count too; replays of an
+// Idempotency-Key do not, as they are answered before reaching it.
+func (a *App) withTransferQuota(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.enforceQuota(w, r, QuotaTransfers) {
+			next(w, r)
+		}
+	}
+}
+
+// handleQuota serves GET /quota, the limits of the caller's API key with the
+// usage and reset time of their current periods
+func (a *App) handleQuota(w http.ResponseWriter, r *http.Request) {
+	usage, err := a.quotaUsage(r.Context(), principalFromContext(r.Context()), "")
+	if err != nil {
+		writeJSONError(w, "Failed to load quota", 1005, http.StatusInternalServerError)
+		return
+	}
+	writeJSONSuccess(w, usage, "Quota retrieved", 2054, http.StatusOK)
+}
+
+// quotaUsage returns the limits of p, of metric only unless it is empty, with
+// the usage of their current periods. Nothing is counted.
+func (a *App) quotaUsage(ctx context.Context, p *Principal, metric string) ([]QuotaUsage, error) {
+	now := time.Now().UTC()
+	usage := []QuotaUsage{}
+	for _, l := range p.Quota.limits(metric) {
+		start, end := quotaPeriod(l.period, now)
+		u := QuotaUsage{Metric: l.metric, Period: l.period, Limit: l.limit, ResetsAt: end}
+		err := a.DB.QueryRowContext(ctx, "SELECT COALESCE(MAX(used), 0) FROM api_quota_usage WHERE principal = $1 AND metric = $2 AND period = $3 AND period_start = $4",
+			p.Name, l.metric, l.period, start).Scan(&u.Used)
+		if err != nil {
+			return nil, err
+		}
+		u.Remaining = max(l.limit-u.Used, 0)
+		usage = append(usage, u)
+	}
+	return usage, nil
+}
+
+// pruneQuotaUsage drops the counters of periods long past
+func (a *App) pruneQuotaUsage(ctx context.Context) error {
+	_, err := a.DB.ExecContext(ctx, "DELETE FROM api_quota_usage WHERE period_start < $1", time.Now().UTC().Add(-quotaUsageRetention))
+	return err
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// TransferQuote previews a transfer: what it would cost and leave on the
+// accounts, and what would hold it up or turn it down
+type TransferQuote struct {
+	FromAccountID int     `json:"source_account_id"`
+	ToAccountID   int     `json:"destination_account_id"`
+	ToTenantID    string  `json:"destination_tenant_id"`
+	Amount        float64 `json:"amount"`
+	Fee           float64 `json:"fee"`
+	// TotalDebit is the amount plus the fee, taken from the source account
+	TotalDebit float64 `json:"total_debit"`
+	// FXRate converts the amount into what the destination receives. All
+	// accounts hold the same currency, so it is 1.
+	FXRate            float64 `json:"fx_rate"`
+	DestinationAmount float64 `json:"destination_amount"`
+	// SourceBalance and DestinationBalance are the balances the transfer
+	// would leave; DestinationBalance is left out for external transfers
+	SourceBalance      float64              `json:"source_balance_after"`
+	DestinationBalance *float64             `json:"destination_balance_after,omitempty"`
+	External           *ExternalDestination `json:"external_destination,omitempty"`
+	// Warnings carry the code the transfer would be answered with when it
+	// would fail or be held
+	Warnings []QuoteWarning `json:"warnings"`
+}
+
+// QuoteWarning is a reason a quoted transfer would not complete right away
+type QuoteWarning struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// handleQuote serves POST /transactions/quote. It takes the body of POST
+// /transactions and validates it the same way, but moves no money and counts
+// against no transfer quota.
+func (a *App) handleQuote(w http.ResponseWriter, r *http.Request) {
+	var tr TransferRequest
+	if apiErr := decodeJSON(r, &tr, 1012, "amount"); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	quote, apiErr := a.quoteTransfer(r.Context(), tenantFromContext(r.Context()), tr)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	language := languageOf(w)
+	for i := range quote.Warnings {
+		quote.Warnings[i].Message = localize(language, quote.Warnings[i].Message)
+	}
+	writeJSONSuccess(w, quote, "Transfer quoted", 2055, http.StatusOK)
+}
+
+// quoteTransfer works out tr as executeTransfer would, reading the accounts
+// in a read-only transaction
+func (a *App) quoteTransfer(ctx context.Context, tenant string, tr TransferRequest) (*TransferQuote, *apiError) {
+	if apiErr := tr.validate(a.Config.Limits); apiErr != nil {
+		return nil, apiErr
+	}
+	toTenant, apiErr := a.resolveTransfer(tenant, &tr)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	fee := a.transferFee(tenant, tr.Amount)
+	q := &TransferQuote{
+		FromAccountID:     tr.FromAccountID,
+		ToAccountID:       tr.ToAccountID,
+		ToTenantID:        toTenant,
+		Amount:            tr.Amount,
+		Fee:               fee,
+		TotalDebit:        roundCents(tr.Amount + fee),
+		FXRate:            1,
+		DestinationAmount: tr.Amount,
+		External:          tr.External,
+		Warnings:          []QuoteWarning{},
+	}
+
+	tx, err := a.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to begin transaction", 1013, http.StatusInternalServerError))
+	}
+	defer tx.Rollback()
+
+	var source Account
+	var reserved float64
+	var accountType string
+	err = tx.QueryRowContext(ctx, "SELECT id, balance, "+reservedFunds+", COALESCE(account_type, '') FROM accounts WHERE id = $1 AND tenant_id = $2 AND closed_at IS NULL", tr.FromAccountID, tenant).
+		Scan(&source.ID, &source.Balance, &reserved, &accountType)
+	if err != nil {
+		return nil, quoteReadError(err, "Source account not found", 1014)
+	}
+	q.SourceBalance = roundCents(source.Balance - q.TotalDebit)
+	if tr.External == nil {
+		var balance float64
+		err = tx.QueryRowContext(ctx, "SELECT balance FROM accounts WHERE id = $1 AND tenant_id = $2 AND closed_at IS NULL", tr.ToAccountID, toTenant).Scan(&balance)
+		if err != nil {
+			return nil, quoteReadError(err, "Destination account not found", 1017)
+		}
+		balance = roundCents(balance + q.DestinationAmount)
+		q.DestinationBalance = &balance
+	}
+
+	if source.Balance-reserved < q.TotalDebit {
+		q.warn(1015, "Insufficient funds")
+	} else if source.Balance-reserved-q.TotalDebit < a.Config.minimumBalance(accountType) {
+		q.warn(1134, "Transfer would take the account below its minimum balance")
+	}
+	if apiErr := a.findDuplicate(ctx, tenant, tr); apiErr != nil {
+		q.warn(apiErr.Code, apiErr.Message)
+	}
+	if apiErr := a.checkVelocity(ctx, tx, tenant, source, tr.Amount); apiErr != nil {
+		q.warn(apiErr.Code, apiErr.Message)
+	}
+	transfers, err := a.quotaUsage(ctx, principalFromContext(ctx), QuotaTransfers)
+	if err != nil {
+		return nil, newAPIError("Failed to load quota", 1005, http.StatusInternalServerError)
+	}
+	for _, u := range transfers {
+		if u.Remaining == 0 {
+			q.warn(1105, "Quota exceeded")
+			break
+		}
+	}
+	if a.Config.StepUp.required(tr.Amount) {
+		q.warn(2015, "Transfer awaiting OTP confirmation")
+	}
+	if a.Config.Approval.required(tr.Amount) {
+		q.warn(2011, "Transfer awaiting approval")
+	}
+	return q, nil
+}
+
+func (q *TransferQuote) warn(code int, message string) {
+	q.Warnings = append(q.Warnings, QuoteWarning{Code: code, Message: message})
+}
+
+// checkVelocity runs the configured velocity rules against a transfer of
+// amount from source. The other risk checkers are only asked about transfers
+// that are executed.
+func (a *App) checkVelocity(ctx context.Context, tx *sql.Tx, tenant string, source Account, amount float64) *apiError {
+	if len(a.Config.Risk.Velocity) == 0 || !a.enabled(tenant, FlagRiskChecks) {
+		return nil
+	}
+	err := velocityChecker(a.Config.Risk.Velocity).Check(ctx, RiskInput{
+		TenantID: tenant,
+		From:     source,
+		Amount:   amount,
+		Activity: a.recentActivity(ctx, tx, tenant, source.ID),
+	})
+	var rejection *RiskRejection
+	if errors.As(err, &rejection) {
+		return newAPIError(fmt.Sprintf("Transfer rejected by risk check: %s", rejection.Reason), 1063, http.StatusForbidden)
+	}
+	if err != nil {
+		return newAPIError("Risk check unavailable", 1064, http.StatusServiceUnavailable)
+	}
+	return nil
+}
+
+// quoteReadError reports a quoted account that could not be read as missing,
+// or as a database error
+func quoteReadError(err error, message string, code int) *apiError {
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(message, code, http.StatusNotFound)
+	}
+	return dbWriteError(err, newAPIError("Failed to load accounts", 1009, http.StatusInternalServerError))
+}
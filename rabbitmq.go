@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// RabbitMQConfig configures the RabbitMQ transport. The queues and the
+// exchange are declared durable when the transport connects.
+type RabbitMQConfig struct {
+	URL string `json:"url"`
+	// CommandQueue carries the transfer commands
+	CommandQueue string `json:"command_queue"`
+	// DeadLetterQueue receives the commands that did not result in a
+	// transfer
+	DeadLetterQueue string `json:"dead_letter_queue"`
+	// EventExchange is the topic exchange the transfer events are published
+	// to, with routing keys like transfer.completed
+	EventExchange string `json:"event_exchange"`
+}
+
+func (c RabbitMQConfig) validate() error {
+	if c.URL == "" || c.CommandQueue == "" || c.DeadLetterQueue == "" || c.EventExchange == "" {
+		return fmt.Errorf("url, command_queue, dead_letter_queue and event_exchange are required")
+	}
+	if c.CommandQueue == c.DeadLetterQueue {
+		return fmt.Errorf("dead_letter_queue must differ from command_queue")
+	}
+	return nil
+}
+
+// rabbitMQTransport consumes commands from a queue with a prefetch of one
+// and publishes with publisher confirms. A lost connection is dialed again
+// on the next call; the commands it left unacknowledged are redelivered.
+type rabbitMQTransport struct {
+	cfg RabbitMQConfig
+
+	mu         sync.Mutex
+	conn       *amqp.Connection
+	consumer   *amqp.Channel
+	publisher  *amqp.Channel
+	deliveries <-chan amqp.Delivery
+}
+
+func newRabbitMQTransport(cfg RabbitMQConfig) *rabbitMQTransport {
+	return &rabbitMQTransport{cfg: cfg}
+}
+
+// connect dials the broker unless connected. Callers hold mu.
+func (r *rabbitMQTransport) connect() error {
+	if r.conn != nil && !r.conn.IsClosed() && !r.consumer.IsClosed() && !r.publisher.IsClosed() {
+		return nil
+	}
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
+	}
+	conn, err := amqp.Dial(r.cfg.URL)
+	if err != nil {
+		return err
+	}
+	consumer, err := conn.Channel()
+	if err == nil {
+		err = r.declare(consumer)
+	}
+	if err == nil {
+		err = consumer.Qos(1, 0, false)
+	}
+	var deliveries <-chan amqp.Delivery
+	if err == nil {
+		deliveries, err = consumer.Consume(r.cfg.CommandQueue, "", false, false, false, false, nil)
+	}
+	var publisher *amqp.Channel
+	if err == nil {
+		publisher, err = conn.Channel()
+	}
+	if err == nil {
+		err = publisher.Confirm(false)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	r.conn, r.consumer, r.publisher, r.deliveries = conn, consumer, publisher, deliveries
+	return nil
+}
+
+func (r *rabbitMQTransport) declare(ch *amqp.Channel) error {
+	for _, queue := range []string{r.cfg.CommandQueue, r.cfg.DeadLetterQueue} {
+		if _, err := ch.QueueDeclare(queue, true, false, false, false, nil); err != nil {
+			return err
+		}
+	}
+	return ch.ExchangeDeclare(r.cfg.EventExchange, amqp.ExchangeTopic, true, false, false, false, nil)
+}
+
+func (r *rabbitMQTransport) fetch(ctx context.Context) (brokerMessage, error) {
+	r.mu.Lock()
+	err := r.connect()
+	deliveries := r.deliveries
+	r.mu.Unlock()
+	if err != nil {
+		return brokerMessage{}, err
+	}
+	select {
+	case <-ctx.Done():
+		return brokerMessage{}, ctx.Err()
+	case d, ok := <-deliveries:
+		if !ok {
+			return brokerMessage{}, amqp.ErrClosed
+		}
+		id := d.MessageId
+		if id == "" {
+			id, _ = d.Headers[headerMessageID].(string)
+		}
+		tenant, _ := d.Headers[headerTenantID].(string)
+		return brokerMessage{messageID: id, tenant: tenant, body: d.Body, raw: d}, nil
+	}
+}
+
+// ack acknowledges a command. A command whose channel closed meanwhile is
+// redelivered, and then skipped as processed.
+func (r *rabbitMQTransport) ack(ctx context.Context, msg brokerMessage) error {
+	if err := msg.raw.(amqp.Delivery).Ack(false); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+func (r *rabbitMQTransport) deadLetter(ctx context.Context, msg brokerMessage, rejection *apiError) error {
+	d := msg.raw.(amqp.Delivery)
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[headerErrorCode] = strconv.Itoa(rejection.Code)
+	headers[headerErrorMessage] = rejection.Message
+	return r.send(ctx, "", []string{r.cfg.DeadLetterQueue}, []amqp.Publishing{{
+		ContentType:  d.ContentType,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    d.MessageId,
+		Headers:      headers,
+		Body:         d.Body,
+	}})
+}
+
+// publish sends the events to the exchange, routed by status
+func (r *rabbitMQTransport) publish(ctx context.Context, events []transferEventMessage) error {
+	keys := make([]string, len(events))
+	msgs := make([]amqp.Publishing, len(events))
+	for i, e := range events {
+		keys[i] = "transfer." + e.Event.Status
+		msgs[i] = amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    strconv.FormatInt(e.Seq, 10),
+			Headers:      amqp.Table{headerTenantID: e.Event.TenantID},
+			Body:         e.Payload,
+		}
+	}
+	return r.send(ctx, r.cfg.EventExchange, keys, msgs)
+}
+
+// send publishes each message to exchange with its routing key and waits
+// for the broker to confirm them all
+func (r *rabbitMQTransport) send(ctx context.Context, exchange string, keys []string, msgs []amqp.Publishing) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.connect(); err != nil {
+		return err
+	}
+	confirms := make([]*amqp.DeferredConfirmation, len(msgs))
+	for i, m := range msgs {
+		var err error
+		if confirms[i], err = r.publisher.PublishWithDeferredConfirmWithContext(ctx, exchange, keys[i], false, false, m); err != nil {
+			return err
+		}
+	}
+	for _, c := range confirms {
+		acked, err := c.WaitContext(ctx)
+		if err != nil {
+			return err
+		}
+		if !acked {
+			return fmt.Errorf("rabbitmq: message %d not confirmed", c.DeliveryTag)
+		}
+	}
+	return nil
+}
+
+func (r *rabbitMQTransport) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		return nil
+	}
+	return r.conn.Close()
+}
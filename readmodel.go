@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+)
+
+// ReadModelConfig configures the projector that keeps the read tables up to
+// date
+type ReadModelConfig struct {
+	IntervalSeconds int `json:"interval_seconds"`
+}
+
+// readModelLockID is the advisory lock held by the one projector running at a
+// time across replicas
+const readModelLockID = 7240_1002
+
+// readModelBatchSize is the number of changes projected per transaction
+const readModelBatchSize = 1000
+
+// projectReadModel copies the accounts and transactions changed since the last
+// run into read_accounts and read_transactions. Triggers queue every changed
+// row in read_model_changes; projected changes are deleted, so a change that
+// commits late is simply picked up by a later run.
+func (a *App) projectReadModel(ctx context.Context) error {
+	for {
+		n, err := a.projectReadModelBatch(ctx)
+		if err != nil || n < readModelBatchSize {
+			return err
+		}
+	}
+}
+
+func (a *App) projectReadModelBatch(ctx context.Context) (int, error) {
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRowContext(ctx, "SELECT pg_try_advisory_xact_lock($1)", readModelLockID).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, nil // another replica is projecting
+	}
+
+	rows, err := tx.QueryContext(ctx, `DELETE FROM read_model_changes
+		WHERE seq IN (SELECT seq FROM read_model_changes ORDER BY seq LIMIT $1) RETURNING entity, entity_id`, readModelBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var accounts, transactions []int64
+	n := 0
+	for rows.Next() {
+		var entity string
+		var id int64
+		if err := rows.Scan(&entity, &id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		n++
+		switch entity {
+		case "accounts":
+			accounts = append(accounts, id)
+		case "transactions":
+			transactions = append(transactions, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if err := projectRows(ctx, tx, readAccountsUpsert, accounts); err != nil {
+		return 0, err
+	}
+	if err := projectRows(ctx, tx, readTransactionsUpsert, transactions); err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// projectRows copies the current state of the rows with the given IDs
+func projectRows(ctx context.Context, tx *sql.Tx, upsert string, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, upsert, pq.Array(ids))
+	return err
+}
+
+const readAccountsUpsert = `INSERT INTO read_accounts (id, tenant_id, customer_id, balance, last_updated, iban)
+	SELECT id, tenant_id, customer_id, balance, last_updated, iban FROM accounts WHERE id = ANY($1)
+	ON CONFLICT (id) DO UPDATE SET tenant_id = EXCLUDED.tenant_id, customer_id = EXCLUDED.customer_id,
+		balance = EXCLUDED.balance, last_updated = EXCLUDED.last_updated, iban = EXCLUDED.iban`
+
+const readTransactionsUpsert = `INSERT INTO read_transactions (id, tenant_id, to_tenant_id, from_account, to_account, amount, status, created_at, completed_at, failure_reason, reference, memo, category, tags)
+	SELECT id, tenant_id, to_tenant_id, from_account, to_account, amount, status, created_at, completed_at, failure_reason, reference, memo, category, tags FROM transactions WHERE id = ANY($1)
+	ON CONFLICT (id) DO UPDATE SET tenant_id = EXCLUDED.tenant_id, to_tenant_id = EXCLUDED.to_tenant_id,
+		from_account = EXCLUDED.from_account, to_account = EXCLUDED.to_account, amount = EXCLUDED.amount,
+		status = EXCLUDED.status, created_at = EXCLUDED.created_at, completed_at = EXCLUDED.completed_at,
+		failure_reason = EXCLUDED.failure_reason, reference = EXCLUDED.reference, memo = EXCLUDED.memo,
+		category = EXCLUDED.category, tags = EXCLUDED.tags`
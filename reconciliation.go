@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ReconciliationConfig configures the reconciliation job, which is disabled
+// by an interval of 0
+type ReconciliationConfig struct {
+	IntervalSeconds int `json:"interval_seconds"`
+}
+
+// ReconciliationRun is one pass of the reconciliation job
+type ReconciliationRun struct {
+	ID              int           `json:"run_id"`
+	StartedAt       time.Time     `json:"started_at"`
+	FinishedAt      time.Time     `json:"finished_at"`
+	AccountsChecked int           `json:"accounts_checked"`
+	Discrepancies   []Discrepancy `json:"discrepancies"`
+}
+
+// Discrepancy is an account whose stored balance differs from the balance
+// computed from its transactions
+type Discrepancy struct {
+	AccountID       int     `json:"account_id"`
+	TenantID        string  `json:"tenant_id"`
+	StoredBalance   float64 `json:"stored_balance"`
+	ComputedBalance float64 `json:"computed_balance"`
+	Difference      float64 `json:"difference"`
+}
+
+// ledgerBalances computes every account's balance from its initial balance
+// and the transactions that moved funds. System accounts take part in
+// transfers of all tenants, so movements are matched by account ID alone.
+const ledgerBalances = `SELECT a.id, a.tenant_id, a.balance, a.initial_balance + COALESCE(m.net, 0)
+	FROM accounts a LEFT JOIN (
+		SELECT account, SUM(amount) AS net FROM (
+			SELECT from_account, -amount FROM ledger_transactions WHERE from_account IS NOT NULL AND status IN ($1, $2, $3)
+			UNION ALL
+			SELECT to_account, amount FROM ledger_transactions WHERE to_account IS NOT NULL AND status IN ($1, $2, $3)
+		) x(account, amount) GROUP BY account
+	) m ON m.account = a.id`
+
+// reconcile recomputes the balance of every account from the ledger,
+// archived transactions included, and records the accounts whose stored
+// balance disagrees
+func (a *App) reconcile(ctx context.Context) error {
+	_, err := a.runReconciliation(ctx)
+	return err
+}
+
+// runReconciliation is one pass of reconcile, returning the ID of its run
+func (a *App) runReconciliation(ctx context.Context) (int, error) {
+	started := time.Now()
+	// one snapshot, so transfers committing meanwhile do not show up as drift
+	tx, err := a.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, ledgerBalances, movingStatuses[0], movingStatuses[1], movingStatuses[2])
+	if err != nil {
+		return 0, err
+	}
+	checked := 0
+	var found []Discrepancy
+	for rows.Next() {
+		var d Discrepancy
+		if err := rows.Scan(&d.AccountID, &d.TenantID, &d.StoredBalance, &d.ComputedBalance); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		checked++
+		if d.Difference = roundCents(d.StoredBalance - d.ComputedBalance); d.Difference != 0 {
+			found = append(found, d)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var runID int
+	err = tx.QueryRowContext(ctx, "INSERT INTO reconciliation_runs (started_at, finished_at, accounts_checked, discrepancies) VALUES ($1, NOW(), $2, $3) RETURNING id",
+		started, checked, len(found)).Scan(&runID)
+	if err != nil {
+		return 0, err
+	}
+	for _, d := range found {
+		_, err := tx.ExecContext(ctx, `INSERT INTO reconciliation_report (run_id, tenant_id, account_id, stored_balance, computed_balance, difference)
+			VALUES ($1, $2, $3, $4, $5, $6)`, runID, d.TenantID, d.AccountID, d.StoredBalance, d.ComputedBalance, d.Difference)
+		if err != nil {
+			return 0, err
+		}
+		log.Printf("reconciliation: account %d (tenant %s) stored %.2f, ledger %.2f", d.AccountID, d.TenantID, d.StoredBalance, d.ComputedBalance)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	reconciliationDiscrepancies.Set(float64(len(found)))
+	reconciliationLastRun.SetToCurrentTime()
+	return runID, nil
+}
+
+// handleReconciliation serves GET /admin/reconciliation, the report of the
+// latest reconciliation run or of ?run_id=, and POST /admin/reconciliation,
+// which runs a reconciliation right away and returns its report
+func (a *App) handleReconciliation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeJSONError(w, "Only GET and POST methods are allowed", 1001, http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+	ctx := r.Context()
+
+	query := "SELECT id, started_at, finished_at, accounts_checked FROM reconciliation_runs ORDER BY id DESC LIMIT 1"
+	var args []interface{}
+	message, code := "Reconciliation report retrieved", 2022
+	if r.Method == http.MethodPost {
+		id, err := a.runReconciliation(ctx)
+		if err != nil {
+			writeAPIError(w, dbWriteError(err, newAPIError("Reconciliation failed", 1005, http.StatusInternalServerError)))
+			return
+		}
+		query = "SELECT id, started_at, finished_at, accounts_checked FROM reconciliation_runs WHERE id = $1"
+		args = append(args, id)
+		message, code = "Reconciliation run completed", 2049
+	} else if v := r.URL.Query().Get("run_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			writeJSONError(w, "Reconciliation run not found", 1070, http.StatusNotFound)
+			return
+		}
+		query = "SELECT id, started_at, finished_at, accounts_checked FROM reconciliation_runs WHERE id = $1"
+		args = append(args, id)
+	}
+
+	run := ReconciliationRun{Discrepancies: []Discrepancy{}}
+	err := a.DB.QueryRowContext(ctx, query, args...).Scan(&run.ID, &run.StartedAt, &run.FinishedAt, &run.AccountsChecked)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, "Reconciliation run not found", 1070, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "Failed to load reconciliation report", 1005, http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := a.DB.QueryContext(ctx, `SELECT account_id, tenant_id, stored_balance, computed_balance, difference
+		FROM reconciliation_report WHERE run_id = $1 ORDER BY account_id`, run.ID)
+	if err != nil {
+		writeJSONError(w, "Failed to load reconciliation report", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d Discrepancy
+		if err := rows.Scan(&d.AccountID, &d.TenantID, &d.StoredBalance, &d.ComputedBalance, &d.Difference); err != nil {
+			writeJSONError(w, "Failed to load reconciliation report", 1005, http.StatusInternalServerError)
+			return
+		}
+		run.Discrepancies = append(run.Discrepancies, d)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, "Failed to load reconciliation report", 1005, http.StatusInternalServerError)
+		return
+	}
+	writeJSONSuccess(w, run, message, code, http.StatusOK)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// paidTransfer is a completed transfer that part of may be paid back
+type paidTransfer struct {
+	ID            int
+	FromAccountID int
+	TenantID      string
+	ToAccountID   int
+	ToTenantID    string
+	Amount        float64
+	Status        string
+}
+
+// lockPaidTransfer reads transaction id whose tenant, or destination tenant
+// when toTenant is set, is tenant and locks its row, so refunds and
+// disputes of it are counted one after another
+func lockPaidTransfer(ctx context.Context, tx *sql.Tx, id int, tenant string, toTenant bool) (paidTransfer, error) {
+	column := "tenant_id"
+	if toTenant {
+		column = "to_tenant_id"
+	}
+	t := paidTransfer{ID: id}
+	err := tx.QueryRowContext(ctx, "SELECT from_account, tenant_id, to_account, to_tenant_id, amount, status FROM transactions WHERE id = $1 AND "+column+" = $2 FOR UPDATE",
+		id, tenant).Scan(&t.FromAccountID, &t.TenantID, &t.ToAccountID, &t.ToTenantID, &t.Amount, &t.Status)
+	return t, err
+}
+
+// returnable reports whether t can be refunded or disputed: it completed and
+// moved funds between customer accounts
+func (a *App) returnable(t paidTransfer) bool {
+	return t.Status == TxCompleted && !a.systemAccount(t.FromAccountID) && !a.systemAccount(t.ToAccountID)
+}
+
+// returnedAmount sums what of a transfer is refunded or claimed by open or
+// reversed disputes
+func returnedAmount(ctx context.Context, tx *sql.Tx, transactionID int) (float64, error) {
+	var returned float64
+	err := tx.QueryRowContext(ctx, `SELECT
+		(SELECT COALESCE(SUM(amount), 0) FROM transaction_refunds WHERE transaction_id = $1) +
+		(SELECT COALESCE(SUM(amount), 0) FROM disputes WHERE transaction_id = $1 AND status IN ($2, $3))`,
+		transactionID, DisputeOpen, DisputeReversed).Scan(&returned)
+	return returned, err
+}
+
+// payBack moves amount of t from its destination back to its source as a
+// completed transaction and returns its ID. The destination cannot give up
+// what reserved, an SQL expression over accounts, sets aside.
+func (a *App) payBack(ctx context.Context, tx *sql.Tx, t paidTransfer, amount float64, reference, memo, reserved string) (int, *apiError) {
+	failed := newAPIError("Failed to pay back transfer", 1005, http.StatusInternalServerError)
+	if err := a.lockAccountsOf(ctx, tx, accountLock{tenant: t.ToTenantID, id: t.ToAccountID}, accountLock{tenant: t.TenantID, id: t.FromAccountID}); err != nil {
+		return 0, dbWriteError(err, newAPIError("Failed to lock accounts", 1013, http.StatusInternalServerError))
+	}
+	var balance, held float64
+	err := tx.QueryRowContext(ctx, "SELECT balance, "+reserved+" FROM accounts WHERE id = $1 AND tenant_id = $2 FOR UPDATE", t.ToAccountID, t.ToTenantID).
+		Scan(&balance, &held)
+	if err == sql.ErrNoRows {
+		return 0, newAPIError("Destination account not found", 1017, http.StatusNotFound)
+	}
+	if err != nil {
+		return 0, dbWriteError(err, failed)
+	}
+	if balance-held < amount {
+		return 0, newAPIError("Insufficient funds", 1015, http.StatusBadRequest)
+	}
+	// the new versions fail the guarded updates of transfers that read the
+	// accounts before
+	if _, err := tx.ExecContext(ctx, "UPDATE accounts SET balance = balance - $1, last_updated = "+nextVersion+" WHERE id = $2", amount, t.ToAccountID); err != nil {
+		return 0, dbWriteError(err, failed)
+	}
+	result, err := tx.ExecContext(ctx, "UPDATE accounts SET balance = balance + $1, last_updated = "+nextVersion+" WHERE id = $2 AND tenant_id = $3 AND closed_at IS NULL",
+		amount, t.FromAccountID, t.TenantID)
+	if err != nil {
+		return 0, dbWriteError(err, failed)
+	}
+	if affectedRows(result, nil) == 0 {
+		return 0, newAPIError("Source account not found", 1014, http.StatusNotFound)
+	}
+
+	var transactionID int
+	err = tx.StmtContext(ctx, a.Stmts.insertTransaction).QueryRowContext(ctx,
+		t.ToAccountID, t.FromAccountID, amount, t.ToTenantID, t.TenantID, TxCompleted, reference, memo).Scan(&transactionID)
+	if err != nil {
+		return 0, dbWriteError(err, newAPIError("Failed to log transaction", 1019, http.StatusInternalServerError))
+	}
+	if err := a.appendEvents(ctx, tx, transferEvents(t.ToAccountID, t.FromAccountID, amount, transactionID)...); err != nil {
+		return 0, dbWriteError(err, failed)
+	}
+	return transactionID, nil
+}
+
+// Refund is part of a completed transfer paid back by its destination
+type Refund struct {
+	ID                  int       `json:"refund_id"`
+	TransactionID       int       `json:"transaction_id"`
+	RefundTransactionID int       `json:"refund_transaction_id"`
+	Amount              float64   `json:"amount"`
+	Reason              string    `json:"reason,omitempty"`
+	CreatedBy           string    `json:"created_by"`
+	CreatedAt           time.Time `json:"created_at"`
+}
+
+// RefundSummary is a transfer with its refunds. Refundable leaves out what
+// open and reversed disputes claim.
+type RefundSummary struct {
+	TransactionID int      `json:"transaction_id"`
+	Amount        float64  `json:"amount"`
+	Refunded      float64  `json:"refunded_amount"`
+	Refundable    float64  `json:"refundable_amount"`
+	Refunds       []Refund `json:"refunds"`
+}
+
+// RefundRequest is the JSON body of POST /transactions/{id}/refunds
+type RefundRequest struct {
+	Amount float64 `json:"amount"`
+	Reason string  `json:"reason,omitempty"`
+}
+
+func (req *RefundRequest) validate() *apiError {
+	var v validator
+	v.amount("amount", req.Amount)
+	v.check(len(req.Reason) <= maxMemoLength, "reason", fmt.Sprintf("must be at most %d characters", maxMemoLength))
+	return v.err()
+}
+
+// handleRefund serves POST /transactions/{id}/refunds. The tenant of the
+// destination pays part or all of a completed transfer back to its source,
+// as a transaction referenced RFD-{id}; the refunds of a transfer never add
+// up to more than its amount.
+func (a *App) handleRefund(w http.ResponseWriter, r *http.Request, transactionID int) {
+	var req RefundRequest
+	if apiErr := decodeJSON(r, &req, 1002, "amount"); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if apiErr := req.validate(); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	summary, apiErr := a.refund(r.Context(), tenantFromContext(r.Context()), transactionID, req)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	writeJSONSuccess(w, summary, "Refund completed", 2069, http.StatusCreated)
+}
+
+func (a *App) refund(ctx context.Context, tenant string, transactionID int, req RefundRequest) (*RefundSummary, *apiError) {
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to begin transaction", 1013, http.StatusInternalServerError))
+	}
+	defer tx.Rollback()
+
+	t, err := lockPaidTransfer(ctx, tx, transactionID, tenant, true)
+	if err == sql.ErrNoRows {
+		return nil, newAPIError("Transaction not found", 1044, http.StatusNotFound)
+	}
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to load transaction", 1005, http.StatusInternalServerError))
+	}
+	if !a.returnable(t) {
+		return nil, newAPIError("Only completed transfers between customer accounts can be refunded", 1122, http.StatusConflict)
+	}
+	returned, err := returnedAmount(ctx, tx, transactionID)
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to refund transfer", 1005, http.StatusInternalServerError))
+	}
+	if req.Amount > roundCents(t.Amount-returned) {
+		apiErr := newAPIError("Refund amount exceeds the refundable amount", 1123, http.StatusUnprocessableEntity)
+		apiErr.Data = map[string]float64{"refundable_amount": roundCents(t.Amount - returned)}
+		return nil, apiErr
+	}
+
+	refundTransactionID, apiErr := a.payBack(ctx, tx, t, req.Amount, "RFD-"+strconv.Itoa(t.ID), req.Reason, reservedFunds)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	rf := Refund{TransactionID: t.ID, RefundTransactionID: refundTransactionID, Amount: req.Amount, Reason: req.Reason, CreatedBy: principalFromContext(ctx).Name}
+	err = tx.QueryRowContext(ctx, "INSERT INTO transaction_refunds (tenant_id, transaction_id, refund_transaction_id, amount, reason, created_by) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at",
+		tenant, rf.TransactionID, rf.RefundTransactionID, rf.Amount, rf.Reason, rf.CreatedBy).Scan(&rf.ID, &rf.CreatedAt)
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to refund transfer", 1005, http.StatusInternalServerError))
+	}
+	err = a.audit(ctx, tx, auditRecord{
+		TenantID:   tenant,
+		Action:     "transfer.refunded",
+		EntityType: "transaction",
+		EntityID:   strconv.Itoa(t.ID),
+		After:      rf,
+	})
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to refund transfer", 1005, http.StatusInternalServerError))
+	}
+	summary, err := loadRefunds(ctx, tx, t)
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to refund transfer", 1005, http.StatusInternalServerError))
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to commit transaction", 1020, http.StatusInternalServerError))
+	}
+	a.Cache.invalidate(ctx, t.ToTenantID, t.ToAccountID)
+	a.Cache.invalidate(ctx, t.TenantID, t.FromAccountID)
+	a.notifyTransfer(refundTransactionID)
+	return summary, nil
+}
+
+// handleListRefunds serves GET /transactions/{id}/refunds to either tenant
+// of the transfer
+func (a *App) handleListRefunds(w http.ResponseWriter, r *http.Request, transactionID int) {
+	ctx := r.Context()
+	tx, err := a.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		writeJSONError(w, "Failed to load refunds", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	tenant := tenantFromContext(ctx)
+	t := paidTransfer{ID: transactionID}
+	err = tx.QueryRowContext(ctx, "SELECT from_account, tenant_id, to_account, to_tenant_id, amount, status FROM transactions WHERE id = $1 AND (tenant_id = $2 OR to_tenant_id = $2)",
+		transactionID, tenant).Scan(&t.FromAccountID, &t.TenantID, &t.ToAccountID, &t.ToTenantID, &t.Amount, &t.Status)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, "Transaction not found", 1044, http.StatusNotFound)
+		return
+	}
+	var summary *RefundSummary
+	if err == nil {
+		summary, err = loadRefunds(ctx, tx, t)
+	}
+	if err != nil {
+		writeJSONError(w, "Failed to load refunds", 1005, http.StatusInternalServerError)
+		return
+	}
+	if !a.returnable(t) {
+		summary.Refundable = 0
+	}
+	writeJSONSuccess(w, summary, "Refunds retrieved", 2070, http.StatusOK)
+}
+
+// loadRefunds returns the refunds of t, oldest first, with their total
+func loadRefunds(ctx context.Context, tx *sql.Tx, t paidTransfer) (*RefundSummary, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT id, transaction_id, refund_transaction_id, amount, reason, created_by, created_at FROM transaction_refunds WHERE transaction_id = $1 ORDER BY id", t.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	summary := &RefundSummary{TransactionID: t.ID, Amount: t.Amount, Refunds: []Refund{}}
+	for rows.Next() {
+		var rf Refund
+		if err := rows.Scan(&rf.ID, &rf.TransactionID, &rf.RefundTransactionID, &rf.Amount, &rf.Reason, &rf.CreatedBy, &rf.CreatedAt); err != nil {
+			return nil, err
+		}
+		summary.Refunds = append(summary.Refunds, rf)
+		summary.Refunded += rf.Amount
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	returned, err := returnedAmount(ctx, tx, t.ID)
+	if err != nil {
+		return nil, err
+	}
+	summary.Refunded = roundCents(summary.Refunded)
+	summary.Refundable = roundCents(t.Amount - returned)
+	return summary, nil
+}
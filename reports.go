@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Report groupings
+const (
+	GroupByDay     = "day"
+	GroupByAccount = "account"
+)
+
+// ReportRow is one group of a report: a day, or a source account
+type ReportRow struct {
+	Day       string         `json:"day,omitempty"`
+	AccountID *int           `json:"account_id,omitempty"`
+	Count     int            `json:"count"`
+	Volume    float64        `json:"volume"`
+	ByStatus  map[string]int `json:"by_status,omitempty"`
+	Reasons   map[string]int `json:"reasons,omitempty"`
+}
+
+// Report is the response of the report endpoints
+type Report struct {
+	From    string      `json:"from,omitempty"`
+	To      string      `json:"to,omitempty"`
+	GroupBy string      `json:"group_by"`
+	Rows    []ReportRow `json:"rows"`
+}
+
+// parseDateRange reads the optional from and to query parameters as
+// YYYY-MM-DD dates, writing a 1069 response and returning false when either
+// is malformed. Absent bounds stay nil.
+func parseDateRange(w http.ResponseWriter, r *http.Request) (from, to interface{}, ok bool) {
+	for name, bound := range map[string]*interface{}{"from": &from, "to": &to} {
+		v := r.URL.Query().Get(name)
+		if v == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", v); err != nil {
+			writeJSONError(w, "Invalid date range, expected YYYY-MM-DD", 1069, http.StatusBadRequest)
+			return nil, nil, false
+		}
+		*bound = v
+	}
+	return from, to, true
+}
+
+// reportGroup is a row of the aggregate query behind all reports
+type reportGroup struct {
+	key    string
+	status string
+	reason string
+	count  int
+	volume float64
+}
+
+// aggregateTransactions groups the tenant's transactions created between two
+// dates, both inclusive, by groupBy, status and failure reason. It reads the
+// read model so dashboards do not load the transfer path.
+func (a *App) aggregateTransactions(ctx context.Context, tenant, groupBy string, from, to interface{}) ([]reportGroup, error) {
+	key := "to_char(created_at, 'YYYY-MM-DD')"
+	if groupBy == GroupByAccount {
+		key = "COALESCE(from_account::text, '')"
+	}
+	rows, err := a.Replica.QueryContext(ctx, "SELECT "+key+`, status, COALESCE(failure_reason, ''), COUNT(*), COALESCE(SUM(amount), 0)
+		FROM read_transactions
+		WHERE tenant_id = $1 AND ($2::date IS NULL OR created_at >= $2::date) AND ($3::date IS NULL OR created_at < $3::date + 1)
+		GROUP BY 1, 2, 3 ORDER BY 1`, tenant, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []reportGroup
+	for rows.Next() {
+		var g reportGroup
+		if err := rows.Scan(&g.key, &g.status, &g.reason, &g.count, &g.volume); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+// reportRows folds the groups accepted by include into one row per key, in
+// day or account order
+func reportRows(groupBy string, groups []reportGroup, include func(reportGroup) bool, add func(*ReportRow, reportGroup)) []ReportRow {
+	byKey := map[string]*ReportRow{}
+	var keys []string
+	for _, g := range groups {
+		if !include(g) {
+			continue
+		}
+		row, ok := byKey[g.key]
+		if !ok {
+			row = &ReportRow{}
+			if groupBy == GroupByAccount {
+				if id, err := strconv.Atoi(g.key); err == nil {
+					row.AccountID = &id
+				}
+			} else {
+				row.Day = g.key
+			}
+			byKey[g.key] = row
+			keys = append(keys, g.key)
+		}
+		row.Count += g.count
+		add(row, g)
+	}
+	if groupBy == GroupByAccount {
+		sort.Slice(keys, func(i, j int) bool {
+			a, _ := strconv.Atoi(keys[i])
+			b, _ := strconv.Atoi(keys[j])
+			return a < b
+		})
+	}
+
+	result := make([]ReportRow, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, *byKey[k])
+	}
+	return result
+}
+
+// handleReport serves GET /reports/daily-volume, /reports/transfer-counts and
+// /reports/failures?from=&to=&group_by=day|account. Accounts are grouped by
+// the source of the transfer.
+func (a *App) handleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, "Only GET method is allowed", 1006, http.StatusMethodNotAllowed)
+		return
+	}
+
+	var include func(reportGroup) bool
+	var add func(*ReportRow, reportGroup)
+	switch r.URL.Path {
+	case "/reports/daily-volume":
+		include = func(g reportGroup) bool { return isMoving(g.status) }
+		add = func(row *ReportRow, g reportGroup) { row.Volume = roundCents(row.Volume + g.volume) }
+	case "/reports/transfer-counts":
+		include = func(reportGroup) bool { return true }
+		add = func(row *ReportRow, g reportGroup) {
+			if row.ByStatus == nil {
+				row.ByStatus = map[string]int{}
+			}
+			row.ByStatus[g.status] += g.count
+			row.Volume = roundCents(row.Volume + g.volume)
+		}
+	case "/reports/failures":
+		include = func(g reportGroup) bool { return g.status == TxFailed || g.status == TxRejected }
+		add = func(row *ReportRow, g reportGroup) {
+			if row.Reasons == nil {
+				row.Reasons = map[string]int{}
+			}
+			row.Reasons[g.reason] += g.count
+			row.Volume = roundCents(row.Volume + g.volume)
+		}
+	default:
+		writeJSONError(w, "Not found", 1040, http.StatusNotFound)
+		return
+	}
+
+	groupBy := r.URL.Query().Get("group_by")
+	switch groupBy {
+	case "":
+		groupBy = GroupByDay
+	case GroupByDay, GroupByAccount:
+	default:
+		writeJSONError(w, "Invalid group_by, expected day or account", 1075, http.StatusBadRequest)
+		return
+	}
+	from, to, ok := parseDateRange(w, r)
+	if !ok {
+		return
+	}
+
+	groups, err := a.aggregateTransactions(r.Context(), tenantFromContext(r.Context()), groupBy, from, to)
+	if err != nil {
+		writeJSONError(w, "Failed to build report", 1005, http.StatusInternalServerError)
+		return
+	}
+	report := Report{GroupBy: groupBy, Rows: reportRows(groupBy, groups, include, add)}
+	report.From, _ = from.(string)
+	report.To, _ = to.(string)
+	writeJSONSuccess(w, report, "Report retrieved", 2028, http.StatusOK)
+}
+
+// isMoving reports whether transactions in status moved funds
+func isMoving(status string) bool {
+	for _, s := range movingStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Orderings of the most-active accounts report
+const (
+	OrderByCount  = "count"
+	OrderByVolume = "volume"
+)
+
+// ActiveAccount is an account ranked by its transfers within a window, both
+// sent and received
+type ActiveAccount struct {
+	AccountID    int     `json:"account_id"`
+	TransfersIn  int     `json:"transfers_in"`
+	TransfersOut int     `json:"transfers_out"`
+	Count        int     `json:"count"`
+	VolumeIn     float64 `json:"volume_in"`
+	VolumeOut    float64 `json:"volume_out"`
+	Volume       float64 `json:"volume"`
+}
+
+// handleMostActive serves GET /admin/reports/most-active?window_hours=&limit=&order_by=,
+// the top accounts of the tenant by transfer count or volume over the last
+// window_hours
+func (a *App) handleMostActive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, "Only GET method is allowed", 1006, http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+
+	q := r.URL.Query()
+	windowHours, limit, orderBy := 24, 10, q.Get("order_by")
+	var err error
+	if v := q.Get("window_hours"); v != "" {
+		if windowHours, err = strconv.Atoi(v); err != nil || windowHours < 1 || windowHours > 24*90 {
+			writeJSONError(w, "Invalid window_hours, expected 1 to 2160", 1076, http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > 100 {
+			writeJSONError(w, "Invalid limit, expected 1 to 100", 1076, http.StatusBadRequest)
+			return
+		}
+	}
+	switch orderBy {
+	case "":
+		orderBy = OrderByCount
+	case OrderByCount, OrderByVolume:
+	default:
+		writeJSONError(w, "Invalid order_by, expected count or volume", 1076, http.StatusBadRequest)
+		return
+	}
+	// both orderings break ties by the other
+	order := "count DESC, volume DESC"
+	if orderBy == OrderByVolume {
+		order = "volume DESC, count DESC"
+	}
+
+	since := time.Now().Add(-time.Duration(windowHours) * time.Hour)
+	rows, err := a.Replica.QueryContext(r.Context(), `SELECT account_id,
+			COUNT(*) FILTER (WHERE incoming), COUNT(*) FILTER (WHERE NOT incoming), COUNT(*) AS count,
+			COALESCE(SUM(amount) FILTER (WHERE incoming), 0), COALESCE(SUM(amount) FILTER (WHERE NOT incoming), 0), SUM(amount) AS volume
+		FROM (
+			SELECT from_account AS account_id, false AS incoming, amount FROM read_transactions
+			WHERE tenant_id = $1 AND from_account IS NOT NULL AND created_at >= $2 AND status IN ($3, $4, $5)
+			UNION ALL
+			SELECT to_account, true, amount FROM read_transactions
+			WHERE to_tenant_id = $1 AND to_account IS NOT NULL AND created_at >= $2 AND status IN ($3, $4, $5)
+		) movements
+		GROUP BY account_id ORDER BY `+order+`, account_id LIMIT $6`,
+		tenantFromContext(r.Context()), since, movingStatuses[0], movingStatuses[1], movingStatuses[2], limit)
+	if err != nil {
+		writeJSONError(w, "Failed to build report", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	accounts := []ActiveAccount{}
+	for rows.Next() {
+		var acc ActiveAccount
+		if err := rows.Scan(&acc.AccountID, &acc.TransfersIn, &acc.TransfersOut, &acc.Count, &acc.VolumeIn, &acc.VolumeOut, &acc.Volume); err != nil {
+			writeJSONError(w, "Failed to build report", 1005, http.StatusInternalServerError)
+			return
+		}
+		accounts = append(accounts, acc)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, "Failed to build report", 1005, http.StatusInternalServerError)
+		return
+	}
+	writeJSONSuccess(w, accounts, "Most active accounts retrieved", 2029, http.StatusOK)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// RetentionConfig configures the job moving old transactions out of the hot
+// transactions table into transactions_archive. A TransactionDays of 0
+// disables it.
+type RetentionConfig struct {
+	// TransactionDays is the age after which finished transactions are
+	// archived
+	TransactionDays int `json:"transaction_days"`
+	IntervalSeconds int `json:"interval_seconds"`
+	// BatchSize bounds the rows moved per statement, keeping locks short
+	BatchSize int `json:"batch_size"`
+}
+
+// validate checks the retention job can run when it is enabled
+func (c RetentionConfig) validate() error {
+	if c.TransactionDays < 0 {
+		return errors.New("transaction_days must not be negative")
+	}
+	if c.TransactionDays > 0 && (c.IntervalSeconds < 1 || c.BatchSize < 1) {
+		return errors.New("interval_seconds and batch_size must be at least 1")
+	}
+	return nil
+}
+
+// historyColumns are the columns shared by read_transactions and
+// transactions_archive that history reads filter on
+const historyColumns = transactionColumns + ", tenant_id, to_tenant_id"
+
+// archivedHistory is read instead of read_transactions when a history
+// request includes archived transactions
+const archivedHistory = "(SELECT " + historyColumns + " FROM read_transactions UNION ALL SELECT " + historyColumns + " FROM transactions_archive) h"
+
+// archiveBatch moves up to $6 transactions created more than $1 days ago into
+// the archive and drops them from the read model. Only finished transactions
+// are moved, and only those no other table references, so sagas, approvals,
+// challenges, adjustments, dead letters, escrows, disputes, refunds, sweeps,
+// prepared transfers and term deposits keep their transactions, which their
+// paths read from the transactions table.
+const archiveBatch = `WITH moved AS (
+		DELETE FROM transactions WHERE id IN (
+			SELECT t.id FROM transactions t
+			WHERE t.created_at < NOW() - make_interval(days => $1) AND t.status IN ($2, $3, $4, $5)
+				AND NOT EXISTS (SELECT 1 FROM external_transfers e WHERE e.transaction_id = t.id)
+				AND NOT EXISTS (SELECT 1 FROM transfer_approvals p WHERE p.transaction_id = t.id)
+				AND NOT EXISTS (SELECT 1 FROM transfer_challenges c WHERE c.transaction_id = t.id)
+				AND NOT EXISTS (SELECT 1 FROM adjustments j WHERE j.transaction_id = t.id)
+				AND NOT EXISTS (SELECT 1 FROM dead_letters d WHERE d.transaction_id = t.id)
+				AND NOT EXISTS (SELECT 1 FROM escrows w WHERE t.id IN (w.hold_transaction_id, w.settlement_transaction_id))
+				AND NOT EXISTS (SELECT 1 FROM disputes ds WHERE t.id IN (ds.transaction_id, ds.reversal_transaction_id))
+				AND NOT EXISTS (SELECT 1 FROM transaction_refunds rf WHERE t.id IN (rf.transaction_id, rf.refund_transaction_id))
+				AND NOT EXISTS (SELECT 1 FROM sweep_executions sw WHERE sw.transaction_id = t.id)
+				AND NOT EXISTS (SELECT 1 FROM prepared_transfers pt WHERE pt.transaction_id = t.id)
+				AND NOT EXISTS (SELECT 1 FROM term_deposits td WHERE td.transaction_id = t.id)
+			ORDER BY t.id LIMIT $6 FOR UPDATE SKIP LOCKED)
+		RETURNING ` + historyColumns + `
+	), archived AS (
+		INSERT INTO transactions_archive (` + historyColumns + `) SELECT ` + historyColumns + ` FROM moved RETURNING id
+	), unprojected AS (
+		DELETE FROM read_transactions WHERE id IN (SELECT id FROM moved)
+	)
+	SELECT COUNT(*) FROM archived`
+
+// archiveTransactions moves every transaction past the retention age into
+// the archive, a batch per statement
+func (a *App) archiveTransactions(ctx context.Context) error {
+	cfg := a.Config.Retention
+	total := 0
+	for {
+		var n int
+		err := a.DB.QueryRowContext(ctx, archiveBatch,
+			cfg.TransactionDays, TxCompleted, TxFailed, TxReversed, TxRejected, cfg.BatchSize).Scan(&n)
+		if err != nil {
+			return err
+		}
+		total += n
+		transactionsArchived.Add(float64(n))
+		if n < cfg.BatchSize {
+			break
+		}
+	}
+	if total > 0 {
+		log.Printf("retention: archived %d transactions", total)
+	}
+	return nil
+}
+
+// includeArchived parses the include_archived query parameter of history
+// endpoints
+func includeArchived(r *http.Request) (bool, *apiError) {
+	v := r.URL.Query().Get("include_archived")
+	if v == "" {
+		return false, nil
+	}
+	include, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, newAPIError("Invalid include_archived parameter, expected true or false", 1093, http.StatusBadRequest)
+	}
+	return include, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// RiskConfig configures the fraud and velocity checks run on every transfer
+type RiskConfig struct {
+	Velocity []VelocityRule `json:"velocity"`
+	// WebhookURL, when set, asks an external risk engine about each transfer
+	WebhookURL string `json:"webhook_url"`
+	// FailOpen lets transfers through when a checker errors instead of
+	// rejecting them
+	FailOpen bool `json:"fail_open"`
+}
+
+// VelocityRule limits how many transfers, or how much in total, a source
+// account may send within a sliding window. A zero limit is not enforced.
+type VelocityRule struct {
+	Name          string  `json:"name"`
+	WindowSeconds int     `json:"window_seconds"`
+	MaxCount      int     `json:"max_count"`
+	MaxAmount     float64 `json:"max_amount"`
+}
+
+// RecentActivity summarizes the transfers a source account sent in a window
+type RecentActivity struct {
+	Count int     `json:"count"`
+	Total float64 `json:"total"`
+}
+
+// RiskInput is the transfer presented to a RiskChecker. The source account is
+// locked and its balance is current; Activity queries the same transaction.
+type RiskInput struct {
+	TenantID    string               `json:"tenant_id"`
+	From        Account              `json:"from"`
+	ToAccountID int                  `json:"to_account_id"`
+	ToTenantID  string               `json:"to_tenant_id"`
+	Amount      float64              `json:"amount"`
+	Fee         float64              `json:"fee"`
+	External    *ExternalDestination `json:"external_destination,omitempty"`
+
+	Activity func(window time.Duration) (RecentActivity, error) `json:"-"`
+}
+
+// RiskChecker vets a transfer before it commits. A *RiskRejection error
+// rejects the transfer; any other error means the check could not run.
+type RiskChecker interface {
+	Check(ctx context.Context, in RiskInput) error
+}
+
+// RiskRejection is a transfer refused by a risk checker
+type RiskRejection struct {
+	Checker string
+	Reason  string
+}
+
+func (e *RiskRejection) Error() string {
+	return e.Checker + ": " + e.Reason
+}
+
+// validate checks the velocity rules at startup
+func (c RiskConfig) validate() error {
+	for i, rule := range c.Velocity {
+		if rule.WindowSeconds <= 0 {
+			return fmt.Errorf("velocity rule %d: window_seconds must be positive", i)
+		}
+	}
+	return nil
+}
+
+// newRiskCheckers builds the checkers enabled in the config
+func newRiskCheckers(cfg RiskConfig) []RiskChecker {
+	var checkers []RiskChecker
+	if len(cfg.Velocity) > 0 {
+		checkers = append(checkers, velocityChecker(cfg.Velocity))
+	}
+	if cfg.WebhookURL != "" {
+		checkers = append(checkers, &webhookRiskChecker{url: cfg.WebhookURL, client: &http.Client{Timeout: 5 * time.Second}})
+	}
+	return checkers
+}
+
+// RegisterRiskChecker adds a checker run after the configured ones
+func (a *App) RegisterRiskChecker(c RiskChecker) {
+	a.Risk = append(a.Risk, c)
+}
+
+// checkRisk runs every checker against the transfer and logs rejections
+func (a *App) checkRisk(ctx context.Context, tx *sql.Tx, in RiskInput) *apiError {
+	if len(a.Risk) == 0 || !a.enabled(in.TenantID, FlagRiskChecks) {
+		return nil
+	}
+	in.Activity = a.recentActivity(ctx, tx, in.TenantID, in.From.ID)
+
+	for _, c := range a.Risk {
+		err := c.Check(ctx, in)
+		if err == nil {
+			continue
+		}
+		var rejection *RiskRejection
+		if errors.As(err, &rejection) {
+			log.Printf("risk check rejected transfer of %.2f from account %d (tenant %s): %v", in.Amount, in.From.ID, in.TenantID, err)
+			return newAPIError(fmt.Sprintf("Transfer rejected by risk check: %s", rejection.Reason), 1063, http.StatusForbidden)
+		}
+		log.Printf("risk check failed for transfer from account %d (tenant %s): %v", in.From.ID, in.TenantID, err)
+		if !a.Config.Risk.FailOpen {
+			return newAPIError("Risk check unavailable", 1064, http.StatusServiceUnavailable)
+		}
+	}
+	return nil
+}
+
+// recentActivity returns the Activity of a RiskInput for the transfers of
+// account from, queried in tx
+func (a *App) recentActivity(ctx context.Context, tx *sql.Tx, tenant string, from int) func(time.Duration) (RecentActivity, error) {
+	feeAccount := a.Config.Fees.AccountID
+	return func(window time.Duration) (RecentActivity, error) {
+		var act RecentActivity
+		// fee legs and failed or held transfers do not count
+		err := tx.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(SUM(amount), 0) FROM transactions
+			WHERE tenant_id = $1 AND from_account = $2 AND status IN ($3, $4) AND COALESCE(to_account, 0) <> $5 AND created_at > NOW() - make_interval(secs => $6)`,
+			tenant, from, TxCompleted, TxPending, feeAccount, window.Seconds()).Scan(&act.Count, &act.Total)
+		return act, err
+	}
+}
+
+// velocityChecker enforces the configured velocity rules
+type velocityChecker []VelocityRule
+
+func (rules velocityChecker) Check(ctx context.Context, in RiskInput) error {
+	for _, rule := range rules {
+		act, err := in.Activity(time.Duration(rule.WindowSeconds) * time.Second)
+		if err != nil {
+			return err
+		}
+		if rule.MaxCount > 0 && act.Count+1 > rule.MaxCount {
+			return &RiskRejection{Checker: "velocity", Reason: fmt.Sprintf("%s: more than %d transfers", rule.Name, rule.MaxCount)}
+		}
+		if rule.MaxAmount > 0 && act.Total+in.Amount > rule.MaxAmount {
+			return &RiskRejection{Checker: "velocity", Reason: fmt.Sprintf("%s: more than %.2f transferred", rule.Name, rule.MaxAmount)}
+		}
+	}
+	return nil
+}
+
+// webhookRiskChecker posts the transfer to an external risk engine, which
+// answers {"decision": "reject", "reason": "..."} to refuse it
+type webhookRiskChecker struct {
+	url    string
+	client *http.Client
+}
+
+func (c *webhookRiskChecker) Check(ctx context.Context, in RiskInput) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("risk webhook returned %s", resp.Status)
+	}
+
+	var out struct {
+		Decision string `json:"decision"`
+		Reason   string `json:"reason"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&out); err != nil {
+		return fmt.Errorf("decode risk webhook response: %w", err)
+	}
+	if out.Decision == "reject" {
+		if out.Reason == "" {
+			out.Reason = "rejected"
+		}
+		return &RiskRejection{Checker: "webhook", Reason: out.Reason}
+	}
+	return nil
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// States of the external leg of an outbound transfer. The local debit commits
+// with the leg pending; the gateway then completes or fails it, and a failed
+// leg is compensated by re-crediting the source account. A leg out of
+// attempts is dead-lettered until an admin requeues or cancels it.
+const (
+	ExternalPending      = "pending"
+	ExternalCompleted    = "completed"
+	ExternalFailed       = "failed"
+	ExternalCompensated  = "compensated"
+	ExternalDeadLettered = "dead_lettered"
+)
+
+// externalTransitions lists the allowed state changes of an external leg
+var externalTransitions = map[string][]string{
+	ExternalPending:      {ExternalCompleted, ExternalFailed, ExternalDeadLettered},
+	ExternalFailed:       {ExternalCompensated},
+	ExternalDeadLettered: {ExternalPending, ExternalFailed},
+}
+
+func canTransition(from, to string) bool {
+	for _, s := range externalTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// OutboundInstruction is the payment handed to an external gateway
+type OutboundInstruction struct {
+	// TransactionID doubles as the idempotency key of the instruction
+	TransactionID int                 `json:"transaction_id"`
+	Amount        float64             `json:"amount"`
+	Destination   ExternalDestination `json:"destination"`
+}
+
+// ExternalGateway delivers outbound instructions to another institution.
+// Send must be idempotent per TransactionID since instructions are retried
+// after crashes and timeouts. A *GatewayRejection error fails the transfer;
+// any other error is treated as transient and retried.
+type ExternalGateway interface {
+	Send(ctx context.Context, instr OutboundInstruction) (reference string, err error)
+}
+
+// GatewayRejection is a permanent refusal of an instruction by the gateway
+type GatewayRejection struct {
+	Reason string
+}
+
+func (e *GatewayRejection) Error() string {
+	return "rejected by gateway: " + e.Reason
+}
+
+// GatewayConfig configures the external gateway. External legs settle through
+// the payment file exports when URL is empty.
+type GatewayConfig struct {
+	URL                  string `json:"url"`
+	TimeoutSeconds       int    `json:"timeout_seconds"`
+	MaxAttempts          int    `json:"max_attempts"`
+	RetryIntervalSeconds int    `json:"retry_interval_seconds"`
+	// Workers bounds the legs delivered concurrently by the recovery loop
+	Workers int `json:"workers"`
+}
+
+// httpGateway posts instructions as JSON to a partner endpoint
+type httpGateway struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPGateway(cfg GatewayConfig) *httpGateway {
+	return &httpGateway{
+		url:    cfg.URL,
+		client: &http.Client{Timeout: time.Duration(cfg.TimeoutSeconds) * time.Second},
+	}
+}
+
+func (g *httpGateway) Send(ctx context.Context, instr OutboundInstruction) (string, error) {
+	body, err := json.Marshal(instr)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", fmt.Sprintf("txn-%d", instr.TransactionID))
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var out struct {
+		Reference string `json:"reference"`
+		Reason    string `json:"reason"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&out)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return out.Reference, nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests:
+		if out.Reason == "" {
+			out.Reason = resp.Status
+		}
+		return "", &GatewayRejection{Reason: out.Reason}
+	}
+	return "", fmt.Errorf("gateway returned %s", resp.Status)
+}
+
+// externalLeg is the persisted state of an outbound transfer's external leg
+type externalLeg struct {
+	TransactionID int
+	TenantID      string
+	FromAccount   int
+	Amount        float64
+	Status        string
+	Attempts      int
+	Destination   ExternalDestination
+}
+
+// runExternalLeg sends a pending leg to the gateway and records the outcome,
+// compensating when the gateway rejects it and dead-lettering it when
+// attempts are exhausted. It returns the resulting state.
+func (a *App) runExternalLeg(ctx context.Context, leg externalLeg) string {
+	ref, err := a.Gateway.Send(ctx, OutboundInstruction{
+		TransactionID: leg.TransactionID,
+		Amount:        leg.Amount,
+		Destination:   leg.Destination,
+	})
+	if err == nil {
+		if err := a.setExternalStatus(leg.TransactionID, ExternalPending, ExternalCompleted, ref, ""); err != nil {
+			log.Printf("saga: transaction %d: %v", leg.TransactionID, err)
+			return ExternalPending
+		}
+		a.notifyTransfer(leg.TransactionID)
+		return ExternalCompleted
+	}
+
+	var rejection *GatewayRejection
+	if !errors.As(err, &rejection) && leg.Attempts < a.Config.External.Gateway.MaxAttempts {
+		// transient; the recovery loop retries it
+		log.Printf("saga: transaction %d attempt %d: %v", leg.TransactionID, leg.Attempts, err)
+		a.DB.Exec("UPDATE external_transfers SET last_error = $1 WHERE transaction_id = $2", err.Error(), leg.TransactionID)
+		return ExternalPending
+	}
+	if rejection == nil {
+		if err := a.deadLetterLeg(ctx, leg, err); err != nil {
+			log.Printf("saga: dead-lettering transaction %d: %v", leg.TransactionID, err)
+			return ExternalPending
+		}
+		return ExternalDeadLettered
+	}
+
+	if err := a.setExternalStatus(leg.TransactionID, ExternalPending, ExternalFailed, "", err.Error()); err != nil {
+		log.Printf("saga: transaction %d: %v", leg.TransactionID, err)
+		return ExternalPending
+	}
+	if err := a.compensateExternalLeg(ctx, leg); err != nil {
+		log.Printf("saga: compensating transaction %d: %v", leg.TransactionID, err)
+		return ExternalFailed
+	}
+	a.notifyTransfer(leg.TransactionID)
+	return ExternalCompensated
+}
+
+// setExternalStatus moves a leg from one state to another, failing if the leg
+// is no longer in the expected state
+func (a *App) setExternalStatus(transactionID int, from, to, reference, lastError string) error {
+	if !canTransition(from, to) {
+		return fmt.Errorf("invalid transition %s -> %s", from, to)
+	}
+	tx, err := a.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var tenant string
+	err = tx.QueryRow(`UPDATE external_transfers
+		SET status = $1, gateway_reference = COALESCE(NULLIF($2, ''), gateway_reference), last_error = NULLIF($3, ''), updated_at = NOW()
+		WHERE transaction_id = $4 AND status = $5 RETURNING tenant_id`, to, reference, lastError, transactionID, from).Scan(&tenant)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("leg is no longer %s", from)
+	}
+	if err != nil {
+		return err
+	}
+
+	if to == ExternalCompleted {
+		_, err = tx.Exec("UPDATE transactions SET status = $1, completed_at = NOW() WHERE id = $2", TxCompleted, transactionID)
+		if err != nil {
+			return err
+		}
+	}
+	err = a.audit(context.Background(), tx, auditRecord{
+		Actor:      auditActorSystem,
+		TenantID:   tenant,
+		Action:     "external_leg." + to,
+		EntityType: "transaction",
+		EntityID:   strconv.Itoa(transactionID),
+		Before:     map[string]interface{}{"external_status": from},
+		After:      map[string]interface{}{"external_status": to, "gateway_reference": reference, "last_error": lastError},
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// compensateExternalLeg returns the principal of a failed leg from the
+// settlement account to the source account and records the reversal
+func (a *App) compensateExternalLeg(ctx context.Context, leg externalLeg) error {
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE external_transfers SET status = $1, updated_at = NOW() WHERE transaction_id = $2 AND status = $3",
+		ExternalCompensated, leg.TransactionID, ExternalFailed)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil // already compensated elsewhere
+	}
+
+	settlement := a.Config.External.SettlementAccountID
+	if _, err := tx.Exec("UPDATE accounts SET balance = balance - $1, last_updated = NOW() WHERE id = $2", leg.Amount, settlement); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE accounts SET balance = balance + $1, last_updated = NOW() WHERE id = $2", leg.Amount, leg.FromAccount); err != nil {
+		return err
+	}
+	var reversalID int
+	err = tx.QueryRow("INSERT INTO transactions (from_account, to_account, amount, tenant_id, to_tenant_id, status, completed_at) VALUES ($1, $2, $3, $4, $4, 'completed', NOW()) RETURNING id",
+		settlement, leg.FromAccount, leg.Amount, leg.TenantID).Scan(&reversalID)
+	if err != nil {
+		return err
+	}
+	if err := a.appendEvents(ctx, tx, transferEvents(settlement, leg.FromAccount, leg.Amount, reversalID)...); err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE transactions SET status = $1, failure_reason = (SELECT last_error FROM external_transfers WHERE transaction_id = $2) WHERE id = $2",
+		TxReversed, leg.TransactionID)
+	if err != nil {
+		return err
+	}
+	err = a.audit(ctx, tx, auditRecord{
+		Actor:      auditActorSystem,
+		TenantID:   leg.TenantID,
+		Action:     "transfer." + TxReversed,
+		EntityType: "transaction",
+		EntityID:   strconv.Itoa(leg.TransactionID),
+		Before:     map[string]interface{}{"external_status": ExternalFailed},
+		After:      map[string]interface{}{"external_status": ExternalCompensated, "status": TxReversed, "refunded_to": leg.FromAccount, "amount": leg.Amount},
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// recoverExternalTransfers periodically resumes legs left pending or failed,
+// e.g. by a crash between the local commit and the gateway call. Legs are
+// claimed by bumping updated_at so replicas do not pick the same leg. Claimed
+// legs run on a pool of workers, in order per source account.
+func (a *App) recoverExternalTransfers(ctx context.Context) {
+	interval := time.Duration(a.Config.External.Gateway.RetryIntervalSeconds) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	pool := newKeyedPool(a.Config.External.Gateway.Workers)
+
+	for {
+		legs, err := a.claimExternalLegs(ctx, interval)
+		if err != nil {
+			log.Printf("saga: recovery: %v", err)
+		}
+		for _, leg := range legs {
+			pool.submit(leg.FromAccount, func() {
+				switch leg.Status {
+				case ExternalPending:
+					a.runExternalLeg(ctx, leg)
+				case ExternalFailed:
+					if err := a.compensateExternalLeg(ctx, leg); err != nil {
+						log.Printf("saga: compensating transaction %d: %v", leg.TransactionID, err)
+					}
+				}
+			})
+		}
+		// legs are claimed for one interval; finish the batch before claiming
+		// again so a slow gateway cannot have a leg claimed twice
+		pool.wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *App) claimExternalLegs(ctx context.Context, staleAfter time.Duration) ([]externalLeg, error) {
+	rows, err := a.DB.QueryContext(ctx, `UPDATE external_transfers e
+		SET updated_at = NOW(), attempts = e.attempts + CASE WHEN e.status = $1 THEN 1 ELSE 0 END
+		FROM transactions t
+		WHERE t.id = e.transaction_id AND e.transaction_id IN (
+			SELECT transaction_id FROM external_transfers
+			WHERE status IN ($1, $2) AND updated_at < NOW() - make_interval(secs => $3)
+			ORDER BY transaction_id LIMIT 100 FOR UPDATE SKIP LOCKED)
+		RETURNING e.transaction_id, e.tenant_id, t.from_account, t.amount, e.status, e.attempts,
+			e.rail, COALESCE(e.routing_number, ''), COALESCE(e.account_number, ''), COALESCE(e.account_type, ''),
+			COALESCE(e.bic, ''), COALESCE(e.iban, ''), e.beneficiary_name`,
+		ExternalPending, ExternalFailed, staleAfter.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var legs []externalLeg
+	for rows.Next() {
+		var leg externalLeg
+		d := &leg.Destination
+		if err := rows.Scan(&leg.TransactionID, &leg.TenantID, &leg.FromAccount, &leg.Amount, &leg.Status, &leg.Attempts,
+			&d.Rail, &d.RoutingNumber, &d.AccountNumber, &d.AccountType, &d.BIC, &d.IBAN, &d.Name); err != nil {
+			return nil, err
+		}
+		legs = append(legs, leg)
+	}
+	return legs, rows.Err()
+}
+
+// initialExternalStatus is the state a new leg is recorded in: pending when a
+// gateway has to deliver it, completed when it settles through file exports
+func (a *App) initialExternalStatus() string {
+	if a.Gateway == nil {
+		return ExternalCompleted
+	}
+	return ExternalPending
+}
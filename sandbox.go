@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sandbox failure scenarios
+const (
+	ScenarioInsufficientFunds = "insufficient_funds"
+	ScenarioConflict          = "conflict"
+	ScenarioTimeout           = "timeout"
+)
+
+// SandboxConfig configures sandbox mode, in which the service keeps accounts
+// and transfers in memory instead of PostgreSQL so integrators can test their
+// clients without a database
+type SandboxConfig struct {
+	Enabled bool `json:"enabled"`
+	// Accounts is the number of demo accounts seeded for every tenant
+	Accounts int `json:"accounts"`
+	// Scenarios maps transfer amounts, with two decimals, to the failure a
+	// transfer of that amount simulates
+	Scenarios map[string]string `json:"scenarios"`
+	// TimeoutSeconds is how long the timeout scenario stalls before failing
+	TimeoutSeconds int `json:"timeout_seconds"`
+}
+
+// validate checks every scenario is known
+func (c SandboxConfig) validate() error {
+	for amount, scenario := range c.Scenarios {
+		if !validScenario(scenario) {
+			return fmt.Errorf("amount %s: unknown scenario %q", amount, scenario)
+		}
+	}
+	if c.Accounts < 0 || c.TimeoutSeconds < 0 {
+		return errors.New("accounts and timeout_seconds must not be negative")
+	}
+	return nil
+}
+
+func validScenario(s string) bool {
+	switch s {
+	case ScenarioInsufficientFunds, ScenarioConflict, ScenarioTimeout:
+		return true
+	}
+	return false
+}
+
+// sandboxEpoch is the last_updated of seeded accounts, so their ETags are the
+// same on every run
+var sandboxEpoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// sandboxAccountBase is the account ID below the first seeded account
+const sandboxAccountBase = 1000
+
+// sandboxTransaction is a transaction with the tenants it is visible to
+type sandboxTransaction struct {
+	Transaction
+	tenant, toTenant string
+}
+
+// sandbox serves the core account and transfer endpoints from memory. Every
+// tenant gets its own seeded accounts on first use.
+type sandbox struct {
+	app *App
+
+	mu           sync.Mutex
+	accounts     map[string]map[int]*Account // by tenant
+	transactions []sandboxTransaction        // ordered by ID
+	nextTxID     int
+}
+
+func newSandbox(app *App) *sandbox {
+	return &sandbox{app: app, accounts: map[string]map[int]*Account{}, nextTxID: 1}
+}
+
+// runSandbox serves the API from memory until the server fails
+func runSandbox(cfg *Config) error {
+	app := &App{Config: cfg}
+	s := newSandbox(app)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /accounts", s.handleCreateAccount)
+	mux.HandleFunc("GET /accounts/{id}", s.handleGetAccount)
+	mux.HandleFunc("PUT /accounts/{id}", s.handlePutAccount)
+	mux.HandleFunc("GET /transactions", s.handleListTransactions)
+	mux.HandleFunc("POST /transactions", s.handleTransfer)
+	mux.HandleFunc("GET /transactions/{id}", s.handleTransaction)
+	mux.HandleFunc("POST /sandbox/reset", s.handleReset)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, "Not available in sandbox mode", 1089, http.StatusNotImplemented)
+	})
+
+	handler := app.withTenant(newAPIRouter(mux))
+	handler = app.withAuth(handler)
+	handler = app.withBodyLimit(handler)
+	handler = app.withAPIVersion(handler)
+	handler = app.withCORS(handler)
+	handler = withRecovery(handler)
+	handler = withContentNegotiation(handler)
+	handler = app.withCompression(handler)
+	handler = withSandboxHeader(handler)
+	log.Printf("sandbox mode: serving %d demo accounts per tenant from memory", cfg.Sandbox.Accounts)
+	return app.serve(app.newServer(handler))
+}
+
+// withSandboxHeader marks every response as coming from the sandbox
+func withSandboxHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Sandbox", "true")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tenantAccounts returns the accounts of tenant, seeding them on first use.
+// The caller holds s.mu.
+func (s *sandbox) tenantAccounts(tenant string) map[int]*Account {
+	accounts, ok := s.accounts[tenant]
+	if !ok {
+		accounts = s.seed()
+		s.accounts[tenant] = accounts
+	}
+	return accounts
+}
+
+// seed returns the demo accounts: 1001 holds 1000.00, 1002 holds 2000.00 and
+// so on, except the last, which is empty
+func (s *sandbox) seed() map[int]*Account {
+	n := s.app.Config.Sandbox.Accounts
+	accounts := make(map[int]*Account, n)
+	for i := 1; i <= n; i++ {
+		acc := &Account{ID: sandboxAccountBase + i, LastUpdated: sandboxEpoch}
+		if i < n {
+			acc.Balance = float64(i) * 1000
+		}
+		if iban, err := s.app.Config.IBAN.generate(acc.ID); err == nil {
+			acc.IBAN = &iban
+		}
+		accounts[acc.ID] = acc
+	}
+	return accounts
+}
+
+// lookup finds an account by ID or IBAN. The caller holds s.mu.
+func (s *sandbox) lookup(tenant string, id int, iban string) *Account {
+	accounts := s.tenantAccounts(tenant)
+	if iban == "" {
+		return accounts[id]
+	}
+	normalized, err := normalizeIBAN(iban)
+	if err != nil {
+		return nil
+	}
+	for _, acc := range accounts {
+		if acc.IBAN != nil && *acc.IBAN == normalized {
+			return acc
+		}
+	}
+	return nil
+}
+
+// touch moves an account to a new version, like a write to last_updated
+func touch(acc *Account) {
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	if !now.After(acc.LastUpdated) {
+		now = acc.LastUpdated.Add(time.Microsecond)
+	}
+	acc.LastUpdated = now
+}
+
+func (s *sandbox) handleCreateAccount(w http.ResponseWriter, r *http.Request) {
+	var req CreateAccountRequest
+	if apiErr := decodeJSON(r, &req, 1002, "account_id", "initial_balance"); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	acc, created, apiErr := s.createAccount(tenantFromContext(r.Context()), req)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	if !created {
+		writeJSONError(w, "Account already exists", 1003, http.StatusConflict)
+		return
+	}
+	writeAccount(w, r, acc, "Account created", 2001, http.StatusCreated)
+}
+
+// createAccount opens the account unless its ID is taken, in which case the
+// existing account is returned
+func (s *sandbox) createAccount(tenant string, req CreateAccountRequest) (Account, bool, *apiError) {
+	if apiErr := req.validate(); apiErr != nil {
+		return Account{}, false, apiErr
+	}
+	if req.CustomerID != nil {
+		return Account{}, false, newAPIError("Customer not found", 1027, http.StatusNotFound)
+	}
+	iban, err := s.app.accountIBAN(req)
+	if errors.Is(err, errInvalidIBAN) {
+		return Account{}, false, newAPIError("Invalid IBAN", 1030, http.StatusBadRequest)
+	}
+	if err != nil {
+		return Account{}, false, newAPIError("Account ID cannot be encoded as an IBAN", 1032, http.StatusBadRequest)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	accounts := s.tenantAccounts(tenant)
+	if existing, ok := accounts[req.AccountID]; ok {
+		return *existing, false, nil
+	}
+	if s.lookup(tenant, 0, iban) != nil {
+		return Account{}, false, newAPIError("IBAN already in use", 1031, http.StatusConflict)
+	}
+	acc := &Account{ID: req.AccountID, Balance: req.InitialBalance, IBAN: &iban}
+	touch(acc)
+	accounts[acc.ID] = acc
+	return *acc, true, nil
+}
+
+// handleGetAccount serves GET /accounts/{id or iban}
+func (s *sandbox) handleGetAccount(w http.ResponseWriter, r *http.Request) {
+	accountID, err := strconv.Atoi(r.PathValue("id"))
+	iban := ""
+	if err != nil {
+		iban = r.PathValue("id")
+	}
+	s.mu.Lock()
+	acc := s.lookup(tenantFromContext(r.Context()), accountID, iban)
+	var found Account
+	if acc != nil {
+		found = *acc
+	}
+	s.mu.Unlock()
+	if acc == nil {
+		writeJSONError(w, "Account not found", 1010, http.StatusNotFound)
+		return
+	}
+	writeAccount(w, r, found, "Account retrieved", 2002, http.StatusOK)
+}
+
+// handlePutAccount serves PUT /accounts/{id}
+func (s *sandbox) handlePutAccount(w http.ResponseWriter, r *http.Request) {
+	accountID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, "Invalid account ID", 1008, http.StatusBadRequest)
+		return
+	}
+	var req CreateAccountRequest
+	if apiErr := decodeJSON(r, &req, 1002, "initial_balance"); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	if req.AccountID != 0 && req.AccountID != accountID {
+		writeJSONError(w, "Account ID in body does not match path", 1047, http.StatusBadRequest)
+		return
+	}
+	req.AccountID = accountID
+	acc, created, apiErr := s.createAccount(tenantFromContext(r.Context()), req)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	if created {
+		writeAccount(w, r, acc, "Account created", 2001, http.StatusCreated)
+		return
+	}
+	writeAccount(w, r, acc, "Account already exists", 2010, http.StatusOK)
+}
+
+func (s *sandbox) handleTransfer(w http.ResponseWriter, r *http.Request) {
+	var tr TransferRequest
+	if apiErr := decodeJSON(r, &tr, 1012, "amount"); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	scenario := r.Header.Get("X-Sandbox-Scenario")
+	if scenario == "" {
+		scenario = s.app.Config.Sandbox.Scenarios[strconv.FormatFloat(tr.Amount, 'f', 2, 64)]
+	} else if !validScenario(scenario) {
+		writeJSONError(w, "Unknown sandbox scenario", 1088, http.StatusBadRequest)
+		return
+	}
+
+	result, apiErr := s.transfer(r.Context(), tenantFromContext(r.Context()), tr, scenario)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	writeJSONSuccess(w, result, "Transfer successful", 2003, http.StatusOK)
+}
+
+// transfer moves funds between two sandbox accounts, failing as the scenario
+// asks. Failed transfers are recorded like in the real service.
+func (s *sandbox) transfer(ctx context.Context, tenant string, tr TransferRequest, scenario string) (*TransferResult, *apiError) {
+	if apiErr := tr.validate(s.app.Config.Limits); apiErr != nil {
+		return nil, apiErr
+	}
+	if tr.External != nil {
+		return nil, newAPIError("External transfers are not enabled", 1036, http.StatusBadRequest)
+	}
+	toTenant := tenant
+	if tr.ToTenantID != "" {
+		toTenant = tr.ToTenantID
+	}
+	if !s.app.Config.Tenancy.crossTenantAllowed(tenant, toTenant) {
+		return nil, newAPIError("Cross-tenant transfer not allowed", 1029, http.StatusForbidden)
+	}
+
+	if scenario == ScenarioTimeout {
+		select {
+		case <-time.After(time.Duration(s.app.Config.Sandbox.TimeoutSeconds) * time.Second):
+		case <-ctx.Done():
+		}
+		return nil, newAPIError("Database unavailable, retry later", 1079, http.StatusServiceUnavailable)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	from := s.lookup(tenant, tr.FromAccountID, tr.FromIBAN)
+	if from == nil {
+		return nil, newAPIError("Source account not found", 1014, http.StatusNotFound)
+	}
+	to := s.lookup(toTenant, tr.ToAccountID, tr.ToIBAN)
+	if to == nil {
+		return nil, newAPIError("Destination account not found", 1017, http.StatusNotFound)
+	}
+	if from == to {
+		var v validator
+		v.check(false, "destination_account_id", "must differ from the source account")
+		return nil, v.err()
+	}
+	fromID, toID := from.ID, to.ID
+
+	var apiErr *apiError
+	switch {
+	case scenario == ScenarioInsufficientFunds || from.Balance < tr.Amount:
+		apiErr = newAPIError("Insufficient funds", 1015, http.StatusBadRequest)
+	case scenario == ScenarioConflict:
+		apiErr = newAPIError("Concurrency conflict on debit after retries", 1016, http.StatusConflict)
+	}
+
+	now := time.Now().UTC()
+	t := sandboxTransaction{
+		Transaction: Transaction{ID: s.nextTxID, FromAccountID: &fromID, ToAccountID: &toID, Amount: tr.Amount, CreatedAt: now},
+		tenant:      tenant,
+		toTenant:    toTenant,
+	}
+	s.nextTxID++
+	if tr.Reference != "" {
+		t.Reference = &tr.Reference
+	}
+	if tr.Memo != "" {
+		t.Memo = &tr.Memo
+	}
+	if apiErr != nil {
+		t.Status = TxFailed
+		t.FailureReason = &apiErr.Message
+		s.transactions = append(s.transactions, t)
+		apiErr.Data = map[string]interface{}{"transaction_id": t.ID}
+		return nil, apiErr
+	}
+
+	from.Balance = roundCents(from.Balance - tr.Amount)
+	to.Balance = roundCents(to.Balance + tr.Amount)
+	touch(from)
+	touch(to)
+	t.Status = TxCompleted
+	t.CompletedAt = &now
+	s.transactions = append(s.transactions, t)
+	return &TransferResult{
+		FromAccountID: from.ID,
+		ToAccountID:   to.ID,
+		ToTenantID:    toTenant,
+		Amount:        tr.Amount,
+		TransactionID: t.ID,
+		Status:        TxCompleted,
+	}, nil
+}
+
+// visible returns the transactions tenant may see that match keep. The
+// caller holds s.mu.
+func (s *sandbox) visible(tenant string, keep func(Transaction) bool) []Transaction {
+	var found []Transaction
+	for _, t := range s.transactions {
+		if (t.tenant == tenant || t.toTenant == tenant) && keep(t.Transaction) {
+			found = append(found, t.Transaction)
+		}
+	}
+	return found
+}
+
+// handleListTransactions serves GET /transactions?reference=...
+func (s *sandbox) handleListTransactions(w http.ResponseWriter, r *http.Request) {
+	reference := r.URL.Query().Get("reference")
+	if reference == "" {
+		writeJSONError(w, "The reference query parameter is required", 1046, http.StatusBadRequest)
+		return
+	}
+	page, apiErr := parsePage(r, true)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	s.mu.Lock()
+	matching := s.visible(tenantFromContext(r.Context()), func(t Transaction) bool {
+		return t.Reference != nil && *t.Reference == reference
+	})
+	s.mu.Unlock()
+
+	key := func(t Transaction) int64 { return int64(t.ID) }
+	transactions, pagination := paginate(page, keysetSlice(page, matching, key), key)
+	if transactions == nil {
+		transactions = []Transaction{}
+	}
+	writeJSONPage(w, transactions, &pagination, "Transactions retrieved", 2009, http.StatusOK)
+}
+
+// handleTransaction serves GET /transactions/{id}
+func (s *sandbox) handleTransaction(w http.ResponseWriter, r *http.Request) {
+	transactionID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, "Invalid transaction ID", 1041, http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	found := s.visible(tenantFromContext(r.Context()), func(t Transaction) bool { return t.ID == transactionID })
+	s.mu.Unlock()
+	if len(found) == 0 {
+		writeJSONError(w, "Transaction not found", 1044, http.StatusNotFound)
+		return
+	}
+	writeJSONSuccess(w, found[0], "Transaction retrieved", 2008, http.StatusOK)
+}
+
+// handleReset serves POST /sandbox/reset, restoring the demo accounts of the
+// caller's tenant and forgetting its transactions
+func (s *sandbox) handleReset(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFromContext(r.Context())
+
+	s.mu.Lock()
+	s.accounts[tenant] = s.seed()
+	kept := s.transactions[:0]
+	for _, t := range s.transactions {
+		if t.tenant != tenant && t.toTenant != tenant {
+			kept = append(kept, t)
+		}
+	}
+	s.transactions = kept
+	accounts := make([]Account, 0, len(s.accounts[tenant]))
+	for _, acc := range s.accounts[tenant] {
+		accounts = append(accounts, *acc)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].ID < accounts[j].ID })
+	writeJSONSuccess(w, accounts, "Sandbox reset", 2037, http.StatusOK)
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scheduled jobs
+const (
+	JobStatements        = "statements"
+	JobSnapshots         = "snapshots"
+	JobPartitions        = "partitions"
+	JobRequestSignatures = "request_signatures"
+	JobIdempotencyKeys   = "idempotency_keys"
+	JobQuotaUsage        = "quota_usage"
+	JobReconciliation    = "reconciliation"
+	JobRetention         = "retention"
+	JobInboundCommands   = "inbound_commands"
+	JobWebhookDeliveries = "webhook_deliveries"
+	JobSweeps            = "sweeps"
+	JobTermDeposits      = "term_deposits"
+)
+
+// jobNames are the jobs whose schedule can be configured
+var jobNames = []string{JobStatements, JobSnapshots, JobPartitions, JobRequestSignatures, JobIdempotencyKeys, JobQuotaUsage, JobReconciliation, JobRetention, JobInboundCommands, JobWebhookDeliveries, JobSweeps, JobTermDeposits}
+
+// Statuses of a job run
+const (
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	// JobAbandoned marks a run still recorded as running after
+	// max_run_seconds, such as one whose replica crashed
+	JobAbandoned = "abandoned"
+)
+
+// SchedulerConfig configures the jobs run on the leader
+type SchedulerConfig struct {
+	// Schedules overrides the default schedules by job name. A schedule is
+	// a cron expression of minute, hour, day of month, month and day of
+	// week in UTC, "@hourly", "@daily" or "@every <duration>".
+	Schedules map[string]string `json:"schedules"`
+	// MaxRunSeconds is how long a run may stay running before the job may
+	// start again
+	MaxRunSeconds int `json:"max_run_seconds"`
+}
+
+func (c SchedulerConfig) validate() error {
+	for name, expr := range c.Schedules {
+		if !slices.Contains(jobNames, name) {
+			return fmt.Errorf("unknown job %q", name)
+		}
+		if _, err := parseSchedule(expr); err != nil {
+			return fmt.Errorf("job %s: %w", name, err)
+		}
+	}
+	if c.MaxRunSeconds < 1 {
+		return fmt.Errorf("max_run_seconds must be at least 1")
+	}
+	return nil
+}
+
+// schedule returns the times a job runs at
+type schedule interface {
+	// next returns the first run after t
+	next(t time.Time) time.Time
+}
+
+// everySchedule runs a job at a fixed interval after the previous run
+// finished, and right away when the scheduler starts
+type everySchedule time.Duration
+
+func (e everySchedule) next(t time.Time) time.Time { return t.Add(time.Duration(e)) }
+
+// cronSchedule runs a job at the minutes matching a cron expression. Each
+// field is a bit set of the values it allows.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny are set when the field starts with "*"; as in cron,
+	// a day matches either restricted day field when both are restricted
+	domAny, dowAny bool
+}
+
+func (c cronSchedule) next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// parseSchedule parses a job schedule; see SchedulerConfig
+func parseSchedule(expr string) (schedule, error) {
+	switch expr {
+	case "@hourly":
+		expr = "0 * * * *"
+	case "@daily":
+		expr = "0 0 * * *"
+	}
+	if d, ok := strings.CutPrefix(expr, "@every "); ok {
+		interval, err := time.ParseDuration(d)
+		if err != nil || interval < time.Second {
+			return nil, fmt.Errorf("invalid interval %q", d)
+		}
+		return everySchedule(interval), nil
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q must have 5 fields", expr)
+	}
+	var c cronSchedule
+	var err error
+	for i, f := range []struct {
+		set      *uint64
+		min, max int
+	}{{&c.minute, 0, 59}, {&c.hour, 0, 23}, {&c.dom, 1, 31}, {&c.month, 1, 12}, {&c.dow, 0, 7}} {
+		if *f.set, err = parseCronField(fields[i], f.min, f.max); err != nil {
+			return nil, fmt.Errorf("schedule %q: %w", expr, err)
+		}
+	}
+	// 7 is Sunday too
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAny, c.dowAny = strings.HasPrefix(fields[2], "*"), strings.HasPrefix(fields[4], "*")
+	if c.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("schedule %q never runs", expr)
+	}
+	return c, nil
+}
+
+// parseCronField returns the values in [min, max] a field of comma separated
+// values, ranges and steps allows
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		span, step := part, 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			span, step = part[:i], s
+		}
+		lo, hi := min, max
+		if span != "*" {
+			bounds := strings.SplitN(span, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value in %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// scheduledJob is a job registered with the scheduler
+type scheduledJob struct {
+	name     string
+	expr     string
+	schedule schedule
+	run      func(context.Context) error
+}
+
+// scheduler runs jobs on their schedules while this replica is the leader.
+// Every run is recorded in job_runs; a job does not start while a run of it
+// is recorded as running, so a run that outlasts a change of leader is not
+// overlapped. Jobs disabled in scheduled_jobs are skipped.
+type scheduler struct {
+	db      *sql.DB
+	elector *leaderElector
+	cfg     SchedulerConfig
+	jobs    []*scheduledJob
+}
+
+func newScheduler(db *sql.DB, elector *leaderElector, cfg SchedulerConfig) *scheduler {
+	return &scheduler{db: db, elector: elector, cfg: cfg}
+}
+
+// add registers a job with its default schedule, which the config may
+// override
+func (s *scheduler) add(name, expr string, run func(context.Context) error) {
+	if override, ok := s.cfg.Schedules[name]; ok {
+		expr = override
+	}
+	s.jobs = append(s.jobs, &scheduledJob{name: name, expr: expr, run: run})
+}
+
+// start parses the schedules and runs every job in its own goroutine until
+// ctx is cancelled
+func (s *scheduler) start(ctx context.Context) error {
+	for _, j := range s.jobs {
+		var err error
+		if j.schedule, err = parseSchedule(j.expr); err != nil {
+			return fmt.Errorf("job %s: %w", j.name, err)
+		}
+	}
+	sort.Slice(s.jobs, func(i, k int) bool { return s.jobs[i].name < s.jobs[k].name })
+	for _, j := range s.jobs {
+		go s.loop(ctx, j)
+	}
+	return nil
+}
+
+func (s *scheduler) lookup(name string) *scheduledJob {
+	for _, j := range s.jobs {
+		if j.name == name {
+			return j
+		}
+	}
+	return nil
+}
+
+func (s *scheduler) loop(ctx context.Context, j *scheduledJob) {
+	next := time.Now()
+	if _, ok := j.schedule.(everySchedule); !ok {
+		next = j.schedule.next(next)
+	}
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := s.execute(ctx, j); err != nil {
+			log.Printf("%s: %v", j.name, err)
+		}
+		next = j.schedule.next(time.Now())
+	}
+}
+
+// execute runs j once if this replica is the leader, the job is enabled and
+// no run of it is in progress
+func (s *scheduler) execute(ctx context.Context, j *scheduledJob) error {
+	if !s.elector.leader.Load() {
+		return nil
+	}
+	enabled, err := s.enabled(ctx, j.name)
+	if err != nil || !enabled {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, "UPDATE job_runs SET status = $1, finished_at = NOW() WHERE job = $2 AND status = $3 AND started_at < NOW() - make_interval(secs => $4)",
+		JobAbandoned, j.name, JobRunning, s.cfg.MaxRunSeconds)
+	if err != nil {
+		return err
+	}
+	var id int
+	err = s.db.QueryRowContext(ctx, "INSERT INTO job_runs (job, instance, status) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING RETURNING id",
+		j.name, s.elector.id, JobRunning).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Printf("%s: previous run still in progress, skipped", j.name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	status, message := JobSucceeded, ""
+	if runErr := j.run(ctx); runErr != nil {
+		status, message = JobFailed, runErr.Error()
+		log.Printf("%s: %v", j.name, runErr)
+	}
+	jobRuns.WithLabelValues(j.name, status).Inc()
+	_, err = s.db.ExecContext(ctx, "UPDATE job_runs SET status = $1, error = $2, finished_at = NOW() WHERE id = $3", status, message, id)
+	return err
+}
+
+// enabled reports whether a job is enabled; jobs are until disabled
+func (s *scheduler) enabled(ctx context.Context, name string) (bool, error) {
+	var enabled bool
+	err := s.db.QueryRowContext(ctx, "SELECT enabled FROM scheduled_jobs WHERE name = $1", name).Scan(&enabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true, nil
+	}
+	return enabled, err
+}
+
+// ScheduledJob is a job as listed by GET /admin/jobs
+type ScheduledJob struct {
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"`
+	Enabled  bool   `json:"enabled"`
+	// NextRunAt is when the leader runs the job next; it is left out while
+	// the job is disabled
+	NextRunAt *time.Time `json:"next_run_at,omitempty"`
+	LastRun   *JobRun    `json:"last_run,omitempty"`
+}
+
+// JobRun is a recorded run of a job
+type JobRun struct {
+	ID         int        `json:"run_id"`
+	Job        string     `json:"job"`
+	Instance   string     `json:"instance"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+}
+
+const jobRunColumns = "id, job, instance, status, error, started_at, finished_at"
+
+func scanJobRun(row interface{ Scan(...interface{}) error }) (JobRun, error) {
+	var run JobRun
+	err := row.Scan(&run.ID, &run.Job, &run.Instance, &run.Status, &run.Error, &run.StartedAt, &run.FinishedAt)
+	return run, err
+}
+
+// JobUpdate represents the JSON body of PUT /admin/jobs/{name}
+type JobUpdate struct {
+	Enabled *bool `json:"enabled"`
+}
+
+// describe returns j as listed by the admin API, given its last run
+func (s *scheduler) describe(j *scheduledJob, enabled bool, last *JobRun) ScheduledJob {
+	job := ScheduledJob{Name: j.name, Schedule: j.expr, Enabled: enabled, LastRun: last}
+	if enabled {
+		next := time.Now()
+		if _, every := j.schedule.(everySchedule); !every || last == nil || last.FinishedAt == nil {
+			next = j.schedule.next(next)
+		} else if n := j.schedule.next(*last.FinishedAt); n.After(next) {
+			next = n
+		}
+		job.NextRunAt = &next
+	}
+	return job
+}
+
+// handleJobs serves GET /admin/jobs, the scheduled jobs with their last run.
+// Jobs run for every tenant.
+func (a *App) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+	ctx := r.Context()
+	disabled := map[string]bool{}
+	rows, err := a.DB.QueryContext(ctx, "SELECT name FROM scheduled_jobs WHERE NOT enabled")
+	if err != nil {
+		writeJSONError(w, "Failed to list jobs", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			writeJSONError(w, "Failed to list jobs", 1005, http.StatusInternalServerError)
+			return
+		}
+		disabled[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, "Failed to list jobs", 1005, http.StatusInternalServerError)
+		return
+	}
+
+	last := map[string]*JobRun{}
+	runs, err := a.DB.QueryContext(ctx, "SELECT DISTINCT ON (job) "+jobRunColumns+" FROM job_runs ORDER BY job, id DESC")
+	if err != nil {
+		writeJSONError(w, "Failed to list jobs", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer runs.Close()
+	for runs.Next() {
+		run, err := scanJobRun(runs)
+		if err != nil {
+			writeJSONError(w, "Failed to list jobs", 1005, http.StatusInternalServerError)
+			return
+		}
+		last[run.Job] = &run
+	}
+	if err := runs.Err(); err != nil {
+		writeJSONError(w, "Failed to list jobs", 1005, http.StatusInternalServerError)
+		return
+	}
+
+	jobs := make([]ScheduledJob, len(a.Jobs.jobs))
+	for i, j := range a.Jobs.jobs {
+		jobs[i] = a.Jobs.describe(j, !disabled[j.name], last[j.name])
+	}
+	writeJSONSuccess(w, jobs, "Jobs retrieved", 2073, http.StatusOK)
+}
+
+// handleSetJob serves PUT /admin/jobs/{name}, which enables or disables a
+// job on every replica. A run in progress is not interrupted.
+func (a *App) handleSetJob(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+	ctx := r.Context()
+	j := a.Jobs.lookup(r.PathValue("name"))
+	if j == nil {
+		writeJSONError(w, "Unknown job", 1125, http.StatusNotFound)
+		return
+	}
+	var req JobUpdate
+	if apiErr := decodeJSON(r, &req, 1002, "enabled"); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	_, err := a.DB.ExecContext(ctx, `INSERT INTO scheduled_jobs (name, enabled, updated_by, updated_at) VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (name) DO UPDATE SET enabled = EXCLUDED.enabled, updated_by = EXCLUDED.updated_by, updated_at = NOW()`,
+		j.name, *req.Enabled, principalFromContext(ctx).Name)
+	if err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to update job", 1005, http.StatusInternalServerError)))
+		return
+	}
+	action := "job.enabled"
+	if !*req.Enabled {
+		action = "job.disabled"
+	}
+	a.auditCommitted(ctx, auditRecord{
+		TenantID:   tenantFromContext(ctx),
+		Action:     action,
+		EntityType: "job",
+		EntityID:   j.name,
+		After:      map[string]interface{}{"enabled": *req.Enabled},
+	})
+
+	var last *JobRun
+	if run, err := scanJobRun(a.DB.QueryRowContext(ctx, "SELECT "+jobRunColumns+" FROM job_runs WHERE job = $1 ORDER BY id DESC LIMIT 1", j.name)); err == nil {
+		last = &run
+	}
+	writeJSONSuccess(w, a.Jobs.describe(j, *req.Enabled, last), "Job updated", 2074, http.StatusOK)
+}
+
+// handleJobRuns serves GET /admin/jobs/{name}/runs, the run history of a job,
+// newest first
+func (a *App) handleJobRuns(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+	j := a.Jobs.lookup(r.PathValue("name"))
+	if j == nil {
+		writeJSONError(w, "Unknown job", 1125, http.StatusNotFound)
+		return
+	}
+	page, apiErr := parsePage(r, true)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	cond, orderLimit, cursor := page.keyset("id", 2)
+
+	rows, err := a.DB.QueryContext(r.Context(), "SELECT "+jobRunColumns+" FROM job_runs WHERE job = $1 AND "+cond+" "+orderLimit, j.name, cursor)
+	if err != nil {
+		writeJSONError(w, "Failed to list job runs", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	runs := []JobRun{}
+	for rows.Next() {
+		run, err := scanJobRun(rows)
+		if err != nil {
+			writeJSONError(w, "Failed to list job runs", 1005, http.StatusInternalServerError)
+			return
+		}
+		runs = append(runs, run)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, "Failed to list job runs", 1005, http.StatusInternalServerError)
+		return
+	}
+	runs, pagination := paginate(page, runs, func(run JobRun) int64 { return int64(run.ID) })
+	writeJSONPage(w, runs, &pagination, "Job runs retrieved", 2075, http.StatusOK)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Sources of the database credentials
+const (
+	CredentialsEnv   = "env"
+	CredentialsFile  = "file"
+	CredentialsVault = "vault"
+)
+
+// vaultTimeout bounds a credential lookup in Vault
+const vaultTimeout = 10 * time.Second
+
+// CredentialsConfig configures where the database user and password come
+// from. They are resolved when the pools open and again whenever a
+// connection attempt fails, so rotated credentials are picked up without a
+// restart. An empty Source uses the DSN as it is.
+type CredentialsConfig struct {
+	Source string `json:"source"`
+	// UserEnv and PasswordEnv name the environment variables of the env
+	// source; unset variables leave the DSN's value
+	UserEnv     string `json:"user_env"`
+	PasswordEnv string `json:"password_env"`
+	// UserFile and PasswordFile are the Docker or Kubernetes secret files of
+	// the file source; an empty UserFile keeps the DSN's user
+	UserFile     string      `json:"user_file"`
+	PasswordFile string      `json:"password_file"`
+	Vault        VaultConfig `json:"vault"`
+}
+
+// VaultConfig locates the credentials in HashiCorp Vault: a KV v2 secret
+// such as secret/data/bank or a database secrets engine role such as
+// database/creds/bank
+type VaultConfig struct {
+	Addr string `json:"addr"`
+	Path string `json:"path"`
+	// TokenFile holds the Vault token, e.g. written by the Vault agent;
+	// without it the token is read from VAULT_TOKEN
+	TokenFile   string `json:"token_file"`
+	UserKey     string `json:"user_key"`
+	PasswordKey string `json:"password_key"`
+}
+
+// validate checks the credential source is complete
+func (c CredentialsConfig) validate() error {
+	switch c.Source {
+	case "", CredentialsEnv:
+	case CredentialsFile:
+		if c.PasswordFile == "" {
+			return errors.New("password_file is required by the file source")
+		}
+	case CredentialsVault:
+		if c.Vault.Addr == "" || c.Vault.Path == "" {
+			return errors.New("vault addr and path are required by the vault source")
+		}
+	default:
+		return fmt.Errorf("unknown credentials source %q", c.Source)
+	}
+	return nil
+}
+
+// dbCredentials are a resolved user and password; empty fields keep the
+// DSN's values
+type dbCredentials struct {
+	user     string
+	password string
+}
+
+// resolve reads the current credentials from the configured source
+func (c CredentialsConfig) resolve(ctx context.Context) (dbCredentials, error) {
+	switch c.Source {
+	case CredentialsEnv:
+		return dbCredentials{user: os.Getenv(c.UserEnv), password: os.Getenv(c.PasswordEnv)}, nil
+	case CredentialsFile:
+		var creds dbCredentials
+		var err error
+		if c.UserFile != "" {
+			if creds.user, err = readSecretFile(c.UserFile); err != nil {
+				return creds, err
+			}
+		}
+		creds.password, err = readSecretFile(c.PasswordFile)
+		return creds, err
+	case CredentialsVault:
+		return c.Vault.read(ctx)
+	}
+	return dbCredentials{}, nil
+}
+
+// readSecretFile returns the content of a secret file without the trailing
+// newline editors and kubectl tend to add
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read secret: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// read fetches the secret at Path. KV v2 nests the values under data.data,
+// dynamic secrets engines return them under data.
+func (v VaultConfig) read(ctx context.Context) (dbCredentials, error) {
+	token := os.Getenv("VAULT_TOKEN")
+	if v.TokenFile != "" {
+		var err error
+		if token, err = readSecretFile(v.TokenFile); err != nil {
+			return dbCredentials{}, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, vaultTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(v.Addr, "/")+"/v1/"+strings.TrimLeft(v.Path, "/"), nil)
+	if err != nil {
+		return dbCredentials{}, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return dbCredentials{}, fmt.Errorf("vault: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return dbCredentials{}, fmt.Errorf("vault: %s returned %s", v.Path, resp.Status)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return dbCredentials{}, fmt.Errorf("vault: %w", err)
+	}
+	values := body.Data
+	if nested, ok := values["data"].(map[string]interface{}); ok {
+		values = nested
+	}
+	userKey, passwordKey := v.UserKey, v.PasswordKey
+	if userKey == "" {
+		userKey = "username"
+	}
+	if passwordKey == "" {
+		passwordKey = "password"
+	}
+	user, _ := values[userKey].(string)
+	password, ok := values[passwordKey].(string)
+	if !ok {
+		return dbCredentials{}, fmt.Errorf("vault: %s has no %s", v.Path, passwordKey)
+	}
+	return dbCredentials{user: user, password: password}, nil
+}
+
+// dsn returns base with the current credentials filled in. base is a
+// key=value connection string or a postgres:// URL.
+func (c CredentialsConfig) dsn(ctx context.Context, base string) (string, error) {
+	creds, err := c.resolve(ctx)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(base, "postgres://") || strings.HasPrefix(base, "postgresql://") {
+		u, err := url.Parse(base)
+		if err != nil {
+			return "", err
+		}
+		user, password := u.User.Username(), ""
+		if p, ok := u.User.Password(); ok {
+			password = p
+		}
+		if creds.user != "" {
+			user = creds.user
+		}
+		if creds.password != "" {
+			password = creds.password
+		}
+		if password != "" {
+			u.User = url.UserPassword(user, password)
+		} else if user != "" {
+			u.User = url.User(user)
+		}
+		return u.String(), nil
+	}
+	// later keys override earlier ones
+	if creds.user != "" {
+		base += " user=" + quoteDSNValue(creds.user)
+	}
+	if creds.password != "" {
+		base += " password=" + quoteDSNValue(creds.password)
+	}
+	return base, nil
+}
+
+// quoteDSNValue quotes a value of a key=value connection string
+func quoteDSNValue(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+// credentialConnector opens connections with the latest resolved
+// credentials. A failed connection attempt re-resolves them and, when they
+// changed, retries once with the new ones.
+type credentialConnector struct {
+	base  string
+	creds CredentialsConfig
+
+	mu        sync.Mutex
+	dsn       string
+	connector driver.Connector
+}
+
+func newCredentialConnector(ctx context.Context, base string, creds CredentialsConfig) (*credentialConnector, error) {
+	c := &credentialConnector{base: base, creds: creds}
+	if _, err := c.refresh(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// refresh resolves the credentials and reports whether they changed
+func (c *credentialConnector) refresh(ctx context.Context) (bool, error) {
+	dsn, err := c.creds.dsn(ctx, c.base)
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if dsn == c.dsn {
+		return false, nil
+	}
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		return false, err
+	}
+	c.dsn, c.connector = dsn, connector
+	return true, nil
+}
+
+func (c *credentialConnector) current() driver.Connector {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connector
+}
+
+func (c *credentialConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.current().Connect(ctx)
+	if err == nil || ctx.Err() != nil || c.creds.Source == "" {
+		return conn, err
+	}
+	changed, rerr := c.refresh(ctx)
+	if rerr != nil {
+		log.Printf("database credentials: %v", rerr)
+	}
+	if !changed {
+		return nil, err
+	}
+	log.Printf("database credentials: rotated after failed connection attempt: %v", err)
+	return c.current().Connect(ctx)
+}
+
+func (c *credentialConnector) Driver() driver.Driver {
+	return c.current().Driver()
+}
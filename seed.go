@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// seedReferencePrefix marks the sample transactions of the fixtures, so a
+// repeated run can tell which ones it already made
+const seedReferencePrefix = "seed-"
+
+// SeedConfig describes the fixtures loaded by the -seed flag for demos and
+// load tests
+type SeedConfig struct {
+	// Tenant owns the accounts; empty means the default tenant
+	Tenant string `json:"tenant"`
+	// Accounts are opened with consecutive IDs from FirstAccountID, each with
+	// InitialBalance
+	Accounts       int     `json:"accounts"`
+	FirstAccountID int     `json:"first_account_id"`
+	InitialBalance float64 `json:"initial_balance"`
+	// Transactions sample transfers move up to MaxAmount between random
+	// pairs of the accounts; RandomSeed makes the pairs and amounts repeatable
+	Transactions int     `json:"transactions"`
+	MaxAmount    float64 `json:"max_amount"`
+	RandomSeed   int64   `json:"random_seed"`
+}
+
+// validate checks the fixtures describe at least a usable set of accounts
+func (c SeedConfig) validate() error {
+	if c.Accounts < 0 || c.Transactions < 0 || c.InitialBalance < 0 {
+		return errors.New("accounts, transactions and initial_balance must not be negative")
+	}
+	if c.FirstAccountID < 1 {
+		return errors.New("first_account_id must be at least 1")
+	}
+	if c.Transactions > 0 && (c.Accounts < 2 || c.MaxAmount < 0.01) {
+		return errors.New("transactions need at least 2 accounts and a max_amount of at least 0.01")
+	}
+	return nil
+}
+
+// seedFixtures loads the configured fixtures. It is idempotent: accounts that
+// already exist are left as they are, and sample transactions already made
+// by an earlier run, recognised by their reference, are not repeated.
+func (a *App) seedFixtures(ctx context.Context) error {
+	cfg := a.Config.Seed
+	tenant := cfg.Tenant
+	if tenant == "" {
+		tenant = a.Config.Tenancy.DefaultTenant
+	}
+
+	report := &AccountImportReport{Errors: []ImportRowError{}}
+	var batch []importRow
+	for i := 0; i < cfg.Accounts; i++ {
+		req := CreateAccountRequest{AccountID: cfg.FirstAccountID + i, InitialBalance: cfg.InitialBalance}
+		iban, err := a.accountIBAN(req)
+		if err != nil {
+			return fmt.Errorf("account %d: %w", req.AccountID, err)
+		}
+		batch = append(batch, importRow{line: i + 1, req: req, iban: iban})
+		if len(batch) == importBatchSize || i == cfg.Accounts-1 {
+			if err := a.importBatch(ctx, tenant, batch, report); err != nil {
+				return fmt.Errorf("seed accounts: %w", err)
+			}
+			batch = batch[:0]
+		}
+	}
+	log.Printf("seed: %d accounts opened, %d already existed", report.Imported, report.Failed)
+
+	done, err := a.seededTransactions(ctx, tenant)
+	if err != nil {
+		return fmt.Errorf("seed transactions: %w", err)
+	}
+	rng := rand.New(rand.NewSource(cfg.RandomSeed))
+	made, failed := 0, 0
+	for i := 1; i <= cfg.Transactions; i++ {
+		// draw every transaction, also skipped ones, so each keeps its pair
+		// and amount across runs
+		from := cfg.FirstAccountID + rng.Intn(cfg.Accounts)
+		to := cfg.FirstAccountID + (from-cfg.FirstAccountID+1+rng.Intn(cfg.Accounts-1))%cfg.Accounts
+		amount := roundCents(0.01 + rng.Float64()*(cfg.MaxAmount-0.01))
+		if done[i] {
+			continue
+		}
+		_, apiErr := a.executeTransfer(ctx, tenant, TransferRequest{
+			FromAccountID:  from,
+			ToAccountID:    to,
+			Amount:         amount,
+			Reference:      seedReferencePrefix + strconv.Itoa(i),
+			AllowDuplicate: true,
+		})
+		switch {
+		case apiErr == nil:
+			made++
+		case apiErr.Code == 1079 || apiErr.Code == 1080:
+			return fmt.Errorf("seed transaction %d: %s", i, apiErr.Message)
+		default:
+			// failed transfers are recorded too, like any other
+			failed++
+		}
+	}
+	log.Printf("seed: %d transactions made, %d failed, %d already made", made, failed, len(done))
+	return nil
+}
+
+// seededTransactions returns the numbers of the sample transactions already
+// recorded for tenant
+func (a *App) seededTransactions(ctx context.Context, tenant string) (map[int]bool, error) {
+	rows, err := a.DB.QueryContext(ctx, "SELECT reference FROM ledger_transactions WHERE tenant_id = $1 AND reference LIKE $2",
+		tenant, seedReferencePrefix+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	done := map[int]bool{}
+	for rows.Next() {
+		var ref string
+		if err := rows.Scan(&ref); err != nil {
+			return nil, err
+		}
+		if n, err := strconv.Atoi(strings.TrimPrefix(ref, seedReferencePrefix)); err == nil {
+			done[n] = true
+		}
+	}
+	return done, rows.Err()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// validate checks the listener settings are consistent
+func (c ServerConfig) validate() error {
+	if c.ReadHeaderTimeoutSeconds < 0 || c.ReadTimeoutSeconds < 0 || c.WriteTimeoutSeconds < 0 || c.IdleTimeoutSeconds < 0 || c.MaxHeaderBytes < 0 {
+		return errors.New("timeouts and max_header_bytes must not be negative")
+	}
+	if c.ReadHeaderTimeoutSeconds == 0 {
+		return errors.New("read_header_timeout_seconds must be at least 1")
+	}
+	if c.MaxRequestTimeoutSeconds < 1 {
+		return errors.New("max_request_timeout_seconds must be at least 1")
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("tls_cert_file and tls_key_file must be set together")
+	}
+	if c.Addr == "" && c.UnixSocket == "" {
+		return errors.New("addr or unix_socket is required")
+	}
+	if _, err := c.unixSocketMode(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// unixSocketMode parses the octal UnixSocketMode, 0660 when unset
+func (c ServerConfig) unixSocketMode() (fs.FileMode, error) {
+	if c.UnixSocketMode == "" {
+		return 0660, nil
+	}
+	mode, err := strconv.ParseUint(c.UnixSocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("unix_socket_mode must be octal permissions such as 0660")
+	}
+	return fs.FileMode(mode), nil
+}
+
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
+
+// newServer returns the HTTP server of the API. HTTP/2 is negotiated over
+// TLS, and accepted in cleartext from clients that speak it directly when
+// UnencryptedHTTP2 is set.
+func (a *App) newServer(handler http.Handler) *http.Server {
+	cfg := a.Config.Server
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(cfg.UnencryptedHTTP2)
+	return &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: seconds(cfg.ReadHeaderTimeoutSeconds),
+		ReadTimeout:       seconds(cfg.ReadTimeoutSeconds),
+		WriteTimeout:      seconds(cfg.WriteTimeoutSeconds),
+		IdleTimeout:       seconds(cfg.IdleTimeoutSeconds),
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		Protocols:         &protocols,
+		ErrorLog:          log.Default(),
+	}
+}
+
+// serve listens on the configured TCP address and Unix socket until either
+// fails. The socket always speaks plain HTTP: it is reachable only from the
+// host, by the clients its permissions admit.
+func (a *App) serve(srv *http.Server) error {
+	cfg := a.Config.Server
+	errs := make(chan error, 2)
+	if cfg.UnixSocket != "" {
+		mode, _ := cfg.unixSocketMode()
+		ln, err := listenUnix(cfg.UnixSocket, mode)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(cfg.UnixSocket)
+		log.Printf("listening on unix socket %s", cfg.UnixSocket)
+		go func() { errs <- srv.Serve(ln) }()
+	}
+	if cfg.Addr != "" {
+		go func() {
+			if cfg.TLSCertFile != "" {
+				errs <- srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+				return
+			}
+			errs <- srv.ListenAndServe()
+		}()
+	}
+	return <-errs
+}
+
+// listenUnix listens on a Unix socket at path with the given permissions,
+// replacing a socket left behind by a previous run
+func listenUnix(path string, mode fs.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("unix socket %s: file exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("unix socket %s: %w", path, err)
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("unix socket %s: %w", path, err)
+	}
+	return ln, nil
+}
+
+// extendWriteDeadline gives a streaming response another write timeout, so
+// long exports keep going while a client that stops reading is still cut off
+func (a *App) extendWriteDeadline(rc *http.ResponseController) {
+	if d := seconds(a.Config.Server.WriteTimeoutSeconds); d > 0 {
+		rc.SetWriteDeadline(time.Now().Add(d))
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// maxStatementLabel caps the statement label of the slow query metric
+const maxStatementLabel = 120
+
+var slowQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "fundtransfer_slow_queries_total",
+	Help: "Statements that took longer than the slow query threshold, by statement.",
+}, []string{"statement"})
+
+// observe logs and counts the statement when it ran for longer than the
+// slow query threshold. Queries are timed until their first rows arrive.
+func (c *trackedConn) observe(query string, args []driver.NamedValue, start time.Time) {
+	took := time.Since(start)
+	if c.slow <= 0 || took < c.slow {
+		return
+	}
+	statement := statementLabel(query)
+	slowQueries.WithLabelValues(statement).Inc()
+	log.Printf("slow query: %s took %s, args %s", statement, took.Round(time.Millisecond), redactArgs(args))
+}
+
+// statementLabel collapses the whitespace of query and truncates it. The
+// service builds its SQL from constants with placeholders, so the label
+// identifies the statement without containing data.
+func statementLabel(query string) string {
+	s := strings.Join(strings.Fields(query), " ")
+	if len(s) > maxStatementLabel {
+		s = s[:maxStatementLabel] + "..."
+	}
+	return s
+}
+
+// redactArgs describes the arguments by type only, so no account numbers,
+// amounts or personal data end up in the logs
+func redactArgs(args []driver.NamedValue) string {
+	parts := make([]string, len(args))
+	for i, arg := range args {
+		parts[i] = fmt.Sprintf("$%d=<%T>", arg.Ordinal, arg.Value)
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
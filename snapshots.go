@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+)
+
+// snapshotBackfillDays is how many past days the snapshot job fills in, so a
+// few days of downtime leave no gaps
+const snapshotBackfillDays = 7
+
+// BalanceSnapshot is the end-of-day balance of an account
+type BalanceSnapshot struct {
+	Date    string  `json:"date"`
+	Balance float64 `json:"balance"`
+}
+
+// snapshotBalances writes the end-of-day balance of every account for each of
+// the last days that has none yet. Days end at midnight UTC.
+func (a *App) snapshotBalances(ctx context.Context) error {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	for d := snapshotBackfillDays; d >= 1; d-- {
+		day := today.AddDate(0, 0, -d)
+		date := day.Format("2006-01-02")
+		pending, err := a.queryAccounts(ctx, `SELECT a.tenant_id, a.id FROM accounts a
+			WHERE NOT EXISTS (SELECT 1 FROM balance_snapshots s WHERE s.tenant_id = a.tenant_id AND s.account_id = a.id AND s.snapshot_date = $1::date)`, date)
+		if err != nil {
+			return err
+		}
+		for _, k := range pending {
+			if err := a.snapshotBalance(ctx, k, day); err != nil {
+				log.Printf("snapshots: account %d on %s: %v", k.id, date, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (a *App) snapshotBalance(ctx context.Context, k accountKey, day time.Time) error {
+	tx, err := a.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// timestamps have microsecond precision
+	balance, err := a.balanceAt(ctx, tx, k.tenant, k.id, day.AddDate(0, 0, 1).Add(-time.Microsecond))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO balance_snapshots (tenant_id, account_id, snapshot_date, balance) VALUES ($1, $2, $3::date, $4)
+		ON CONFLICT (tenant_id, account_id, snapshot_date) DO NOTHING`, k.tenant, k.id, day.Format("2006-01-02"), balance)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// handleSnapshots serves GET /accounts/{id}/snapshots?from=&to=, the
+// account's end-of-day balances between two dates, both inclusive
+func (a *App) handleSnapshots(w http.ResponseWriter, r *http.Request, accountID int) {
+	// absent bounds stay nil and are not applied
+	from, to, ok := parseDateRange(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	tenant := tenantFromContext(ctx)
+	var exists bool
+	if err := a.Replica.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM accounts WHERE id = $1 AND tenant_id = $2)", accountID, tenant).Scan(&exists); err != nil {
+		writeJSONError(w, "Failed to list snapshots", 1005, http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		writeJSONError(w, "Account not found", 1010, http.StatusNotFound)
+		return
+	}
+
+	rows, err := a.Replica.QueryContext(ctx, `SELECT to_char(snapshot_date, 'YYYY-MM-DD'), balance FROM balance_snapshots
+		WHERE tenant_id = $1 AND account_id = $2 AND ($3::date IS NULL OR snapshot_date >= $3::date) AND ($4::date IS NULL OR snapshot_date <= $4::date)
+		ORDER BY snapshot_date LIMIT 1000`, tenant, accountID, from, to)
+	if err != nil {
+		writeJSONError(w, "Failed to list snapshots", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	snapshots := []BalanceSnapshot{}
+	for rows.Next() {
+		var s BalanceSnapshot
+		if err := rows.Scan(&s.Date, &s.Balance); err != nil {
+			writeJSONError(w, "Failed to list snapshots", 1005, http.StatusInternalServerError)
+			return
+		}
+		snapshots = append(snapshots, s)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, "Failed to list snapshots", 1005, http.StatusInternalServerError)
+		return
+	}
+	writeJSONSuccess(w, snapshots, "Snapshots retrieved", 2021, http.StatusOK)
+}
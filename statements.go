@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+)
+
+// statementPeriodLayout is the format of statement periods, e.g. 2024-05
+const statementPeriodLayout = "2006-01"
+
+// movingStatuses are the transaction statuses whose amounts moved funds. A
+// reversed transfer moved them and was offset by a separate compensation.
+var movingStatuses = []string{TxCompleted, TxPending, TxReversed}
+
+// The movements of account $1 of tenant $2, credits positive, restricted to
+// the statuses $3 to $5
+const (
+	signedAmount   = "CASE WHEN from_account = $1 AND tenant_id = $2 THEN -amount ELSE amount END"
+	movementFilter = "((from_account = $1 AND tenant_id = $2) OR (to_account = $1 AND to_tenant_id = $2)) AND status IN ($3, $4, $5)"
+)
+
+// Statement is the monthly statement of an account
+type Statement struct {
+	AccountID      int              `json:"account_id"`
+	Period         string           `json:"period"`
+	OpeningBalance float64          `json:"opening_balance"`
+	ClosingBalance float64          `json:"closing_balance"`
+	Entries        []StatementEntry `json:"entries"`
+	GeneratedAt    time.Time        `json:"generated_at"`
+}
+
+// StatementEntry is one movement on an account; Amount is negative for debits
+type StatementEntry struct {
+	TransactionID int       `json:"transaction_id"`
+	Date          time.Time `json:"date"`
+	Amount        float64   `json:"amount"`
+	Balance       float64   `json:"balance"`
+	Reference     string    `json:"reference,omitempty"`
+}
+
+// statementPeriod parses a period and returns its first instant and the first
+// instant of the following month
+func statementPeriod(period string) (time.Time, time.Time, error) {
+	start, err := time.Parse(statementPeriodLayout, period)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return start, start.AddDate(0, 1, 0), nil
+}
+
+// balanceAt reconstructs the balance an account held at instant at, after
+// the movements created up to and including it. With event sourcing it
+// replays the account's events when they reach back to at. Otherwise it
+// replays the movements since the latest end-of-day snapshot before at, or
+// without one reverts the later movements from the current balance. Run it in
+// a repeatable read transaction so balances and movements come from one
+// snapshot. It returns sql.ErrNoRows for unknown accounts.
+func (a *App) balanceAt(ctx context.Context, tx *sql.Tx, tenant string, accountID int, at time.Time) (float64, error) {
+	if a.Config.EventSourcing.Enabled {
+		state, _, err := replayAccount(ctx, tx, tenant, accountID, at)
+		if err == nil {
+			return state.Balance, nil
+		}
+		if err != sql.ErrNoRows {
+			return 0, err
+		}
+	}
+
+	var day time.Time
+	var balance, since float64
+	err := tx.QueryRowContext(ctx, `SELECT snapshot_date, balance FROM balance_snapshots
+		WHERE tenant_id = $1 AND account_id = $2 AND snapshot_date < $3::date ORDER BY snapshot_date DESC LIMIT 1`,
+		tenant, accountID, at.UTC().Format("2006-01-02")).Scan(&day, &balance)
+	if err == nil {
+		var moved float64
+		err = tx.QueryRowContext(ctx, "SELECT COALESCE(SUM("+signedAmount+"), 0) FROM ledger_transactions WHERE "+movementFilter+" AND created_at >= $6 AND created_at <= $7",
+			accountID, tenant, movingStatuses[0], movingStatuses[1], movingStatuses[2], day.AddDate(0, 0, 1), at).Scan(&moved)
+		if err != nil {
+			return 0, err
+		}
+		return roundCents(balance + moved), nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	err = tx.QueryRowContext(ctx, "SELECT balance FROM accounts WHERE id = $1 AND tenant_id = $2", accountID, tenant).Scan(&balance)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(SUM("+signedAmount+"), 0) FROM ledger_transactions WHERE "+movementFilter+" AND created_at > $6",
+		accountID, tenant, movingStatuses[0], movingStatuses[1], movingStatuses[2], at).Scan(&since)
+	if err != nil {
+		return 0, err
+	}
+	return roundCents(balance - since), nil
+}
+
+// generateStatement computes the statement of a closed period from the
+// ledger
+func (a *App) generateStatement(ctx context.Context, tenant string, accountID int, period string) (*Statement, error) {
+	start, end, err := statementPeriod(period)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := a.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// timestamps have microsecond precision
+	opening, err := a.balanceAt(ctx, tx, tenant, accountID, start.Add(-time.Microsecond))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT id, created_at, "+signedAmount+", COALESCE(reference, '') FROM ledger_transactions WHERE "+movementFilter+
+		" AND created_at >= $6 AND created_at < $7 ORDER BY created_at, id",
+		accountID, tenant, movingStatuses[0], movingStatuses[1], movingStatuses[2], start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	s := &Statement{AccountID: accountID, Period: period, OpeningBalance: opening, Entries: []StatementEntry{}}
+	running := s.OpeningBalance
+	for rows.Next() {
+		var e StatementEntry
+		if err := rows.Scan(&e.TransactionID, &e.Date, &e.Amount, &e.Reference); err != nil {
+			return nil, err
+		}
+		running = roundCents(running + e.Amount)
+		e.Balance = running
+		s.Entries = append(s.Entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	s.ClosingBalance = running
+	return s, nil
+}
+
+// statement returns the stored statement of a closed period, generating and
+// storing it on first request
+func (a *App) statement(ctx context.Context, tenant string, accountID int, period string) (*Statement, error) {
+	var s Statement
+	var entries []byte
+	err := a.DB.QueryRowContext(ctx, "SELECT opening_balance, closing_balance, entries, generated_at FROM statements WHERE tenant_id = $1 AND account_id = $2 AND period = $3",
+		tenant, accountID, period).Scan(&s.OpeningBalance, &s.ClosingBalance, &entries, &s.GeneratedAt)
+	if err == nil {
+		s.AccountID, s.Period = accountID, period
+		return &s, json.Unmarshal(entries, &s.Entries)
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	generated, err := a.generateStatement(ctx, tenant, accountID, period)
+	if err != nil {
+		return nil, err
+	}
+	if entries, err = json.Marshal(generated.Entries); err != nil {
+		return nil, err
+	}
+	// a concurrent request may have stored it first; both computed the same
+	err = a.DB.QueryRowContext(ctx, `INSERT INTO statements (tenant_id, account_id, period, opening_balance, closing_balance, entries) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (tenant_id, account_id, period) DO UPDATE SET period = EXCLUDED.period RETURNING generated_at`,
+		tenant, accountID, period, generated.OpeningBalance, generated.ClosingBalance, entries).Scan(&generated.GeneratedAt)
+	return generated, err
+}
+
+// generateStatements stores last month's statements of every account so they
+// are ready before they are asked for
+func (a *App) generateStatements(ctx context.Context) error {
+	period := time.Now().UTC().AddDate(0, -1, 0).Format(statementPeriodLayout)
+	pending, err := a.queryAccounts(ctx, `SELECT a.tenant_id, a.id FROM accounts a
+		WHERE NOT EXISTS (SELECT 1 FROM statements s WHERE s.tenant_id = a.tenant_id AND s.account_id = a.id AND s.period = $1)`, period)
+	if err != nil {
+		return err
+	}
+	for _, k := range pending {
+		if _, err := a.statement(ctx, k.tenant, k.id, period); err != nil {
+			log.Printf("statements: account %d period %s: %v", k.id, period, err)
+		}
+	}
+	return nil
+}
+
+// BalanceAsOf is the balance of an account at a past instant
+type BalanceAsOf struct {
+	AccountID int       `json:"account_id"`
+	AsOf      time.Time `json:"as_of"`
+	Balance   float64   `json:"balance"`
+}
+
+// handleBalanceAsOf serves GET /accounts/{id}/balance?as_of=TIMESTAMP,
+// reconstructing the balance at that instant from the transaction history
+func (a *App) handleBalanceAsOf(w http.ResponseWriter, r *http.Request, accountID int) {
+	result := BalanceAsOf{AccountID: accountID, AsOf: time.Now().UTC()}
+	if v := r.URL.Query().Get("as_of"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			writeJSONError(w, "Invalid as_of, expected an RFC 3339 timestamp", 1068, http.StatusBadRequest)
+			return
+		}
+		result.AsOf = t
+	}
+
+	ctx := r.Context()
+	tx, err := a.Replica.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		writeJSONError(w, "Failed to load balance", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result.Balance, err = a.balanceAt(ctx, tx, tenantFromContext(ctx), accountID, result.AsOf)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, "Account not found", 1010, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "Failed to load balance", 1005, http.StatusInternalServerError)
+		return
+	}
+	writeJSONSuccess(w, result, "Balance retrieved", 2020, http.StatusOK)
+}
+
+// handleStatement serves GET /accounts/{id}/statements/{period} as JSON, or
+// as PDF when the client accepts application/pdf or asks for ?format=pdf
+func (a *App) handleStatement(w http.ResponseWriter, r *http.Request, accountID int) {
+	period := r.PathValue("period")
+	_, end, err := statementPeriod(period)
+	if err != nil {
+		writeJSONError(w, "Invalid statement period, expected YYYY-MM", 1065, http.StatusBadRequest)
+		return
+	}
+	if end.After(time.Now().UTC()) {
+		writeJSONError(w, "Statement period has not ended", 1066, http.StatusBadRequest)
+		return
+	}
+
+	s, err := a.statement(r.Context(), tenantFromContext(r.Context()), accountID, period)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, "Account not found", 1010, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "Failed to generate statement", 1005, http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "pdf" || strings.Contains(r.Header.Get("Accept"), "application/pdf") {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=statement-%d-%s.pdf", accountID, period))
+		if err := renderStatementPDF(s).Output(w); err != nil {
+			log.Printf("statements: render PDF: %v", err)
+		}
+		return
+	}
+	writeJSONSuccess(w, s, "Statement retrieved", 2019, http.StatusOK)
+}
+
+// renderStatementPDF lays the statement out as a printable A4 document
+func renderStatementPDF(s *Statement) *fpdf.Fpdf {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.SetTitle(fmt.Sprintf("Statement %s account %d", s.Period, s.AccountID), false)
+	pdf.AddPage()
+
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.Cell(0, 10, "Account Statement")
+	pdf.Ln(12)
+	pdf.SetFont("Helvetica", "", 11)
+	pdf.Cell(0, 6, fmt.Sprintf("Account: %d", s.AccountID))
+	pdf.Ln(6)
+	pdf.Cell(0, 6, fmt.Sprintf("Period: %s", s.Period))
+	pdf.Ln(6)
+	pdf.Cell(0, 6, fmt.Sprintf("Opening balance: %.2f", s.OpeningBalance))
+	pdf.Ln(10)
+
+	widths := []float64{35, 25, 60, 35, 35}
+	header := func() {
+		pdf.SetFont("Helvetica", "B", 10)
+		for i, h := range []string{"Date", "Transaction", "Reference", "Amount", "Balance"} {
+			pdf.CellFormat(widths[i], 7, h, "B", 0, "L", false, 0, "")
+		}
+		pdf.Ln(-1)
+		pdf.SetFont("Helvetica", "", 10)
+	}
+	pdf.SetHeaderFunc(func() {
+		if pdf.PageNo() > 1 {
+			header()
+		}
+	})
+	header()
+
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	for _, e := range s.Entries {
+		cells := []string{
+			e.Date.Format("2006-01-02 15:04"),
+			fmt.Sprint(e.TransactionID),
+			tr(truncate(e.Reference, 35)),
+			fmt.Sprintf("%.2f", e.Amount),
+			fmt.Sprintf("%.2f", e.Balance),
+		}
+		for i, c := range cells {
+			align := "L"
+			if i >= 3 {
+				align = "R"
+			}
+			pdf.CellFormat(widths[i], 6, c, "", 0, align, false, 0, "")
+		}
+		pdf.Ln(-1)
+	}
+
+	pdf.Ln(4)
+	pdf.SetFont("Helvetica", "B", 11)
+	pdf.Cell(0, 6, fmt.Sprintf("Closing balance: %.2f", s.ClosingBalance))
+	return pdf
+}
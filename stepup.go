@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OTP providers selectable in the step-up config
+const (
+	OTPProviderLog     = "log"
+	OTPProviderWebhook = "webhook"
+)
+
+// StepUpConfig configures one-time password verification of high-value
+// transfers
+type StepUpConfig struct {
+	// Threshold holds transfers above this amount until the client confirms
+	// them with an OTP; 0 disables step-up verification
+	Threshold   float64 `json:"threshold"`
+	Provider    string  `json:"provider"`
+	WebhookURL  string  `json:"webhook_url"`
+	CodeDigits  int     `json:"code_digits"`
+	TTLSeconds  int     `json:"ttl_seconds"`
+	MaxAttempts int     `json:"max_attempts"`
+}
+
+// required reports whether a transfer of amount needs OTP confirmation
+func (c StepUpConfig) required(amount float64) bool {
+	return c.Threshold > 0 && amount > c.Threshold
+}
+
+// validate checks the step-up configuration at startup
+func (c StepUpConfig) validate() error {
+	if c.Threshold <= 0 {
+		return nil
+	}
+	switch c.Provider {
+	case OTPProviderLog:
+	case OTPProviderWebhook:
+		if c.WebhookURL == "" {
+			return errors.New("webhook_url is required by the webhook provider")
+		}
+	default:
+		return fmt.Errorf("unknown OTP provider %q", c.Provider)
+	}
+	if c.CodeDigits < 4 || c.CodeDigits > 10 {
+		return errors.New("code_digits must be between 4 and 10")
+	}
+	if c.TTLSeconds <= 0 || c.MaxAttempts <= 0 {
+		return errors.New("ttl_seconds and max_attempts must be positive")
+	}
+	return nil
+}
+
+// OTPChallenge is a one-time password to deliver to the owner of a transfer
+type OTPChallenge struct {
+	ID            string    `json:"challenge_id"`
+	TenantID      string    `json:"tenant_id"`
+	Principal     string    `json:"principal,omitempty"`
+	TransactionID int       `json:"transaction_id"`
+	AccountID     int       `json:"account_id,omitempty"`
+	Amount        float64   `json:"amount"`
+	Code          string    `json:"code"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// OTPProvider delivers one-time passwords to the customer, e.g. by SMS or an
+// authenticator push. An error aborts the transfer before anything is held.
+type OTPProvider interface {
+	Deliver(ctx context.Context, c OTPChallenge) error
+}
+
+func newOTPProvider(cfg StepUpConfig) OTPProvider {
+	if cfg.Provider == OTPProviderWebhook {
+		return &webhookOTPProvider{url: cfg.WebhookURL, client: &http.Client{Timeout: 10 * time.Second}}
+	}
+	return logOTPProvider{}
+}
+
+// logOTPProvider writes codes to the server log; meant for development only
+type logOTPProvider struct{}
+
+func (logOTPProvider) Deliver(ctx context.Context, c OTPChallenge) error {
+	log.Printf("OTP for challenge %s (transaction %d): %s", c.ID, c.TransactionID, c.Code)
+	return nil
+}
+
+// webhookOTPProvider posts challenges as JSON to a delivery service
+type webhookOTPProvider struct {
+	url    string
+	client *http.Client
+}
+
+func (p *webhookOTPProvider) Deliver(ctx context.Context, c OTPChallenge) error {
+	body, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("OTP webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// ConfirmTransferRequest is the JSON body of POST /transactions/{id}/confirm
+type ConfirmTransferRequest struct {
+	ChallengeID string `json:"challenge_id"`
+	OTP         string `json:"otp"`
+}
+
+// holdForConfirmation records the transfer as pending_confirmation and sends
+// an OTP challenge for it. The challenge is only committed once delivered.
+func (a *App) holdForConfirmation(ctx context.Context, tenant string, tr TransferRequest) (*TransferResult, *apiError) {
+	cfg := a.Config.StepUp
+	payload, err := json.Marshal(tr)
+	if err != nil {
+		return nil, newAPIError("Failed to hold transfer for confirmation", 1005, http.StatusInternalServerError)
+	}
+	challengeID, code, err := newOTP(cfg.CodeDigits)
+	if err != nil {
+		return nil, newAPIError("Failed to hold transfer for confirmation", 1005, http.StatusInternalServerError)
+	}
+
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, newAPIError("Failed to begin transaction", 1013, http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	result, err := a.holdTransfer(ctx, tx, tenant, tr, TxPendingConfirmation)
+	if err != nil {
+		return nil, newAPIError("Failed to log transaction", 1019, http.StatusInternalServerError)
+	}
+
+	expiresAt := time.Now().Add(time.Duration(cfg.TTLSeconds) * time.Second)
+	_, err = tx.Exec("INSERT INTO transfer_challenges (id, transaction_id, tenant_id, request, code_hash, expires_at) VALUES ($1, $2, $3, $4, $5, $6)",
+		challengeID, result.TransactionID, tenant, payload, hashOTP(code), expiresAt)
+	if err != nil {
+		return nil, newAPIError("Failed to hold transfer for confirmation", 1005, http.StatusInternalServerError)
+	}
+
+	err = a.OTP.Deliver(ctx, OTPChallenge{
+		ID:            challengeID,
+		TenantID:      tenant,
+		Principal:     principalFromContext(ctx).Name,
+		TransactionID: result.TransactionID,
+		AccountID:     tr.FromAccountID,
+		Amount:        tr.Amount,
+		Code:          code,
+		ExpiresAt:     expiresAt,
+	})
+	if err != nil {
+		log.Printf("OTP delivery for transaction %d failed: %v", result.TransactionID, err)
+		return nil, newAPIError("Failed to deliver OTP", 1057, http.StatusBadGateway)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, newAPIError("Failed to commit transaction", 1020, http.StatusInternalServerError)
+	}
+	result.ChallengeID = challengeID
+	return result, nil
+}
+
+// handleConfirmTransfer serves POST /transactions/{id}/confirm, executing a
+// held transfer once the client presents the OTP of its challenge
+func (a *App) handleConfirmTransfer(w http.ResponseWriter, r *http.Request, transactionID int) {
+	var req ConfirmTransferRequest
+	if apiErr := decodeJSON(r, &req, 1002, "challenge_id", "otp"); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	ctx := r.Context()
+	tenant := tenantFromContext(ctx)
+	maxAttempts := a.Config.StepUp.MaxAttempts
+
+	var confirmed, expired bool
+	err := a.DB.QueryRowContext(ctx, "SELECT confirmed_at IS NOT NULL, expires_at < $1 FROM transfer_challenges WHERE id = $2 AND transaction_id = $3 AND tenant_id = $4",
+		time.Now(), req.ChallengeID, transactionID, tenant).Scan(&confirmed, &expired)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, "OTP challenge not found", 1058, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "Failed to load OTP challenge", 1005, http.StatusInternalServerError)
+		return
+	}
+	if confirmed {
+		writeJSONError(w, "OTP challenge has already been used", 1062, http.StatusConflict)
+		return
+	}
+	if expired {
+		a.failHeldTransfer(ctx, tenant, transactionID, "OTP challenge expired")
+		writeJSONError(w, "OTP challenge expired", 1059, http.StatusGone)
+		return
+	}
+
+	// Counting the attempt before checking the code bounds guessing even
+	// under concurrent requests
+	var codeHash string
+	var payload []byte
+	err = a.DB.QueryRowContext(ctx, `UPDATE transfer_challenges SET attempts = attempts + 1
+		WHERE id = $1 AND confirmed_at IS NULL AND attempts < $2 RETURNING code_hash, request`, req.ChallengeID, maxAttempts).Scan(&codeHash, &payload)
+	if err == sql.ErrNoRows {
+		a.failHeldTransfer(ctx, tenant, transactionID, "Too many OTP attempts")
+		writeJSONError(w, "Too many OTP attempts", 1060, http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "Failed to load OTP challenge", 1005, http.StatusInternalServerError)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(hashOTP(strings.TrimSpace(req.OTP))), []byte(codeHash)) != 1 {
+		writeJSONError(w, "Invalid OTP", 1061, http.StatusForbidden)
+		return
+	}
+
+	result, err := a.DB.ExecContext(ctx, "UPDATE transfer_challenges SET confirmed_at = NOW() WHERE id = $1 AND confirmed_at IS NULL", req.ChallengeID)
+	if err != nil {
+		writeJSONError(w, "Failed to confirm transfer", 1005, http.StatusInternalServerError)
+		return
+	}
+	if affectedRows(result, nil) == 0 {
+		writeJSONError(w, "OTP challenge has already been used", 1062, http.StatusConflict)
+		return
+	}
+
+	var tr TransferRequest
+	if err := json.Unmarshal(payload, &tr); err != nil {
+		writeJSONError(w, "Failed to load OTP challenge", 1005, http.StatusInternalServerError)
+		return
+	}
+	tr.pendingID = transactionID
+	tr.verified = true
+
+	transfer, apiErr := a.executeTransfer(ctx, tenant, tr)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	if transfer.Status == TxPendingApproval {
+		writeJSONSuccess(w, transfer, "Transfer awaiting approval", 2011, http.StatusAccepted)
+		return
+	}
+	writeJSONSuccess(w, transfer, "Transfer confirmed", 2016, http.StatusOK)
+}
+
+// failHeldTransfer marks a transfer still awaiting confirmation as failed
+func (a *App) failHeldTransfer(ctx context.Context, tenant string, transactionID int, reason string) {
+	result, err := a.DB.Exec("UPDATE transactions SET status = $1, failure_reason = $2 WHERE id = $3 AND status = $4",
+		TxFailed, reason, transactionID, TxPendingConfirmation)
+	if err != nil {
+		log.Printf("failed to fail held transfer %d: %v", transactionID, err)
+		return
+	}
+	if affectedRows(result, nil) == 0 {
+		return
+	}
+	a.auditCommitted(ctx, auditRecord{
+		TenantID:   tenant,
+		Action:     "transfer." + TxFailed,
+		EntityType: "transaction",
+		EntityID:   strconv.Itoa(transactionID),
+		Before:     map[string]interface{}{"status": TxPendingConfirmation},
+		After:      map[string]interface{}{"status": TxFailed, "failure_reason": reason},
+	})
+}
+
+// newOTP returns a random challenge ID and numeric code of the given length
+func newOTP(digits int) (string, string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", err
+	}
+	code := make([]byte, digits)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", "", err
+		}
+		code[i] = byte('0' + n.Int64())
+	}
+	return hex.EncodeToString(id), string(code), nil
+}
+
+// hashOTP returns the stored form of a code; codes are never persisted
+func hashOTP(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Outcomes of a sweep execution
+const (
+	SweepSucceeded = "succeeded"
+	SweepFailed    = "failed"
+)
+
+// sweepReferencePrefix prefixes the reference of sweep transfers, followed
+// by the rule ID
+const sweepReferencePrefix = "sweep-"
+
+// SweepRule moves the balance of an account above Threshold to another
+// account of the tenant each time the sweeps job runs
+type SweepRule struct {
+	ID          int       `json:"id"`
+	AccountID   int       `json:"account_id"`
+	ToAccountID int       `json:"destination_account_id"`
+	Threshold   float64   `json:"threshold"`
+	CreatedBy   string    `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// CreateSweepRequest is the JSON body of POST /accounts/{id}/sweeps
+type CreateSweepRequest struct {
+	ToAccountID int     `json:"destination_account_id"`
+	Threshold   float64 `json:"threshold"`
+}
+
+func (req *CreateSweepRequest) validate(accountID int) *apiError {
+	var v validator
+	v.check(req.ToAccountID > 0, "destination_account_id", "must be a positive integer")
+	v.check(req.ToAccountID != accountID, "destination_account_id", "must differ from the account")
+	v.check(req.Threshold >= 0, "threshold", "must not be negative")
+	v.check(math.Abs(req.Threshold*100-math.Round(req.Threshold*100)) < 1e-6, "threshold", "must have at most two decimal places")
+	return v.err()
+}
+
+// SweepExecution is one transfer the sweeps job made or tried for a rule
+type SweepExecution struct {
+	ID            int64     `json:"id"`
+	RuleID        int       `json:"sweep_id"`
+	Amount        float64   `json:"amount"`
+	Status        string    `json:"status"`
+	TransactionID *int      `json:"transaction_id,omitempty"`
+	Code          int       `json:"code,omitempty"`
+	Message       string    `json:"message,omitempty"`
+	ExecutedAt    time.Time `json:"executed_at"`
+}
+
+// dueSweep is a rule the sweeps job runs, with the balance of its account
+type dueSweep struct {
+	SweepRule
+	tenant   string
+	balance  float64
+	reserved float64
+}
+
+// sweepBalances runs every sweep rule whose account is open, in the order
+// the rules were created. A rule sweeps what its account holds above the
+// threshold less the fee, so the balance after the transfer is the
+// threshold; funds set aside in wallets or held by disputes stay. Running
+// again right away finds nothing to sweep, so a run cut short is simply
+// repeated.
+func (a *App) sweepBalances(ctx context.Context) error {
+	rows, err := a.DB.QueryContext(ctx, `SELECT r.id, r.tenant_id, r.account_id, r.to_account_id, r.threshold, r.created_by, r.created_at,
+			accounts.balance, `+reservedFunds+`
+		FROM sweep_rules r JOIN accounts ON accounts.id = r.account_id AND accounts.tenant_id = r.tenant_id AND accounts.closed_at IS NULL
+		WHERE r.deleted_at IS NULL
+		ORDER BY r.id`)
+	if err != nil {
+		return err
+	}
+	var due []dueSweep
+	for rows.Next() {
+		var s dueSweep
+		if err := rows.Scan(&s.ID, &s.tenant, &s.AccountID, &s.ToAccountID, &s.Threshold, &s.CreatedBy, &s.CreatedAt, &s.balance, &s.reserved); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, s := range due {
+		if err := a.sweep(ctx, s); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			log.Printf("sweeps: rule %d: %v", s.ID, err)
+		}
+	}
+	return nil
+}
+
+// sweep makes the transfer of a rule and logs it. Sweeps run as the
+// principal that created the rule. No one is present to answer an OTP
+// challenge or to wait for an approval, so amounts that need either fail.
+func (a *App) sweep(ctx context.Context, s dueSweep) error {
+	excess := roundCents(math.Min(s.balance-s.Threshold, s.balance-s.reserved))
+	amount, err := a.sweepAmount(s.tenant, excess)
+	if err != nil || amount <= 0 {
+		return err
+	}
+
+	var result *TransferResult
+	var apiErr *apiError
+	if a.Config.StepUp.required(amount) || a.Config.Approval.required(amount) {
+		apiErr = newAPIError("Sweep amount requires approval or confirmation", 1146, http.StatusUnprocessableEntity)
+	} else {
+		ctx = context.WithValue(ctx, principalKey{}, &Principal{Name: s.CreatedBy, Tenant: s.tenant})
+		ctx = context.WithValue(ctx, tenantKey{}, s.tenant)
+		result, apiErr = a.executeTransfer(ctx, s.tenant, TransferRequest{
+			FromAccountID:  s.AccountID,
+			ToAccountID:    s.ToAccountID,
+			Amount:         amount,
+			Reference:      sweepReferencePrefix + strconv.Itoa(s.ID),
+			AllowDuplicate: true,
+		})
+	}
+
+	e := SweepExecution{RuleID: s.ID, Amount: amount, Status: SweepSucceeded}
+	if apiErr != nil {
+		e.Status, e.Code, e.Message = SweepFailed, apiErr.Code, apiErr.Message
+		if data, ok := apiErr.Data.(map[string]interface{}); ok {
+			if id, ok := data["transaction_id"].(int); ok {
+				e.TransactionID = &id
+			}
+		}
+	} else {
+		e.TransactionID = &result.TransactionID
+	}
+	sweepExecutions.WithLabelValues(e.Status).Inc()
+	_, err = a.DB.ExecContext(ctx, "INSERT INTO sweep_executions (rule_id, amount, status, transaction_id, code, message) VALUES ($1, $2, $3, $4, $5, $6)",
+		e.RuleID, e.Amount, e.Status, e.TransactionID, e.Code, e.Message)
+	return err
+}
+
+// maxSweepSteps bounds the steps sweepAmount takes down tiered fees
+const maxSweepSteps = 10
+
+// sweepAmount returns what to sweep out of excess, leaving room for the fee.
+// Tiered fees can rise as the amount falls into a lower tier, so the amount
+// steps down until it and its fee fit; if that takes too long the rule is
+// skipped.
+func (a *App) sweepAmount(tenant string, excess float64) (float64, error) {
+	amount := roundCents(excess - a.transferFee(tenant, excess))
+	for i := 0; i < maxSweepSteps && amount > 0; i++ {
+		fee := a.transferFee(tenant, amount)
+		if roundCents(amount+fee) <= excess {
+			return amount, nil
+		}
+		amount = math.Min(roundCents(amount-0.01), roundCents(excess-fee))
+	}
+	if amount <= 0 {
+		return 0, nil
+	}
+	return 0, fmt.Errorf("no amount out of %.2f fits with its fee", excess)
+}
+
+// sweepRoute parses the rule ID of /accounts/{id}/sweeps/{sweep_id} routes
+func sweepRoute(h func(http.ResponseWriter, *http.Request, int, int)) http.HandlerFunc {
+	return accountRoute(func(w http.ResponseWriter, r *http.Request, accountID int) {
+		id, err := strconv.Atoi(r.PathValue("sweep_id"))
+		if err != nil {
+			writeJSONError(w, "Sweep rule not found", 1135, http.StatusNotFound)
+			return
+		}
+		h(w, r, accountID, id)
+	})
+}
+
+const sweepRuleColumns = "id, account_id, to_account_id, threshold, created_by, created_at"
+
+func scanSweepRule(row rowScanner) (SweepRule, error) {
+	var s SweepRule
+	err := row.Scan(&s.ID, &s.AccountID, &s.ToAccountID, &s.Threshold, &s.CreatedBy, &s.CreatedAt)
+	return s, err
+}
+
+// handleSweeps serves GET /accounts/{id}/sweeps, the account's rules
+func (a *App) handleSweeps(w http.ResponseWriter, r *http.Request, accountID int) {
+	ctx := r.Context()
+	rows, err := a.DB.QueryContext(ctx, "SELECT "+sweepRuleColumns+" FROM sweep_rules WHERE account_id = $1 AND tenant_id = $2 AND deleted_at IS NULL ORDER BY id",
+		accountID, tenantFromContext(ctx))
+	if err != nil {
+		writeJSONError(w, "Failed to list sweep rules", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	rules := []SweepRule{}
+	for rows.Next() {
+		s, err := scanSweepRule(rows)
+		if err != nil {
+			writeJSONError(w, "Failed to list sweep rules", 1005, http.StatusInternalServerError)
+			return
+		}
+		rules = append(rules, s)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, "Failed to list sweep rules", 1005, http.StatusInternalServerError)
+		return
+	}
+	writeJSONSuccess(w, rules, "Sweep rules retrieved", 2083, http.StatusOK)
+}
+
+// handleCreateSweep serves POST /accounts/{id}/sweeps. Both accounts must be
+// open accounts of the tenant.
+func (a *App) handleCreateSweep(w http.ResponseWriter, r *http.Request, accountID int) {
+	var req CreateSweepRequest
+	if apiErr := decodeJSON(r, &req, 1002, "destination_account_id", "threshold"); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	if apiErr := req.validate(accountID); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	ctx := r.Context()
+	tenant := tenantFromContext(ctx)
+	var source, destination bool
+	err := a.DB.QueryRowContext(ctx, `SELECT
+			EXISTS (SELECT 1 FROM accounts WHERE id = $1 AND tenant_id = $3 AND closed_at IS NULL),
+			EXISTS (SELECT 1 FROM accounts WHERE id = $2 AND tenant_id = $3 AND closed_at IS NULL)`,
+		accountID, req.ToAccountID, tenant).Scan(&source, &destination)
+	if err != nil {
+		writeJSONError(w, "Failed to create sweep rule", 1005, http.StatusInternalServerError)
+		return
+	}
+	if !source {
+		writeJSONError(w, "Account not found", 1010, http.StatusNotFound)
+		return
+	}
+	if !destination {
+		writeJSONError(w, "Destination account not found", 1017, http.StatusNotFound)
+		return
+	}
+
+	s, err := scanSweepRule(a.DB.QueryRowContext(ctx, `INSERT INTO sweep_rules (tenant_id, account_id, to_account_id, threshold, created_by)
+		VALUES ($1, $2, $3, $4, $5) RETURNING `+sweepRuleColumns, tenant, accountID, req.ToAccountID, req.Threshold, principalFromContext(ctx).Name))
+	if err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to create sweep rule", 1005, http.StatusInternalServerError)))
+		return
+	}
+	a.auditCommitted(ctx, auditRecord{
+		TenantID:   tenant,
+		Action:     "sweep.created",
+		EntityType: "sweep",
+		EntityID:   strconv.Itoa(s.ID),
+		After:      s,
+	})
+	writeJSONSuccess(w, s, "Sweep rule created", 2084, http.StatusCreated)
+}
+
+// handleDeleteSweep serves DELETE /accounts/{id}/sweeps/{sweep_id}. The rule
+// stops running; its executions stay listed.
+func (a *App) handleDeleteSweep(w http.ResponseWriter, r *http.Request, accountID, id int) {
+	ctx := r.Context()
+	tenant := tenantFromContext(ctx)
+	s, err := scanSweepRule(a.DB.QueryRowContext(ctx, `UPDATE sweep_rules SET deleted_at = NOW()
+		WHERE id = $1 AND account_id = $2 AND tenant_id = $3 AND deleted_at IS NULL RETURNING `+sweepRuleColumns, id, accountID, tenant))
+	if err == sql.ErrNoRows {
+		writeJSONError(w, "Sweep rule not found", 1135, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to delete sweep rule", 1005, http.StatusInternalServerError)))
+		return
+	}
+	a.auditCommitted(ctx, auditRecord{
+		TenantID:   tenant,
+		Action:     "sweep.deleted",
+		EntityType: "sweep",
+		EntityID:   strconv.Itoa(id),
+		Before:     s,
+	})
+	writeJSONSuccess(w, s, "Sweep rule deleted", 2085, http.StatusOK)
+}
+
+// handleSweepExecutions serves GET /accounts/{id}/sweeps/{sweep_id}/executions,
+// newest first. The log of deleted rules stays readable.
+func (a *App) handleSweepExecutions(w http.ResponseWriter, r *http.Request, accountID, id int) {
+	ctx := r.Context()
+	var exists bool
+	err := a.DB.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM sweep_rules WHERE id = $1 AND account_id = $2 AND tenant_id = $3)",
+		id, accountID, tenantFromContext(ctx)).Scan(&exists)
+	if err != nil {
+		writeJSONError(w, "Failed to list sweep executions", 1005, http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		writeJSONError(w, "Sweep rule not found", 1135, http.StatusNotFound)
+		return
+	}
+	page, apiErr := parsePage(r, true)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	cond, orderLimit, cursor := page.keyset("id", 2)
+
+	rows, err := a.DB.QueryContext(ctx, `SELECT id, rule_id, amount, status, transaction_id, code, message, executed_at
+		FROM sweep_executions WHERE rule_id = $1 AND `+cond+" "+orderLimit, id, cursor)
+	if err != nil {
+		writeJSONError(w, "Failed to list sweep executions", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	executions := []SweepExecution{}
+	for rows.Next() {
+		var e SweepExecution
+		if err := rows.Scan(&e.ID, &e.RuleID, &e.Amount, &e.Status, &e.TransactionID, &e.Code, &e.Message, &e.ExecutedAt); err != nil {
+			writeJSONError(w, "Failed to list sweep executions", 1005, http.StatusInternalServerError)
+			return
+		}
+		executions = append(executions, e)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, "Failed to list sweep executions", 1005, http.StatusInternalServerError)
+		return
+	}
+	executions, pagination := paginate(page, executions, func(e SweepExecution) int64 { return e.ID })
+	writeJSONPage(w, executions, &pagination, "Sweep executions retrieved", 2086, http.StatusOK)
+}
@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestSweepAmount(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  []FeeRule
+		excess float64
+		want   float64
+	}{
+		{name: "no fees", excess: 50, want: 50},
+		{name: "flat fee", rules: []FeeRule{{Type: FeeTypeFlat, Amount: 1}}, excess: 50, want: 49},
+		{name: "fee above the excess", rules: []FeeRule{{Type: FeeTypeFlat, Amount: 5}}, excess: 3, want: 0},
+		{
+			// 100 falls into the tier charging 5, so the amount steps
+			// down to what fits with that fee
+			name: "higher fee in a lower tier",
+			rules: []FeeRule{{Type: FeeTypeTiered, Tiers: []FeeTier{
+				{UpTo: 100, Flat: 5},
+				{UpTo: 0, Flat: 1},
+			}}},
+			excess: 101,
+			want:   96,
+		},
+		{
+			name: "lower tier leaves nothing",
+			rules: []FeeRule{{Type: FeeTypeTiered, Tiers: []FeeTier{
+				{UpTo: 99, Flat: 1000},
+				{UpTo: 0, Flat: 1},
+			}}},
+			excess: 100,
+			want:   0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &App{Config: &Config{Fees: FeeConfig{AccountID: 9, Rules: tt.rules}}}
+			got, err := a.sweepAmount("default", tt.excess)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("sweepAmount(%.2f) = %.2f, want %.2f", tt.excess, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSweepAmountGivesUp(t *testing.T) {
+	// each cent less costs a cent more in fees, so no amount ever fits
+	a := &App{Config: &Config{Fees: FeeConfig{AccountID: 9, Rules: []FeeRule{
+		{Type: FeeTypeTiered, Tiers: []FeeTier{{UpTo: 0, Flat: 100.01, Percent: -100}}},
+	}}}}
+	if amount, err := a.sweepAmount("default", 100); err == nil {
+		t.Fatalf("got %.2f, want an error", amount)
+	}
+}
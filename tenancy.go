@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// TenancyConfig configures how the tenant of a request is resolved and which
+// cross-tenant transfers are permitted
+type TenancyConfig struct {
+	// Header carries the tenant ID on each request
+	Header string `json:"header"`
+	// DefaultTenant is used when the header is absent
+	DefaultTenant string `json:"default_tenant"`
+	// Tenants restricts the accepted tenant IDs; empty accepts any
+	Tenants []string `json:"tenants"`
+	// CrossTenantTransfers maps a source tenant to the destination tenants
+	// its accounts may send funds to
+	CrossTenantTransfers map[string][]string `json:"cross_tenant_transfers"`
+}
+
+type tenantKey struct{}
+
+// tenantFromContext returns the tenant resolved for the request
+func tenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// withTenant resolves the tenant of every request from the caller's API key
+// or the tenant header and stores it in the request context, rejecting
+// tenants that are not configured
+func (a *App) withTenant(next http.Handler) http.Handler {
+	cfg := a.Config.Tenancy
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant := strings.TrimSpace(r.Header.Get(cfg.Header))
+		if tenant == "" {
+			tenant = cfg.DefaultTenant
+		}
+		// API keys bound to a tenant cannot act on another one
+		if pinned := principalFromContext(r.Context()).Tenant; pinned != "" {
+			if tenant != pinned && r.Header.Get(cfg.Header) != "" {
+				writeJSONError(w, "Unknown tenant", 1028, http.StatusForbidden)
+				return
+			}
+			tenant = pinned
+		}
+		if !cfg.knownTenant(tenant) {
+			writeJSONError(w, "Unknown tenant", 1028, http.StatusForbidden)
+			return
+		}
+		if e := accessEntryFromContext(r.Context()); e != nil {
+			e.TenantID = tenant
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant)))
+	})
+}
+
+func (c TenancyConfig) knownTenant(tenant string) bool {
+	if len(c.Tenants) == 0 {
+		return true
+	}
+	for _, t := range c.Tenants {
+		if t == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+// crossTenantAllowed reports whether accounts of tenant from may send funds to
+// accounts of tenant to
+func (c TenancyConfig) crossTenantAllowed(from, to string) bool {
+	if from == to {
+		return true
+	}
+	for _, t := range c.CrossTenantTransfers[from] {
+		if t == to {
+			return true
+		}
+	}
+	return false
+}
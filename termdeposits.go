@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxTermDays bounds the term of a deposit to ten years
+const maxTermDays = 3650
+
+// Statuses of a term deposit
+const (
+	DepositActive    = "active"
+	DepositMatured   = "matured"
+	DepositWithdrawn = "withdrawn"
+)
+
+// depositReferencePrefix prefixes the reference of the interest and penalty
+// postings of a deposit, followed by its ID
+const depositReferencePrefix = "TD-"
+
+// depositHolds selects the funds of an account of accounts locked in its
+// active term deposits
+const depositHolds = "(SELECT COALESCE(SUM(d.amount), 0) FROM term_deposits d WHERE d.account_id = accounts.id AND d.status = '" + DepositActive + "')"
+
+// TermDepositConfig configures term deposits. Interest is paid from and
+// penalties are paid to InterestAccountID, a system account like the
+// fee-income account, and deposits are disabled while it is 0.
+type TermDepositConfig struct {
+	InterestAccountID int `json:"interest_account_id"`
+	// Terms are the terms deposits can be opened for, in days, with their
+	// yearly interest rate, e.g. 0.03 for 3%
+	Terms map[int]float64 `json:"terms"`
+	// AllowEarlyWithdrawal lets a deposit be withdrawn before it matures,
+	// forfeiting its interest and paying EarlyWithdrawalPenalty, a fraction
+	// of the amount
+	AllowEarlyWithdrawal   bool    `json:"allow_early_withdrawal"`
+	EarlyWithdrawalPenalty float64 `json:"early_withdrawal_penalty"`
+}
+
+func (c TermDepositConfig) validate() error {
+	if c.EarlyWithdrawalPenalty < 0 || c.EarlyWithdrawalPenalty > 1 {
+		return fmt.Errorf("early_withdrawal_penalty must be between 0 and 1")
+	}
+	if c.InterestAccountID != 0 && len(c.Terms) == 0 {
+		return fmt.Errorf("terms are required when interest_account_id is set")
+	}
+	for days, rate := range c.Terms {
+		if days < 1 || days > maxTermDays {
+			return fmt.Errorf("term %d: days must be between 1 and %d", days, maxTermDays)
+		}
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("term %d: rate must be between 0 and 1", days)
+		}
+	}
+	return nil
+}
+
+// TermDeposit locks part of the balance of an account until it matures, when
+// the interest is credited and the funds are free again. The locked funds
+// stay in the balance, like those of wallets.
+type TermDeposit struct {
+	ID            int        `json:"id"`
+	AccountID     int        `json:"account_id"`
+	Amount        float64    `json:"amount"`
+	Rate          float64    `json:"rate"`
+	TermDays      int        `json:"term_days"`
+	Interest      float64    `json:"interest"`
+	Penalty       float64    `json:"penalty,omitempty"`
+	Status        string     `json:"status"`
+	TransactionID *int       `json:"transaction_id,omitempty"`
+	CreatedBy     string     `json:"created_by"`
+	OpenedAt      time.Time  `json:"opened_at"`
+	MaturesAt     time.Time  `json:"matures_at"`
+	ClosedAt      *time.Time `json:"closed_at,omitempty"`
+
+	tenant string
+}
+
+// OpenDepositRequest is the JSON body of POST /accounts/{id}/deposits. The
+// deposit earns the rate configured for TermDays.
+type OpenDepositRequest struct {
+	Amount   float64 `json:"amount"`
+	TermDays int     `json:"term_days"`
+}
+
+func (req *OpenDepositRequest) validate(terms map[int]float64) *apiError {
+	var v validator
+	v.amount("amount", req.Amount)
+	_, ok := terms[req.TermDays]
+	v.check(ok, "term_days", "must be a configured term")
+	return v.err()
+}
+
+// depositInterest is the simple interest a deposit earns over its term
+func depositInterest(amount, rate float64, termDays int) float64 {
+	return roundCents(amount * rate * float64(termDays) / 365)
+}
+
+// settle returns active deposit d as closed: matured with its interest, or
+// withdrawn early paying the penalty and forfeiting the interest
+func (c TermDepositConfig) settle(d TermDeposit, early bool) TermDeposit {
+	if !early {
+		d.Status = DepositMatured
+		return d
+	}
+	d.Status, d.Interest, d.Penalty = DepositWithdrawn, 0, roundCents(d.Amount*c.EarlyWithdrawalPenalty)
+	return d
+}
+
+const termDepositColumns = "id, tenant_id, account_id, amount, rate, term_days, interest, penalty, status, transaction_id, created_by, opened_at, matures_at, closed_at"
+
+func scanTermDeposit(row rowScanner) (TermDeposit, error) {
+	var d TermDeposit
+	err := row.Scan(&d.ID, &d.tenant, &d.AccountID, &d.Amount, &d.Rate, &d.TermDays, &d.Interest, &d.Penalty, &d.Status, &d.TransactionID,
+		&d.CreatedBy, &d.OpenedAt, &d.MaturesAt, &d.ClosedAt)
+	return d, err
+}
+
+// depositRoute parses the deposit ID of /accounts/{id}/deposits/{deposit_id}
+// routes
+func depositRoute(h func(http.ResponseWriter, *http.Request, int, int)) http.HandlerFunc {
+	return accountRoute(func(w http.ResponseWriter, r *http.Request, accountID int) {
+		id, err := strconv.Atoi(r.PathValue("deposit_id"))
+		if err != nil {
+			writeJSONError(w, "Term deposit not found", 1141, http.StatusNotFound)
+			return
+		}
+		h(w, r, accountID, id)
+	})
+}
+
+// handleDeposits serves GET /accounts/{id}/deposits, the account's deposits
+// newest first
+func (a *App) handleDeposits(w http.ResponseWriter, r *http.Request, accountID int) {
+	ctx := r.Context()
+	rows, err := a.Replica.QueryContext(ctx, "SELECT "+termDepositColumns+" FROM term_deposits WHERE account_id = $1 AND tenant_id = $2 ORDER BY id DESC",
+		accountID, tenantFromContext(ctx))
+	if err != nil {
+		writeJSONError(w, "Failed to list term deposits", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deposits := []TermDeposit{}
+	for rows.Next() {
+		d, err := scanTermDeposit(rows)
+		if err != nil {
+			writeJSONError(w, "Failed to list term deposits", 1005, http.StatusInternalServerError)
+			return
+		}
+		deposits = append(deposits, d)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, "Failed to list term deposits", 1005, http.StatusInternalServerError)
+		return
+	}
+	writeJSONSuccess(w, deposits, "Term deposits retrieved", 2091, http.StatusOK)
+}
+
+// handleOpenDeposit serves POST /accounts/{id}/deposits, locking amount of
+// the funds the account may spend until the deposit matures
+func (a *App) handleOpenDeposit(w http.ResponseWriter, r *http.Request, accountID int) {
+	if a.Config.TermDeposits.InterestAccountID == 0 {
+		writeJSONError(w, "Term deposits are not enabled", 1143, http.StatusBadRequest)
+		return
+	}
+	var req OpenDepositRequest
+	if apiErr := decodeJSON(r, &req, 1002, "amount", "term_days"); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	if apiErr := req.validate(a.Config.TermDeposits.Terms); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	rate := a.Config.TermDeposits.Terms[req.TermDays]
+
+	ctx := r.Context()
+	tenant := tenantFromContext(ctx)
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to begin transaction", 1013, http.StatusInternalServerError)))
+		return
+	}
+	defer tx.Rollback()
+	if err := a.lockAccounts(ctx, tx, tenant, accountID); err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to lock accounts", 1013, http.StatusInternalServerError)))
+		return
+	}
+	var balance, reserved float64
+	err = tx.QueryRowContext(ctx, "SELECT balance, "+reservedFunds+" FROM accounts WHERE id = $1 AND tenant_id = $2 AND closed_at IS NULL FOR UPDATE", accountID, tenant).
+		Scan(&balance, &reserved)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, "Account not found", 1010, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to open term deposit", 1005, http.StatusInternalServerError)))
+		return
+	}
+	if balance-reserved < req.Amount {
+		writeJSONError(w, "Insufficient funds", 1015, http.StatusBadRequest)
+		return
+	}
+
+	// the new version fails the guarded debits of transfers that read the
+	// account before the funds were locked
+	if err := touchAccount(ctx, tx, accountID); err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to open term deposit", 1005, http.StatusInternalServerError)))
+		return
+	}
+	d, err := scanTermDeposit(tx.QueryRowContext(ctx, `INSERT INTO term_deposits (tenant_id, account_id, amount, rate, term_days, interest, status, created_by, matures_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW() + make_interval(days => $5)) RETURNING `+termDepositColumns,
+		tenant, accountID, req.Amount, rate, req.TermDays, depositInterest(req.Amount, rate, req.TermDays), DepositActive, principalFromContext(ctx).Name))
+	if err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to open term deposit", 1005, http.StatusInternalServerError)))
+		return
+	}
+	if err := a.audit(ctx, tx, auditRecord{
+		TenantID:   tenant,
+		Action:     "deposit.opened",
+		EntityType: "term_deposit",
+		EntityID:   strconv.Itoa(d.ID),
+		After:      d,
+	}); err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to open term deposit", 1005, http.StatusInternalServerError)))
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to commit transaction", 1020, http.StatusInternalServerError)))
+		return
+	}
+	a.Cache.invalidate(ctx, tenant, accountID)
+	writeJSONSuccess(w, d, "Term deposit opened", 2092, http.StatusCreated)
+}
+
+// handleWithdrawDeposit serves POST /accounts/{id}/deposits/{deposit_id}/withdraw.
+// A deposit that is due matures, with its interest; one that is not fails
+// with 1142 unless early withdrawal is allowed, when its penalty is debited
+// and no interest is paid.
+func (a *App) handleWithdrawDeposit(w http.ResponseWriter, r *http.Request, accountID, id int) {
+	ctx := r.Context()
+	d, err := scanTermDeposit(a.DB.QueryRowContext(ctx, "SELECT "+termDepositColumns+" FROM term_deposits WHERE id = $1 AND account_id = $2 AND tenant_id = $3",
+		id, accountID, tenantFromContext(ctx)))
+	if err == sql.ErrNoRows {
+		writeJSONError(w, "Term deposit not found", 1141, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "Failed to load term deposit", 1005, http.StatusInternalServerError)
+		return
+	}
+	if d.Status != DepositActive {
+		writeJSONError(w, "Term deposit is not active", 1144, http.StatusConflict)
+		return
+	}
+	early := time.Now().Before(d.MaturesAt)
+	if early && !a.Config.TermDeposits.AllowEarlyWithdrawal {
+		apiErr := newAPIError("Term deposit has not matured", 1142, http.StatusConflict)
+		apiErr.Data = map[string]interface{}{"matures_at": d.MaturesAt}
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	closed, apiErr := a.closeDeposit(ctx, d, early)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	writeJSONSuccess(w, closed, "Term deposit withdrawn", 2093, http.StatusOK)
+}
+
+// closeDeposit frees the funds of active deposit d. A matured deposit is
+// credited its interest from the interest account; one withdrawn early pays
+// its penalty to it instead. The posting is recorded in transactions under
+// the reference TD-{id}.
+func (a *App) closeDeposit(ctx context.Context, d TermDeposit, early bool) (*TermDeposit, *apiError) {
+	failed := newAPIError("Failed to close term deposit", 1005, http.StatusInternalServerError)
+	system := a.Config.TermDeposits.InterestAccountID
+	if system == 0 {
+		return nil, newAPIError("Term deposits are not enabled", 1143, http.StatusBadRequest)
+	}
+	before := d
+	d = a.Config.TermDeposits.settle(d, early)
+	amount, from, to, memo := d.Interest, system, d.AccountID, "interest"
+	if early {
+		amount, from, to, memo = d.Penalty, d.AccountID, system, "early withdrawal penalty"
+	}
+
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to begin transaction", 1013, http.StatusInternalServerError))
+	}
+	defer tx.Rollback()
+	if err := a.lockAccounts(ctx, tx, d.tenant, d.AccountID); err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to lock accounts", 1013, http.StatusInternalServerError))
+	}
+	// the funds are freed first, so a penalty can be paid out of them
+	result, err := tx.ExecContext(ctx, "UPDATE term_deposits SET status = $1, interest = $2, penalty = $3, closed_at = NOW() WHERE id = $4 AND status = $5",
+		d.Status, d.Interest, d.Penalty, d.ID, DepositActive)
+	if err != nil {
+		return nil, dbWriteError(err, failed)
+	}
+	if affectedRows(result, nil) == 0 {
+		return nil, newAPIError("Term deposit is not active", 1144, http.StatusConflict)
+	}
+
+	if amount > 0 {
+		var balance, reserved float64
+		err := tx.QueryRowContext(ctx, "SELECT balance, "+reservedFunds+" FROM accounts WHERE id = $1 FOR UPDATE", d.AccountID).Scan(&balance, &reserved)
+		if err != nil {
+			return nil, dbWriteError(err, failed)
+		}
+		if early && balance-reserved < amount {
+			return nil, newAPIError("Insufficient funds", 1015, http.StatusBadRequest)
+		}
+		delta := amount
+		if early {
+			delta = -amount
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE accounts SET balance = balance + $1, last_updated = "+nextVersion+" WHERE id = $2", delta, d.AccountID); err != nil {
+			return nil, dbWriteError(err, failed)
+		}
+		// the interest account is a hot system account, updated relatively
+		result, err := tx.ExecContext(ctx, "UPDATE accounts SET balance = balance - $1, last_updated = NOW() WHERE id = $2", delta, system)
+		if err != nil {
+			return nil, dbWriteError(err, failed)
+		}
+		if affectedRows(result, nil) == 0 {
+			return nil, newAPIError("Interest account not found", 1145, http.StatusInternalServerError)
+		}
+		var transactionID int
+		err = tx.StmtContext(ctx, a.Stmts.insertTransaction).QueryRowContext(ctx,
+			from, to, amount, d.tenant, d.tenant, TxCompleted, depositReferencePrefix+strconv.Itoa(d.ID), memo).Scan(&transactionID)
+		if err != nil {
+			return nil, dbWriteError(err, newAPIError("Failed to log transaction", 1019, http.StatusInternalServerError))
+		}
+		if err := a.appendEvents(ctx, tx, transferEvents(from, to, amount, transactionID)...); err != nil {
+			return nil, dbWriteError(err, failed)
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE term_deposits SET transaction_id = $1 WHERE id = $2", transactionID, d.ID); err != nil {
+			return nil, dbWriteError(err, failed)
+		}
+		d.TransactionID = &transactionID
+	} else if err := touchAccount(ctx, tx, d.AccountID); err != nil {
+		return nil, dbWriteError(err, failed)
+	}
+
+	if err := a.audit(ctx, tx, auditRecord{
+		TenantID:   d.tenant,
+		Action:     "deposit." + d.Status,
+		EntityType: "term_deposit",
+		EntityID:   strconv.Itoa(d.ID),
+		Before:     before,
+		After:      d,
+	}); err != nil {
+		return nil, dbWriteError(err, failed)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, dbWriteError(err, newAPIError("Failed to commit transaction", 1020, http.StatusInternalServerError))
+	}
+	a.Cache.invalidate(ctx, d.tenant, d.AccountID, system)
+	now := time.Now()
+	d.ClosedAt = &now
+	return &d, nil
+}
+
+// matureDeposits credits the interest of every active deposit that is due
+// and frees its funds, oldest maturity first. A deposit already matured is
+// skipped, so a run cut short is simply repeated.
+func (a *App) matureDeposits(ctx context.Context) error {
+	rows, err := a.DB.QueryContext(ctx, "SELECT "+termDepositColumns+" FROM term_deposits WHERE status = $1 AND matures_at <= NOW() ORDER BY matures_at, id", DepositActive)
+	if err != nil {
+		return err
+	}
+	var due []TermDeposit
+	for rows.Next() {
+		d, err := scanTermDeposit(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// maturities are audited as the system
+	ctx = context.WithValue(ctx, principalKey{}, &Principal{Name: auditActorSystem})
+	for _, d := range due {
+		if _, apiErr := a.closeDeposit(ctx, d, false); apiErr != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("term deposits: deposit %d: %s", d.ID, apiErr.Message)
+		}
+	}
+	return nil
+}
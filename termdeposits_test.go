@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestDepositInterest(t *testing.T) {
+	tests := []struct {
+		amount, rate float64
+		termDays     int
+		want         float64
+	}{
+		{amount: 5000, rate: 0.03, termDays: 180, want: 73.97},
+		{amount: 1000, rate: 0.05, termDays: 365, want: 50},
+		{amount: 1000, rate: 0, termDays: 90, want: 0},
+		{amount: 0.5, rate: 0.01, termDays: 1, want: 0},
+	}
+	for _, tt := range tests {
+		if got := depositInterest(tt.amount, tt.rate, tt.termDays); got != tt.want {
+			t.Errorf("depositInterest(%.2f, %g, %d) = %.2f, want %.2f", tt.amount, tt.rate, tt.termDays, got, tt.want)
+		}
+	}
+}
+
+func TestTermDepositConfigValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   TermDepositConfig
+		valid bool
+	}{
+		{name: "disabled", valid: true},
+		{name: "enabled", cfg: TermDepositConfig{InterestAccountID: 9002, Terms: map[int]float64{90: 0.02, 365: 0.035}}, valid: true},
+		{name: "enabled without terms", cfg: TermDepositConfig{InterestAccountID: 9002}},
+		{name: "term of no days", cfg: TermDepositConfig{InterestAccountID: 9002, Terms: map[int]float64{0: 0.02}}},
+		{name: "term too long", cfg: TermDepositConfig{InterestAccountID: 9002, Terms: map[int]float64{maxTermDays + 1: 0.02}}},
+		{name: "negative rate", cfg: TermDepositConfig{InterestAccountID: 9002, Terms: map[int]float64{90: -0.01}}},
+		{name: "rate above 1", cfg: TermDepositConfig{InterestAccountID: 9002, Terms: map[int]float64{90: 1.5}}},
+		{name: "negative penalty", cfg: TermDepositConfig{EarlyWithdrawalPenalty: -0.01}},
+		{name: "penalty above 1", cfg: TermDepositConfig{EarlyWithdrawalPenalty: 1.01}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.validate(); (err == nil) != tt.valid {
+				t.Errorf("validate() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestSettleDeposit(t *testing.T) {
+	cfg := TermDepositConfig{EarlyWithdrawalPenalty: 0.01}
+	d := TermDeposit{Amount: 5000, Interest: 73.97, Status: DepositActive}
+
+	matured := cfg.settle(d, false)
+	if matured.Status != DepositMatured || matured.Interest != 73.97 || matured.Penalty != 0 {
+		t.Errorf("matured deposit %+v, want its interest and no penalty", matured)
+	}
+	withdrawn := cfg.settle(d, true)
+	if withdrawn.Status != DepositWithdrawn || withdrawn.Interest != 0 || withdrawn.Penalty != 50 {
+		t.Errorf("deposit withdrawn early %+v, want no interest and a penalty of 50", withdrawn)
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Transaction statuses
+const (
+	TxPending   = "pending"
+	TxCompleted = "completed"
+	TxFailed    = "failed"
+	TxReversed  = "reversed"
+
+	TxPendingApproval     = "pending_approval"
+	TxPendingConfirmation = "pending_confirmation"
+	TxRejected            = "rejected"
+)
+
+// Length limits of the free-text transfer fields
+const (
+	maxReferenceLength = 140
+	maxMemoLength      = 500
+)
+
+// transactionColumns is the column list read by scanTransaction
+const transactionColumns = "id, from_account, to_account, amount, status, created_at, completed_at, failure_reason, reference, memo, category, tags"
+
+// tenantTransactionColumns is transactionColumns as seen by the tenant in
+// the tenantParam placeholder. Category and tags are the budgeting labels of
+// the source tenant, so the destination of a cross-tenant transfer reads it
+// unlabelled.
+func tenantTransactionColumns(tenantParam string) string {
+	return "id, from_account, to_account, amount, status, created_at, completed_at, failure_reason, reference, memo, " +
+		"CASE WHEN tenant_id = " + tenantParam + " THEN category END, CASE WHEN tenant_id = " + tenantParam + " THEN tags ELSE '{}' END"
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanTransaction reads a row selected with transactionColumns
+func scanTransaction(row rowScanner) (Transaction, error) {
+	var t Transaction
+	err := row.Scan(&t.ID, &t.FromAccountID, &t.ToAccountID, &t.Amount, &t.Status, &t.CreatedAt, &t.CompletedAt, &t.FailureReason, &t.Reference, &t.Memo, &t.Category, pq.Array(&t.Tags))
+	return t, err
+}
+
+// Transaction represents a transaction record
+type Transaction struct {
+	ID            int        `json:"transaction_id"`
+	FromAccountID *int       `json:"source_account_id"`
+	ToAccountID   *int       `json:"destination_account_id"`
+	Amount        float64    `json:"amount"`
+	Status        string     `json:"status"`
+	CreatedAt     time.Time  `json:"created_at"`
+	CompletedAt   *time.Time `json:"completed_at,omitempty"`
+	FailureReason *string    `json:"failure_reason,omitempty"`
+	Reference     *string    `json:"reference,omitempty"`
+	Memo          *string    `json:"memo,omitempty"`
+	Category      *string    `json:"category,omitempty"`
+	Tags          []string   `json:"tags,omitempty"`
+}
+
+// transactionRoute adapts a handler of one transaction to a route with an
+// {id} path parameter
+func transactionRoute(h func(http.ResponseWriter, *http.Request, int)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		transactionID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			writeJSONError(w, "Invalid transaction ID", 1041, http.StatusBadRequest)
+			return
+		}
+		h(w, r, transactionID)
+	}
+}
+
+// handleMT103 serves GET /transactions/{id}/mt103 as a SWIFT MT103 message
+func (a *App) handleMT103(w http.ResponseWriter, r *http.Request, transactionID int) {
+	msg, apiErr := a.buildMT103(r.Context(), tenantFromContext(r.Context()), transactionID)
+	if apiErr != nil {
+		writeJSONError(w, apiErr.Message, apiErr.Code, apiErr.Status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(msg))
+}
+
+// handleGetTransaction serves GET /transactions/{id}
+func (a *App) handleGetTransaction(w http.ResponseWriter, r *http.Request, transactionID int) {
+	tenant := tenantFromContext(r.Context())
+	archived, apiErr := includeArchived(r)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	source := "transactions"
+	if archived {
+		source = "ledger_transactions"
+	}
+	t, err := scanTransaction(a.DB.QueryRowContext(r.Context(),
+		"SELECT "+tenantTransactionColumns("$2")+" FROM "+source+" WHERE id = $1 AND (tenant_id = $2 OR to_tenant_id = $2)", transactionID, tenant))
+	if err == sql.ErrNoRows {
+		writeJSONError(w, "Transaction not found", 1044, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "Failed to load transaction", 1005, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSONSuccess(w, t, "Transaction retrieved", 2008, http.StatusOK)
+}
+
+// recordFailedTransfer persists a transfer that could not be completed and
+// attaches its transaction ID to the error returned to the client
+func (a *App) recordFailedTransfer(ctx context.Context, tenant string, tr TransferRequest, apiErr *apiError) {
+	failed := auditRecord{
+		TenantID:   tenant,
+		Action:     "transfer." + TxFailed,
+		EntityType: "transaction",
+		After:      map[string]interface{}{"status": TxFailed, "failure_reason": apiErr.Message},
+	}
+	if tr.pendingID != 0 {
+		_, err := a.DB.Exec("UPDATE transactions SET status = $1, failure_reason = $2 WHERE id = $3", TxFailed, apiErr.Message, tr.pendingID)
+		if err != nil {
+			log.Printf("failed to record failed transfer: %v", err)
+			return
+		}
+		apiErr.Data = map[string]interface{}{"transaction_id": tr.pendingID}
+		failed.EntityID = strconv.Itoa(tr.pendingID)
+		a.auditCommitted(ctx, failed)
+		return
+	}
+
+	toTenant := tenant
+	if tr.ToTenantID != "" {
+		toTenant = tr.ToTenantID
+	}
+
+	var from, to interface{}
+	if tr.FromAccountID != 0 {
+		from = tr.FromAccountID
+	}
+	if tr.ToAccountID != 0 {
+		to = tr.ToAccountID
+	}
+
+	var transactionID int
+	err := a.DB.QueryRow(`INSERT INTO transactions (from_account, to_account, amount, tenant_id, to_tenant_id, status, failure_reason, reference, memo, category, tags)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), NULLIF($9, ''), NULLIF($10, ''), $11) RETURNING id`,
+		from, to, tr.Amount, tenant, toTenant, TxFailed, apiErr.Message, truncate(tr.Reference, maxReferenceLength), truncate(tr.Memo, maxMemoLength),
+		tr.Category, pq.Array(nonNilTags(tr.Tags))).Scan(&transactionID)
+	if err != nil {
+		log.Printf("failed to record failed transfer: %v", err)
+		return
+	}
+	apiErr.Data = map[string]interface{}{"transaction_id": transactionID}
+	failed.EntityID = strconv.Itoa(transactionID)
+	a.auditCommitted(ctx, failed)
+}
+
+// holdTransfer records a transfer that waits on a client action under status.
+// A transfer already held for another reason keeps its transaction.
+func (a *App) holdTransfer(ctx context.Context, tx *sql.Tx, tenant string, tr TransferRequest, status string) (*TransferResult, error) {
+	toTenant := tenant
+	if tr.ToTenantID != "" {
+		toTenant = tr.ToTenantID
+	}
+	result := &TransferResult{
+		FromAccountID: tr.FromAccountID,
+		ToAccountID:   tr.ToAccountID,
+		ToTenantID:    toTenant,
+		Amount:        tr.Amount,
+		TransactionID: tr.pendingID,
+		Status:        status,
+		External:      tr.External,
+	}
+
+	var before interface{}
+	if tr.pendingID != 0 {
+		var previous string
+		if err := tx.QueryRow("SELECT status FROM transactions WHERE id = $1 FOR UPDATE", tr.pendingID).Scan(&previous); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec("UPDATE transactions SET status = $1 WHERE id = $2", status, tr.pendingID); err != nil {
+			return nil, err
+		}
+		before = map[string]interface{}{"status": previous}
+	} else {
+		var from, to interface{}
+		if tr.FromAccountID != 0 {
+			from = tr.FromAccountID
+		}
+		if tr.ToAccountID != 0 {
+			to = tr.ToAccountID
+		}
+		err := tx.QueryRow(`INSERT INTO transactions (from_account, to_account, amount, tenant_id, to_tenant_id, status, reference, memo, category, tags)
+			VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''), NULLIF($9, ''), $10) RETURNING id`,
+			from, to, tr.Amount, tenant, toTenant, status, tr.Reference, tr.Memo, tr.Category, pq.Array(nonNilTags(tr.Tags))).Scan(&result.TransactionID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := a.audit(ctx, tx, auditRecord{
+		TenantID:   tenant,
+		Action:     "transfer." + status,
+		EntityType: "transaction",
+		EntityID:   strconv.Itoa(result.TransactionID),
+		Before:     before,
+		After:      result,
+	})
+	return result, err
+}
+
+// Sort orders of transaction lists; a leading - sorts descending
+const (
+	sortNewest  = "-created_at"
+	sortOldest  = "created_at"
+	sortAmount  = "amount"
+	sortLargest = "-amount"
+)
+
+// transactionStatuses are the statuses a transaction search can filter by
+var transactionStatuses = []string{TxPending, TxCompleted, TxFailed, TxReversed, TxPendingApproval, TxPendingConfirmation, TxRejected}
+
+// transactionFilter narrows a transaction list. Absent criteria stay nil and
+// are not applied.
+type transactionFilter struct {
+	reference            interface{}
+	account              interface{}
+	source, destination  interface{}
+	from, to             interface{}
+	minAmount, maxAmount interface{}
+	statuses             interface{}
+	category, tags       interface{}
+	sort                 string
+}
+
+// parseTransactionFilter reads the search criteria of GET /transactions:
+// reference, source_account_id, destination_account_id, status (a comma
+// separated list), from and to (dates or RFC 3339 timestamps, to exclusive
+// unless a date), min_amount, max_amount, category, tag (a comma separated
+// list the transactions must all carry) and sort
+func parseTransactionFilter(r *http.Request) (transactionFilter, *apiError) {
+	q := r.URL.Query()
+	f := transactionFilter{sort: sortNewest}
+	var v validator
+	if ref := q.Get("reference"); ref != "" {
+		f.reference = ref
+	}
+	for name, bound := range map[string]*interface{}{"source_account_id": &f.source, "destination_account_id": &f.destination} {
+		if raw := q.Get(name); raw != "" {
+			id, err := strconv.Atoi(raw)
+			v.check(err == nil && id > 0, name, "must be a positive integer")
+			*bound = id
+		}
+	}
+	for name, bound := range map[string]*interface{}{"from": &f.from, "to": &f.to} {
+		if raw := q.Get(name); raw != "" {
+			t, err := parseExportBound(raw, name == "to")
+			v.check(err == nil, name, "must be a date or RFC 3339 timestamp")
+			*bound = t
+		}
+	}
+	for name, bound := range map[string]*interface{}{"min_amount": &f.minAmount, "max_amount": &f.maxAmount} {
+		if raw := q.Get(name); raw != "" {
+			amount, err := strconv.ParseFloat(raw, 64)
+			v.check(err == nil && amount >= 0, name, "must be a non-negative number")
+			*bound = amount
+		}
+	}
+	if raw := q.Get("status"); raw != "" {
+		statuses := strings.Split(raw, ",")
+		for _, status := range statuses {
+			v.check(slices.Contains(transactionStatuses, status), "status", "must be one of "+strings.Join(transactionStatuses, ", "))
+		}
+		f.statuses = pq.Array(statuses)
+	}
+	if raw := q.Get("category"); raw != "" {
+		f.category, _ = normalizeLabels(raw, nil)
+	}
+	if raw := q.Get("tag"); raw != "" {
+		_, tags := normalizeLabels("", strings.Split(raw, ","))
+		f.tags = pq.Array(tags)
+	}
+	if raw := q.Get("sort"); raw != "" {
+		v.check(raw == sortNewest || raw == sortOldest || raw == sortAmount || raw == sortLargest, "sort", "must be created_at, -created_at, amount or -amount")
+		f.sort = raw
+	}
+	return f, v.err()
+}
+
+// handleListTransactions serves GET /transactions, searching the tenant's
+// transactions in the read model by the criteria of parseTransactionFilter,
+// newest first unless sorted otherwise and a page at a time.
+// include_archived=true adds archived transactions. Clients accepting NDJSON
+// get the bare transactions one per line instead, with the cursors in the
+// X-Next-Cursor and X-Prev-Cursor headers.
+func (a *App) handleListTransactions(w http.ResponseWriter, r *http.Request) {
+	f, apiErr := parseTransactionFilter(r)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	a.listTransactions(w, r, f, "Transactions retrieved", 2009)
+}
+
+// handleAccountTransactions serves GET /accounts/{id}/transactions, the
+// transfers the account sent or received, filtered and paginated like
+// GET /transactions
+func (a *App) handleAccountTransactions(w http.ResponseWriter, r *http.Request, accountID int) {
+	f, apiErr := parseTransactionFilter(r)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	f.account = accountID
+	var exists bool
+	err := a.Replica.QueryRowContext(r.Context(), "SELECT EXISTS (SELECT 1 FROM read_accounts WHERE id = $1 AND tenant_id = $2)",
+		accountID, tenantFromContext(r.Context())).Scan(&exists)
+	if err != nil {
+		writeJSONError(w, "Failed to list transactions", 1005, http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		writeJSONError(w, "Account not found", 1010, http.StatusNotFound)
+		return
+	}
+	a.listTransactions(w, r, f, "Account transactions retrieved", 2052)
+}
+
+// listTransactions answers with a page of the tenant's transactions matching f
+func (a *App) listTransactions(w http.ResponseWriter, r *http.Request, f transactionFilter, message string, code int) {
+	page, apiErr := parsePage(r, strings.HasPrefix(f.sort, "-"))
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	archived, apiErr := includeArchived(r)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	source := "read_transactions"
+	if archived {
+		source = archivedHistory
+	}
+	args := []interface{}{tenantFromContext(r.Context()), f.reference, f.account, f.source, f.destination, f.from, f.to, f.minAmount, f.maxAmount, f.statuses, f.category, f.tags}
+	var cond, orderLimit string
+	if strings.HasSuffix(f.sort, sortAmount) {
+		var keys []interface{}
+		cond, orderLimit, keys = page.keysetBy("amount", "id", len(args)+1)
+		args = append(args, keys...)
+	} else {
+		var key interface{}
+		cond, orderLimit, key = page.keyset("id", len(args)+1)
+		args = append(args, key)
+	}
+
+	rows, err := a.Replica.QueryContext(r.Context(), "SELECT "+tenantTransactionColumns("$1")+" FROM "+source+`
+		WHERE (tenant_id = $1 OR to_tenant_id = $1)
+		AND ($2::text IS NULL OR reference = $2)
+		AND ($3::int IS NULL OR from_account = $3 OR to_account = $3)
+		AND ($4::int IS NULL OR from_account = $4)
+		AND ($5::int IS NULL OR to_account = $5)
+		AND ($6::timestamp IS NULL OR created_at >= $6)
+		AND ($7::timestamp IS NULL OR created_at < $7)
+		AND ($8::numeric IS NULL OR amount >= $8)
+		AND ($9::numeric IS NULL OR amount <= $9)
+		AND ($10::text[] IS NULL OR status = ANY($10))
+		AND ($11::text IS NULL OR (tenant_id = $1 AND category = $11))
+		AND ($12::text[] IS NULL OR (tenant_id = $1 AND tags @> $12))
+		AND `+cond+" "+orderLimit,
+		args...)
+	if err != nil {
+		writeJSONError(w, "Failed to list transactions", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	transactions := []Transaction{}
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			writeJSONError(w, "Failed to list transactions", 1005, http.StatusInternalServerError)
+			return
+		}
+		transactions = append(transactions, t)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, "Failed to list transactions", 1005, http.StatusInternalServerError)
+		return
+	}
+	transactions, pagination := paginateBy(page, transactions, func(t Transaction) pageCursor {
+		c := pageCursor{Key: int64(t.ID)}
+		if strings.HasSuffix(f.sort, sortAmount) {
+			c.Value = &t.Amount
+		}
+		return c
+	})
+
+	if wantsNDJSON(r) {
+		if pagination.NextCursor != "" {
+			w.Header().Set("X-Next-Cursor", pagination.NextCursor)
+		}
+		if pagination.PrevCursor != "" {
+			w.Header().Set("X-Prev-Cursor", pagination.PrevCursor)
+		}
+		out := newNDJSONTransactionWriter(w)
+		for _, t := range transactions {
+			out.write(t)
+		}
+		out.flush()
+		return
+	}
+	writeJSONPage(w, transactions, &pagination, message, code, http.StatusOK)
+}
+
+// truncate shortens s to at most n bytes
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,250 @@
+// Package transfer holds the rules of moving funds between two accounts:
+// reading and locking them, checking funds, debiting and crediting under
+// optimistic version checks with retries, and charging the fee. It knows
+// nothing about HTTP or SQL; the storage it runs against is a Store, so the
+// rules can be reused by every API surface and tested without a database.
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Account is the state of an account as a transfer reads it. Version is the
+// value a conditional update must still find for the update to apply.
+type Account struct {
+	ID      int
+	Balance float64
+	// Reserved is the part of Balance a transfer may not spend, such as the
+	// funds set aside in wallets
+	Reserved float64
+	// MinimumBalance is the balance a transfer may not take the account
+	// below, not counting Reserved
+	MinimumBalance float64
+	Version        time.Time
+}
+
+// Transfer is a transfer whose accounts are resolved to IDs
+type Transfer struct {
+	Tenant   string
+	ToTenant string
+	From     int
+	To       int
+	Amount   float64
+	// Fee is debited from From on top of Amount and credited to FeeAccount
+	Fee        float64
+	FeeAccount int
+	// Settlement marks To as a system account, such as the settlement
+	// account of external transfers: it is credited without being read,
+	// locked or version checked, so it does not become a conflict hotspot
+	Settlement bool
+}
+
+// Outcome describes a transfer that has been applied but not yet committed
+type Outcome struct {
+	Transfer
+	// Source and Destination are the accounts before the transfer;
+	// Destination is nil for a settlement transfer
+	Source      Account
+	Destination *Account
+	// TransactionID is the ID the transfer was recorded under
+	TransactionID int
+}
+
+// Store begins the units of work the transfers run in
+type Store interface {
+	Begin(ctx context.Context) (Tx, error)
+}
+
+// Tx is a unit of work: all changes are made visible by Commit, or none.
+// The update methods report false when the account was not found in the
+// expected version; they only fail on errors that make retrying pointless.
+type Tx interface {
+	// Lock serializes the writers of the accounts, if the store needs it
+	Lock(ctx context.Context, tenant string, accountIDs ...int) error
+	// Account reads an account of tenant; it fails when there is none
+	Account(ctx context.Context, tenant string, id int) (Account, error)
+	Debit(ctx context.Context, id int, amount float64, version time.Time) (bool, error)
+	Credit(ctx context.Context, id int, amount float64, version time.Time) (bool, error)
+	// CreditUnchecked credits a system account without a version check
+	CreditUnchecked(ctx context.Context, id int, amount float64) (bool, error)
+	// Record stores the transaction of an applied transfer and its
+	// bookkeeping and returns the transaction's ID
+	Record(ctx context.Context, o Outcome) (int, error)
+	// RecordFee stores the transaction of the fee of an applied transfer
+	RecordFee(ctx context.Context, o Outcome) error
+	Commit() error
+	Rollback() error
+}
+
+// Step names the part of a transfer that failed
+type Step string
+
+// Steps of a transfer, in order
+const (
+	StepBegin          Step = "begin"
+	StepLock           Step = "lock"
+	StepSource         Step = "source"
+	StepFunds          Step = "funds"
+	StepMinimumBalance Step = "minimum balance"
+	StepDebit          Step = "debit"
+	StepDestination    Step = "destination"
+	StepCredit         Step = "credit"
+	StepSettlement     Step = "settlement"
+	StepRecord         Step = "record"
+	StepFee            Step = "fee"
+	StepCommit         Step = "commit"
+	StepDebitConflict  Step = "debit conflict"
+	StepCreditConflict Step = "credit conflict"
+)
+
+// Error is a transfer that failed at Step. Err is the storage error behind
+// it; it is nil when a rule was violated, such as insufficient funds, or an
+// account was missing or kept changing.
+type Error struct {
+	Step Step
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return "transfer failed at " + string(e.Step)
+	}
+	return fmt.Sprintf("transfer failed at %s: %v", e.Step, e.Err)
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// StepOf returns the step err failed at, or "" when it is not an *Error
+func StepOf(err error) Step {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Step
+	}
+	return ""
+}
+
+// Service applies transfers against its Store
+type Service struct {
+	Store Store
+	// MaxAttempts bounds the attempts of a transfer whose accounts keep
+	// changing between read and update; 0 means 3
+	MaxAttempts int
+	// RetryDelay is the pause before the next attempt; 0 means 50ms
+	RetryDelay time.Duration
+	// Check vets a transfer once its source is read and before anything is
+	// changed; an error aborts the transfer and is returned as is
+	Check func(ctx context.Context, tx Tx, t Transfer, source Account) error
+	// ForceConflict makes the debit of an attempt fail as if the source had
+	// changed, for fault injection
+	ForceConflict func(attempt int) bool
+}
+
+// Execute applies t and returns its committed outcome
+func (s *Service) Execute(ctx context.Context, t Transfer) (*Outcome, error) {
+	attempts := s.MaxAttempts
+	if attempts == 0 {
+		attempts = 3
+	}
+	delay := s.RetryDelay
+	if delay == 0 {
+		delay = 50 * time.Millisecond
+	}
+	for attempt := 1; ; attempt++ {
+		o, err := s.attempt(ctx, t, attempt)
+		step := StepOf(err)
+		if step != StepDebitConflict && step != StepCreditConflict {
+			return o, err
+		}
+		if attempt == attempts {
+			return nil, err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, &Error{Step: StepBegin, Err: ctx.Err()}
+		}
+	}
+}
+
+// attempt is one try of Execute, in its own unit of work
+func (s *Service) attempt(ctx context.Context, t Transfer, attempt int) (*Outcome, error) {
+	tx, err := s.Store.Begin(ctx)
+	if err != nil {
+		return nil, &Error{Step: StepBegin, Err: err}
+	}
+	defer tx.Rollback()
+
+	locked := []int{t.From}
+	if !t.Settlement {
+		locked = append(locked, t.To)
+	}
+	if err := tx.Lock(ctx, t.Tenant, locked...); err != nil {
+		return nil, &Error{Step: StepLock, Err: err}
+	}
+
+	o := &Outcome{Transfer: t}
+	if o.Source, err = tx.Account(ctx, t.Tenant, t.From); err != nil {
+		return nil, &Error{Step: StepSource, Err: err}
+	}
+	if o.Source.Balance-o.Source.Reserved < t.Amount+t.Fee {
+		return nil, &Error{Step: StepFunds}
+	}
+	if o.Source.Balance-o.Source.Reserved-t.Amount-t.Fee < o.Source.MinimumBalance {
+		return nil, &Error{Step: StepMinimumBalance}
+	}
+	if s.Check != nil {
+		if err := s.Check(ctx, tx, t, o.Source); err != nil {
+			return nil, err
+		}
+	}
+
+	ok, err := tx.Debit(ctx, t.From, t.Amount+t.Fee, o.Source.Version)
+	if err != nil {
+		return nil, &Error{Step: StepDebit, Err: err}
+	}
+	if !ok || s.ForceConflict != nil && s.ForceConflict(attempt) {
+		return nil, &Error{Step: StepDebitConflict}
+	}
+
+	if t.Settlement {
+		ok, err := tx.CreditUnchecked(ctx, t.To, t.Amount)
+		if err != nil || !ok {
+			return nil, &Error{Step: StepSettlement, Err: err}
+		}
+	} else {
+		to, err := tx.Account(ctx, t.ToTenant, t.To)
+		if err != nil {
+			return nil, &Error{Step: StepDestination, Err: err}
+		}
+		o.Destination = &to
+		ok, err := tx.Credit(ctx, t.To, t.Amount, to.Version)
+		if err != nil {
+			return nil, &Error{Step: StepCredit, Err: err}
+		}
+		if !ok {
+			return nil, &Error{Step: StepCreditConflict}
+		}
+	}
+
+	if o.TransactionID, err = tx.Record(ctx, *o); err != nil {
+		return nil, &Error{Step: StepRecord, Err: err}
+	}
+
+	if t.Fee > 0 {
+		ok, err := tx.CreditUnchecked(ctx, t.FeeAccount, t.Fee)
+		if err != nil || !ok {
+			return nil, &Error{Step: StepFee, Err: err}
+		}
+		if err := tx.RecordFee(ctx, *o); err != nil {
+			return nil, &Error{Step: StepRecord, Err: err}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, &Error{Step: StepCommit, Err: err}
+	}
+	return o, nil
+}
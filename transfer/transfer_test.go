@@ -0,0 +1,239 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// memStore keeps accounts in memory. A unit of work copies them and swaps
+// the copy in on commit, which is enough for the sequential tests here.
+type memStore struct {
+	accounts  map[int]Account
+	recorded  []Outcome
+	fees      int
+	conflicts int // debits to fail as if the source had changed
+}
+
+func newMemStore(balances map[int]float64) *memStore {
+	s := &memStore{accounts: map[int]Account{}}
+	for id, b := range balances {
+		s.accounts[id] = Account{ID: id, Balance: b, Version: time.Unix(0, 0)}
+	}
+	return s
+}
+
+func (s *memStore) Begin(ctx context.Context) (Tx, error) {
+	work := map[int]Account{}
+	for id, acc := range s.accounts {
+		work[id] = acc
+	}
+	return &memTx{store: s, accounts: work}, nil
+}
+
+type memTx struct {
+	store    *memStore
+	accounts map[int]Account
+	recorded []Outcome
+	fees     int
+}
+
+func (t *memTx) Lock(ctx context.Context, tenant string, ids ...int) error { return nil }
+
+func (t *memTx) Account(ctx context.Context, tenant string, id int) (Account, error) {
+	acc, ok := t.accounts[id]
+	if !ok {
+		return Account{}, errors.New("no such account")
+	}
+	return acc, nil
+}
+
+func (t *memTx) update(id int, delta float64, version *time.Time) bool {
+	acc, ok := t.accounts[id]
+	if !ok || version != nil && !acc.Version.Equal(*version) {
+		return false
+	}
+	acc.Balance += delta
+	acc.Version = acc.Version.Add(time.Second)
+	t.accounts[id] = acc
+	return true
+}
+
+func (t *memTx) Debit(ctx context.Context, id int, amount float64, version time.Time) (bool, error) {
+	if t.store.conflicts > 0 {
+		t.store.conflicts--
+		return false, nil
+	}
+	return t.update(id, -amount, &version), nil
+}
+
+func (t *memTx) Credit(ctx context.Context, id int, amount float64, version time.Time) (bool, error) {
+	return t.update(id, amount, &version), nil
+}
+
+func (t *memTx) CreditUnchecked(ctx context.Context, id int, amount float64) (bool, error) {
+	return t.update(id, amount, nil), nil
+}
+
+func (t *memTx) Record(ctx context.Context, o Outcome) (int, error) {
+	t.recorded = append(t.recorded, o)
+	return len(t.store.recorded) + len(t.recorded), nil
+}
+
+func (t *memTx) RecordFee(ctx context.Context, o Outcome) error {
+	t.fees++
+	return nil
+}
+
+func (t *memTx) Commit() error {
+	t.store.accounts = t.accounts
+	t.store.recorded = append(t.store.recorded, t.recorded...)
+	t.store.fees += t.fees
+	return nil
+}
+
+func (t *memTx) Rollback() error { return nil }
+
+func TestExecuteMovesFundsAndFee(t *testing.T) {
+	store := newMemStore(map[int]float64{1: 100, 2: 0, 9: 0})
+	svc := &Service{Store: store}
+
+	o, err := svc.Execute(context.Background(), Transfer{From: 1, To: 2, Amount: 40, Fee: 1.5, FeeAccount: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.TransactionID != 1 || o.Source.Balance != 100 || o.Destination == nil || o.Destination.Balance != 0 {
+		t.Errorf("unexpected outcome %+v", o)
+	}
+	for id, want := range map[int]float64{1: 58.5, 2: 40, 9: 1.5} {
+		if got := store.accounts[id].Balance; got != want {
+			t.Errorf("account %d: balance %.2f, want %.2f", id, got, want)
+		}
+	}
+	if len(store.recorded) != 1 || store.fees != 1 {
+		t.Errorf("%d transactions and %d fees recorded, want 1 and 1", len(store.recorded), store.fees)
+	}
+}
+
+func TestExecuteRejectsInsufficientFunds(t *testing.T) {
+	store := newMemStore(map[int]float64{1: 10, 2: 0, 9: 0})
+	svc := &Service{Store: store}
+
+	_, err := svc.Execute(context.Background(), Transfer{From: 1, To: 2, Amount: 10, Fee: 0.01, FeeAccount: 9})
+	if StepOf(err) != StepFunds {
+		t.Fatalf("got %v, want a funds failure", err)
+	}
+	if store.accounts[1].Balance != 10 || len(store.recorded) != 0 {
+		t.Error("a rejected transfer changed the store")
+	}
+}
+
+func TestExecuteKeepsReservedFunds(t *testing.T) {
+	store := newMemStore(map[int]float64{1: 100, 2: 0})
+	acc := store.accounts[1]
+	acc.Reserved = 70
+	store.accounts[1] = acc
+	svc := &Service{Store: store}
+
+	if _, err := svc.Execute(context.Background(), Transfer{From: 1, To: 2, Amount: 31}); StepOf(err) != StepFunds {
+		t.Fatalf("got %v, want a funds failure", err)
+	}
+	if _, err := svc.Execute(context.Background(), Transfer{From: 1, To: 2, Amount: 30}); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.accounts[1].Balance; got != 70 {
+		t.Errorf("balance %.2f, want 70", got)
+	}
+}
+
+func TestExecuteKeepsMinimumBalance(t *testing.T) {
+	store := newMemStore(map[int]float64{1: 100, 2: 0, 9: 0})
+	acc := store.accounts[1]
+	acc.MinimumBalance = 50
+	store.accounts[1] = acc
+	svc := &Service{Store: store}
+
+	if _, err := svc.Execute(context.Background(), Transfer{From: 1, To: 2, Amount: 50, Fee: 0.5, FeeAccount: 9}); StepOf(err) != StepMinimumBalance {
+		t.Fatalf("got %v, want a minimum balance failure", err)
+	}
+	if _, err := svc.Execute(context.Background(), Transfer{From: 1, To: 2, Amount: 49.5, Fee: 0.5, FeeAccount: 9}); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.accounts[1].Balance; got != 50 {
+		t.Errorf("balance %.2f, want 50", got)
+	}
+}
+
+func TestExecuteKeepsMinimumBalanceBesidesReserved(t *testing.T) {
+	store := newMemStore(map[int]float64{1: 100, 2: 0})
+	acc := store.accounts[1]
+	acc.Reserved, acc.MinimumBalance = 30, 50
+	store.accounts[1] = acc
+	svc := &Service{Store: store}
+
+	if _, err := svc.Execute(context.Background(), Transfer{From: 1, To: 2, Amount: 21}); StepOf(err) != StepMinimumBalance {
+		t.Fatalf("got %v, want a minimum balance failure", err)
+	}
+	if _, err := svc.Execute(context.Background(), Transfer{From: 1, To: 2, Amount: 20}); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.accounts[1].Balance; got != 80 {
+		t.Errorf("balance %.2f, want 80", got)
+	}
+}
+
+func TestExecuteRetriesConflicts(t *testing.T) {
+	store := newMemStore(map[int]float64{1: 100, 2: 0})
+	store.conflicts = 2
+	svc := &Service{Store: store, RetryDelay: time.Millisecond}
+
+	if _, err := svc.Execute(context.Background(), Transfer{From: 1, To: 2, Amount: 5}); err != nil {
+		t.Fatalf("third attempt should succeed: %v", err)
+	}
+
+	store.conflicts = 3
+	_, err := svc.Execute(context.Background(), Transfer{From: 1, To: 2, Amount: 5})
+	if StepOf(err) != StepDebitConflict {
+		t.Fatalf("got %v, want a debit conflict", err)
+	}
+	if store.accounts[1].Balance != 95 || store.accounts[2].Balance != 5 {
+		t.Errorf("balances %.2f and %.2f, want 95.00 and 5.00", store.accounts[1].Balance, store.accounts[2].Balance)
+	}
+}
+
+func TestExecuteCreditsSettlementWithoutReadingIt(t *testing.T) {
+	store := newMemStore(map[int]float64{1: 100, 7: 0})
+	checked := false
+	svc := &Service{
+		Store: store,
+		Check: func(ctx context.Context, tx Tx, tr Transfer, source Account) error {
+			checked = true
+			return nil
+		},
+	}
+
+	o, err := svc.Execute(context.Background(), Transfer{From: 1, To: 7, Amount: 30, Settlement: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checked || o.Destination != nil || store.accounts[7].Balance != 30 {
+		t.Errorf("checked %v, outcome %+v, settlement balance %.2f", checked, o, store.accounts[7].Balance)
+	}
+}
+
+func TestExecuteStopsOnCheckError(t *testing.T) {
+	store := newMemStore(map[int]float64{1: 100, 2: 0})
+	rejected := errors.New("rejected")
+	svc := &Service{
+		Store: store,
+		Check: func(ctx context.Context, tx Tx, tr Transfer, source Account) error { return rejected },
+	}
+
+	if _, err := svc.Execute(context.Background(), Transfer{From: 1, To: 2, Amount: 5}); err != rejected {
+		t.Fatalf("got %v, want the check's error", err)
+	}
+	if store.accounts[1].Balance != 100 {
+		t.Error("a rejected transfer changed the store")
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"internal-transfers/transfer"
+)
+
+// transferStore runs the transfer service against the primary for one
+// transfer request, whose reference, memo, external destination and hold
+// the bookkeeping needs
+type transferStore struct {
+	a              *App
+	tr             TransferRequest
+	status         string
+	externalStatus string
+	// link, when set, records what the transfer is part of in the same
+	// transaction, such as the escrow it funds
+	link func(ctx context.Context, tx *sql.Tx, transactionID int) error
+	// claim, when set, runs first in the transaction, such as to take the
+	// prepared transfer being confirmed
+	claim func(ctx context.Context, tx *sql.Tx) error
+}
+
+func (s *transferStore) Begin(ctx context.Context) (transfer.Tx, error) {
+	tx, err := s.a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.claim != nil {
+		if err := s.claim(ctx, tx); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return &transferTx{transferStore: s, tx: tx}, nil
+}
+
+// transferTx is a transfer.Tx on a database transaction
+type transferTx struct {
+	*transferStore
+	tx *sql.Tx
+}
+
+func (t *transferTx) Lock(ctx context.Context, tenant string, accountIDs ...int) error {
+	return t.a.lockAccounts(ctx, t.tx, tenant, accountIDs...)
+}
+
+func (t *transferTx) Account(ctx context.Context, tenant string, id int) (transfer.Account, error) {
+	var acc transfer.Account
+	var accountType string
+	err := t.tx.StmtContext(ctx, t.a.Stmts.lockedAccount).QueryRowContext(ctx, id, tenant).Scan(&acc.ID, &acc.Balance, &acc.Version, &acc.Reserved, &accountType)
+	acc.MinimumBalance = t.a.Config.minimumBalance(accountType)
+	return acc, err
+}
+
+func (t *transferTx) Debit(ctx context.Context, id int, amount float64, version time.Time) (bool, error) {
+	return t.guardedUpdate(ctx, t.a.Stmts.debit, id, amount, version)
+}
+
+func (t *transferTx) Credit(ctx context.Context, id int, amount float64, version time.Time) (bool, error) {
+	return t.guardedUpdate(ctx, t.a.Stmts.credit, id, amount, version)
+}
+
+// guardedUpdate runs a debit or credit under the version guard. Failures
+// other than an unreachable database count as conflicts and are retried.
+func (t *transferTx) guardedUpdate(ctx context.Context, stmt *sql.Stmt, id int, amount float64, version time.Time) (bool, error) {
+	result, err := t.tx.StmtContext(ctx, stmt).ExecContext(ctx, amount, id, t.a.versionGuard(version))
+	if dbUnavailable(err) {
+		return false, err
+	}
+	return affectedRows(result, err) > 0, nil
+}
+
+func (t *transferTx) CreditUnchecked(ctx context.Context, id int, amount float64) (bool, error) {
+	result, err := t.tx.StmtContext(ctx, t.a.Stmts.creditUnchecked).ExecContext(ctx, amount, id)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+func (t *transferTx) Record(ctx context.Context, o transfer.Outcome) (int, error) {
+	tr := t.tr
+	var transactionID int
+	var err error
+	if tr.pendingID != 0 {
+		// a held transfer keeps the transaction it was recorded under
+		err = t.tx.QueryRowContext(ctx, "UPDATE transactions SET from_account = $1, to_account = $2, to_tenant_id = $3, status = $4, completed_at = CASE WHEN $4 = 'completed' THEN NOW() END WHERE id = $5 AND status IN ($6, $7) RETURNING id",
+			o.From, o.To, o.ToTenant, t.status, tr.pendingID, TxPendingApproval, TxPendingConfirmation).Scan(&transactionID)
+	} else {
+		err = t.tx.StmtContext(ctx, t.a.Stmts.insertTransaction).QueryRowContext(ctx,
+			o.From, o.To, o.Amount, o.Tenant, o.ToTenant, t.status, tr.Reference, tr.Memo).Scan(&transactionID)
+		// the prepared insert is shared with unlabelled postings, so
+		// labels are set apart
+		if err == nil && (tr.Category != "" || len(tr.Tags) > 0) {
+			err = labelTransaction(ctx, t.tx, transactionID, tr.Category, tr.Tags)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	before := map[string]interface{}{"from_balance": o.Source.Balance}
+	after := map[string]interface{}{
+		"status":       t.status,
+		"amount":       o.Amount,
+		"fee":          o.Fee,
+		"to_account":   o.To,
+		"from_balance": roundCents(o.Source.Balance - o.Amount - o.Fee),
+	}
+	if o.Destination != nil {
+		before["to_balance"] = o.Destination.Balance
+		after["to_balance"] = roundCents(o.Destination.Balance + o.Amount)
+	}
+	if err := t.a.appendEvents(ctx, t.tx, transferEvents(o.From, o.To, o.Amount, transactionID)...); err != nil {
+		return 0, err
+	}
+	err = t.a.audit(ctx, t.tx, auditRecord{
+		TenantID:   o.Tenant,
+		Action:     "transfer." + t.status,
+		EntityType: "transaction",
+		EntityID:   strconv.Itoa(transactionID),
+		Before:     before,
+		After:      after,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if ext := tr.External; ext != nil {
+		_, err = t.tx.ExecContext(ctx, "INSERT INTO external_transfers (transaction_id, tenant_id, rail, routing_number, account_number, account_type, beneficiary_name, bic, iban, status, attempts) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, 1)",
+			transactionID, o.Tenant, ext.Rail, ext.RoutingNumber, ext.AccountNumber, ext.AccountType, ext.Name, ext.BIC, ext.IBAN, t.externalStatus)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if t.link != nil {
+		if err := t.link(ctx, t.tx, transactionID); err != nil {
+			return 0, err
+		}
+	}
+	return transactionID, nil
+}
+
+func (t *transferTx) RecordFee(ctx context.Context, o transfer.Outcome) error {
+	var feeTransactionID int
+	err := t.tx.QueryRowContext(ctx, "INSERT INTO transactions (from_account, to_account, amount, tenant_id, to_tenant_id, status, completed_at) VALUES ($1, $2, $3, $4, $4, 'completed', NOW()) RETURNING id",
+		o.From, o.FeeAccount, o.Fee, o.Tenant).Scan(&feeTransactionID)
+	if err != nil {
+		return err
+	}
+	return t.a.appendEvents(ctx, t.tx, transferEvents(o.From, o.FeeAccount, o.Fee, feeTransactionID)...)
+}
+
+func (t *transferTx) Commit() error   { return t.tx.Commit() }
+func (t *transferTx) Rollback() error { return t.tx.Rollback() }
+
+// riskCheck returns the Check of a transfer service running the risk checkers
+// against in, once the source account is read
+func (a *App) riskCheck(in RiskInput) func(ctx context.Context, tx transfer.Tx, t transfer.Transfer, source transfer.Account) error {
+	return func(ctx context.Context, tx transfer.Tx, t transfer.Transfer, source transfer.Account) error {
+		in.From = Account{ID: source.ID, Balance: source.Balance, LastUpdated: source.Version}
+		if apiErr := a.checkRisk(ctx, tx.(*transferTx).tx, in); apiErr != nil {
+			return apiErr
+		}
+		return nil
+	}
+}
+
+// transferAPIError maps a failed transfer onto the API error it is reported
+// as. Errors of the Check hook are API errors already.
+func transferAPIError(err error) *apiError {
+	if apiErr, ok := err.(*apiError); ok {
+		return apiErr
+	}
+	if errors.Is(err, errPreparedTransferGone) {
+		return preparedGone("")
+	}
+	cause := errors.Unwrap(err)
+	switch transfer.StepOf(err) {
+	case transfer.StepLock:
+		return dbWriteError(cause, newAPIError("Failed to lock accounts", 1013, http.StatusInternalServerError))
+	case transfer.StepSource:
+		return dbWriteError(cause, newAPIError("Source account not found", 1014, http.StatusNotFound))
+	case transfer.StepFunds:
+		return newAPIError("Insufficient funds", 1015, http.StatusBadRequest)
+	case transfer.StepMinimumBalance:
+		return newAPIError("Transfer would take the account below its minimum balance", 1134, http.StatusBadRequest)
+	case transfer.StepDebit, transfer.StepDebitConflict:
+		return dbWriteError(cause, newAPIError("Concurrency conflict on debit after retries", 1016, http.StatusConflict))
+	case transfer.StepDestination:
+		return dbWriteError(cause, newAPIError("Destination account not found", 1017, http.StatusNotFound))
+	case transfer.StepCredit, transfer.StepCreditConflict:
+		return dbWriteError(cause, newAPIError("Concurrency conflict on credit after retries", 1018, http.StatusConflict))
+	case transfer.StepSettlement:
+		if cause == nil {
+			return newAPIError("Settlement account not found", 1039, http.StatusInternalServerError)
+		}
+		return dbWriteError(cause, newAPIError("Failed to credit settlement account", 1038, http.StatusInternalServerError))
+	case transfer.StepRecord:
+		return dbWriteError(cause, newAPIError("Failed to log transaction", 1019, http.StatusInternalServerError))
+	case transfer.StepFee:
+		if cause == nil {
+			return newAPIError("Fee account not found", 1022, http.StatusInternalServerError)
+		}
+		return dbWriteError(cause, newAPIError("Failed to credit fee account", 1021, http.StatusInternalServerError))
+	case transfer.StepCommit:
+		return dbWriteError(cause, newAPIError("Failed to commit transaction", 1020, http.StatusInternalServerError))
+	}
+	return dbWriteError(cause, newAPIError("Failed to begin transaction", 1013, http.StatusInternalServerError))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// FieldError describes why a single request field failed validation
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// LimitsConfig bounds the values accepted in requests
+type LimitsConfig struct {
+	// MaxTransferAmount caps a single transfer; 0 means no cap
+	MaxTransferAmount float64 `json:"max_transfer_amount"`
+	// DuplicateWindowSeconds turns away a transfer identical to one made
+	// that many seconds before, unless it allows duplicates; 0 disables the
+	// check
+	DuplicateWindowSeconds int `json:"duplicate_window_seconds"`
+}
+
+// validator collects field errors of a request
+type validator struct {
+	errors []FieldError
+}
+
+// check records message for field unless ok holds
+func (v *validator) check(ok bool, field, message string) {
+	if !ok {
+		v.errors = append(v.errors, FieldError{Field: field, Message: message})
+	}
+}
+
+// err returns the API error for the collected field errors, or nil when the
+// request is valid
+func (v *validator) err() *apiError {
+	if len(v.errors) == 0 {
+		return nil
+	}
+	e := newAPIError("Validation failed", 1048, http.StatusBadRequest)
+	e.Errors = v.errors
+	return e
+}
+
+// amount checks that field holds a positive amount with at most two decimals
+func (v *validator) amount(field string, amount float64) {
+	v.check(amount > 0, field, "must be greater than zero")
+	v.check(math.Abs(amount*100-math.Round(amount*100)) < 1e-6, field, "must have at most two decimal places")
+}
+
+func (tr *TransferRequest) validate(limits LimitsConfig) *apiError {
+	var v validator
+	v.amount("amount", tr.Amount)
+	if limits.MaxTransferAmount > 0 {
+		v.check(tr.Amount <= limits.MaxTransferAmount, "amount", fmt.Sprintf("must not exceed %.2f", limits.MaxTransferAmount))
+	}
+
+	v.check(tr.FromAccountID != 0 || tr.FromIBAN != "" || tr.FromAlias != "", "source_account_id", "is required")
+	v.check(tr.FromAccountID == 0 || tr.FromIBAN == "", "source_iban", "must not be combined with source_account_id")
+	v.check(tr.FromAlias == "" || tr.FromAccountID == 0 && tr.FromIBAN == "", "source_alias", "must not be combined with source_account_id or source_iban")
+	if tr.External == nil {
+		v.check(tr.ToAccountID != 0 || tr.ToIBAN != "" || tr.ToAlias != "", "destination_account_id", "is required")
+		v.check(tr.ToAccountID == 0 || tr.ToIBAN == "", "destination_iban", "must not be combined with destination_account_id")
+		v.check(tr.ToAlias == "" || tr.ToAccountID == 0 && tr.ToIBAN == "", "destination_alias", "must not be combined with destination_account_id or destination_iban")
+		sameID := tr.FromAccountID != 0 && tr.FromAccountID == tr.ToAccountID && tr.ToTenantID == ""
+		sameIBAN := tr.FromIBAN != "" && strings.EqualFold(strings.ReplaceAll(tr.FromIBAN, " ", ""), strings.ReplaceAll(tr.ToIBAN, " ", ""))
+		sameAlias := tr.FromAlias != "" && normalizeAlias(tr.FromAlias) == normalizeAlias(tr.ToAlias) && tr.ToTenantID == ""
+		v.check(!sameID && !sameIBAN && !sameAlias, "destination_account_id", "must differ from the source account")
+	} else {
+		v.check(tr.ToAccountID == 0 && tr.ToIBAN == "" && tr.ToAlias == "", "external_destination", "must not be combined with a destination account")
+	}
+
+	v.check(len(tr.Reference) <= maxReferenceLength, "reference", fmt.Sprintf("must be at most %d characters", maxReferenceLength))
+	v.check(len(tr.Memo) <= maxMemoLength, "memo", fmt.Sprintf("must be at most %d characters", maxMemoLength))
+	v.labels(tr.Category, tr.Tags)
+	return v.err()
+}
+
+func (req *CreateAccountRequest) validate() *apiError {
+	var v validator
+	v.check(req.AccountID > 0, "account_id", "must be a positive integer")
+	v.check(req.InitialBalance >= 0, "initial_balance", "must not be negative")
+	v.check(math.Abs(req.InitialBalance*100-math.Round(req.InitialBalance*100)) < 1e-6, "initial_balance", "must have at most two decimal places")
+	v.check(req.Alias == "" || validAlias(req.Alias), "alias", "must be 3 to 32 lowercase letters, digits, dots, hyphens or underscores, starting with a letter")
+	v.check(len(req.ExternalRef) <= maxExternalRefLength, "external_ref", fmt.Sprintf("must be at most %d characters", maxExternalRefLength))
+	return v.err()
+}
+
+func (req *CreateCustomerRequest) validate() *apiError {
+	var v validator
+	v.check(req.Name != "", "name", "is required")
+	v.check(req.Email != "", "email", "is required")
+	v.check(req.Email == "" || strings.Count(req.Email, "@") == 1 && !strings.HasPrefix(req.Email, "@") && !strings.HasSuffix(req.Email, "@"), "email", "must be a valid email address")
+	v.check(validKYCStatus(req.KYCStatus), "kyc_status", "must be pending, verified or rejected")
+	return v.err()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// latestAPIVersion is the newest version served under /v{n}/
+const latestAPIVersion = 1
+
+// unversionedDeprecated is when the paths without a version prefix were
+// deprecated in favour of /v1/
+var unversionedDeprecated = time.Date(2026, time.October, 14, 0, 0, 0, 0, time.UTC)
+
+// unversionedPaths are operational endpoints that stay outside the versioned
+// API
+var unversionedPaths = []string{"/metrics", "/admin/debug/", "/admin/dashboard/"}
+
+type apiVersionKey struct{}
+
+// apiVersionFromContext returns the API version the request was made against
+func apiVersionFromContext(ctx context.Context) int {
+	if v, ok := ctx.Value(apiVersionKey{}).(int); ok {
+		return v
+	}
+	return 1
+}
+
+// sunset returns when the unversioned paths stop being served, or the zero
+// time when no date has been announced
+func (c ServerConfig) sunset() (time.Time, error) {
+	if c.UnversionedSunset == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.DateOnly, c.UnversionedSunset)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unversioned_sunset must be a YYYY-MM-DD date")
+	}
+	return t, nil
+}
+
+// splitVersion removes a /v{n} prefix from path, returning 0 when there is
+// none
+func splitVersion(path string) (int, string) {
+	rest, ok := strings.CutPrefix(path, "/v")
+	if !ok {
+		return 0, path
+	}
+	digits, tail, _ := strings.Cut(rest, "/")
+	v, err := strconv.Atoi(digits)
+	if err != nil || v < 1 || digits[0] == '0' {
+		return 0, path
+	}
+	return v, "/" + tail
+}
+
+// withAPIVersion strips the /v{n} prefix so the rest of the chain sees the
+// same paths for every version, and records the version in the request
+// context. Unversioned paths are served as v1 with Deprecation, Sunset and
+// successor Link headers.
+func (a *App) withAPIVersion(next http.Handler) http.Handler {
+	sunset, _ := a.Config.Server.sunset()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version, path := splitVersion(r.URL.Path)
+		if version > latestAPIVersion {
+			writeJSONError(w, "Unknown API version", 1087, http.StatusNotFound)
+			return
+		}
+		if version == 0 {
+			version = 1
+			if !isUnversionedPath(path) {
+				w.Header().Set("Deprecation", "@"+strconv.FormatInt(unversionedDeprecated.Unix(), 10))
+				if !sunset.IsZero() {
+					w.Header().Set("Sunset", sunset.Format(http.TimeFormat))
+				}
+				w.Header().Set("Link", "</v1"+path+`>; rel="successor-version"`)
+			}
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version))
+		if path != r.URL.Path {
+			u := *r.URL
+			u.Path = path
+			u.RawPath = ""
+			r.URL = &u
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isUnversionedPath(path string) bool {
+	for _, p := range unversionedPaths {
+		if path == p || strings.HasSuffix(p, "/") && strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiRouter dispatches a request to the handlers of its API version. A
+// version only registers the routes whose behaviour or response shape it
+// changes; every other route falls back to the previous version.
+type apiRouter struct {
+	versions []*http.ServeMux // versions[0] serves v1
+}
+
+func newAPIRouter(v1 *http.ServeMux) *apiRouter {
+	rt := &apiRouter{versions: []*http.ServeMux{v1}}
+	for len(rt.versions) < latestAPIVersion {
+		rt.versions = append(rt.versions, http.NewServeMux())
+	}
+	return rt
+}
+
+// handle registers the handler of pattern from the given version on
+func (rt *apiRouter) handle(version int, pattern string, handler http.Handler) {
+	if version < 1 || version > latestAPIVersion {
+		panic(fmt.Sprintf("api router: unknown version %d", version))
+	}
+	rt.versions[version-1].Handle(pattern, handler)
+}
+
+func (rt *apiRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for i := apiVersionFromContext(r.Context()) - 1; i >= 0; i-- {
+		if _, pattern := rt.versions[i].Handler(r); pattern != "" {
+			// subtree patterns keep the route derived from the full path
+			if e := accessEntryFromContext(r.Context()); e != nil && !strings.HasSuffix(pattern, "/") {
+				e.Route = routeOfPattern(pattern)
+			}
+			rt.versions[i].ServeHTTP(w, r)
+			return
+		}
+	}
+
+	// No version has a route for the method and path; answer in the API's
+	// error format instead of the mux's plain text
+	if allowed := rt.allowedMethods(r); len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeJSONError(w, "Method not allowed", 1001, http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSONError(w, "Not found", 1040, http.StatusNotFound)
+}
+
+// routeMethods are the methods probed to fill the Allow header of a 405
+var routeMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// allowedMethods returns the methods some version routes the path of r for
+func (rt *apiRouter) allowedMethods(r *http.Request) []string {
+	var allowed []string
+	probe := r.WithContext(r.Context())
+	for _, method := range routeMethods {
+		probe.Method = method
+		for i := apiVersionFromContext(r.Context()) - 1; i >= 0; i-- {
+			if _, pattern := rt.versions[i].Handler(probe); pattern != "" {
+				allowed = append(allowed, method)
+				break
+			}
+		}
+	}
+	return allowed
+}
+
+// routeOfPattern drops the method from a mux pattern, leaving the path with
+// its {name} wildcards
+func routeOfPattern(pattern string) string {
+	if _, path, ok := strings.Cut(pattern, " "); ok {
+		return path
+	}
+	return pattern
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// mainWallet names the part of an account's balance outside its wallets,
+// the only part transfers and debits can spend
+const mainWallet = "main"
+
+// maxWalletNameLength bounds wallet names
+const maxWalletNameLength = 64
+
+// walletReserved selects the funds an account of accounts has set aside in
+// wallets
+const walletReserved = "(SELECT COALESCE(SUM(w.balance), 0) FROM account_wallets w WHERE w.account_id = accounts.id)"
+
+// reservedFunds selects the part of the balance of an account of accounts
+// that transfers and debits cannot spend: its wallets, dispute holds,
+// prepared transfers and term deposits
+const reservedFunds = "(" + walletReserved + " + " + disputeHolds + " + " + preparedHolds + " + " + depositHolds + ")"
+
+// reservedFundsBesides selects reservedFunds less the hold of dispute
+// disputeID, for paying out of the funds that hold is lifted from
+func reservedFundsBesides(disputeID int) string {
+	return "(" + walletReserved + " + " + disputeHoldsBesides(disputeID) + " + " + preparedHolds + " + " + depositHolds + ")"
+}
+
+// Wallet is a named part of an account's balance, such as "savings pot".
+// Moving funds between the wallets of an account changes neither its balance
+// nor the ledger.
+type Wallet struct {
+	Name      string    `json:"name"`
+	Balance   float64   `json:"balance"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateWalletRequest is the JSON body of POST /accounts/{id}/wallets
+type CreateWalletRequest struct {
+	Name string `json:"name"`
+}
+
+func (req *CreateWalletRequest) validate() *apiError {
+	var v validator
+	v.check(req.Name != "", "name", "is required")
+	v.check(len(req.Name) <= maxWalletNameLength, "name", fmt.Sprintf("must be at most %d characters", maxWalletNameLength))
+	v.check(!strings.EqualFold(req.Name, mainWallet), "name", "must not be "+mainWallet)
+	return v.err()
+}
+
+// WalletMoveRequest is the JSON body of POST /accounts/{id}/wallets/moves.
+// "main" names the balance outside the wallets.
+type WalletMoveRequest struct {
+	From   string  `json:"from_wallet"`
+	To     string  `json:"to_wallet"`
+	Amount float64 `json:"amount"`
+}
+
+func (req *WalletMoveRequest) validate() *apiError {
+	var v validator
+	v.amount("amount", req.Amount)
+	v.check(req.From != "", "from_wallet", "is required")
+	v.check(req.To != "", "to_wallet", "is required")
+	v.check(req.From != req.To, "to_wallet", "must differ from from_wallet")
+	return v.err()
+}
+
+// loadWallets fills in the wallets of acc and what is left in its main
+// wallet. Accounts without wallets are left as they are.
+func loadWallets(ctx context.Context, q queryer, acc *Account) error {
+	rows, err := q.QueryContext(ctx, "SELECT name, balance, created_at FROM account_wallets WHERE account_id = $1 ORDER BY name", acc.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	acc.Wallets, acc.MainBalance = nil, nil
+	main := acc.Balance
+	for rows.Next() {
+		var wl Wallet
+		if err := rows.Scan(&wl.Name, &wl.Balance, &wl.CreatedAt); err != nil {
+			return err
+		}
+		acc.Wallets = append(acc.Wallets, wl)
+		main -= wl.Balance
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if acc.Wallets != nil {
+		main = roundCents(main)
+		acc.MainBalance = &main
+	}
+	return nil
+}
+
+// walletBalance returns the balance of the wallet of acc named name
+func walletBalance(acc Account, name string) (float64, bool) {
+	if name == mainWallet {
+		if acc.MainBalance == nil {
+			return acc.Balance, true
+		}
+		return *acc.MainBalance, true
+	}
+	for _, wl := range acc.Wallets {
+		if wl.Name == name {
+			return wl.Balance, true
+		}
+	}
+	return 0, false
+}
+
+// touchAccount moves the version of an account whose wallets changed, so its
+// ETag changes and transfers that read it before retry against the new split
+func touchAccount(ctx context.Context, tx *sql.Tx, accountID int) error {
+	_, err := tx.ExecContext(ctx, "UPDATE accounts SET last_updated = "+nextVersion+" WHERE id = $1", accountID)
+	return err
+}
+
+// handleListWallets serves GET /accounts/{id}/wallets
+func (a *App) handleListWallets(w http.ResponseWriter, r *http.Request, accountID int) {
+	ctx := r.Context()
+	acc, err := scanAccount(a.Replica.QueryRowContext(ctx, "SELECT "+accountColumns+" FROM accounts WHERE id = $1 AND tenant_id = $2", accountID, tenantFromContext(ctx)))
+	if err == sql.ErrNoRows {
+		writeJSONError(w, "Account not found", 1010, http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = loadWallets(ctx, a.Replica, &acc)
+	}
+	if err != nil {
+		writeJSONError(w, "Failed to load wallets", 1005, http.StatusInternalServerError)
+		return
+	}
+	wallets := acc.Wallets
+	if wallets == nil {
+		wallets = []Wallet{}
+	}
+	writeJSONSuccess(w, wallets, "Wallets retrieved", 2060, http.StatusOK)
+}
+
+// handleCreateWallet serves POST /accounts/{id}/wallets, adding an empty
+// wallet to the account
+func (a *App) handleCreateWallet(w http.ResponseWriter, r *http.Request, accountID int) {
+	var req CreateWalletRequest
+	if apiErr := decodeJSON(r, &req, 1002, "name"); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if apiErr := req.validate(); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	acc, apiErr := a.changeAccount(r, accountID, "account.wallet_created", func(ctx context.Context, tx *sql.Tx, acc Account) (*apiError, error) {
+		result, err := tx.ExecContext(ctx, "INSERT INTO account_wallets (account_id, name, balance) VALUES ($1, $2, 0) ON CONFLICT DO NOTHING", acc.ID, req.Name)
+		if err != nil {
+			return newAPIError("Failed to create wallet", 1005, http.StatusInternalServerError), err
+		}
+		if affectedRows(result, nil) == 0 {
+			return newAPIError("Wallet already exists", 1113, http.StatusConflict), nil
+		}
+		if err := touchAccount(ctx, tx, acc.ID); err != nil {
+			return newAPIError("Failed to create wallet", 1005, http.StatusInternalServerError), err
+		}
+		return nil, nil
+	})
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	writeAccount(w, r, acc, "Wallet created", 2061, http.StatusCreated)
+}
+
+// handleDeleteWallet serves DELETE /accounts/{id}/wallets/{name}. Only empty
+// wallets can be deleted.
+func (a *App) handleDeleteWallet(w http.ResponseWriter, r *http.Request, accountID int) {
+	name := r.PathValue("name")
+	acc, apiErr := a.changeAccount(r, accountID, "account.wallet_deleted", func(ctx context.Context, tx *sql.Tx, acc Account) (*apiError, error) {
+		balance, ok := walletBalance(acc, name)
+		if !ok || name == mainWallet {
+			return newAPIError("Wallet not found", 1114, http.StatusNotFound), nil
+		}
+		if balance != 0 {
+			return newAPIError("Wallet balance must be zero to delete it", 1115, http.StatusConflict), nil
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM account_wallets WHERE account_id = $1 AND name = $2", acc.ID, name); err != nil {
+			return newAPIError("Failed to delete wallet", 1005, http.StatusInternalServerError), err
+		}
+		if err := touchAccount(ctx, tx, acc.ID); err != nil {
+			return newAPIError("Failed to delete wallet", 1005, http.StatusInternalServerError), err
+		}
+		return nil, nil
+	})
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	writeAccount(w, r, acc, "Wallet deleted", 2062, http.StatusOK)
+}
+
+// handleWalletMove serves POST /accounts/{id}/wallets/moves, moving funds
+// between two wallets of the account. The account balance stays the same and
+// nothing is recorded in the ledger; the move is audited with the wallets
+// before and after it.
+func (a *App) handleWalletMove(w http.ResponseWriter, r *http.Request, accountID int) {
+	var req WalletMoveRequest
+	if apiErr := decodeJSON(r, &req, 1002, "from_wallet", "to_wallet", "amount"); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	if apiErr := req.validate(); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	acc, apiErr := a.changeAccount(r, accountID, "account.wallet_moved", func(ctx context.Context, tx *sql.Tx, acc Account) (*apiError, error) {
+		from, ok := walletBalance(acc, req.From)
+		if _, toOK := walletBalance(acc, req.To); !ok || !toOK {
+			return newAPIError("Wallet not found", 1114, http.StatusNotFound), nil
+		}
+		if req.From == mainWallet {
+			// funds held by disputes, prepared transfers and term deposits
+			// cannot be moved out of their reach
+			if err := tx.QueryRowContext(ctx, "SELECT balance - "+reservedFunds+" FROM accounts WHERE id = $1", acc.ID).Scan(&from); err != nil {
+				return newAPIError("Failed to move funds between wallets", 1005, http.StatusInternalServerError), err
+			}
+		}
+		if from < req.Amount {
+			return newAPIError("Insufficient funds", 1015, http.StatusBadRequest), nil
+		}
+		for _, m := range []struct {
+			name  string
+			delta float64
+		}{{req.From, -req.Amount}, {req.To, req.Amount}} {
+			if m.name == mainWallet {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, "UPDATE account_wallets SET balance = balance + $1 WHERE account_id = $2 AND name = $3", m.delta, acc.ID, m.name); err != nil {
+				return newAPIError("Failed to move funds between wallets", 1005, http.StatusInternalServerError), err
+			}
+		}
+		if err := touchAccount(ctx, tx, acc.ID); err != nil {
+			return newAPIError("Failed to move funds between wallets", 1005, http.StatusInternalServerError), err
+		}
+		return nil, nil
+	})
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	writeAccount(w, r, acc, "Wallet move completed", 2063, http.StatusOK)
+}
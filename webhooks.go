@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WebhookConfig configures the delivery of transfer events to webhook
+// subscriptions
+type WebhookConfig struct {
+	TimeoutSeconds int `json:"timeout_seconds"`
+	// MaxAttempts bounds the attempts at a delivery before it is marked
+	// failed; a failed delivery can still be redelivered by hand
+	MaxAttempts int `json:"max_attempts"`
+	// RetryIntervalSeconds is the wait after the first failed attempt,
+	// doubled after each further one up to MaxRetryIntervalSeconds
+	RetryIntervalSeconds    int `json:"retry_interval_seconds"`
+	MaxRetryIntervalSeconds int `json:"max_retry_interval_seconds"`
+	Workers                 int `json:"workers"`
+	// RetentionDays is how long finished deliveries and their attempts are
+	// kept
+	RetentionDays int `json:"retention_days"`
+}
+
+func (c WebhookConfig) validate() error {
+	switch {
+	case c.TimeoutSeconds < 1:
+		return fmt.Errorf("timeout_seconds must be at least 1")
+	case c.MaxAttempts < 1:
+		return fmt.Errorf("max_attempts must be at least 1")
+	case c.RetryIntervalSeconds < 1:
+		return fmt.Errorf("retry_interval_seconds must be at least 1")
+	case c.MaxRetryIntervalSeconds < c.RetryIntervalSeconds:
+		return fmt.Errorf("max_retry_interval_seconds must be at least retry_interval_seconds")
+	case c.Workers < 1:
+		return fmt.Errorf("workers must be at least 1")
+	case c.RetentionDays < 1:
+		return fmt.Errorf("retention_days must be at least 1")
+	}
+	return nil
+}
+
+// Webhook delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+	DeliveryCancelled = "cancelled"
+)
+
+// Headers of webhook requests. The signature has the t=<unix>,v1=<hex> form
+// of X-Signature, keyed with the secret of the subscription.
+const (
+	headerWebhookID        = "X-Webhook-ID"
+	headerWebhookSignature = "X-Webhook-Signature"
+)
+
+// CreateWebhookRequest subscribes a URL to the transfer events of the tenant
+type CreateWebhookRequest struct {
+	URL string `json:"url"`
+}
+
+func (req CreateWebhookRequest) validate() *apiError {
+	var v validator
+	u, err := url.Parse(req.URL)
+	v.check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "", "url", "must be an absolute http or https URL")
+	return v.err()
+}
+
+// WebhookSubscription is a URL receiving the transfer events of a tenant.
+// Its secret is only returned when it is created.
+type WebhookSubscription struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is a transfer event queued for a subscription
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	SubscriptionID int             `json:"subscription_id"`
+	EventID        int64           `json:"event_id"`
+	Event          json.RawMessage `json:"event"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+	// AttemptLog is only returned for a single delivery
+	AttemptLog []WebhookAttempt `json:"attempt_log,omitempty"`
+}
+
+// WebhookAttempt is one request made for a delivery. StatusCode is 0 when
+// no response was received.
+type WebhookAttempt struct {
+	AttemptedAt time.Time `json:"attempted_at"`
+	StatusCode  int       `json:"status_code"`
+	Error       string    `json:"error,omitempty"`
+	DurationMS  int64     `json:"duration_ms"`
+}
+
+// webhookEvent is the body of a webhook request
+type webhookEvent struct {
+	ID   int64           `json:"id"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// webhookJob is a claimed delivery with its subscription
+type webhookJob struct {
+	id             int64
+	subscriptionID int
+	eventID        int64
+	payload        json.RawMessage
+	attempts       int
+	url            string
+	secret         string
+}
+
+// newWebhookSecret returns a random signing secret
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// backoff is the wait after the nth failed attempt at a delivery
+func (c WebhookConfig) backoff(n int) time.Duration {
+	wait := time.Duration(c.RetryIntervalSeconds) * time.Second
+	max := time.Duration(c.MaxRetryIntervalSeconds) * time.Second
+	for i := 1; i < n && wait < max; i++ {
+		wait *= 2
+	}
+	return min(wait, max)
+}
+
+// deliverWebhooks sends due deliveries until ctx is cancelled. Every replica
+// runs it; a claim lasts longer than its deliveries can take sent one after
+// another, and the deliveries of a subscription are sent one at a time,
+// oldest first. A delivery waiting to be retried does not hold back the
+// later ones.
+func (a *App) deliverWebhooks(ctx context.Context) {
+	cfg := a.Config.Webhooks
+	client := &http.Client{
+		Timeout: time.Duration(cfg.TimeoutSeconds) * time.Second,
+		// a redirect is a failed attempt rather than a request to another URL
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	pool := newKeyedPool(cfg.Workers)
+
+	for {
+		jobs, err := a.claimWebhookDeliveries(ctx, client.Timeout)
+		if err != nil {
+			log.Printf("webhooks: %v", err)
+		}
+		for _, job := range jobs {
+			pool.submit(job.subscriptionID, func() {
+				if err := a.attemptWebhook(ctx, client, job); err != nil {
+					log.Printf("webhooks: delivery %d: %v", job.id, err)
+				}
+			})
+		}
+		pool.wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// webhookClaimMargin is added to the time the requests of a claim can take
+const webhookClaimMargin = 30 * time.Second
+
+// claimWebhookDeliveries claims up to 100 due deliveries for timeout per
+// delivery plus webhookClaimMargin, long enough to send them all one after
+// another however the claim is spread over the workers
+func (a *App) claimWebhookDeliveries(ctx context.Context, timeout time.Duration) ([]webhookJob, error) {
+	rows, err := a.DB.QueryContext(ctx, `WITH due AS (
+			SELECT id FROM webhook_deliveries
+			WHERE status = $1 AND next_attempt_at <= NOW()
+			ORDER BY id LIMIT 100 FOR UPDATE SKIP LOCKED)
+		UPDATE webhook_deliveries d
+		SET next_attempt_at = NOW() + make_interval(secs => $2::float8 * (SELECT COUNT(*) FROM due) + $3::float8)
+		FROM webhook_subscriptions s
+		WHERE s.id = d.subscription_id AND d.id IN (SELECT id FROM due)
+		RETURNING d.id, d.subscription_id, d.event_id, d.payload, d.attempts, s.url, s.secret`,
+		DeliveryPending, timeout.Seconds(), webhookClaimMargin.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []webhookJob
+	for rows.Next() {
+		var job webhookJob
+		if err := rows.Scan(&job.id, &job.subscriptionID, &job.eventID, &job.payload, &job.attempts, &job.url, &job.secret); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	// RETURNING does not keep the order of the subquery
+	slices.SortFunc(jobs, func(x, y webhookJob) int { return cmp.Compare(x.id, y.id) })
+	return jobs, rows.Err()
+}
+
+// attemptWebhook posts a delivery to its subscription and records the
+// attempt, scheduling the next one with backoff when it failed
+func (a *App) attemptWebhook(ctx context.Context, client *http.Client, job webhookJob) error {
+	var event TransferEvent
+	if err := json.Unmarshal(job.payload, &event); err != nil {
+		return err
+	}
+	body, err := json.Marshal(webhookEvent{ID: job.eventID, Type: "transfer." + event.Status, Data: job.payload})
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	statusCode, sendErr := sendWebhook(ctx, client, job, body)
+	if ctx.Err() != nil {
+		return nil // the claim runs out and another replica retries
+	}
+	attempt := WebhookAttempt{StatusCode: statusCode, DurationMS: time.Since(start).Milliseconds()}
+	if sendErr != nil {
+		attempt.Error = sendErr.Error()
+	}
+
+	cfg := a.Config.Webhooks
+	status := DeliveryDelivered
+	switch {
+	case sendErr == nil:
+	case job.attempts+1 >= cfg.MaxAttempts:
+		status = DeliveryFailed
+	default:
+		status = DeliveryPending
+	}
+	webhookAttempts.WithLabelValues(status).Inc()
+
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `INSERT INTO webhook_attempts (delivery_id, status_code, error, duration_ms) VALUES ($1, $2, $3, $4)`,
+		job.id, attempt.StatusCode, attempt.Error, attempt.DurationMS); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE webhook_deliveries
+		SET status = $2, attempts = attempts + 1, last_error = $3,
+			next_attempt_at = NOW() + make_interval(secs => $4),
+			delivered_at = CASE WHEN $2 = $5 THEN NOW() END
+		WHERE id = $1 AND status = $6`,
+		job.id, status, attempt.Error, cfg.backoff(job.attempts+1).Seconds(), DeliveryDelivered, DeliveryPending); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sendWebhook posts body, signed with the subscription secret. Any response
+// outside 2xx fails the attempt.
+func sendWebhook(ctx context.Context, client *http.Client, job webhookJob, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(headerWebhookID, strconv.FormatInt(job.eventID, 10))
+	req.Header.Set(headerWebhookSignature, "t="+timestamp+",v1="+signature(job.secret, timestamp, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// pruneWebhookDeliveries deletes the finished deliveries older than the
+// retention, with their attempts
+func (a *App) pruneWebhookDeliveries(ctx context.Context) error {
+	_, err := a.DB.ExecContext(ctx, "DELETE FROM webhook_deliveries WHERE status <> $1 AND created_at < NOW() - make_interval(days => $2)",
+		DeliveryPending, a.Config.Webhooks.RetentionDays)
+	return err
+}
+
+// webhookRoute parses the subscription ID of /webhooks/{id} routes
+func webhookRoute(h func(http.ResponseWriter, *http.Request, int)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireRole(w, r, RoleAdmin) {
+			return
+		}
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			writeJSONError(w, "Webhook not found", 1128, http.StatusNotFound)
+			return
+		}
+		h(w, r, id)
+	}
+}
+
+// handleCreateWebhook serves POST /webhooks
+func (a *App) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+	var req CreateWebhookRequest
+	if apiErr := decodeJSON(r, &req, 1002, "url"); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	req.URL = strings.TrimSpace(req.URL)
+	if apiErr := req.validate(); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	secret, err := newWebhookSecret()
+	if err != nil {
+		writeJSONError(w, "Failed to create webhook", 1005, http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+	tenant := tenantFromContext(ctx)
+	sub := WebhookSubscription{URL: req.URL, CreatedBy: principalFromContext(ctx).Name}
+	err = a.DB.QueryRowContext(ctx, `INSERT INTO webhook_subscriptions (tenant_id, url, secret, created_by)
+		VALUES ($1, $2, $3, $4) RETURNING id, created_at`, tenant, sub.URL, secret, sub.CreatedBy).Scan(&sub.ID, &sub.CreatedAt)
+	if err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to create webhook", 1005, http.StatusInternalServerError)))
+		return
+	}
+	a.auditCommitted(ctx, auditRecord{
+		TenantID:   tenant,
+		Action:     "webhook.created",
+		EntityType: "webhook",
+		EntityID:   strconv.Itoa(sub.ID),
+		After:      sub,
+	})
+
+	sub.Secret = secret
+	writeJSONSuccess(w, sub, "Webhook created", 2076, http.StatusCreated)
+}
+
+// handleWebhooks serves GET /webhooks
+func (a *App) handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, RoleAdmin) {
+		return
+	}
+	rows, err := a.DB.QueryContext(r.Context(), `SELECT id, url, created_by, created_at FROM webhook_subscriptions
+		WHERE tenant_id = $1 AND deleted_at IS NULL ORDER BY id`, tenantFromContext(r.Context()))
+	if err != nil {
+		writeJSONError(w, "Failed to list webhooks", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	subs := []WebhookSubscription{}
+	for rows.Next() {
+		var sub WebhookSubscription
+		if err := rows.Scan(&sub.ID, &sub.URL, &sub.CreatedBy, &sub.CreatedAt); err != nil {
+			writeJSONError(w, "Failed to list webhooks", 1005, http.StatusInternalServerError)
+			return
+		}
+		subs = append(subs, sub)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, "Failed to list webhooks", 1005, http.StatusInternalServerError)
+		return
+	}
+	writeJSONSuccess(w, subs, "Webhooks retrieved", 2077, http.StatusOK)
+}
+
+// handleDeleteWebhook serves DELETE /webhooks/{id}. The subscription stops
+// receiving events and its pending deliveries are cancelled; its delivery
+// log is kept.
+func (a *App) handleDeleteWebhook(w http.ResponseWriter, r *http.Request, id int) {
+	ctx := r.Context()
+	tenant := tenantFromContext(ctx)
+	tx, err := a.DB.BeginTx(ctx, nil)
+	if err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to begin transaction", 1013, http.StatusInternalServerError)))
+		return
+	}
+	defer tx.Rollback()
+
+	var sub WebhookSubscription
+	err = tx.QueryRowContext(ctx, `UPDATE webhook_subscriptions SET deleted_at = NOW()
+		WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NULL RETURNING id, url, created_by, created_at`,
+		id, tenant).Scan(&sub.ID, &sub.URL, &sub.CreatedBy, &sub.CreatedAt)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, "Webhook not found", 1128, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to delete webhook", 1005, http.StatusInternalServerError)))
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE webhook_deliveries SET status = $1 WHERE subscription_id = $2 AND status = $3",
+		DeliveryCancelled, id, DeliveryPending); err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to delete webhook", 1005, http.StatusInternalServerError)))
+		return
+	}
+	if err := a.audit(ctx, tx, auditRecord{
+		TenantID:   tenant,
+		Action:     "webhook.deleted",
+		EntityType: "webhook",
+		EntityID:   strconv.Itoa(id),
+		Before:     sub,
+	}); err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to delete webhook", 1005, http.StatusInternalServerError)))
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to commit transaction", 1020, http.StatusInternalServerError)))
+		return
+	}
+	writeJSONSuccess(w, sub, "Webhook deleted", 2078, http.StatusOK)
+}
+
+// ownsWebhook reports whether subscription id belongs to the tenant,
+// including deleted subscriptions, whose delivery logs stay readable
+func (a *App) ownsWebhook(ctx context.Context, id int, tenant string) (bool, error) {
+	var exists bool
+	err := a.DB.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM webhook_subscriptions WHERE id = $1 AND tenant_id = $2)", id, tenant).Scan(&exists)
+	return exists, err
+}
+
+const webhookDeliveryColumns = `id, subscription_id, event_id, payload, status, attempts,
+	CASE WHEN status = 'pending' THEN next_attempt_at END, last_error, created_at, delivered_at`
+
+func scanWebhookDelivery(row rowScanner) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	err := row.Scan(&d.ID, &d.SubscriptionID, &d.EventID, &d.Event, &d.Status, &d.Attempts, &d.NextAttemptAt, &d.LastError, &d.CreatedAt, &d.DeliveredAt)
+	return d, err
+}
+
+// handleWebhookDeliveries serves GET /webhooks/{id}/deliveries, newest first
+func (a *App) handleWebhookDeliveries(w http.ResponseWriter, r *http.Request, id int) {
+	ctx := r.Context()
+	if ok, err := a.ownsWebhook(ctx, id, tenantFromContext(ctx)); err != nil {
+		writeJSONError(w, "Failed to list webhook deliveries", 1005, http.StatusInternalServerError)
+		return
+	} else if !ok {
+		writeJSONError(w, "Webhook not found", 1128, http.StatusNotFound)
+		return
+	}
+	page, apiErr := parsePage(r, true)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	cond, orderLimit, cursor := page.keyset("id", 2)
+
+	rows, err := a.DB.QueryContext(ctx, "SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE subscription_id = $1 AND "+cond+" "+orderLimit, id, cursor)
+	if err != nil {
+		writeJSONError(w, "Failed to list webhook deliveries", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			writeJSONError(w, "Failed to list webhook deliveries", 1005, http.StatusInternalServerError)
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, "Failed to list webhook deliveries", 1005, http.StatusInternalServerError)
+		return
+	}
+	deliveries, pagination := paginate(page, deliveries, func(d WebhookDelivery) int64 { return d.ID })
+	writeJSONPage(w, deliveries, &pagination, "Webhook deliveries retrieved", 2079, http.StatusOK)
+}
+
+// webhookDeliveryRoute parses the delivery ID of
+// /webhooks/{id}/deliveries/{delivery_id} routes and checks the delivery
+// belongs to a subscription of the tenant
+func (a *App) webhookDeliveryRoute(h func(http.ResponseWriter, *http.Request, int, int64)) http.HandlerFunc {
+	return webhookRoute(func(w http.ResponseWriter, r *http.Request, id int) {
+		deliveryID, err := strconv.ParseInt(r.PathValue("delivery_id"), 10, 64)
+		if err != nil {
+			writeJSONError(w, "Webhook delivery not found", 1129, http.StatusNotFound)
+			return
+		}
+		ctx := r.Context()
+		if ok, err := a.ownsWebhook(ctx, id, tenantFromContext(ctx)); err != nil {
+			writeJSONError(w, "Failed to load webhook delivery", 1005, http.StatusInternalServerError)
+			return
+		} else if !ok {
+			writeJSONError(w, "Webhook not found", 1128, http.StatusNotFound)
+			return
+		}
+		h(w, r, id, deliveryID)
+	})
+}
+
+// handleWebhookDelivery serves GET /webhooks/{id}/deliveries/{delivery_id}
+// with the log of its attempts
+func (a *App) handleWebhookDelivery(w http.ResponseWriter, r *http.Request, id int, deliveryID int64) {
+	ctx := r.Context()
+	d, err := scanWebhookDelivery(a.DB.QueryRowContext(ctx, "SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE id = $1 AND subscription_id = $2", deliveryID, id))
+	if err == sql.ErrNoRows {
+		writeJSONError(w, "Webhook delivery not found", 1129, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "Failed to load webhook delivery", 1005, http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := a.DB.QueryContext(ctx, "SELECT attempted_at, status_code, error, duration_ms FROM webhook_attempts WHERE delivery_id = $1 ORDER BY id", deliveryID)
+	if err != nil {
+		writeJSONError(w, "Failed to load webhook delivery", 1005, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	d.AttemptLog = []WebhookAttempt{}
+	for rows.Next() {
+		var attempt WebhookAttempt
+		if err := rows.Scan(&attempt.AttemptedAt, &attempt.StatusCode, &attempt.Error, &attempt.DurationMS); err != nil {
+			writeJSONError(w, "Failed to load webhook delivery", 1005, http.StatusInternalServerError)
+			return
+		}
+		d.AttemptLog = append(d.AttemptLog, attempt)
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, "Failed to load webhook delivery", 1005, http.StatusInternalServerError)
+		return
+	}
+	writeJSONSuccess(w, d, "Webhook delivery retrieved", 2080, http.StatusOK)
+}
+
+// handleRedeliverWebhook serves
+// POST /webhooks/{id}/deliveries/{delivery_id}/redeliver. A delivered,
+// failed or cancelled delivery is queued again with fresh attempts, to the
+// subscription's current URL and secret.
+func (a *App) handleRedeliverWebhook(w http.ResponseWriter, r *http.Request, id int, deliveryID int64) {
+	ctx := r.Context()
+	d, err := scanWebhookDelivery(a.DB.QueryRowContext(ctx, `UPDATE webhook_deliveries
+		SET status = $1, attempts = 0, next_attempt_at = NOW(), delivered_at = NULL
+		WHERE id = $2 AND subscription_id = $3 AND status <> $1
+			AND EXISTS (SELECT 1 FROM webhook_subscriptions WHERE id = $3 AND deleted_at IS NULL)
+		RETURNING `+webhookDeliveryColumns, DeliveryPending, deliveryID, id))
+	if err == sql.ErrNoRows {
+		var status string
+		var deleted bool
+		err := a.DB.QueryRowContext(ctx, `SELECT d.status, s.deleted_at IS NOT NULL FROM webhook_deliveries d
+			JOIN webhook_subscriptions s ON s.id = d.subscription_id WHERE d.id = $1 AND d.subscription_id = $2`,
+			deliveryID, id).Scan(&status, &deleted)
+		switch {
+		case err == sql.ErrNoRows:
+			writeJSONError(w, "Webhook delivery not found", 1129, http.StatusNotFound)
+		case err != nil:
+			writeJSONError(w, "Failed to redeliver webhook", 1005, http.StatusInternalServerError)
+		case deleted:
+			writeJSONError(w, "Webhook has been deleted", 1130, http.StatusConflict)
+		default:
+			writeJSONError(w, "Webhook delivery is already pending", 1131, http.StatusConflict)
+		}
+		return
+	}
+	if err != nil {
+		writeAPIError(w, dbWriteError(err, newAPIError("Failed to redeliver webhook", 1005, http.StatusInternalServerError)))
+		return
+	}
+	a.auditCommitted(ctx, auditRecord{
+		TenantID:   tenantFromContext(ctx),
+		Action:     "webhook.redelivered",
+		EntityType: "webhook_delivery",
+		EntityID:   strconv.FormatInt(deliveryID, 10),
+	})
+	writeJSONSuccess(w, d, "Webhook redelivery scheduled", 2081, http.StatusAccepted)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lib/pq"
+)
+
+// Keepalive and flow control of WebSocket connections
+const (
+	wsPingInterval     = 30 * time.Second
+	wsPongWait         = 60 * time.Second
+	wsWriteWait        = 10 * time.Second
+	wsSendBuffer       = 64
+	wsMaxSubscriptions = 100
+)
+
+// wsRequest is a message from a WebSocket client
+type wsRequest struct {
+	Action     string `json:"action"`
+	AccountIDs []int  `json:"account_ids"`
+}
+
+// wsMessage is a message to a WebSocket client
+type wsMessage struct {
+	Type       string          `json:"type"`
+	AccountIDs []int           `json:"account_ids,omitempty"`
+	Message    string          `json:"message,omitempty"`
+	Data       json.RawMessage `json:"data,omitempty"`
+}
+
+// handleWebSocket serves /ws, a feed of the transfers of the accounts a
+// client subscribes to. Clients send {"action": "subscribe", "account_ids":
+// [...]} or "unsubscribe"; the server pushes {"type": "transfer", ...}.
+func (a *App) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{CheckOrigin: a.wsOriginAllowed}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // the upgrader has answered the request
+	}
+	defer conn.Close()
+
+	ctx := r.Context()
+	tenant := tenantFromContext(ctx)
+	sub := newSubscriber(wsSendBuffer)
+	subscriptions := map[int]func(){}
+	defer func() {
+		for _, unsubscribe := range subscriptions {
+			unsubscribe()
+		}
+	}()
+
+	replies := make(chan wsMessage, 8)
+	writerDone := make(chan struct{})
+	readerDone := make(chan struct{})
+	defer close(readerDone)
+	go wsWrite(conn, sub, replies, readerDone, writerDone)
+
+	reply := func(m wsMessage) {
+		select {
+		case replies <- m:
+		case <-writerDone:
+		}
+	}
+
+	conn.SetReadLimit(4096)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var req wsRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			reply(wsMessage{Type: "error", Message: "invalid message"})
+			continue
+		}
+
+		switch req.Action {
+		case "subscribe":
+			if len(subscriptions)+len(req.AccountIDs) > wsMaxSubscriptions {
+				reply(wsMessage{Type: "error", Message: "too many subscriptions"})
+				continue
+			}
+			var found []int
+			err := a.DB.QueryRowContext(ctx, "SELECT COALESCE(array_agg(id), '{}') FROM accounts WHERE tenant_id = $1 AND id = ANY($2)",
+				tenant, pq.Array(req.AccountIDs)).Scan(pq.Array(&found))
+			if err != nil {
+				reply(wsMessage{Type: "error", Message: "failed to load accounts"})
+				continue
+			}
+			if len(found) != len(uniqueInts(req.AccountIDs)) {
+				reply(wsMessage{Type: "error", Message: "account not found"})
+				continue
+			}
+			for _, id := range found {
+				if _, ok := subscriptions[id]; !ok {
+					subscriptions[id] = a.Events.subscribe(sub, tenant, id)
+				}
+			}
+			reply(wsMessage{Type: "subscribed", AccountIDs: found})
+		case "unsubscribe":
+			for _, id := range req.AccountIDs {
+				if unsubscribe, ok := subscriptions[id]; ok {
+					unsubscribe()
+					delete(subscriptions, id)
+				}
+			}
+			reply(wsMessage{Type: "unsubscribed", AccountIDs: req.AccountIDs})
+		default:
+			reply(wsMessage{Type: "error", Message: "unknown action"})
+		}
+	}
+}
+
+// wsWrite is the only writer of conn. It pushes events and replies, pings the
+// client, and drops clients that cannot keep up: once their buffer overflows
+// they are disconnected and expected to reconnect and resync.
+func wsWrite(conn *websocket.Conn, sub *subscriber, replies <-chan wsMessage, readerDone <-chan struct{}, writerDone chan<- struct{}) {
+	defer close(writerDone)
+	// closing the connection stops the reader too
+	defer conn.Close()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		var m wsMessage
+		select {
+		case <-readerDone:
+			return
+		case <-sub.overflow:
+			msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "slow consumer")
+			conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+			return
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+			continue
+		case e := <-sub.events:
+			if e.Type != EventTransfer {
+				continue
+			}
+			m = wsMessage{Type: EventTransfer, Data: e.Data}
+		case m = <-replies:
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		if err := conn.WriteJSON(m); err != nil {
+			return
+		}
+	}
+}
+
+// wsOriginAllowed accepts non-browser clients, same-origin pages and the
+// origins allowed by the CORS config
+func (a *App) wsOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || a.Config.CORS.originAllowed(origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+func uniqueInts(values []int) map[int]struct{} {
+	set := make(map[int]struct{}, len(values))
+	for _, v := range values {
+		set[v] = struct{}{}
+	}
+	return set
+}
@@ -0,0 +1,70 @@
+package main
+
+import "sync"
+
+// keyedPool runs jobs on a bounded number of workers. Jobs of the same key run
+// one at a time in submission order, and keys with work take turns, so a key
+// with a long backlog holds at most one worker and cannot starve the others.
+type keyedPool struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queues  map[int][]func()
+	ready   []int // keys with queued jobs and none running
+	pending sync.WaitGroup
+}
+
+// newKeyedPool starts workers that run until the process exits
+func newKeyedPool(workers int) *keyedPool {
+	p := &keyedPool{queues: map[int][]func(){}}
+	p.cond = sync.NewCond(&p.mu)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// submit queues job behind the other jobs of key
+func (p *keyedPool) submit(key int, job func()) {
+	p.pending.Add(1)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	q, known := p.queues[key]
+	p.queues[key] = append(q, job)
+	if !known {
+		p.ready = append(p.ready, key)
+		p.cond.Signal()
+	}
+}
+
+// wait blocks until every submitted job has run
+func (p *keyedPool) wait() {
+	p.pending.Wait()
+}
+
+func (p *keyedPool) work() {
+	for {
+		p.mu.Lock()
+		for len(p.ready) == 0 {
+			p.cond.Wait()
+		}
+		key := p.ready[0]
+		p.ready = p.ready[1:]
+		job := p.queues[key][0]
+		p.mu.Unlock()
+
+		job()
+		p.pending.Done()
+
+		p.mu.Lock()
+		// the key stays in queues while its job runs so submit does not mark
+		// it ready twice; afterwards it goes to the back of the line
+		if q := p.queues[key][1:]; len(q) > 0 {
+			p.queues[key] = q
+			p.ready = append(p.ready, key)
+			p.cond.Signal()
+		} else {
+			delete(p.queues, key)
+		}
+		p.mu.Unlock()
+	}
+}